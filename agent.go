@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/tink"
+)
+
+// agentEnvSock names the environment variable overriding the agent socket.
+const agentEnvSock = "DURIN_AGENT_SOCK"
+
+// agentRequestTimeout bounds how long the agent works on one request,
+// however long a deadline the client set.
+const agentRequestTimeout = 30 * time.Second
+
+// agentSocket returns the socket of the agent for the store in dir.
+func agentSocket(dir string) string {
+	if s := os.Getenv(agentEnvSock); s != "" {
+		return s
+	}
+	return filepath.Join(dir, "agent.sock")
+}
+
+// agentRequest is a request to the agent. Requests and responses are JSON
+// values sent back to back on the connection.
+type agentRequest struct {
+	Op         string `json:"op"`
+	Name       string `json:"name,omitempty"`
+	Data       []byte `json:"data,omitempty"`
+	AD         []byte `json:"ad,omitempty"`
+	Passphrase []byte `json:"passphrase,omitempty"`
+	// Deadline is the deadline of the client's context, if it has one.
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
+type agentResponse struct {
+	// Dir is the store the agent holds the key of, so that a client of
+	// $DURIN_AGENT_SOCK opening another store does not use it.
+	Dir    string        `json:"dir,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Locked bool          `json:"locked,omitempty"`
+	Data   []byte        `json:"data,omitempty"`
+	Names  []string      `json:"names,omitempty"`
+	Record *store.Record `json:"record,omitempty"`
+}
+
+var errAgentLocked = errors.New("agent is locked")
+
+// agent holds the unlocked master key for other durin processes. It never
+// takes the store lock: get reads the db file, which is replaced atomically,
+// and commands that write use the agent only to encrypt and decrypt.
+type agent struct {
+	dir  string
+	idle time.Duration
+
+	mu     sync.Mutex
+	master tink.AEAD
+	// keyFrom is the digest of the master file master was unlocked from;
+	// see store.MasterDigest.
+	keyFrom  [sha256.Size]byte
+	timer    *time.Timer
+	relockAt time.Time
+
+	metrics *daemonMetrics
+}
+
+func newAgent(dir string, idle time.Duration) *agent {
+	a := &agent{dir: dir, idle: idle}
+	a.metrics = newDaemonMetrics(dir, a.state)
+	return a
+}
+
+// state reports whether the agent holds the master key and when it locks.
+func (a *agent) state() (bool, time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.master == nil {
+		return false, time.Time{}
+	}
+	return true, a.relockAt
+}
+
+// touch restarts the idle timer. mu must be held.
+func (a *agent) touch() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if a.idle > 0 {
+		a.timer = time.AfterFunc(a.idle, a.lock)
+		a.relockAt = time.Now().Add(a.idle)
+	}
+}
+
+func (a *agent) lock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.master = nil
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.relockAt = time.Time{}
+}
+
+func (a *agent) handle(ctx context.Context, req *agentRequest) *agentResponse {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if req.Op == "lock" {
+		a.master = nil
+		return &agentResponse{Locked: true}
+	}
+	if req.Op == "unlock" {
+		sum, err := store.MasterDigest(a.dir)
+		if err != nil {
+			return &agentResponse{Error: err.Error(), Locked: a.master == nil}
+		}
+		ks, err := store.UnlockKeyset(ctx, a.dir, req.Passphrase)
+		if err != nil {
+			return &agentResponse{Error: err.Error(), Locked: a.master == nil}
+		}
+		key, err := aead.New(ks)
+		if err != nil {
+			return &agentResponse{Error: err.Error(), Locked: a.master == nil}
+		}
+		a.master, a.keyFrom = key, sum
+		a.touch()
+		return &agentResponse{}
+	}
+	if req.Op == "list" {
+		names, err := store.ListNames(a.dir)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		return &agentResponse{Names: names}
+	}
+	if a.master != nil {
+		// A keyset replaced since, e.g. by durin key rekey, may lack the
+		// keys new entries must be encrypted with: lock until unlocked
+		// with the new one.
+		if sum, err := store.MasterDigest(a.dir); err != nil || sum != a.keyFrom {
+			a.master = nil
+		}
+	}
+	if a.master == nil {
+		return &agentResponse{Error: errAgentLocked.Error(), Locked: true}
+	}
+	a.touch()
+	switch req.Op {
+	case "status":
+		return &agentResponse{}
+	case "encrypt":
+		c, err := a.master.Encrypt(req.Data, req.AD)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		return &agentResponse{Data: c}
+	case "decrypt":
+		p, err := a.master.Decrypt(req.Data, req.AD)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		secmem.Lock(p)
+		return &agentResponse{Data: p}
+	case "get":
+		r, err := a.get(ctx, req.Name)
+		if err != nil {
+			return &agentResponse{Error: err.Error()}
+		}
+		return &agentResponse{Record: r}
+	default:
+		return &agentResponse{Error: fmt.Sprintf("unknown agent request %q", req.Op)}
+	}
+}
+
+func (a *agent) get(ctx context.Context, name string) (*store.Record, error) {
+	env, err := store.ReadEnvelope(a.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return store.DecryptEnvelope(ctx, a.master, a.dir, env)
+}
+
+func (a *agent) serveConn(conn net.Conn) {
+	defer conn.Close()
+	dec, enc := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req agentRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		deadline := time.Now().Add(agentRequestTimeout)
+		if !req.Deadline.IsZero() && req.Deadline.Before(deadline) {
+			deadline = req.Deadline
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		resp := a.handle(ctx, &req)
+		resp.Dir = a.dir
+		cancel()
+		a.metrics.count(req.Op, resp.Error != "")
+		conn.SetWriteDeadline(deadline)
+		err := enc.Encode(resp)
+		conn.SetWriteDeadline(time.Time{})
+		// Requests and responses carry passphrases, plaintexts and
+		// records; none is needed once the response is sent.
+		secmem.Wipe(req.Passphrase)
+		secmem.Wipe(req.Data)
+		secmem.Wipe(resp.Data)
+		if resp.Record != nil {
+			resp.Record.Wipe()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// serve accepts connections on ln until it is closed.
+func (a *agent) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+// agentClient is a connection to a running agent.
+type agentClient struct {
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+// dialAgent connects to the agent for the store in dir, if one is running.
+func dialAgent(ctx context.Context, dir string) (*agentClient, error) {
+	d := net.Dialer{Timeout: time.Second}
+	conn, err := d.DialContext(ctx, "unix", agentSocket(dir))
+	if err != nil {
+		return nil, err
+	}
+	return &agentClient{conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}, nil
+}
+
+// call sends req and waits for the response until ctx is done. A call that
+// fails midway leaves the connection unusable.
+func (c *agentClient) call(ctx context.Context, req *agentRequest) (*agentResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline
+	}
+	c.conn.SetDeadline(req.Deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the reads and writes below.
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	if err := c.enc.Encode(req); err != nil {
+		return nil, callError(ctx, err)
+	}
+	var resp agentResponse
+	if err := c.dec.Decode(&resp); err != nil {
+		return nil, callError(ctx, err)
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// callError prefers ctx's error to the I/O error it caused.
+func callError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// agentAEAD encrypts and decrypts with the agent's master key. It
+// implements store.ContextAEAD; without a context, calls are bounded by
+// agentRequestTimeout.
+type agentAEAD struct {
+	c *agentClient
+}
+
+func (k agentAEAD) Encrypt(plaintext, ad []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentRequestTimeout)
+	defer cancel()
+	return k.EncryptContext(ctx, plaintext, ad)
+}
+
+func (k agentAEAD) Decrypt(ciphertext, ad []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentRequestTimeout)
+	defer cancel()
+	return k.DecryptContext(ctx, ciphertext, ad)
+}
+
+func (k agentAEAD) EncryptContext(ctx context.Context, plaintext, ad []byte) ([]byte, error) {
+	resp, err := k.c.call(ctx, &agentRequest{Op: "encrypt", Data: plaintext, AD: ad})
+	if err != nil {
+		return nil, agentError(resp, err)
+	}
+	return resp.Data, nil
+}
+
+func (k agentAEAD) DecryptContext(ctx context.Context, ciphertext, ad []byte) ([]byte, error) {
+	resp, err := k.c.call(ctx, &agentRequest{Op: "decrypt", Data: ciphertext, AD: ad})
+	if err != nil {
+		return nil, agentError(resp, err)
+	}
+	return resp.Data, nil
+}
+
+// agentError describes a failed call to the agent. A locked agent is
+// reported as a locked store.
+func agentError(resp *agentResponse, err error) error {
+	if resp != nil && resp.Locked {
+		return fmt.Errorf("agent: %w", store.ErrLocked)
+	}
+	return fmt.Errorf("agent: %v", err)
+}
+
+// agentKey returns the master key of a running, unlocked agent for the
+// store in dir, or nil.
+func agentKey(ctx context.Context, dir string) tink.AEAD {
+	c, err := dialAgent(ctx, dir)
+	if err != nil {
+		return nil
+	}
+	if resp, err := c.call(ctx, &agentRequest{Op: "status"}); err != nil || !agentServes(resp, dir) {
+		c.conn.Close()
+		return nil
+	}
+	return agentAEAD{c}
+}
+
+// agentUnlock hands pw to a running agent that is locked. Failures are
+// ignored: the agent is a convenience.
+func agentUnlock(dir string, pw []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), agentRequestTimeout)
+	defer cancel()
+	c, err := dialAgent(ctx, dir)
+	if err != nil {
+		return
+	}
+	defer c.conn.Close()
+	// The passphrase of one store is not for the agent of another.
+	if resp, err := c.call(ctx, &agentRequest{Op: "status"}); err != nil && resp != nil && resp.Locked && agentServes(resp, dir) {
+		c.call(ctx, &agentRequest{Op: "unlock", Passphrase: pw})
+	}
+}
+
+// agentLock locks a running agent for the store in dir, so that it stops
+// using a keyset about to change. It is an error only if the agent answers
+// but does not lock.
+func agentLock(ctx context.Context, dir string) error {
+	c, err := dialAgent(ctx, dir)
+	if err != nil {
+		return nil
+	}
+	defer c.conn.Close()
+	resp, err := c.call(ctx, &agentRequest{Op: "status"})
+	if !agentServes(resp, dir) {
+		return nil
+	}
+	if err == nil || !resp.Locked {
+		if _, err := c.call(ctx, &agentRequest{Op: "lock"}); err != nil {
+			return fmt.Errorf("failed to lock durin agent: %v", err)
+		}
+	}
+	return nil
+}
+
+// agentServes reports whether the agent that sent resp holds the key of
+// the store in dir. $DURIN_AGENT_SOCK points every store at the same agent,
+// which serves one of them only.
+func agentServes(resp *agentResponse, dir string) bool {
+	if resp == nil || resp.Dir == "" {
+		return false
+	}
+	a, err := os.Stat(resp.Dir)
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(dir)
+	return err == nil && os.SameFile(a, b)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The names the agent is installed under with launchd and systemd.
+const (
+	agentLabel = "com.citizencloud.durin.agent"
+	agentUnit  = "durin-agent.service"
+)
+
+// agentService is how durin agent --install starts the agent at login.
+type agentService struct {
+	// Path is where the file goes, and Contents what it holds.
+	Path     string
+	Contents []byte
+	// Start tells how to start it without logging in again.
+	Start string
+}
+
+// newAgentService returns the service that runs the durin executable exe
+// with args as the agent on this platform: a launchd agent on macOS and a
+// systemd user unit elsewhere.
+func newAgentService(exe string, args []string) (*agentService, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	argv := append([]string{exe, "agent"}, args...)
+	switch runtime.GOOS {
+	case "darwin":
+		var b bytes.Buffer
+		str := func(indent, s string) {
+			b.WriteString(indent + "<string>")
+			xml.EscapeText(&b, []byte(s))
+			b.WriteString("</string>\n")
+		}
+		b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + agentLabel + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+		for _, a := range argv {
+			str("\t\t", a)
+		}
+		b.WriteString(`	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ProcessType</key>
+	<string>Interactive</string>
+	<key>StandardErrorPath</key>
+`)
+		str("\t", filepath.Join(home, "Library", "Logs", "durin-agent.log"))
+		b.WriteString("</dict>\n</plist>\n")
+		path := filepath.Join(home, "Library", "LaunchAgents", agentLabel+".plist")
+		return &agentService{
+			Path:     path,
+			Contents: b.Bytes(),
+			Start:    fmt.Sprintf("launchctl bootstrap gui/%d %s", os.Getuid(), path),
+		}, nil
+	case "linux":
+		// systemd has quoting rules of its own; rather than get them
+		// wrong, refuse what would need them.
+		for _, a := range argv {
+			if strings.ContainsAny(a, " \t\n\"'\\%$;") {
+				return nil, fmt.Errorf("cannot write %q into a systemd unit", a)
+			}
+		}
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, err
+		}
+		contents := fmt.Sprintf(`[Unit]
+Description=durin agent, keeping the store unlocked for other durin commands
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, strings.Join(argv, " "))
+		return &agentService{
+			Path:     filepath.Join(dir, "systemd", "user", agentUnit),
+			Contents: []byte(contents),
+			Start:    "systemctl --user enable --now " + agentUnit,
+		}, nil
+	}
+	return nil, errors.New("durin agent --install knows launchd and systemd; start durin agent from your session instead")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// askpassHelperName is an executable name under which durin acts as
+// "durin askpass", since SSH_ASKPASS and SUDO_ASKPASS take a bare path.
+const askpassHelperName = "durin-askpass"
+
+var (
+	// e.g. "Enter passphrase for key '/home/me/.ssh/id_ed25519': "
+	sshKeyPrompt = regexp.MustCompile(`passphrase for (?:key )?'?([^':]+)'?:`)
+	// e.g. "[sudo] password for me: "
+	sudoPrompt = regexp.MustCompile(`^\[sudo\] password for ([^:]+):`)
+)
+
+// askpassName returns the entry named by an askpass prompt: ssh/KEY for an
+// ssh key passphrase, where KEY is the key file's base name, or sudo/USER for
+// a sudo password.
+func askpassName(prompt string) (string, bool) {
+	prompt = strings.TrimSpace(prompt)
+	if m := sshKeyPrompt.FindStringSubmatch(prompt); m != nil {
+		return "ssh/" + filepath.Base(strings.TrimSpace(m[1])), true
+	}
+	if m := sudoPrompt.FindStringSubmatch(prompt); m != nil {
+		return "sudo/" + strings.TrimSpace(m[1]), true
+	}
+	return "", false
+}
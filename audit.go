@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// severity ranks audit findings. Higher is worse.
+type severity int
+
+const (
+	severityLow severity = iota + 1
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+var severityNames = map[severity]string{
+	severityLow:      "low",
+	severityMedium:   "medium",
+	severityHigh:     "high",
+	severityCritical: "critical",
+}
+
+func (s severity) String() string {
+	return severityNames[s]
+}
+
+func (s severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func parseSeverity(s string) (severity, error) {
+	for sev, name := range severityNames {
+		if name == s {
+			return sev, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q: want low, medium, high or critical", s)
+}
+
+// Audit checks, as accepted by --checks.
+const (
+	checkWeak    = "weak"
+	checkReuse   = "reuse"
+	checkBreach  = "breach"
+	checkExpired = "expired"
+	checkStale   = "stale"
+	checkPolicy  = "policy"
+)
+
+var allChecks = []string{checkWeak, checkReuse, checkBreach, checkExpired, checkStale, checkPolicy}
+
+// finding is a single problem reported by audit.
+type finding struct {
+	Name     string   `json:"name" yaml:"name"`
+	Check    string   `json:"check" yaml:"check"`
+	Severity severity `json:"severity" yaml:"severity"`
+	Detail   string   `json:"detail" yaml:"detail"`
+	// Modified is when the entry was last written, if known.
+	Modified *time.Time `json:"modified,omitempty" yaml:"modified,omitempty"`
+}
+
+// auditOptions configures runAudit.
+type auditOptions struct {
+	checks     map[string]bool
+	staleAfter time.Duration
+	breaches   breachChecker
+	now        time.Time
+}
+
+// runAudit runs the enabled checks over every entry in db and returns the
+// findings, worst first.
+func runAudit(ctx context.Context, db *store.DB, opts *auditOptions) ([]finding, error) {
+	findings := []finding{}
+	add := func(name, check string, sev severity, format string, args ...interface{}) {
+		findings = append(findings, finding{Name: name, Check: check, Severity: sev, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	modified := make(map[string]*time.Time)
+	err := db.ForEach(ctx, func(name string, r *store.Record) error {
+		defer r.Wipe()
+		modified[name] = r.Modified
+		if r.Password == "" {
+			return nil
+		}
+		if opts.checks[checkBreach] {
+			n, err := opts.breaches.breachCount(ctx, sha1Hex(r.Password))
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				add(name, checkBreach, severityCritical, "password seen %d times in breaches", n)
+			}
+		}
+		if opts.checks[checkWeak] {
+			if s := passwordStrength(r.Password, name, r.Username); s.weak() {
+				add(name, checkWeak, severityMedium, "password is %s (estimated crack time: %s)", s.Label, s.CrackTime)
+			}
+		}
+		if opts.checks[checkExpired] && r.Expires != nil && r.Expires.Before(opts.now) {
+			add(name, checkExpired, severityHigh, "password expired on %s", r.Expires.Format("2006-01-02"))
+		}
+		if opts.checks[checkPolicy] && r.Policy != nil {
+			if v := policyViolations(r.Policy, r.Password, r.Changed, opts.now); len(v) > 0 {
+				add(name, checkPolicy, severityMedium, "password violates its policy: %s", strings.Join(v, ", "))
+			}
+		}
+		// The password of an entry with no record of it changing is as old
+		// as the entry.
+		changed := r.Changed
+		if changed == nil {
+			changed = r.Created
+		}
+		if opts.checks[checkStale] && changed != nil && opts.now.Sub(*changed) > opts.staleAfter {
+			add(name, checkStale, severityLow, "password not changed since %s", changed.Format("2006-01-02"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.checks[checkReuse] {
+		groups, err := findReused(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			for _, name := range g {
+				var others []string
+				for _, o := range g {
+					if o != name {
+						others = append(others, o)
+					}
+				}
+				add(name, checkReuse, severityHigh, "password also used by %s", strings.Join(others, ", "))
+			}
+		}
+	}
+
+	for i := range findings {
+		findings[i].Modified = modified[findings[i].Name]
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Severity != findings[j].Severity {
+			return findings[i].Severity > findings[j].Severity
+		}
+		return findings[i].Name < findings[j].Name
+	})
+	return findings, nil
+}
+
+// findingsError is returned when audit finds problems at or above the
+// --fail-on severity.
+type findingsError struct {
+	count     int
+	threshold severity
+}
+
+func (e findingsError) Error() string {
+	return fmt.Sprintf("audit found %d problem(s) of severity %s or worse", e.count, e.threshold)
+}
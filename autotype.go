@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// defaultAutotype is the sequence typed for entries that set none.
+const defaultAutotype = "{USER}{TAB}{PASS}{ENTER}"
+
+// autotypeField is the field an entry can keep its own sequence in.
+const autotypeField = "autotype"
+
+// typist types into the focused window with an external program: wtype on
+// Wayland, xdotool on X11, or ydotool, which works anywhere its daemon can
+// reach /dev/uinput.
+type typist struct {
+	// typeCmd types the text on its standard input.
+	typeCmd []string
+	// keyCmd presses key, one of the keys in autotypeKeys.
+	keyCmd func(key string) []string
+	// keys maps the keys of autotypeKeys to the program's names for them.
+	keys map[string]string
+}
+
+// autotypeKeys are the keys sequences can press, as {NAME}.
+var autotypeKeys = []string{"TAB", "ENTER", "ESC", "BACKSPACE"}
+
+var (
+	wtypeTypist = typist{
+		typeCmd: []string{"wtype", "-"},
+		keyCmd:  func(key string) []string { return []string{"wtype", "-k", key} },
+		keys:    map[string]string{"TAB": "Tab", "ENTER": "Return", "ESC": "Escape", "BACKSPACE": "BackSpace"},
+	}
+	xdotoolTypist = typist{
+		typeCmd: []string{"xdotool", "type", "--clearmodifiers", "--file", "-"},
+		keyCmd:  func(key string) []string { return []string{"xdotool", "key", "--clearmodifiers", key} },
+		keys:    map[string]string{"TAB": "Tab", "ENTER": "Return", "ESC": "Escape", "BACKSPACE": "BackSpace"},
+	}
+	// ydotool presses keys by their Linux input event codes.
+	ydotoolTypist = typist{
+		typeCmd: []string{"ydotool", "type", "--file", "-"},
+		keyCmd:  func(key string) []string { return []string{"ydotool", "key", key + ":1", key + ":0"} },
+		keys:    map[string]string{"TAB": "15", "ENTER": "28", "ESC": "1", "BACKSPACE": "14"},
+	}
+)
+
+// systemTypist returns the typist for the current session, preferring the
+// program made for it and falling back to ydotool.
+func systemTypist() (*typist, error) {
+	var candidates []*typist
+	switch {
+	case waylandSession():
+		candidates = []*typist{&wtypeTypist, &ydotoolTypist}
+	case os.Getenv("DISPLAY") != "":
+		candidates = []*typist{&xdotoolTypist, &ydotoolTypist}
+	default:
+		candidates = []*typist{&ydotoolTypist}
+	}
+	for _, t := range candidates {
+		if _, err := exec.LookPath(t.typeCmd[0]); err == nil {
+			return t, nil
+		}
+	}
+	if len(candidates) == 1 {
+		return nil, errors.New("typing requires an X11 or Wayland session, or ydotool")
+	}
+	return nil, fmt.Errorf("no typing tool found; install %s", candidates[0].typeCmd[0])
+}
+
+func (t *typist) run(args []string, stdin string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+func (t *typist) typeText(s string) error {
+	if s == "" {
+		return nil
+	}
+	return t.run(t.typeCmd, s)
+}
+
+func (t *typist) press(key string) error {
+	return t.run(t.keyCmd(t.keys[key]), "")
+}
+
+// typeText types s into the focused window.
+func typeText(s string) error {
+	t, err := systemTypist()
+	if err != nil {
+		return err
+	}
+	return t.typeText(s)
+}
+
+// autotypeStep is one step of an auto-type sequence: text to type, a key
+// to press or a pause.
+type autotypeStep struct {
+	text  string
+	key   string
+	delay time.Duration
+}
+
+// parseAutotype parses an auto-type sequence for r. Placeholders in braces
+// stand for the parts of the entry: {USER}, {PASS}, {URL}, {TOTP} for the
+// current TOTP code and {S:field} for a custom field. {TAB}, {ENTER},
+// {ESC} and {BACKSPACE} press those keys, {DELAY n} waits n milliseconds,
+// and {{} and {}} type braces. Anything else is typed as it is.
+func parseAutotype(seq string, r *store.Record) ([]autotypeStep, error) {
+	var (
+		steps []autotypeStep
+		text  strings.Builder
+	)
+	flush := func() {
+		if text.Len() > 0 {
+			steps = append(steps, autotypeStep{text: text.String()})
+			text.Reset()
+		}
+	}
+	for seq != "" {
+		i := strings.IndexByte(seq, '{')
+		if i < 0 {
+			text.WriteString(seq)
+			break
+		}
+		text.WriteString(seq[:i])
+		seq = seq[i:]
+		// The closing brace of {}} is the second one.
+		j := strings.IndexByte(seq[1:], '}') + 1
+		if strings.HasPrefix(seq, "{}}") {
+			j = 2
+		}
+		if j == 0 {
+			return nil, fmt.Errorf("unclosed { in auto-type sequence")
+		}
+		token := seq[1:j]
+		seq = seq[j+1:]
+		upper := strings.ToUpper(token)
+		switch {
+		case token == "{" || token == "}":
+			text.WriteString(token)
+		case upper == "USER" || upper == "USERNAME":
+			text.WriteString(r.Username)
+		case upper == "PASS" || upper == "PASSWORD":
+			text.WriteString(r.Password)
+		case upper == "URL":
+			text.WriteString(r.LoginURL())
+		case upper == "TOTP":
+			uri := r.TOTPURI()
+			if uri == "" {
+				return nil, errors.New("the entry has no TOTP secret for {TOTP}")
+			}
+			code, err := totpCode(uri, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			text.WriteString(code)
+		case strings.HasPrefix(upper, "S:"):
+			v, ok := r.Fields[token[2:]]
+			if !ok {
+				return nil, fmt.Errorf("the entry has no field %q", token[2:])
+			}
+			text.WriteString(v)
+		case strings.HasPrefix(upper, "DELAY "):
+			ms, err := strconv.Atoi(strings.TrimSpace(token[len("DELAY "):]))
+			if err != nil || ms < 0 {
+				return nil, fmt.Errorf("invalid {%s} in auto-type sequence", token)
+			}
+			flush()
+			steps = append(steps, autotypeStep{delay: time.Duration(ms) * time.Millisecond})
+		default:
+			known := false
+			for _, k := range autotypeKeys {
+				known = known || upper == k
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown placeholder {%s} in auto-type sequence", token)
+			}
+			flush()
+			steps = append(steps, autotypeStep{key: upper})
+		}
+	}
+	flush()
+	return steps, nil
+}
+
+// autotype types steps with t.
+func autotype(t *typist, steps []autotypeStep) error {
+	for _, s := range steps {
+		var err error
+		switch {
+		case s.key != "":
+			err = t.press(s.key)
+		case s.delay > 0:
+			time.Sleep(s.delay)
+		default:
+			err = t.typeText(s.text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
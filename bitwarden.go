@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+	"github.com/citizencloud/passwordstore/store"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// bitwardenExport is a Bitwarden JSON export. Encrypted exports only fill
+// the first group of fields; data decrypts to an unencrypted export.
+type bitwardenExport struct {
+	Encrypted         bool   `json:"encrypted"`
+	PasswordProtected bool   `json:"passwordProtected"`
+	Salt              string `json:"salt"`
+	KDFType           int    `json:"kdfType"`
+	KDFIterations     int    `json:"kdfIterations"`
+	KDFMemory         int    `json:"kdfMemory"`
+	KDFParallelism    int    `json:"kdfParallelism"`
+	KeyValidation     string `json:"encKeyValidation_DO_NOT_EDIT"`
+	Data              string `json:"data"`
+
+	Folders []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"folders"`
+	Items []bitwardenItem `json:"items"`
+}
+
+// Bitwarden item types.
+const (
+	bitwardenLogin    = 1
+	bitwardenNote     = 2
+	bitwardenCard     = 3
+	bitwardenIdentity = 4
+	bitwardenSSHKey   = 5
+)
+
+// bitwardenItem is an item of a Bitwarden export.
+type bitwardenItem struct {
+	FolderID     string     `json:"folderId"`
+	Type         int        `json:"type"`
+	Name         string     `json:"name"`
+	Notes        string     `json:"notes"`
+	CreationDate *time.Time `json:"creationDate"`
+	RevisionDate *time.Time `json:"revisionDate"`
+	Fields       []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+		// Type 3 fields link to another value of the item and hold none.
+		Type int `json:"type"`
+	} `json:"fields"`
+	Login *struct {
+		URIs []struct {
+			URI string `json:"uri"`
+		} `json:"uris"`
+		Username             string     `json:"username"`
+		Password             string     `json:"password"`
+		TOTP                 string     `json:"totp"`
+		PasswordRevisionDate *time.Time `json:"passwordRevisionDate"`
+	} `json:"login"`
+	Card     map[string]string `json:"card"`
+	Identity map[string]string `json:"identity"`
+	SSHKey   map[string]string `json:"sshKey"`
+
+	PasswordHistory []struct {
+		LastUsedDate time.Time `json:"lastUsedDate"`
+		Password     string    `json:"password"`
+	} `json:"passwordHistory"`
+}
+
+// Bitwarden key derivation functions.
+const (
+	bitwardenPBKDF2   = 0
+	bitwardenArgon2id = 1
+)
+
+// bitwardenEncrypted reports whether the export in data is protected by a
+// password, so that the caller knows whether to ask for it.
+func bitwardenEncrypted(data []byte) (bool, error) {
+	var exp bitwardenExport
+	if err := strictjson.Unmarshal(data, &exp, importLimits); err != nil {
+		return false, fmt.Errorf("not a Bitwarden JSON export: %v", err)
+	}
+	if exp.Encrypted && !exp.PasswordProtected {
+		return false, errors.New("the export is encrypted with the Bitwarden account's key; export it again with a file password, or unencrypted")
+	}
+	return exp.Encrypted, nil
+}
+
+// readBitwarden parses the Bitwarden JSON export in data, decrypting it with
+// password if it is password protected, and maps its items to entries.
+// Folders become name prefixes.
+func readBitwarden(data, password []byte) ([]importedEntry, error) {
+	var exp bitwardenExport
+	if err := strictjson.Unmarshal(data, &exp, importLimits); err != nil {
+		return nil, fmt.Errorf("not a Bitwarden JSON export: %v", err)
+	}
+	if exp.Encrypted {
+		plain, err := decryptBitwarden(&exp, password)
+		if err != nil {
+			return nil, err
+		}
+		exp = bitwardenExport{}
+		err = strictjson.Unmarshal(plain, &exp, importLimits)
+		secmem.Wipe(plain)
+		if err != nil {
+			return nil, fmt.Errorf("the decrypted export is not valid: %v", err)
+		}
+	}
+	folders := make(map[string]string)
+	for _, f := range exp.Folders {
+		folders[f.ID] = f.Name
+	}
+	taken := make(map[string]bool)
+	entries := make([]importedEntry, 0, len(exp.Items))
+	for i := range exp.Items {
+		item := &exp.Items[i]
+		name := importNamePart(item.Name)
+		if folder := folders[item.FolderID]; folder != "" {
+			// Bitwarden nests folders by naming them parent/child.
+			name = folder + "/" + name
+		}
+		entries = append(entries, importedEntry{Name: uniqueName(importName(name), taken), Record: bitwardenRecord(item)})
+	}
+	return entries, nil
+}
+
+// bitwardenRecord maps a Bitwarden item to a record: logins keep their
+// username, password, URIs as url fields and TOTP secret; cards and
+// identities become records of their own kinds with a field per value;
+// secure notes become notes.
+func bitwardenRecord(item *bitwardenItem) *store.Record {
+	r := &store.Record{Notes: item.Notes, Changed: item.RevisionDate, Created: item.CreationDate, Modified: item.RevisionDate}
+	switch item.Type {
+	case bitwardenLogin:
+		r.Kind = store.KindLogin
+		if l := item.Login; l != nil {
+			r.Username, r.Password = l.Username, l.Password
+			for _, u := range l.URIs {
+				if u.URI != "" {
+					setURL(r, u.URI)
+				}
+			}
+			switch {
+			case l.TOTP == "":
+			case strings.Contains(l.TOTP, "://"):
+				// otpauth:// URIs, and steam:// for Steam Guard codes.
+				setField(r, totpField, l.TOTP)
+			default:
+				setField(r, totpField, totpURI(l.TOTP, item.Name, l.Username, nil))
+			}
+			if l.PasswordRevisionDate != nil {
+				r.Changed = l.PasswordRevisionDate
+			}
+		}
+	case bitwardenNote:
+		r.Kind = store.KindNote
+	case bitwardenCard:
+		r.Kind = store.KindCard
+		setFields(r, item.Card)
+	case bitwardenIdentity:
+		r.Kind = store.KindIdentity
+		r.Username = item.Identity["username"]
+		delete(item.Identity, "username")
+		setFields(r, item.Identity)
+	case bitwardenSSHKey:
+		setFields(r, item.SSHKey)
+	}
+	for _, f := range item.Fields {
+		if f.Type != 3 && f.Value != "" {
+			setField(r, f.Name, f.Value)
+		}
+	}
+	// Bitwarden lists the newest password first.
+	sort.Slice(item.PasswordHistory, func(i, j int) bool {
+		return item.PasswordHistory[i].LastUsedDate.Before(item.PasswordHistory[j].LastUsedDate)
+	})
+	for _, h := range item.PasswordHistory {
+		r.History = append(r.History, store.HistoryEntry{Password: h.Password, Retired: h.LastUsedDate})
+	}
+	return r
+}
+
+// setFields sets a field of r for every non-empty value, in key order so
+// that numbered duplicates come out the same every time.
+func setFields(r *store.Record, values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if values[k] != "" {
+			setField(r, k, values[k])
+		}
+	}
+}
+
+// decryptBitwarden decrypts a password protected export. The file password
+// is stretched with the export's KDF and then with HKDF into an encryption
+// and a MAC key, which encKeyValidation_DO_NOT_EDIT lets us check before
+// decrypting the data.
+func decryptBitwarden(exp *bitwardenExport, password []byte) ([]byte, error) {
+	var key []byte
+	switch exp.KDFType {
+	case bitwardenPBKDF2:
+		key = pbkdf2.Key(password, []byte(exp.Salt), exp.KDFIterations, 32, sha256.New)
+	case bitwardenArgon2id:
+		salt := sha256.Sum256([]byte(exp.Salt))
+		key = argon2.IDKey(password, salt[:], uint32(exp.KDFIterations), uint32(exp.KDFMemory)*1024, uint8(exp.KDFParallelism), 32)
+	default:
+		return nil, fmt.Errorf("unknown key derivation function %d", exp.KDFType)
+	}
+	defer secmem.Wipe(key)
+	encKey, macKey := make([]byte, 32), make([]byte, 32)
+	defer secmem.Wipe(encKey)
+	defer secmem.Wipe(macKey)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte("enc")), encKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, []byte("mac")), macKey); err != nil {
+		return nil, err
+	}
+	check, err := decryptBitwardenString(exp.KeyValidation, encKey, macKey)
+	if err != nil {
+		return nil, err
+	}
+	secmem.Wipe(check)
+	return decryptBitwardenString(exp.Data, encKey, macKey)
+}
+
+// errBitwardenPassword is returned for an encrypted export when the
+// password is wrong.
+var errBitwardenPassword = errors.New("wrong password for the Bitwarden export")
+
+// decryptBitwardenString decrypts a Bitwarden "cipher string" of type 2,
+// "2.IV|CIPHERTEXT|MAC" in base64: AES-256-CBC authenticated with
+// HMAC-SHA256 over the IV and ciphertext.
+func decryptBitwardenString(s string, encKey, macKey []byte) ([]byte, error) {
+	typ, rest, _ := strings.Cut(s, ".")
+	parts := strings.Split(rest, "|")
+	if typ != "2" || len(parts) != 3 {
+		return nil, fmt.Errorf("unsupported Bitwarden cipher string of type %q", typ)
+	}
+	var raw [3][]byte
+	for i, p := range parts {
+		b, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Bitwarden cipher string: %v", err)
+		}
+		raw[i] = b
+	}
+	iv, ct, sum := raw[0], raw[1], raw[2]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ct)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return nil, errBitwardenPassword
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(ct) == 0 || len(ct)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed Bitwarden cipher string")
+	}
+	plain := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ct)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		secmem.Wipe(plain)
+		return nil, errors.New("malformed Bitwarden cipher string")
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// breachChecker reports how often a password appears in known breaches.
+type breachChecker interface {
+	// breachCount returns the number of times the password with the given
+	// uppercase hex SHA-1 digest was seen, or 0.
+	breachCount(ctx context.Context, digest string) (int, error)
+}
+
+func sha1Hex(pw string) string {
+	d := sha1.Sum([]byte(pw))
+	return strings.ToUpper(hex.EncodeToString(d[:]))
+}
+
+// hibpRangeURL is the HaveIBeenPwned k-anonymity endpoint. Only the first
+// five hex characters of the SHA-1 digest are ever sent.
+const hibpRangeURL = "https://api.pwnedpasswords.com/range/"
+
+type hibpClient struct {
+	client *http.Client
+	// cache maps digest prefixes to the suffix counts returned for them.
+	cache map[string]map[string]int
+}
+
+func newHIBPClient() *hibpClient {
+	return &hibpClient{
+		client: newHTTPClient(30*time.Second, nil),
+		cache:  make(map[string]map[string]int),
+	}
+}
+
+func (c *hibpClient) breachCount(ctx context.Context, digest string) (int, error) {
+	prefix, suffix := digest[:5], digest[5:]
+	counts, ok := c.cache[prefix]
+	if !ok {
+		var err error
+		if counts, err = c.fetchRange(ctx, prefix); err != nil {
+			return 0, err
+		}
+		c.cache[prefix] = counts
+	}
+	return counts[suffix], nil
+}
+
+func (c *hibpClient) fetchRange(ctx context.Context, prefix string) (map[string]int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", hibpRangeURL+prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "durin-password-store")
+	// Padding hides the number of matching suffixes from observers.
+	req.Header.Set("Add-Padding", "true")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HIBP range query failed: %s", resp.Status)
+	}
+
+	counts := make(map[string]int)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		suffix, count, err := parseHashCount(s.Text())
+		if err != nil {
+			return nil, err
+		}
+		// Padding entries have a count of zero.
+		if count > 0 {
+			counts[suffix] = count
+		}
+	}
+	return counts, s.Err()
+}
+
+// parseHashCount parses a "HASH:COUNT" line as used by both the range API
+// and the downloadable corpus.
+func parseHashCount(line string) (string, int, error) {
+	hash, countStr, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if !ok {
+		return "", 0, fmt.Errorf("malformed breach line %q", line)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed breach line %q", line)
+	}
+	return strings.ToUpper(hash), count, nil
+}
+
+// breachCorpus looks passwords up in a locally downloaded copy of the Pwned
+// Passwords SHA-1 list ordered by hash, one "HASH:COUNT" per line. The file
+// is binary searched, so it is never read in full.
+type breachCorpus struct {
+	f    *os.File
+	size int64
+}
+
+func openBreachCorpus(path string) (*breachCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &breachCorpus{f: f, size: fi.Size()}, nil
+}
+
+func (c *breachCorpus) Close() error {
+	return c.f.Close()
+}
+
+// lineAt returns the first complete line starting after off, or the first
+// line of the file when off is 0. It returns "" past the last line.
+func (c *breachCorpus) lineAt(off int64) (string, error) {
+	r := bufio.NewReader(io.NewSectionReader(c.f, off, c.size-off))
+	if off > 0 {
+		// off may point into the middle of a line; skip to the next one.
+		if _, err := r.ReadBytes('\n'); err != nil {
+			return "", nil
+		}
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+func (c *breachCorpus) breachCount(ctx context.Context, digest string) (int, error) {
+	// Bisect on byte offsets for the first line whose hash is >= digest.
+	// Comparing whole lines works because every hash has the same length
+	// and ":" sorts before the hex digits.
+	lo, hi := int64(0), c.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		line, err := c.lineAt(mid)
+		if err != nil {
+			return 0, err
+		}
+		if line == "" || line >= digest {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	line, err := c.lineAt(lo)
+	if err != nil || line == "" {
+		return 0, err
+	}
+	hash, count, err := parseHashCount(line)
+	if err != nil {
+		return 0, err
+	}
+	if hash != digest {
+		return 0, nil
+	}
+	return count, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// openBrowser opens u in the user's web browser: the one $BROWSER names, a
+// colon-separated list of commands as with xdg-utils, or the desktop's
+// default. It does not wait for the browser to exit.
+func openBrowser(u string) error {
+	var candidates [][]string
+	if b := os.Getenv("BROWSER"); b != "" {
+		for _, c := range strings.Split(b, ":") {
+			if c = strings.TrimSpace(c); c != "" {
+				candidates = append(candidates, []string{c})
+			}
+		}
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = append(candidates, []string{"open"})
+	case "windows":
+		candidates = append(candidates, []string{"rundll32", "url.dll,FileProtocolHandler"})
+	default:
+		candidates = append(candidates, []string{"xdg-open"})
+	}
+	for _, c := range candidates {
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			continue
+		}
+		cmd := exec.Command(path, append(c[1:], u)...)
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		return cmd.Process.Release()
+	}
+	return errors.New("no browser found; set $BROWSER")
+}
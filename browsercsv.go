@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// browserLogin is a saved login read from a browser's password export or
+// the macOS Keychain.
+type browserLogin struct {
+	origin, host string
+	changed      *time.Time
+	record       *store.Record
+}
+
+// readBrowserCSV reads the passwords a browser exported as CSV. Chromium
+// based browsers such as Chrome, Edge and Brave write
+//
+//	name,url,username,password,note
+//
+// Firefox writes url, username and password followed by httpRealm and
+// the like, with times in milliseconds since 1970, and Safari adds title,
+// notes and otpauth columns.
+//
+// Browsers keep a login per page they saw the form on, so logins are
+// deduplicated by origin and username, keeping the one changed last.
+// Entries are named after the host, or host/username if several logins
+// share one.
+func readBrowserCSV(r io.Reader) ([]importedEntry, error) {
+	t, err := readCSV(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the password export: %v", err)
+	}
+	if c := t.missing("url", "username", "password"); c != "" {
+		return nil, fmt.Errorf("not a browser password export: no %s column", c)
+	}
+	var logins []*browserLogin
+	seen := make(map[string]*browserLogin)
+	for _, row := range t.rows {
+		l := browserRecord(t, row)
+		key := l.origin + "\x00" + l.record.Username
+		prev := seen[key]
+		switch {
+		case prev == nil:
+			seen[key] = l
+			logins = append(logins, l)
+		case l.changed != nil && (prev.changed == nil || l.changed.After(*prev.changed)):
+			prev.record.Wipe()
+			*prev = *l
+		default:
+			l.record.Wipe()
+		}
+	}
+
+	return nameLogins(logins), nil
+}
+
+// nameLogins names logins after their hosts, or host/username for the
+// hosts that have several.
+func nameLogins(logins []*browserLogin) []importedEntry {
+	perHost := make(map[string]int)
+	for _, l := range logins {
+		perHost[l.host]++
+	}
+	// Name the logins in a stable order, so that numbered duplicates
+	// come out the same every time.
+	sort.SliceStable(logins, func(i, j int) bool { return logins[i].host < logins[j].host })
+	entries := make([]importedEntry, 0, len(logins))
+	taken := make(map[string]bool)
+	for _, l := range logins {
+		name := importNamePart(l.host)
+		if perHost[l.host] > 1 {
+			name += "/" + importNamePart(l.record.Username)
+		}
+		entries = append(entries, importedEntry{Name: uniqueName(name, taken), Record: l.record})
+	}
+	return entries
+}
+
+// browserRecord maps a row of a browser's password export to a login.
+func browserRecord(t *csvTable, row []string) *browserLogin {
+	r := &store.Record{
+		Kind:     store.KindLogin,
+		Username: t.value(row, "username"),
+		Password: t.value(row, "password"),
+		Notes:    t.value(row, "note"),
+	}
+	if r.Notes == "" {
+		r.Notes = t.value(row, "notes")
+	}
+	raw := t.value(row, "url")
+	if raw != "" {
+		setURL(r, raw)
+	}
+	if otp := t.value(row, "otpauth"); otp != "" {
+		setField(r, totpField, otp)
+	}
+	l := &browserLogin{origin: raw, record: r}
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		l.origin = u.Scheme + "://" + u.Host
+		l.host = strings.TrimPrefix(u.Hostname(), "www.")
+	}
+	if l.host == "" {
+		l.host = t.value(row, "name")
+		if l.host == "" {
+			l.host = t.value(row, "title")
+		}
+	}
+	if ms, err := strconv.ParseInt(t.value(row, "timepasswordchanged"), 10, 64); err == nil && ms > 0 {
+		changed := time.UnixMilli(ms).UTC()
+		l.changed = &changed
+		r.Changed = &changed
+	}
+	return l
+}
@@ -0,0 +1,124 @@
+// Package client connects to the gRPC API of a running "durin grpc", so that
+// Go programs can use the store without parsing CLI output.
+//
+//	c, err := client.Dial(ctx, "")
+//	if err != nil {
+//		...
+//	}
+//	defer c.Close()
+//	r, err := c.Get(ctx, "github.com")
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/citizencloud/passwordstore/durinpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// DefaultSocket returns the socket "durin grpc" listens on by default.
+func DefaultSocket() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".durin", "grpc.sock"), nil
+}
+
+// Client is a connection to durin. Its methods wrap the generated
+// StoreClient, which can be used directly for full control over requests.
+type Client struct {
+	durinpb.StoreClient
+	conn *grpc.ClientConn
+}
+
+// Dial connects to the server listening on socket, or DefaultSocket if
+// socket is empty.
+func Dial(ctx context.Context, socket string, opts ...grpc.DialOption) (*Client, error) {
+	if socket == "" {
+		var err error
+		if socket, err = DefaultSocket(); err != nil {
+			return nil, err
+		}
+	}
+	opts = append([]grpc.DialOption{
+		// The unix socket's permissions stand in for transport security.
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+	}, opts...)
+	conn, err := grpc.DialContext(ctx, socket, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{StoreClient: durinpb.NewStoreClient(conn), conn: conn}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Get returns the entry called name.
+func (c *Client) Get(ctx context.Context, name string) (*durinpb.Record, error) {
+	return c.StoreClient.Get(ctx, &durinpb.GetRequest{Name: name})
+}
+
+// List calls fn with each entry whose name starts with prefix, in name
+// order, stopping at the first error.
+func (c *Client) List(ctx context.Context, prefix string, fn func(*durinpb.Entry) error) error {
+	stream, err := c.StoreClient.List(ctx, &durinpb.ListRequest{Prefix: prefix})
+	if err != nil {
+		return err
+	}
+	return drain(stream, fn)
+}
+
+// Search calls fn with each entry whose name fuzzily matches query, best
+// match first, stopping at the first error.
+func (c *Client) Search(ctx context.Context, query string, fn func(*durinpb.Entry) error) error {
+	stream, err := c.StoreClient.Search(ctx, &durinpb.SearchRequest{Query: query})
+	if err != nil {
+		return err
+	}
+	return drain(stream, fn)
+}
+
+// Put stores r, replacing an existing entry only if overwrite is set.
+func (c *Client) Put(ctx context.Context, r *durinpb.Record, overwrite bool) error {
+	_, err := c.StoreClient.Put(ctx, &durinpb.PutRequest{Record: r, Overwrite: overwrite})
+	return err
+}
+
+// Delete removes the entry called name.
+func (c *Client) Delete(ctx context.Context, name string) error {
+	_, err := c.StoreClient.Delete(ctx, &durinpb.DeleteRequest{Name: name})
+	return err
+}
+
+type entryStream interface {
+	Recv() (*durinpb.Entry, error)
+}
+
+func drain(stream entryStream, fn func(*durinpb.Entry) error) error {
+	for {
+		e, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
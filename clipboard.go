@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/spf13/cobra"
+)
+
+// defaultClipTimeout is how long copied secrets stay on the clipboard.
+const defaultClipTimeout = 45 * time.Second
+
+// clipboard is somewhere secrets can be copied to.
+type clipboard interface {
+	copy(data []byte) error
+	// paste returns the current contents, or errPasteUnsupported.
+	paste() ([]byte, error)
+}
+
+var errPasteUnsupported = errors.New("clipboard cannot be read")
+
+// clipOptions controls how secrets are copied.
+type clipOptions struct {
+	timeout time.Duration
+	osc52   bool
+	// x11Owner makes clip-restore own the X11 clipboard itself.
+	x11Owner bool
+}
+
+// addClipFlags registers the flags filling opts on cmd.
+func addClipFlags(cmd *cobra.Command, opts *clipOptions) {
+	cmd.Flags().DurationVarP(&opts.timeout, "timeout", "t", defaultClipTimeout, "clear the clipboard after this long")
+	cmd.Flags().BoolVar(&opts.osc52, "osc52", false, "copy through the terminal with OSC 52 escape sequences (default when running over SSH without a display)")
+}
+
+// useOSC52 reports whether secrets should be copied with OSC 52: when asked
+// to, or when in a remote session with no display server to talk to.
+func (opts *clipOptions) useOSC52() bool {
+	if opts.osc52 {
+		return true
+	}
+	if runtime.GOOS == "darwin" || waylandSession() || os.Getenv("DISPLAY") != "" {
+		return false
+	}
+	return os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" || os.Getenv("TMUX") != ""
+}
+
+func (opts *clipOptions) clipboard() (clipboard, error) {
+	if opts.useOSC52() {
+		return osc52Clipboard{}, nil
+	}
+	return systemClipboard()
+}
+
+// cmdClipboard is a system clipboard driven by external helper programs.
+type cmdClipboard struct {
+	copyCmd  []string
+	pasteCmd []string
+	// clearCmd, if set, empties the clipboard; otherwise copyCmd is run
+	// with no input.
+	clearCmd []string
+	// primary is the X11 PRIMARY selection, through the same program.
+	primary *cmdClipboard
+}
+
+// x11Session reports whether the clipboard is that of an X server.
+func x11Session() bool {
+	return runtime.GOOS != "darwin" && !waylandSession() && os.Getenv("DISPLAY") != ""
+}
+
+// waylandSession reports whether durin runs in a Wayland session, where the
+// clipboard is the compositor's and X programs only see it through XWayland,
+// if at all. Programs started from some compositor key bindings and user
+// services are told the session type, or Sway's socket, but not
+// WAYLAND_DISPLAY; for those it points WAYLAND_DISPLAY at the compositor's
+// socket in XDG_RUNTIME_DIR, so that wl-clipboard finds it.
+func waylandSession() bool {
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		return true
+	}
+	if os.Getenv("XDG_SESSION_TYPE") != "wayland" && os.Getenv("SWAYSOCK") == "" {
+		return false
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return false
+	}
+	socks, _ := filepath.Glob(filepath.Join(dir, "wayland-*"))
+	for _, sock := range socks {
+		if fi, err := os.Stat(sock); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Setenv("WAYLAND_DISPLAY", filepath.Base(sock))
+			return true
+		}
+	}
+	return false
+}
+
+// systemClipboard returns the clipboard of the current desktop session.
+func systemClipboard() (*cmdClipboard, error) {
+	var candidates []cmdClipboard
+	switch {
+	case runtime.GOOS == "darwin":
+		candidates = []cmdClipboard{{copyCmd: []string{"pbcopy"}, pasteCmd: []string{"pbpaste"}}}
+	case waylandSession():
+		// wl-clipboard talks to wlroots compositors such as Sway over the
+		// data-control protocol, so neither needs a window or focus. The
+		// type is given so that wl-copy does not guess one from what the
+		// secret looks like.
+		candidates = []cmdClipboard{{
+			copyCmd:  []string{"wl-copy", "--type", "text/plain;charset=utf-8"},
+			pasteCmd: []string{"wl-paste", "--no-newline", "--type", "text"},
+			clearCmd: []string{"wl-copy", "--clear"},
+		}}
+	case x11Session():
+		candidates = []cmdClipboard{
+			{
+				copyCmd:  []string{"xclip", "-selection", "clipboard", "-in"},
+				pasteCmd: []string{"xclip", "-selection", "clipboard", "-out"},
+				primary:  &cmdClipboard{copyCmd: []string{"xclip", "-selection", "primary", "-in"}, pasteCmd: []string{"xclip", "-selection", "primary", "-out"}},
+			},
+			{
+				copyCmd:  []string{"xsel", "--clipboard", "--input"},
+				pasteCmd: []string{"xsel", "--clipboard", "--output"},
+				primary:  &cmdClipboard{copyCmd: []string{"xsel", "--primary", "--input"}, pasteCmd: []string{"xsel", "--primary", "--output"}, clearCmd: []string{"xsel", "--primary", "--clear"}},
+			},
+		}
+	default:
+		return nil, errors.New("no clipboard available: not running under X11, Wayland or macOS (try --osc52)")
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c.copyCmd[0]); err == nil {
+			c := c
+			return &c, nil
+		}
+	}
+	if candidates[0].copyCmd[0] == "wl-copy" {
+		return nil, errors.New("no clipboard tool found; install wl-clipboard")
+	}
+	return nil, fmt.Errorf("no clipboard tool found; install %s", candidates[0].copyCmd[0])
+}
+
+func (c *cmdClipboard) copy(data []byte) error {
+	args := c.copyCmd
+	if len(data) == 0 && c.clearCmd != nil {
+		args = c.clearCmd
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", args[0], err)
+	}
+	return nil
+}
+
+func (c *cmdClipboard) paste() ([]byte, error) {
+	out, err := exec.Command(c.pasteCmd[0], c.pasteCmd[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.pasteCmd[0], err)
+	}
+	return out, nil
+}
+
+// osc52Clipboard sets the clipboard of the terminal emulator itself by
+// writing an OSC 52 escape sequence to the controlling terminal. This works
+// across SSH and inside tmux or screen, but the clipboard cannot be read
+// back.
+type osc52Clipboard struct{}
+
+func (osc52Clipboard) copy(data []byte) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("no terminal for OSC 52: %v", err)
+	}
+	defer tty.Close()
+
+	seq := "\x1b]52;c;" + base64.StdEncoding.EncodeToString(data) + "\a"
+	switch {
+	case os.Getenv("TMUX") != "":
+		// Pass the sequence through tmux to the outer terminal.
+		seq = "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+	case os.Getenv("STY") != "":
+		seq = "\x1bP" + seq + "\x1b\\"
+	}
+	_, err = io.WriteString(tty, seq)
+	return err
+}
+
+func (osc52Clipboard) paste() ([]byte, error) {
+	return nil, errPasteUnsupported
+}
+
+// clipRestore is handed to the background process that clears the
+// clipboard once the timeout expires.
+type clipRestore struct {
+	Digest   []byte `json:"digest"`
+	Previous []byte `json:"previous"`
+	// Secret is set for a process that offers it on the X11 clipboard
+	// itself until the timeout.
+	Secret []byte `json:"secret,omitempty"`
+}
+
+// copyWithTimeout puts secret on the clipboard and starts a background
+// process that restores the previous contents after the timeout, unless the
+// clipboard was changed in the meantime.
+//
+// Secrets are never put on the X11 PRIMARY selection. On X11, the
+// background process owns the clipboard itself (see x11Owner) and marks the
+// secret for clipboard managers; xclip or xsel, if installed, only read
+// and restore the previous contents.
+func copyWithTimeout(secret []byte, opts *clipOptions) error {
+	if !opts.useOSC52() && x11Session() {
+		var prev []byte
+		if c, err := systemClipboard(); err == nil {
+			prev, _ = c.paste()
+		}
+		digest := sha256.Sum256(secret)
+		err := spawnClipRestore(clipRestore{Digest: digest[:], Previous: prev, Secret: secret}, opts)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Warning: cannot own the X11 clipboard (%v); copying with xclip or xsel, which cannot mark the secret for clipboard managers.\n", err)
+	}
+	c, err := opts.clipboard()
+	if err != nil {
+		return err
+	}
+	// Failing to read the clipboard, e.g. because it is empty, just means
+	// there is nothing to restore.
+	prev, _ := c.paste()
+	if err := c.copy(secret); err != nil {
+		return err
+	}
+	digest := sha256.Sum256(secret)
+	return spawnClipRestore(clipRestore{Digest: digest[:], Previous: prev}, opts)
+}
+
+func spawnClipRestore(r clipRestore, opts *clipOptions) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	// Hand the payload over through an explicit pipe: exec's own stdin
+	// copying goroutine would die with this process.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pw.Close()
+	args := []string{"clip-restore", "--after", opts.timeout.String()}
+	// OSC 52 needs the controlling terminal, so only leave the process
+	// group rather than the session.
+	attr := &syscall.SysProcAttr{Setsid: true}
+	if opts.useOSC52() {
+		args = append(args, "--osc52")
+		attr = &syscall.SysProcAttr{Setpgid: true}
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = pr
+	cmd.SysProcAttr = attr
+	var ready *os.File
+	if r.Secret != nil {
+		// The process tells on a pipe of its own whether it got the
+		// clipboard.
+		cmd.Args = append(cmd.Args, "--x11-owner")
+		rr, rw, err := os.Pipe()
+		if err != nil {
+			pr.Close()
+			return err
+		}
+		defer rr.Close()
+		ready = rr
+		cmd.ExtraFiles = []*os.File{rw}
+	}
+	err = cmd.Start()
+	pr.Close()
+	if ready != nil {
+		// Only the process may hold the write end, so that its exit ends
+		// the read below.
+		cmd.ExtraFiles[0].Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to schedule clipboard clearing: %v", err)
+	}
+	if _, err := pw.Write(b); err != nil {
+		return fmt.Errorf("failed to schedule clipboard clearing: %v", err)
+	}
+	if ready != nil {
+		ready.SetReadDeadline(time.Now().Add(10 * time.Second))
+		line, err := bufio.NewReader(ready).ReadString('\n')
+		if line = strings.TrimSpace(line); line != "ok" {
+			if line == "" {
+				line = fmt.Sprintf("clip-restore did not start: %v", err)
+			}
+			cmd.Process.Kill()
+			cmd.Wait()
+			return errors.New(line)
+		}
+	}
+	return cmd.Process.Release()
+}
+
+// runClipRestore is the body of the background process started by
+// spawnClipRestore.
+func runClipRestore(in io.Reader, opts *clipOptions) error {
+	var r clipRestore
+	if err := json.NewDecoder(in).Decode(&r); err != nil {
+		return err
+	}
+	if opts.x11Owner {
+		return runX11ClipOwner(&r, opts)
+	}
+	c, err := opts.clipboard()
+	if err != nil {
+		return err
+	}
+	time.Sleep(opts.timeout)
+	cur, err := c.paste()
+	if err == errPasteUnsupported {
+		// We cannot tell whether the secret is still there, so clear it
+		// regardless.
+		return c.copy(nil)
+	}
+	if err != nil {
+		return err
+	}
+	clearSyncedPrimary(c, r.Digest)
+	digest := sha256.Sum256(cur)
+	if subtle.ConstantTimeCompare(digest[:], r.Digest) != 1 {
+		// Someone copied something else; leave it alone.
+		return nil
+	}
+	return c.copy(r.Previous)
+}
+
+// runX11ClipOwner is runClipRestore for a process that owns the X11
+// clipboard with r's secret, telling its parent on file descriptor 3
+// whether it got it.
+func runX11ClipOwner(r *clipRestore, opts *clipOptions) error {
+	secmem.Lock(r.Secret)
+	defer secmem.Wipe(r.Secret)
+	ready := os.NewFile(3, "ready")
+	o, err := ownX11Clipboard(os.Getenv("DISPLAY"), r.Secret)
+	if err != nil {
+		fmt.Fprintln(ready, err)
+		ready.Close()
+		return err
+	}
+	fmt.Fprintln(ready, "ok")
+	ready.Close()
+	lost, err := o.serve(opts.timeout)
+	// Disconnecting empties the clipboard.
+	o.close()
+	if err != nil || lost {
+		// Someone copied something else; leave it alone.
+		return err
+	}
+	c, err := systemClipboard()
+	if err != nil {
+		// Without xclip or xsel, there was nothing to restore.
+		return nil
+	}
+	clearSyncedPrimary(c, r.Digest)
+	if len(r.Previous) == 0 {
+		return nil
+	}
+	return c.copy(r.Previous)
+}
+
+// clearSyncedPrimary empties the X11 PRIMARY selection if it holds the
+// secret with the given digest. durin never puts secrets there, but
+// clipboard managers that keep the selections in sync copy them over.
+func clearSyncedPrimary(c clipboard, digest []byte) {
+	cc, ok := c.(*cmdClipboard)
+	if !ok || cc.primary == nil {
+		return
+	}
+	cur, err := cc.primary.paste()
+	if err != nil {
+		return
+	}
+	d := sha256.Sum256(cur)
+	if subtle.ConstantTimeCompare(d[:], digest) == 1 {
+		cc.primary.copy(nil)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newACLCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "acl",
+		Short: "Restrict entries of a shared vault to some of its members",
+		Long: `Restrict entries of a shared vault to some of its members.
+
+An ACL applies to an entry, or to every entry in a folder if its path ends
+in a slash; an entry's own ACL wins over its folder's, and an inner folder's
+over an outer one. Entries without an ACL are shared with every member.
+ACLs are enforced by wrapping an entry's data key only to the members they
+allow.`,
+		Args: exactArgs(0),
+	}
+	cmd.AddCommand(newACLShowCmd(), newACLSetCmd(), newACLClearCmd())
+	return cmd
+}
+
+func newACLShowCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:               "show NAME",
+		Short:             "Show who can read an entry",
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openSharedVault(cmd.Context())
+			if err != nil {
+				return err
+			}
+			acl, err := db.ACL(args[0])
+			if err != nil {
+				return err
+			}
+			return writeOutput(cmd.OutOrStdout(), format, acl, func(w io.Writer) error {
+				if acl.Path == "" {
+					fmt.Fprintln(w, "acl: none, shared with every member")
+				} else {
+					fmt.Fprintf(w, "acl: %s (%s)\n", strings.Join(acl.Members, ", "), acl.Path)
+				}
+				fmt.Fprintf(w, "readable by: %s\n", strings.Join(acl.Readers, ", "))
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
+
+// reportACLSkipped warns about the entries SetACL could not re-encrypt.
+func reportACLSkipped(skipped []string) {
+	for _, name := range skipped {
+		fmt.Fprintf(os.Stderr, "Warning: %s is not shared with you, so its ACL takes effect when a member who can read it writes it\n", name)
+	}
+}
+
+func newACLSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set NAME|FOLDER/ MEMBER...",
+		Short: "Restrict an entry or folder to some members",
+		Long: `Restrict an entry, or every entry in a folder if the path ends in a slash,
+to the members named, who must include you. The entries are encrypted again
+with new data keys wrapped only to them.`,
+		Args:              minArgs(2),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openSharedVault(ctx)
+			if err != nil {
+				return err
+			}
+			skipped, err := db.SetACL(ctx, args[0], args[1:])
+			if err != nil {
+				return err
+			}
+			reportACLSkipped(skipped)
+			return nil
+		},
+	}
+}
+
+func newACLClearCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "clear NAME|FOLDER/",
+		Short:             "Remove the ACL of an entry or folder",
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openSharedVault(ctx)
+			if err != nil {
+				return err
+			}
+			skipped, err := db.SetACL(ctx, args[0], nil)
+			if err != nil {
+				return err
+			}
+			reportACLSkipped(skipped)
+			return nil
+		},
+	}
+}
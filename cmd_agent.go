@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+func newAgentCmd() *cobra.Command {
+	var (
+		socket, metricsAddr string
+		idle                time.Duration
+		install             bool
+	)
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Keep the store unlocked for other durin commands",
+		Long: `Keep the store unlocked for other durin commands.
+
+The agent starts locked. The next command that asks for the passphrase hands
+it to the agent, and later commands use the agent's key instead of
+prompting, until it has been idle for --idle, "durin agent lock" is run, it
+gets SIGHUP, or systemd-logind reports a suspend or the session being locked.
+The TUI still asks for the passphrase when it unlocks itself.
+
+The agent listens on agent.sock in the store, or $DURIN_AGENT_SOCK, which
+only its owner can use. Besides serving other durin commands it answers
+JSON requests such as {"op": "list"} and {"op": "get", "name": NAME}.
+
+With --metrics-listen, the agent also serves GET /healthz and GET /metrics
+over plain HTTP on that address, for monitoring: the lock state, the
+seconds until it locks, request counts and the time of the last sync, as
+durin serve does. They tell nothing about the entries, but anyone who can
+reach the address can read them; keep it on localhost.
+
+With --install, instead of running the agent, durin writes a service that
+starts it, with the other flags given, whenever you log in: a launchd agent
+in ~/Library/LaunchAgents on macOS, or a systemd user unit elsewhere. The
+session lock events above come from systemd-logind, so on macOS the agent
+locks on --idle, SIGHUP and durin agent lock only.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if install {
+				return installAgent(cmd)
+			}
+			dir, err := store.DefaultDir()
+			if err != nil {
+				return err
+			}
+			if socket != "" {
+				os.Setenv(agentEnvSock, socket)
+			}
+			socket = agentSocket(dir)
+			if c, err := dialAgent(cmd.Context(), dir); err == nil {
+				c.conn.Close()
+				return fmt.Errorf("an agent is already listening on %s", socket)
+			}
+			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			old := unix.Umask(0077)
+			ln, err := net.Listen("unix", socket)
+			unix.Umask(old)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(socket)
+			if err := os.Chmod(socket, 0600); err != nil {
+				return err
+			}
+			a := newAgent(dir, idle)
+			if metricsAddr != "" {
+				mln, err := net.Listen("tcp", metricsAddr)
+				if err != nil {
+					return err
+				}
+				defer mln.Close()
+				mux := http.NewServeMux()
+				a.metrics.register(mux)
+				srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+				go srv.Serve(mln)
+			}
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sig
+				a.lock()
+				ln.Close()
+			}()
+			events, stop := watchLockEvents(syscall.SIGHUP)
+			defer stop()
+			go func() {
+				for range events {
+					a.lock()
+				}
+			}()
+			fmt.Fprintf(cmd.OutOrStdout(), "%s=%s; export %s\n", agentEnvSock, socket, agentEnvSock)
+			if err := a.serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&socket, "socket", "", "unix socket to listen on (default agent.sock in the store)")
+	cmd.Flags().StringVar(&metricsAddr, "metrics-listen", "", "also serve /healthz and /metrics over HTTP on this address, e.g. 127.0.0.1:7990")
+	cmd.Flags().DurationVar(&idle, "idle", 15*time.Minute, "lock again after this long without requests (0 to never)")
+	cmd.Flags().BoolVar(&install, "install", false, "install a launchd agent or systemd user unit that runs the agent at login, and exit")
+	cmd.AddCommand(&cobra.Command{
+		Use:   "lock",
+		Short: "Make the running agent forget the master key",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := store.DefaultDir()
+			if err != nil {
+				return err
+			}
+			c, err := dialAgent(cmd.Context(), dir)
+			if err != nil {
+				return fmt.Errorf("no agent is running: %v", err)
+			}
+			defer c.conn.Close()
+			_, err = c.call(cmd.Context(), &agentRequest{Op: "lock"})
+			return err
+		},
+	})
+	return cmd
+}
+
+// installAgent writes the service that runs durin agent at login with the
+// flags cmd was given besides --install.
+func installAgent(cmd *cobra.Command) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	var args []string
+	for _, name := range []string{"socket", "idle", "metrics-listen"} {
+		if f := cmd.Flags().Lookup(name); f.Changed {
+			args = append(args, "--"+name+"="+f.Value.String())
+		}
+	}
+	svc, err := newAgentService(exe, args)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(svc.Path), 0700); err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(svc.Path, svc.Contents); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "Wrote %s; to start the agent now and at every login, run:\n  %s\n", svc.Path, svc.Start)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newArchiveCmd() *cobra.Command {
+	var (
+		undo   bool
+		reason string
+	)
+	cmd := &cobra.Command{
+		Use:   "archive",
+		Short: "Make the store read-only",
+		Long: `Make the store read-only, such as a copy of it kept as it was at the end
+of a year, or with --vault a shared vault no longer in use. Its entries
+can still be read, but put, edit, rm and every other command writing them
+fail with status 8 until durin archive --undo makes it writable again.
+The journal is folded into pw.db first, so that pw.db holds every entry.
+
+The mark is synced with the store, so every copy of it is read-only too.
+It guards against mistakes rather than attackers: whoever can write the
+store's files can remove it. It does not need the passphrase.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(cmd.Context(), dir); err != nil {
+				return err
+			}
+			exists, err := store.Exists(dir)
+			if err != nil {
+				return err
+			}
+			shared, err := store.IsShared(dir)
+			if err != nil {
+				return err
+			}
+			if !exists && !shared {
+				return storeError(&store.NoStoreError{Dir: dir})
+			}
+			info, err := store.ReadOnly(dir)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if undo {
+				if info == nil {
+					fmt.Fprintf(out, "The store in %s is not read-only.\n", dir)
+					return nil
+				}
+				if err := store.SetReadOnly(dir, nil); err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "The store in %s is writable again.\n", dir)
+				return nil
+			}
+			if info != nil {
+				fmt.Fprintf(out, "The store in %s is read-only already, since %s.\n", dir, info.Since.Local().Format("2006-01-02"))
+				return nil
+			}
+			if _, _, err := store.Compact(dir); err != nil {
+				return err
+			}
+			if err := store.SetReadOnly(dir, &store.ReadOnlyInfo{Since: time.Now().UTC(), Reason: reason}); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "The store in %s is read-only now; durin archive --undo makes it writable.\n", dir)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&undo, "undo", false, "make the store writable again")
+	cmd.Flags().StringVar(&reason, "reason", "", "why the store is read-only, shown when writing it fails, e.g. \"2025 year-end snapshot\"")
+	return cmd
+}
+
+// noteReadOnly tells on the terminal that the store of db is read-only, if
+// it is, for listings of a store to say so.
+func noteReadOnly(db *store.DB) {
+	if !isTerminal(os.Stderr.Fd()) {
+		return
+	}
+	if info, err := store.ReadOnly(db.Dir()); err == nil && info != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", db.Dir(), readOnlyLabel(info))
+	}
+}
+
+// readOnlyLabel describes the read-only store that info is about, for
+// commands to label it with.
+func readOnlyLabel(info *store.ReadOnlyInfo) string {
+	label := "read-only since " + info.Since.Local().Format("2006-01-02")
+	if info.Reason != "" {
+		label += " (" + info.Reason + ")"
+	}
+	return label
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newAskpassCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "askpass [NAME|PROMPT]",
+		Short: "Print a password for SSH_ASKPASS or SUDO_ASKPASS",
+		Long: `Print a password for SSH_ASKPASS or SUDO_ASKPASS.
+
+If the argument is an entry name, that entry's password is printed.
+Otherwise it is taken to be the prompt ssh or sudo passes to its askpass
+program: a key passphrase prompt reads ssh/KEY, where KEY is the key file's
+base name, and a sudo prompt reads sudo/USER.
+
+The askpass variables take a bare path, so link durin into PATH as
+durin-askpass and point them at that:
+
+  SSH_ASKPASS=durin-askpass SSH_ASKPASS_REQUIRE=force ssh-add
+  SUDO_ASKPASS=durin-askpass sudo -A true
+
+There is usually no terminal to prompt on, so set DURIN_PASSPHRASE_CMD or
+--passphrase-fd in the environment that runs it.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+				return usageError{fmt.Errorf("no entry name or prompt given")}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			if !db.Has(name) {
+				var ok bool
+				if name, ok = askpassName(args[0]); !ok {
+					return fmt.Errorf("no entry for prompt %q", strings.TrimSpace(args[0]))
+				}
+			}
+			if !db.Has(name) {
+				return fmt.Errorf("password %q %w", name, store.ErrNotFound)
+			}
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			fmt.Fprintln(cmd.OutOrStdout(), r.Password)
+			return nil
+		},
+	}
+}
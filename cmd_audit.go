@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newAuditCmd() *cobra.Command {
+	var (
+		format, staleAfter, failOn, corpus string
+		checks                             []string
+		tf                                 tableFlags
+	)
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Check stored passwords for problems",
+		Long: `Check stored passwords for problems.
+
+Without a subcommand, runs every check and reports the findings by severity:
+critical (breached), high (reused or expired), medium (weak or violating
+the entry's policy) and low (not changed for --stale-after). With --fail-on, exits with status 10 if any
+finding is at least that severe.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			opts := auditOptions{checks: make(map[string]bool), now: time.Now()}
+			for _, c := range checks {
+				if !contains(allChecks, c) {
+					return usageError{fmt.Errorf("unknown check %q: want one of %s", c, strings.Join(allChecks, ", "))}
+				}
+				opts.checks[c] = true
+			}
+			var err error
+			if opts.staleAfter, err = parseAge(staleAfter); err != nil {
+				return usageError{err}
+			}
+			var threshold severity
+			if failOn != "" {
+				if threshold, err = parseSeverity(failOn); err != nil {
+					return usageError{err}
+				}
+			}
+			if opts.checks[checkBreach] {
+				switch {
+				case corpus != "":
+					c, err := openBreachCorpus(corpus)
+					if err != nil {
+						return err
+					}
+					defer c.Close()
+					opts.breaches = c
+				case offlineMode:
+					return usageError{errors.New("--offline requires --corpus, or leave out the breach check")}
+				default:
+					opts.breaches = newHIBPClient()
+				}
+			}
+
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			findings, err := runAudit(ctx, db, &opts)
+			if err != nil {
+				return err
+			}
+			err = writeOutput(cmd.OutOrStdout(), format, findings, func(w io.Writer) error {
+				if len(findings) == 0 && !tf.porcelain {
+					fmt.Fprintln(w, "No problems found.")
+					return nil
+				}
+				t := newTable("SEVERITY", "NAME", "CHECK", "DETAIL", "MODIFIED")
+				for _, f := range findings {
+					var modified string
+					if f.Modified != nil {
+						modified = f.Modified.Format("2006-01-02")
+					}
+					t.row(f.Severity.String(), f.Name, f.Check, f.Detail, modified)
+				}
+				return t.write(w, tf)
+			})
+			if err != nil {
+				return err
+			}
+			if threshold > 0 {
+				n := 0
+				for _, f := range findings {
+					if f.Severity >= threshold {
+						n++
+					}
+				}
+				if n > 0 {
+					return findingsError{count: n, threshold: threshold}
+				}
+			}
+			return nil
+		},
+	}
+	addFormatFlag(cmd, &format)
+	addTableFlags(cmd, &tf)
+	cmd.Flags().StringSliceVar(&checks, "checks", allChecks, "checks to run")
+	cmd.Flags().StringVar(&staleAfter, "stale-after", "365d", "report passwords not changed for this long")
+	cmd.Flags().StringVar(&failOn, "fail-on", "", "exit with status 10 if any finding is at least this severe (low, medium, high or critical)")
+	cmd.Flags().StringVar(&corpus, "corpus", "", "path to a downloaded Pwned Passwords SHA-1 file ordered by hash")
+	cmd.AddCommand(
+		newAuditStrengthCmd(),
+		newAuditReuseCmd(),
+		newAuditBreachCmd(),
+		newAuditDuplicatesCmd(),
+	)
+	return cmd
+}
+
+// entryStrength is the strength of a single entry's password.
+type entryStrength struct {
+	Name     string `json:"name" yaml:"name"`
+	strength `yaml:",inline"`
+}
+
+func newAuditStrengthCmd() *cobra.Command {
+	var (
+		format   string
+		weakOnly bool
+		tf       tableFlags
+	)
+	cmd := &cobra.Command{
+		Use:   "strength",
+		Short: "Score the strength of every password",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			scores := []entryStrength{}
+			err = db.ForEach(ctx, func(name string, r *store.Record) error {
+				defer r.Wipe()
+				s := passwordStrength(r.Password, name, r.Username)
+				if !weakOnly || s.weak() {
+					scores = append(scores, entryStrength{Name: name, strength: s})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return writeOutput(cmd.OutOrStdout(), format, scores, func(w io.Writer) error {
+				t := newTable("NAME", "SCORE", "STRENGTH", "CRACK TIME")
+				for _, s := range scores {
+					t.row(s.Name, strconv.Itoa(s.Score), s.Label, s.CrackTime)
+				}
+				return t.write(w, tf)
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	addTableFlags(cmd, &tf)
+	cmd.Flags().BoolVar(&weakOnly, "weak", false, "only report passwords scoring below 3")
+	return cmd
+}
+
+func newAuditReuseCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "reuse",
+		Short: "Find entries sharing the same password",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			groups, err := findReused(ctx, db)
+			if err != nil {
+				return err
+			}
+			return writeOutput(cmd.OutOrStdout(), format, groups, func(w io.Writer) error {
+				for _, g := range groups {
+					fmt.Fprintf(w, "%d entries share a password: %s\n", len(g), strings.Join(g, ", "))
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
+
+// entryBreach is an entry whose password appears in known breaches.
+type entryBreach struct {
+	Name  string `json:"name" yaml:"name"`
+	Count int    `json:"count" yaml:"count"`
+}
+
+func newAuditBreachCmd() *cobra.Command {
+	var format, corpus string
+	cmd := &cobra.Command{
+		Use:   "breach",
+		Short: "Check passwords against HaveIBeenPwned",
+		Long: `Check passwords against HaveIBeenPwned.
+
+Only the first five characters of each password's SHA-1 digest are sent to
+the Pwned Passwords range API. With --corpus, passwords are instead looked
+up in a downloaded copy of the SHA-1 list ordered by hash, and nothing is
+sent over the network.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			var checker breachChecker
+			switch {
+			case corpus != "":
+				c, err := openBreachCorpus(corpus)
+				if err != nil {
+					return err
+				}
+				defer c.Close()
+				checker = c
+			case offlineMode:
+				return usageError{errors.New("--offline requires --corpus")}
+			default:
+				checker = newHIBPClient()
+			}
+
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			breached := []entryBreach{}
+			err = db.ForEach(ctx, func(name string, r *store.Record) error {
+				defer r.Wipe()
+				if r.Password == "" {
+					return nil
+				}
+				n, err := checker.breachCount(ctx, sha1Hex(r.Password))
+				if err != nil {
+					return err
+				}
+				if n > 0 {
+					breached = append(breached, entryBreach{Name: name, Count: n})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return writeOutput(cmd.OutOrStdout(), format, breached, func(w io.Writer) error {
+				for _, b := range breached {
+					fmt.Fprintf(w, "%s: seen %d times in breaches\n", b.Name, b.Count)
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().StringVar(&corpus, "corpus", "", "path to a downloaded Pwned Passwords SHA-1 file ordered by hash")
+	return cmd
+}
+
+func newAuditDuplicatesCmd() *cobra.Command {
+	var (
+		format string
+		merge  bool
+	)
+	cmd := &cobra.Command{
+		Use:   "duplicates",
+		Short: "Find entries that look like copies of one another",
+		Long: `Find entries that look like copies of one another, as imports often
+leave: identical ones, whose usernames, passwords, URLs, notes and fields
+all match, and ones for the same login, sharing a username and the host of
+their URL.
+
+With --merge, asks for each group which entry to keep, folds the others
+into it and removes them. The kept entry gains the others' passwords in its
+history and whatever username, URL, notes, fields, tags and attachments it
+lacked.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if merge {
+				if err := promptAllowed("the entries to keep"); err != nil {
+					return err
+				}
+			}
+			if merge && !isTerminal(os.Stdin.Fd()) {
+				return usageError{errors.New("--merge asks which entries to keep, so it needs a terminal")}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			groups, err := findDuplicates(ctx, db)
+			if err != nil {
+				return err
+			}
+			if merge {
+				return mergeDuplicates(ctx, db, groups)
+			}
+			return writeOutput(cmd.OutOrStdout(), format, groups, func(w io.Writer) error {
+				for _, g := range groups {
+					fmt.Fprintf(w, "%s: %s\n", g.Reason, strings.Join(g.Names, ", "))
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().BoolVar(&merge, "merge", false, "merge each group interactively")
+	return cmd
+}
+
+// mergeDuplicates asks for each group which entry to keep and merges the
+// others into it.
+func mergeDuplicates(ctx context.Context, db *store.DB, groups []duplicateGroup) error {
+	if len(groups) == 0 {
+		fmt.Fprintln(os.Stderr, "No duplicates found.")
+		return nil
+	}
+	for _, g := range groups {
+		fmt.Fprintf(os.Stderr, "\n%s:\n", g.Reason)
+		for i, name := range g.Names {
+			fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, name)
+		}
+		keep := -1
+		for keep < 0 {
+			fmt.Fprintf(os.Stderr, "Keep which? [1-%d, s to skip] ", len(g.Names))
+			line, err := readLine(os.Stdin)
+			if err != nil {
+				return err
+			}
+			answer := strings.TrimSpace(string(line))
+			if answer == "s" || answer == "" {
+				break
+			}
+			if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(g.Names) {
+				keep = n - 1
+			}
+		}
+		if keep < 0 {
+			continue
+		}
+		if err := mergeGroup(ctx, db, g.Names[keep], g.Names); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Merged into %s.\n", g.Names[keep])
+	}
+	return nil
+}
+
+// mergeGroup merges the entries called names into the one called keep and
+// removes them.
+func mergeGroup(ctx context.Context, db *store.DB, keep string, names []string) error {
+	into, err := db.Peek(ctx, keep)
+	if err != nil {
+		return err
+	}
+	defer into.Wipe()
+	// The merged record shares strings and attachment data with the
+	// others, so they are wiped only once it is written.
+	var merged []*store.Record
+	defer func() {
+		for _, r := range merged {
+			r.Wipe()
+		}
+	}()
+	for _, name := range names {
+		if name == keep {
+			continue
+		}
+		r, err := db.Peek(ctx, name)
+		if err != nil {
+			return err
+		}
+		merged = append(merged, r)
+		mergeRecords(into, r)
+	}
+	if err := db.Put(ctx, keep, into); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name != keep {
+			if err := db.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newAutotypeCmd() *cobra.Command {
+	var (
+		sequence string
+		delay    time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "autotype NAME",
+		Short: "Type an entry's credentials into the focused window",
+		Long: `Type an entry's credentials into the focused window, for sites and
+programs that do not allow pasting. The keys typed follow --sequence, the
+entry's autotype field or else ` + defaultAutotype + `.
+
+Placeholders in braces stand for the parts of the entry: {USER}, {PASS},
+{URL}, {TOTP} for the current TOTP code and {S:field} for a custom field.
+{TAB}, {ENTER}, {ESC} and {BACKSPACE} press those keys, {DELAY n} waits n
+milliseconds, and {{} and {}} type braces.
+
+Typing uses wtype on Wayland and xdotool on X11, or ydotool if those are
+missing or there is neither.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			seq := sequence
+			if seq == "" {
+				seq = r.Fields[autotypeField]
+			}
+			if seq == "" {
+				seq = defaultAutotype
+			}
+			steps, err := parseAutotype(seq, r)
+			if err != nil {
+				return err
+			}
+			t, err := systemTypist()
+			if err != nil {
+				return err
+			}
+			time.Sleep(delay)
+			return autotype(t, steps)
+		},
+	}
+	cmd.Flags().StringVar(&sequence, "sequence", "", "keys to type, with placeholders such as {USER} and {TAB}")
+	cmd.Flags().DurationVar(&delay, "delay", 0, "wait this long before typing, to switch to the window to type into")
+	return cmd
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// clipEntry copies the password of r to the clipboard and tells the user
+// when it will be cleared.
+func clipEntry(name string, r *store.Record, opts *clipOptions) error {
+	secret := secmem.NewBuffer([]byte(r.Password))
+	defer secret.Wipe()
+	if err := copyWithTimeout(secret.Bytes(), opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copied %s to clipboard. Will clear in %v.\n", name, opts.timeout)
+	return nil
+}
+
+// clipField copies field of r to the clipboard like clipEntry: a field
+// recordField knows, or otp for the current TOTP code.
+func clipField(name string, r *store.Record, field string, opts *clipOptions) error {
+	var v string
+	if field == "otp" {
+		uri := r.TOTPURI()
+		if uri == "" {
+			return fmt.Errorf("%s has no TOTP secret", name)
+		}
+		code, err := totpCode(uri, time.Now())
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		v = code
+	} else {
+		var err error
+		if v, err = recordField(r, field); err != nil {
+			return err
+		}
+		if v == "" {
+			return fmt.Errorf("%s has no %s", name, field)
+		}
+	}
+	secret := secmem.NewBuffer([]byte(v))
+	defer secret.Wipe()
+	if err := copyWithTimeout(secret.Bytes(), opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Copied the %s of %s to clipboard. Will clear in %v.\n", field, name, opts.timeout)
+	return nil
+}
+
+func newClipCmd() *cobra.Command {
+	var (
+		opts  clipOptions
+		field string
+	)
+	cmd := &cobra.Command{
+		Use:   "clip NAME",
+		Short: "Copy an entry's password, or another field, to the clipboard",
+		Long: `Copy an entry's password, or another field, to the clipboard, and put the
+previous contents back after --timeout unless something else was copied
+meanwhile.
+
+Secrets never go to the X11 PRIMARY selection, and are cleared from it if
+a clipboard manager synced them there. On X11, durin offers the secret on
+the clipboard itself, marked with x-kde-passwordManagerHint so that Klipper
+and other managers honoring it leave it out of their history; xclip or
+xsel, if installed, are only used to save and restore what was there
+before.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			if field != "" && field != "password" {
+				return clipField(args[0], r, field, &opts)
+			}
+			return clipEntry(args[0], r, &opts)
+		},
+	}
+	cmd.Flags().StringVar(&field, "field", "", "copy this field instead (username, notes, url, otp for the current TOTP code, or a custom field)")
+	addClipFlags(cmd, &opts)
+	return cmd
+}
+
+func newClipRestoreCmd() *cobra.Command {
+	var opts clipOptions
+	cmd := &cobra.Command{
+		Use:    "clip-restore",
+		Short:  "Restore the clipboard after a copied secret expires",
+		Hidden: true,
+		Args:   exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runClipRestore(os.Stdin, &opts)
+		},
+	}
+	cmd.Flags().DurationVar(&opts.timeout, "after", defaultClipTimeout, "time to wait before restoring")
+	cmd.Flags().BoolVar(&opts.osc52, "osc52", false, "restore through OSC 52")
+	cmd.Flags().BoolVar(&opts.x11Owner, "x11-owner", false, "own the X11 clipboard with the secret until restoring")
+	return cmd
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newCompactCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "compact",
+		Short: "Fold the change journal into a fresh pw.db",
+		Long: `Compact rewrites pw.db with the changes recorded in pw.journal since it
+was last written, and removes the journal. Records that later changes
+superseded or deleted take no space afterwards.
+
+Put and rm compact the store on their own once the journal grows long,
+and sync does before committing pw.db, so this is rarely needed. It
+does not need the passphrase.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(cmd.Context(), dir); err != nil {
+				return err
+			}
+			before, after, err := store.Compact(dir)
+			if err != nil {
+				return err
+			}
+			if before == after {
+				fmt.Fprintln(cmd.OutOrStdout(), "nothing to compact")
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "compacted %d bytes to %d, reclaiming %d\n", before, after, before-after)
+			return nil
+		},
+	}
+}
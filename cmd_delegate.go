@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// subVaultWords is the length of the passphrases made up for sub-vaults.
+const subVaultWords = 6
+
+func newDelegateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "delegate",
+		Short: "Hand the entries under a prefix to CI as a store of their own",
+		Long: `Hand the entries under a prefix to a CI system, or anyone else who should
+have only those, as a store of their own: a sub-vault with its own master
+keyset and passphrase. Use it with durin --vault DIR, and bring changes
+made there back with durin delegate absorb.
+
+What both stores held when they last exchanged changes is recorded in
+the delegations file of your store, so absorb must run where export did.`,
+		Args: exactArgs(0),
+	}
+	cmd.AddCommand(newDelegateExportCmd(), newDelegateAbsorbCmd(), newDelegateListCmd(), newDelegateForgetCmd())
+	return cmd
+}
+
+// delegationPrefix cleans up the prefix of a delegation, so that team/ci,
+// team/ci/ and team/ci/* all delegate the entries under team/ci/.
+func delegationPrefix(s string) (string, error) {
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "*"), "/")
+	if s == "" {
+		return "", errors.New("give the prefix of the entries to delegate, such as team/ci/")
+	}
+	return s + "/", nil
+}
+
+// openSubVault opens the sub-vault in dir, reading its passphrase from
+// pwFile or asking for it.
+func openSubVault(ctx context.Context, dir, pwFile string) (*store.DB, error) {
+	pw := func() ([]byte, error) {
+		return readSecret(fmt.Sprintf("Enter passphrase for the sub-vault %s: ", dir))
+	}
+	if pwFile != "" {
+		pw = passphraseFromFile(pwFile)
+	}
+	db, err := store.Open(ctx, dir, store.Options{Passphrase: pw, LockWait: lockWait, DerivePassword: derivedPassword})
+	return db, storeError(err)
+}
+
+func newDelegateExportCmd() *cobra.Command {
+	var pwFile string
+	cmd := &cobra.Command{
+		Use:   "export PREFIX DIR",
+		Short: "Create a sub-vault holding the entries under PREFIX",
+		Long: `Create a new store in DIR holding copies of the entries under PREFIX, such
+as team/ci/, with a master keyset of its own. Its passphrase is read from
+--sub-passphrase-file, or made up and printed to standard error once; hand
+it to the CI system as a secret, with DIR.`,
+		Args: exactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			prefix, err := delegationPrefix(args[0])
+			if err != nil {
+				return usageError{err}
+			}
+			dir, err := filepath.Abs(args[1])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if dir == db.Dir() {
+				return usageError{errors.New("the sub-vault needs a directory of its own")}
+			}
+			if len(db.ListPrefix(prefix)) == 0 {
+				return fmt.Errorf("no entries under %s", prefix)
+			}
+			ds, err := readDelegations(db.Dir())
+			if err != nil {
+				return err
+			}
+			if findDelegation(ds, dir) != nil {
+				return fmt.Errorf("%s is already a sub-vault; use durin delegate absorb", dir)
+			}
+			if exists, err := store.Exists(dir); err != nil {
+				return err
+			} else if exists {
+				return fmt.Errorf("a store already exists in %s", dir)
+			}
+
+			var pw []byte
+			if pwFile != "" {
+				if pw, err = passphraseFromFile(pwFile)(); err != nil {
+					return err
+				}
+			} else {
+				words, err := generatePassphrase(subVaultWords, "-")
+				if err != nil {
+					return err
+				}
+				pw = []byte(words)
+				fmt.Fprintf(os.Stderr, "Passphrase of the sub-vault: %s\n", words)
+			}
+			defer secmem.Wipe(pw)
+			if len(pw) == 0 {
+				return errors.New("the passphrase must not be empty")
+			}
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+			if err := store.Create(dir, pw); err != nil {
+				return err
+			}
+			sub, err := store.Open(ctx, dir, store.Options{
+				Passphrase: func() ([]byte, error) { return append([]byte(nil), pw...), nil },
+			})
+			if err != nil {
+				return err
+			}
+			defer sub.Close()
+
+			now := time.Now().UTC()
+			d := &delegation{Dir: dir, Prefix: prefix, Created: now}
+			if _, err := absorbDelegation(ctx, db, sub, d, absorbOptions{}, ioutil.Discard); err != nil {
+				return err
+			}
+			if err := writeDelegations(db.Dir(), append(ds, d)); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Delegated %d entries under %s to %s\n", len(d.Base), prefix, dir)
+			fmt.Fprintf(os.Stderr, "Use it with durin --vault %s, and bring changes back with durin delegate absorb %s.\n", dir, dir)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&pwFile, "sub-passphrase-file", "", "read the passphrase of the sub-vault from this file instead of making one up")
+	return cmd
+}
+
+func newDelegateAbsorbCmd() *cobra.Command {
+	var (
+		pwFile string
+		opts   absorbOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "absorb DIR",
+		Short: "Exchange changes with a sub-vault",
+		Long: `Exchange the changes made since the last export or absorb between your
+store and the sub-vault in DIR. An entry under the prefix that was changed,
+added or removed on one side only is changed likewise on the other, so
+that entries rotated in CI come back and entries rotated here reach CI.
+An entry changed on both sides is a conflict and left alone, unless
+--prefer tells which side to take it from: parent for your store, or sub.
+Entries outside the prefix are never copied.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			switch opts.prefer {
+			case preferNone, preferParent, preferSub:
+			default:
+				return usageError{fmt.Errorf("invalid --prefer %q: want parent or sub", opts.prefer)}
+			}
+			dir, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			ds, err := readDelegations(db.Dir())
+			if err != nil {
+				return err
+			}
+			d := findDelegation(ds, dir)
+			if d == nil {
+				return fmt.Errorf("%s is not a sub-vault of %s", dir, db.Dir())
+			}
+			sub, err := openSubVault(ctx, dir, pwFile)
+			if err != nil {
+				return err
+			}
+			defer sub.Close()
+			conflicts, err := absorbDelegation(ctx, db, sub, d, opts, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+			if !opts.dryRun {
+				if err := writeDelegations(db.Dir(), ds); err != nil {
+					return err
+				}
+			}
+			if conflicts > 0 {
+				return fmt.Errorf("%d entries changed in both stores; choose with --prefer parent or --prefer sub", conflicts)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&pwFile, "sub-passphrase-file", "", "read the passphrase of the sub-vault from this file")
+	cmd.Flags().StringVar(&opts.prefer, "prefer", "", "resolve conflicts with the entry from parent or sub")
+	cmd.RegisterFlagCompletionFunc("prefer", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{preferParent, preferSub}, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "show what would change without changing anything")
+	return cmd
+}
+
+func newDelegateListCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the sub-vaults made from the store",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			ds, err := readDelegations(dir)
+			if err != nil {
+				return err
+			}
+			if ds == nil {
+				ds = []*delegation{}
+			}
+			return writeOutput(cmd.OutOrStdout(), format, ds, func(w io.Writer) error {
+				for _, d := range ds {
+					fmt.Fprintf(w, "%s  %s  %d entries, synced %s\n", d.Dir, d.Prefix, len(d.Base), d.Synced.Local().Format("2006-01-02 15:04"))
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
+
+func newDelegateForgetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "forget DIR",
+		Short: "Stop tracking a sub-vault",
+		Long: `Stop tracking the sub-vault in DIR, so that it can no longer be absorbed.
+The sub-vault itself is left as it is; delete DIR, and rotate what it
+held if it may have leaked.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sub, err := filepath.Abs(args[0])
+			if err != nil {
+				return err
+			}
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(cmd.Context(), dir); err != nil {
+				return err
+			}
+			ds, err := readDelegations(dir)
+			if err != nil {
+				return err
+			}
+			for i, d := range ds {
+				if d.Dir == sub {
+					return writeDelegations(dir, append(ds[:i], ds[i+1:]...))
+				}
+			}
+			return fmt.Errorf("%s is not a sub-vault of %s", sub, dir)
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newDiffCmd() *cobra.Command {
+	var (
+		format string
+		fields bool
+	)
+	cmd := &cobra.Command{
+		Use:   "diff BACKUP",
+		Short: "Show how the store differs from a backup",
+		Long: `Show which entries were added, removed or modified since BACKUP, to see
+what changed before restoring it or after a bad sync.
+
+BACKUP is a copy of a store directory, opened with its own passphrase, or
+a file written by durin export as CSV or JSON, in which case only the
+fields it holds are compared. With --fields, the fields that differ are
+listed too; the values of fields that may hold secrets, such as passwords,
+notes and custom fields, are never shown, only that they changed.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			path := args[0]
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			var (
+				backup flatEntries
+				only   []string
+			)
+			if info.IsDir() {
+				if ok, err := store.Exists(path); err != nil {
+					return err
+				} else if !ok {
+					return fmt.Errorf("%s holds no durin store", path)
+				}
+				db, err := openStoreDir(ctx, path)
+				if err != nil {
+					return err
+				}
+				var records []*store.Record
+				backup, records, err = flattenStore(ctx, db)
+				defer wipeRecords(records)
+				if err != nil {
+					return err
+				}
+			} else if backup, only, err = readExport(path); err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			current, records, err := flattenStore(ctx, db)
+			defer wipeRecords(records)
+			if err != nil {
+				return err
+			}
+			diffs := diffEntries(backup, current, only)
+			if !fields {
+				for i := range diffs {
+					diffs[i].Fields = nil
+				}
+			}
+			return writeOutput(cmd.OutOrStdout(), format, diffs, func(w io.Writer) error {
+				marks := map[string]string{diffAdded: "+", diffRemoved: "-", diffModified: "~"}
+				for _, d := range diffs {
+					fmt.Fprintf(w, "%s %s\n", marks[d.Change], d.Name)
+					for _, f := range d.Fields {
+						fmt.Fprintf(w, "    %s\n", f)
+					}
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().BoolVar(&fields, "fields", false, "also list the fields that differ, with secret values masked")
+	return cmd
+}
+
+func wipeRecords(records []*store.Record) {
+	for _, r := range records {
+		r.Wipe()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newDockerCredentialCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "docker-credential store|get|erase|list",
+		Short: "Act as a docker credential helper",
+		Long: `Act as a docker credential helper.
+
+Link durin into PATH as docker-credential-durin and set "credsStore": "durin"
+in ~/.docker/config.json. Credentials for a registry are kept in
+docker/HOST/PATH, e.g. docker/index.docker.io/v1.`,
+		Args:      exactArgs(1),
+		ValidArgs: []string{"store", "get", "erase", "list"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err == nil {
+				out := cmd.OutOrStdout()
+				switch args[0] {
+				case "store":
+					err = dockerStore(ctx, db, os.Stdin)
+				case "get":
+					err = dockerGet(ctx, db, os.Stdin, out)
+				case "erase":
+					err = dockerErase(ctx, db, os.Stdin)
+				case "list":
+					err = dockerList(ctx, db, out)
+				default:
+					err = fmt.Errorf("unknown credential action %q", args[0])
+				}
+			}
+			if err != nil {
+				// Docker reads helper errors from stdout.
+				fmt.Fprintln(cmd.OutOrStdout(), err)
+				return exitStatusError(exitError)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// editableRecord holds the parts of a record edit lets the user change.
+type editableRecord struct {
+	Password string            `yaml:"password"`
+	Username string            `yaml:"username"`
+	URL      string            `yaml:"url"`
+	Notes    string            `yaml:"notes"`
+	Tags     []string          `yaml:"tags"`
+	Fields   map[string]string `yaml:"fields"`
+}
+
+func newEditCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "edit NAME",
+		Short: "Edit an entry in $EDITOR",
+		Long: `Edit the password, username, URL, notes, tags and fields of an entry as
+YAML in $VISUAL or $EDITOR.
+
+The plaintext is written to a private directory in RAM ($XDG_RUNTIME_DIR
+or /dev/shm) where there is one. vim and emacs are told not to keep swap,
+backup or undo files, and whatever is left in the directory afterwards is
+overwritten and removed.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			var buf bytes.Buffer
+			enc := yaml.NewEncoder(&buf)
+			enc.SetIndent(2)
+			if err := enc.Encode(editableRecord{
+				Password: r.Password,
+				Username: r.Username,
+				URL:      r.URL,
+				Notes:    r.Notes,
+				Tags:     r.Tags,
+				Fields:   r.Fields,
+			}); err != nil {
+				return err
+			}
+			before := buf.Bytes()
+			defer secmem.Wipe(before)
+			after, err := editPlaintext(name, before)
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(after)
+			if bytes.Equal(before, after) {
+				fmt.Fprintf(os.Stderr, "%s unchanged.\n", name)
+				return nil
+			}
+			var e editableRecord
+			if err := yaml.Unmarshal(after, &e); err != nil {
+				return fmt.Errorf("invalid entry, not saved: %v", err)
+			}
+			if e.Password != r.Password {
+				r.SetPassword(e.Password, time.Now())
+			}
+			r.Username, r.URL, r.Notes, r.Tags, r.Fields = e.Username, e.URL, e.Notes, e.Tags, e.Fields
+			return db.Put(ctx, name, r)
+		},
+	}
+}
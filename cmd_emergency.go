@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"os/user"
+	"syscall"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newEmergencyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "emergency",
+		Short: "Give a trusted contact access to entries should you be unable to",
+		Long: `Give a trusted contact, such as family, an emergency bundle of entries
+they can open should you no longer be able to.
+
+The bundle is encrypted so that it takes both the contact's identity, the
+key pair in their own durin store that durin share key prints, and either
+a release code from you or solving a time lock: days of computing, by
+default 7d, that cannot be sped up by using more computers. Nobody else
+can open it, so it may be kept anywhere, and while you are able you can
+hand out the release code to skip the wait.
+
+Run durin emergency refresh when the entries change and give the contact
+the new file. An old bundle keeps opening to the entries it was made with.`,
+		Args: exactArgs(0),
+	}
+	cmd.AddCommand(newEmergencyCreateCmd(), newEmergencyRefreshCmd(), newEmergencyReleaseCmd(), newEmergencyOpenCmd())
+	return cmd
+}
+
+// emergencyIdentity returns the identity in the user's own store,
+// creating it if there is none, for the bundles they make.
+func emergencyIdentity(ctx context.Context) (*store.Identity, error) {
+	db, err := openOwnStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.Identity(true)
+}
+
+// writeEmergencyBundle seals the entries under b's prefixes into b and
+// writes it to file.
+func writeEmergencyBundle(ctx context.Context, file string, b *emergencyBundle) error {
+	delay, err := parseAge(b.Delay)
+	if err != nil {
+		return usageError{err}
+	}
+	owner, err := emergencyIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	names := exportNames(db, b.Prefixes)
+	if len(names) == 0 {
+		return errors.New("no entries to put in the bundle")
+	}
+	fmt.Fprintf(os.Stderr, "Making a time lock of %s...\n", b.Delay)
+	if err := sealEmergency(ctx, b, db, names, owner, delay); err != nil {
+		return err
+	}
+	if err := writeEmergency(file, b); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d entries to %s for %s (%s).\n", b.Entries, file, b.Contact.Name, b.Contact.ID())
+	return nil
+}
+
+func newEmergencyCreateCmd() *cobra.Command {
+	var (
+		out   string
+		delay string
+		name  string
+	)
+	cmd := &cobra.Command{
+		Use:   "create CONTACT KEY [PREFIX...]",
+		Short: "Write an emergency bundle for a contact",
+		Long: `Write the entries under the given name prefixes, or all of them, to an
+emergency bundle in --out for CONTACT, whose public key KEY they print with
+durin share key.
+
+--delay is how long opening the bundle without a release code takes, on a
+computer as fast as this one; a faster one takes less.`,
+		Args: minArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if out == "" {
+				return usageError{fmt.Errorf("no output file given; use --out")}
+			}
+			if _, err := parseAge(delay); err != nil {
+				return usageError{err}
+			}
+			contact, err := store.ParseRecipient(args[0], args[1])
+			if err != nil {
+				return usageError{err}
+			}
+			if name == "" {
+				u, err := user.Current()
+				if err != nil {
+					return usageError{fmt.Errorf("cannot tell your user name (%v); give one with --name", err)}
+				}
+				name = u.Username
+			}
+			if _, err := os.Lstat(out); err == nil {
+				return fmt.Errorf("%s already exists; use durin emergency refresh to update it", out)
+			}
+			b := &emergencyBundle{Owner: name, Contact: contact, Prefixes: args[2:], Delay: delay}
+			return writeEmergencyBundle(cmd.Context(), out, b)
+		},
+	}
+	cmd.Flags().StringVar(&out, "out", "", "file to write the bundle to")
+	cmd.Flags().StringVar(&delay, "delay", "7d", "how long opening the bundle without a release code takes")
+	cmd.Flags().StringVar(&name, "name", "", "your name in the bundle (default your user name)")
+	return cmd
+}
+
+func newEmergencyRefreshCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "refresh FILE",
+		Short: "Rewrite an emergency bundle with the current entries",
+		Long: `Rewrite the emergency bundle in FILE with the current entries under its
+prefixes, for the same contact and with the same delay, under new keys.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			old, err := readEmergency(args[0])
+			if err != nil {
+				return err
+			}
+			b := &emergencyBundle{Owner: old.Owner, Contact: old.Contact, Prefixes: old.Prefixes, Delay: old.Delay}
+			return writeEmergencyBundle(cmd.Context(), args[0], b)
+		},
+	}
+}
+
+func newEmergencyReleaseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "release FILE",
+		Short: "Print the code that opens an emergency bundle without waiting",
+		Long: `Print the release code of the emergency bundle in FILE, which lets its
+contact open it at once with durin emergency open --release. Only the
+identity that made the bundle can tell it.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			b, err := readEmergency(args[0])
+			if err != nil {
+				return err
+			}
+			id, err := ownIdentity(cmd.Context())
+			if err != nil {
+				return err
+			}
+			code, err := releaseCode(b, id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), code)
+			return nil
+		},
+	}
+}
+
+func newEmergencyOpenCmd() *cobra.Command {
+	var (
+		opts    importOptions
+		release string
+	)
+	cmd := &cobra.Command{
+		Use:   "open FILE",
+		Short: "Import the entries of an emergency bundle made for you",
+		Long: `Import the entries of the emergency bundle in FILE, made for your
+identity, into your store under --prefix.
+
+Without --release it solves the bundle's time lock first, which takes about
+as long as the bundle's delay. It saves how far it got to FILE.progress
+every so often and when interrupted, and picks up from there when run
+again.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			b, err := readEmergency(args[0])
+			if err != nil {
+				return err
+			}
+			id, err := ownIdentity(ctx)
+			if err != nil {
+				return err
+			}
+			if id.ID() != b.Contact.ID() {
+				return fmt.Errorf("%s is for %s, not for your identity", args[0], b.Contact.Name)
+			}
+			var share []byte
+			if release != "" {
+				if share, err = parseReleaseCode(release); err != nil {
+					return usageError{err}
+				}
+			} else if share, err = solveEmergency(ctx, args[0], b); err != nil {
+				return err
+			}
+			backup, err := openEmergency(b, id, share)
+			secmem.Wipe(share)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Opened the bundle %s made on %s.\n", b.Owner, b.Created.Local().Format("2006-01-02"))
+			return importEntries(ctx, db, backupEntries(backup), opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&release, "release", "", "open the bundle with this release code from its owner instead of solving its time lock")
+	cmd.Flags().StringVar(&opts.prefix, "prefix", "emergency/", "prepend this to the names of the entries")
+	cmd.Flags().BoolVarP(&opts.force, "force", "f", false, "overwrite existing entries")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "show what would be imported without storing anything")
+	return cmd
+}
+
+// solveEmergency solves the time lock of the bundle in file, resuming from
+// and saving to file.progress, and returns the share it hides.
+func solveEmergency(ctx context.Context, file string, b *emergencyBundle) ([]byte, error) {
+	progressFile := file + ".progress"
+	var progress *timeLockProgress
+	if data, err := ioutil.ReadFile(progressFile); err == nil {
+		var p timeLockProgress
+		if err := json.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("%s: %v", progressFile, err)
+		}
+		progress = &p
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	total := b.TimeLock.Squarings
+	start, first := time.Now(), uint64(0)
+	if progress != nil && progress.Puzzle == b.TimeLock.id() {
+		first = progress.Done
+	}
+	fmt.Fprintf(os.Stderr, "Solving the time lock of %s; this takes about %s. Interrupt it at any time to resume later.\n", file, b.Delay)
+	share, err := b.TimeLock.solve(ctx, progress, func(p timeLockProgress) error {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(progressFile, data); err != nil {
+			return err
+		}
+		left := "unknown"
+		if rate := float64(p.Done-first) / time.Since(start).Seconds(); rate > 0 {
+			left = (time.Duration(float64(total-p.Done)/rate) * time.Second).Round(time.Second).String()
+		}
+		fmt.Fprintf(os.Stderr, "%.1f%% done, about %s left\n", 100*float64(p.Done)/float64(total), left)
+		return nil
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil, fmt.Errorf("interrupted; run durin emergency open again to resume")
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(progressFile)
+	return share, nil
+}
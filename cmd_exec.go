@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+func newExecCmd() *cobra.Command {
+	var bare bool
+	cmd := &cobra.Command{
+		Use:   "exec NAME -- COMMAND [ARG...]",
+		Short: "Run a command with secrets in its environment",
+		Long: `Run a command with secrets in its environment.
+
+The entry NAME, or every entry under it if NAME ends in "/", is exported as
+BASE_USERNAME and BASE_PASSWORD, where BASE is the rest of the entry name
+upper-cased with other characters replaced by "_". For example, with
+"durin exec aws/ -- cmd" the entry aws/prod becomes PROD_USERNAME and
+PROD_PASSWORD. With --bare only BASE is set, to the password.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
+				return usageError{errors.New("expected NAME -- COMMAND [ARG...]")}
+			}
+			return nil
+		},
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			path, err := exec.LookPath(args[1])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			env, err := secretEnv(ctx, db, args[0], bare)
+			if err != nil {
+				return err
+			}
+			// The store lock is close-on-exec, so the command does not
+			// inherit it.
+			err = syscall.Exec(path, args[1:], append(os.Environ(), env...))
+			return fmt.Errorf("exec %s: %v", path, err)
+		},
+	}
+	cmd.Flags().BoolVar(&bare, "bare", false, "export each entry's password as BASE instead of BASE_USERNAME and BASE_PASSWORD")
+	return cmd
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newExportCmd() *cobra.Command {
+	var (
+		format   string
+		fields   string
+		secrets  bool
+		paper    bool
+		snap     bool
+		redacted bool
+	)
+	cmd := &cobra.Command{
+		Use:   "export [PREFIX...]",
+		Short: "Export entries as CSV or JSON, or for another password manager",
+		Long: `Write the entries under the given name prefixes, or all of them, to
+standard output as CSV with a header row, or with --format json as a JSON
+array, for inventories and entry lists to share.
+
+--fields chooses what to write, by default name, username and url. Besides
+those, kind, tags, changed, expires, created and modified can be written
+safely. password,
+notes and custom fields may hold secrets and are refused unless
+--include-secrets is given.
+
+--paper writes every secret instead, encrypted with a passphrase it asks
+for, as QR codes on an HTML page to print and keep as a backup that needs
+no working disk to survive. durin import --paper restores it from the text
+of the scanned codes.
+
+--snapshot --redact-secrets writes a signed inventory for a security review
+instead: for every entry its name, kind, tags, url, owners, when the
+password was last rotated and when it expires, whether it has a password,
+TOTP secret and policy, and whether it passes the weak, reuse, expired,
+stale and policy checks of durin audit. Owners are the members who can
+read an entry of a shared vault, or the "owner" field of an entry. No
+password, note or field value is written. The inventory is signed with the
+audit log key of your store, so that durin export verify-snapshot can tell
+it was not edited after.
+
+The subcommands write entries in the formats of other password managers.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if snap || redacted {
+				if !redacted {
+					return usageError{errors.New("snapshots never hold secrets; give --snapshot --redact-secrets")}
+				}
+				if !snap {
+					return usageError{errors.New("--redact-secrets only applies to --snapshot")}
+				}
+				for _, f := range []string{"format", "fields", "include-secrets", "paper"} {
+					if cmd.Flags().Changed(f) {
+						return usageError{fmt.Errorf("--%s cannot be used with --snapshot", f)}
+					}
+				}
+				db, err := openStore(ctx)
+				if err != nil {
+					return err
+				}
+				id, err := writeSnapshot(ctx, db, cmd.OutOrStdout(), exportNames(db, args))
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Signed with audit log key %s.\n", id)
+				return nil
+			}
+			if paper {
+				for _, f := range []string{"format", "fields", "include-secrets"} {
+					if cmd.Flags().Changed(f) {
+						return usageError{fmt.Errorf("--%s cannot be used with --paper", f)}
+					}
+				}
+				return exportPaper(ctx, cmd.OutOrStdout(), args)
+			}
+			fieldList, err := parseExportFields(fields, secrets)
+			if err != nil {
+				return usageError{err}
+			}
+			if format != exportCSV && format != exportJSON {
+				return usageError{fmt.Errorf("unknown export format %q; use csv or json", format)}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return writeExport(ctx, db, cmd.OutOrStdout(), format, fieldList, exportNames(db, args))
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", exportCSV, "output format: csv or json")
+	cmd.RegisterFlagCompletionFunc("format", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{exportCSV, exportJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.Flags().StringVar(&fields, "fields", defaultExportFields, "comma separated fields to export")
+	cmd.Flags().BoolVar(&secrets, "include-secrets", false, "allow exporting passwords, notes and custom fields")
+	cmd.Flags().BoolVar(&paper, "paper", false, "write an encrypted backup as QR codes to print")
+	cmd.Flags().BoolVar(&snap, "snapshot", false, "write a signed inventory for a security review, with --redact-secrets")
+	cmd.Flags().BoolVar(&redacted, "redact-secrets", false, "leave every secret out of the snapshot")
+	cmd.AddCommand(newExportPassCmd(), newExportKeepassCmd(), newExportVaultCmd(), newVerifySnapshotCmd())
+	return cmd
+}
+
+// exportNames returns the sorted names of the entries under prefixes, or
+// of all entries if there are none.
+func exportNames(db *store.DB, prefixes []string) []string {
+	if len(prefixes) == 0 {
+		return db.List()
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, p := range prefixes {
+		for _, name := range db.ListPrefix(p) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportPaper writes the entries under prefixes as a paper backup to w.
+func exportPaper(ctx context.Context, w io.Writer, prefixes []string) error {
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	return writePaperBackup(ctx, db, w, prefixes)
+}
+
+// writePaperBackup writes the entries of db under prefixes as a paper
+// backup to w.
+func writePaperBackup(ctx context.Context, db *store.DB, w io.Writer, prefixes []string) error {
+	names := exportNames(db, prefixes)
+	if len(names) == 0 {
+		return errors.New("no entries to back up")
+	}
+	pw, err := readSecret("Enter passphrase for the paper backup: ")
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	again, err := readSecret("Confirm passphrase: ")
+	if err != nil {
+		return err
+	}
+	match := bytes.Equal(pw, again)
+	secmem.Wipe(again)
+	if !match {
+		return errors.New("passphrases do not match")
+	}
+	if len(pw) == 0 {
+		return errors.New("the paper backup needs a passphrase")
+	}
+	blob, err := sealPaper(ctx, db, names, pw)
+	if err != nil {
+		return err
+	}
+	if err := writePaper(w, blob, len(names)); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d entries as paper backup %s.\n", len(names), paperSet(blob))
+	return nil
+}
+
+func newExportVaultCmd() *cobra.Command {
+	var f vaultFlags
+	cmd := &cobra.Command{
+		Use:   "vault --path MOUNT/PATH/ [PREFIX...]",
+		Short: "Write entries to a HashiCorp Vault KV v2 mount",
+		Long: `Write the entries under the given name prefixes, or all of them, to a
+HashiCorp Vault KV version 2 mount, each as the secret at --path followed
+by its name, as a new version of any secret already there. The password,
+username, url, notes and fields are written as keys of those names, as
+durin import vault reads them back; password history and attachments are
+not exported. Vault is reached and logged in to as with import vault.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			names := exportNames(db, args)
+			n, err := writeVault(ctx, db, &f, names)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "exported %d entries to %s\n", n, f.path)
+			return nil
+		},
+	}
+	addVaultFlags(cmd, &f)
+	return cmd
+}
+
+func newVerifySnapshotCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify-snapshot FILE",
+		Short: "Check the signature of an inventory written by export --snapshot",
+		Long: `Check that the inventory in FILE, written by durin export --snapshot, is
+signed by the key it names, and print that key's ID. A valid signature
+only shows the inventory was not changed since; compare the ID with the
+one export --snapshot printed for its author to know who signed it.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, inv, err := verifySnapshot(args[0])
+			if err != nil {
+				return err
+			}
+			w := cmd.OutOrStdout()
+			fmt.Fprintf(w, "Good signature by audit log key %s.\n", s.Signature.KeyID)
+			if inv.StoreID != "" {
+				fmt.Fprintf(w, "Store:     %s\n", inv.StoreID)
+			}
+			fmt.Fprintf(w, "Created:   %s\n", inv.Created.Local().Format(time.RFC3339))
+			fmt.Fprintf(w, "Entries:   %d, %d compliant\n", len(inv.Entries), inv.Compliant)
+			return nil
+		},
+	}
+}
+
+func newExportPassCmd() *cobra.Command {
+	var (
+		gpgIDs []string
+		out    string
+	)
+	cmd := &cobra.Command{
+		Use:   "pass [PREFIX...]",
+		Short: "Write entries as a pass (password-store) tree",
+		Long: `Write the entries under the given name prefixes, or all of them, as a
+password store in --out that pass and the tools speaking its format can
+read. Entries are encrypted with gpg for every --gpg-id, which is also
+written to .gpg-id. --out must be empty or not exist yet.
+
+Each file holds the password on its first line, then "login: USERNAME", the
+fields as "key: value" lines and the notes; durin import pass reads them
+back. Password history is not exported.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if out == "" {
+				return usageError{fmt.Errorf("no output directory given; use --out")}
+			}
+			if len(gpgIDs) == 0 {
+				return usageError{fmt.Errorf("no gpg key given; use --gpg-id")}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			n, err := writePassStore(ctx, db, out, gpgIDs, exportNames(db, args))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "exported %d entries to %s\n", n, out)
+			return nil
+		},
+	}
+	cmd.Flags().StringArrayVar(&gpgIDs, "gpg-id", nil, "encrypt for this gpg key; may be repeated")
+	cmd.Flags().StringVar(&out, "out", "", "directory to write the password store to")
+	return cmd
+}
+
+func newExportKeepassCmd() *cobra.Command {
+	var out string
+	cmd := &cobra.Command{
+		Use:   "keepass [PREFIX...]",
+		Short: "Write entries to a KeePass database",
+		Long: `Write the entries under the given name prefixes, or all of them, to a new
+KDBX 4 file in --out that KeePass and KeePassXC open. It asks for the
+password to protect the file with, twice; --out must not exist yet.
+
+Name prefixes become groups, the url field the URL and the otpauth field
+the TOTP settings; other fields are kept as protected strings, password
+history as older versions of the entry, and attachments as attachments.
+durin import keepass reads the file back.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if out == "" {
+				return usageError{fmt.Errorf("no output file given; use --out")}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			pw, err := readSecret(fmt.Sprintf("Enter new password for %s: ", out))
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(pw)
+			again, err := readSecret("Confirm password: ")
+			if err != nil {
+				return err
+			}
+			match := bytes.Equal(pw, again)
+			secmem.Wipe(again)
+			if !match {
+				return errors.New("passwords do not match")
+			}
+			n, err := writeKeepass(ctx, db, out, pw, exportNames(db, args))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "exported %d entries to %s\n", n, out)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&out, "out", "", "file to write the KeePass database to")
+	return cmd
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// policyFlags are the flags registered by addPolicyFlags.
+var policyFlags = []string{"length", "symbols", "no-lower", "no-upper", "no-digits", "no-ambiguous", "exclude", "words", "separator", "pronounceable"}
+
+// policyFlagsChanged reports whether any policy flag was given on the
+// command line.
+func policyFlagsChanged(cmd *cobra.Command) bool {
+	for _, f := range policyFlags {
+		if cmd.Flags().Changed(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// effectivePolicy returns the policy to generate a password for a record
+// with: the record's own policy, unless policy flags were given.
+func effectivePolicy(cmd *cobra.Command, flags *store.PasswordPolicy, r *store.Record) *store.PasswordPolicy {
+	if r != nil && r.Policy != nil && !policyFlagsChanged(cmd) {
+		return r.Policy
+	}
+	return flags
+}
+
+// addPolicyFlags registers the flags filling p on cmd.
+func addPolicyFlags(cmd *cobra.Command, p *store.PasswordPolicy) {
+	*p = defaultPolicy
+	cmd.Flags().IntVarP(&p.Length, "length", "l", p.Length, "length of the generated password")
+	cmd.Flags().BoolVar(&p.Symbols, "symbols", false, "include symbols")
+	cmd.Flags().BoolVar(&p.NoLower, "no-lower", false, "leave out lowercase letters")
+	cmd.Flags().BoolVar(&p.NoUpper, "no-upper", false, "leave out uppercase letters")
+	cmd.Flags().BoolVar(&p.NoDigits, "no-digits", false, "leave out digits")
+	cmd.Flags().BoolVar(&p.NoAmbiguous, "no-ambiguous", false, "leave out easily confused characters ("+ambiguousChars+")")
+	cmd.Flags().StringVar(&p.Exclude, "exclude", "", "characters that must not appear")
+	cmd.Flags().IntVar(&p.Words, "words", 0, "generate a diceware passphrase of this many words from the EFF wordlist")
+	cmd.Flags().StringVar(&p.Separator, "separator", p.Separator, "with --words, string placed between words")
+	cmd.Flags().BoolVar(&p.Pronounceable, "pronounceable", false, "generate alternating consonants and vowels that are easy to read aloud")
+}
+
+func newGenerateCmd() *cobra.Command {
+	var (
+		r       store.Record
+		policy  store.PasswordPolicy
+		force   bool
+		expires string
+		derived bool
+		site    string
+	)
+	cmd := &cobra.Command{
+		Use:   "generate NAME",
+		Short: "Generate a random password and store it",
+		Long: `Generate a random password under the policy flags and store it as NAME.
+
+With --derived, the entry is a derived one instead, whose password is not
+stored but computed whenever it is read, from --site (by default NAME), a
+counter and the policy with a key kept in the store, like LessPass does
+from a master password. durin rotate bumps its counter to change it.
+Derived passwords are the same in every copy of the store, but cannot be
+set by hand; entries copied to other stores store theirs.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			if db.Has(name) {
+				if !force {
+					return fmt.Errorf("entry %q already exists; use --force to overwrite", name)
+				}
+				old, err := db.Get(ctx, name)
+				if err != nil {
+					return err
+				}
+				r.Policy = old.Policy
+			}
+			p := effectivePolicy(cmd, &policy, &r)
+			if derived {
+				if site == "" {
+					site = name
+				}
+				return putDerived(cmd, db, name, &r, p, site, expires)
+			}
+			pw, err := generatePassword(p)
+			if err != nil {
+				return usageError{err}
+			}
+			now := time.Now()
+			r.SetPassword(pw, now)
+			if err := setExpiry(&r, expires, now); err != nil {
+				return err
+			}
+			if err := db.Put(ctx, name, &r); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Entropy: %.1f bits\n", policyEntropy(p))
+			fmt.Fprintln(cmd.OutOrStdout(), pw)
+			return nil
+		},
+	}
+	addPolicyFlags(cmd, &policy)
+	cmd.Flags().StringVarP(&r.Username, "username", "u", "", "username to store with the entry")
+	cmd.Flags().StringVarP(&r.Notes, "notes", "n", "", "free-form notes to store with the entry")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "overwrite an existing entry")
+	addExpiresFlag(cmd, &expires)
+	cmd.Flags().BoolVar(&derived, "derived", false, "compute the password whenever it is read instead of storing it")
+	cmd.Flags().StringVar(&site, "site", "", "with --derived, what the password is for (default NAME)")
+	return cmd
+}
+
+// putDerived stores r as the derived entry name for site under p, and
+// prints its password.
+func putDerived(cmd *cobra.Command, db *store.DB, name string, r *store.Record, p *store.PasswordPolicy, site, expires string) error {
+	if _, err := policyPassword(p, randomIndex); err != nil {
+		return usageError{err}
+	}
+	// The policy is kept with the entry, so that changes to the defaults
+	// do not change its password.
+	policy := *p
+	r.Kind = store.KindDerived
+	r.Policy = &policy
+	r.Derived = &store.Derivation{Site: site, Counter: 1}
+	now := time.Now()
+	r.Changed = &now
+	if err := setExpiry(r, expires, now); err != nil {
+		return err
+	}
+	if err := db.Put(cmd.Context(), name, r); err != nil {
+		return err
+	}
+	if err := db.Derive(r); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Entropy: %.1f bits\n", policyEntropy(p))
+	fmt.Fprintln(cmd.OutOrStdout(), r.Password)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// namedRecord is a record together with its name, as printed by get.
+type namedRecord struct {
+	Name          string `json:"name" yaml:"name"`
+	*store.Record `yaml:",inline"`
+}
+
+// maskedRecord returns a copy of r with its password and those in its
+// history replaced by maskedSecret, and without a passkey's private key.
+func maskedRecord(r *store.Record) *store.Record {
+	m := *r
+	if m.Password != "" {
+		m.Password = maskedSecret
+	}
+	if r.Passkey != nil {
+		p := *r.Passkey
+		p.PrivateKey = nil
+		m.Passkey = &p
+	}
+	m.History = make([]store.HistoryEntry, len(r.History))
+	for i, h := range r.History {
+		h.Password = maskedSecret
+		m.History[i] = h
+	}
+	return &m
+}
+
+func newGetCmd() *cobra.Command {
+	var (
+		format, field, attachment string
+		clip, showQR, show, regex bool
+		clipOpts                  clipOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "get NAME",
+		Short: "Decrypt and print an entry",
+		Long: `Decrypt and print an entry. Its password is masked unless --show is given,
+so that it does not end up on screen or in the terminal's scrollback by
+accident; --field password, --clip and --qr give it as before.
+
+NAME can also be a glob such as 'aws/*', or with --regex a regular
+expression, matching exactly one entry.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name, err := resolveName(args[0], regex, db.List())
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			if clip {
+				return clipEntry(name, r, &clipOpts)
+			}
+			out := cmd.OutOrStdout()
+			if showQR {
+				if field == "" {
+					field = "password"
+				}
+				v, err := recordField(r, field)
+				if err != nil {
+					return err
+				}
+				return writeQR(out, v)
+			}
+			if attachment != "" {
+				for _, a := range r.Attachments {
+					if a.Name == attachment {
+						_, err := out.Write(a.Data)
+						return err
+					}
+				}
+				return fmt.Errorf("%s has no attachment %q", name, attachment)
+			}
+			if field != "" {
+				v, err := recordField(r, field)
+				if err != nil {
+					return err
+				}
+				_, err = io.WriteString(out, v)
+				return err
+			}
+			shown := r
+			if !show {
+				shown = maskedRecord(r)
+			}
+			return writeOutput(out, format, namedRecord{Name: name, Record: shown}, func(w io.Writer) error {
+				fmt.Fprintln(w, shown.Password)
+				if r.Username != "" {
+					fmt.Fprintf(w, "username: %s\n", r.Username)
+				}
+				if r.URL != "" {
+					fmt.Fprintf(w, "url: %s\n", r.URL)
+				}
+				if r.Notes != "" {
+					fmt.Fprintf(w, "notes: %s\n", r.Notes)
+				}
+				if len(r.Tags) > 0 {
+					fmt.Fprintf(w, "tags: %s\n", strings.Join(r.Tags, ", "))
+				}
+				for _, k := range sortedKeys(r.Fields) {
+					fmt.Fprintf(w, "%s: %s\n", k, r.Fields[k])
+				}
+				if r.Expires != nil {
+					fmt.Fprintf(w, "expires: %s\n", r.Expires.Format("2006-01-02"))
+				}
+				if r.Created != nil {
+					fmt.Fprintf(w, "created: %s\n", r.Created.Local().Format("2006-01-02 15:04"))
+				}
+				if r.Modified != nil {
+					fmt.Fprintf(w, "modified: %s\n", r.Modified.Local().Format("2006-01-02 15:04"))
+				}
+				for _, a := range r.Attachments {
+					fmt.Fprintf(w, "attachment: %s (%d bytes)\n", a.Name, len(a.Data))
+				}
+				if d := r.Derived; d != nil {
+					fmt.Fprintf(w, "derived: for %s, counter %d\n", d.Site, d.Counter)
+				}
+				if p := r.Passkey; p != nil {
+					fmt.Fprintf(w, "passkey: %s at %s (%d signatures)\n", p.UserName, p.RPID, p.SignCount)
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().StringVar(&field, "field", "", "print only this field (username, password, notes, url or a custom field) with no trailing newline")
+	addRegexFlag(cmd, &regex)
+	cmd.Flags().BoolVarP(&show, "show", "p", false, "print the password instead of masking it")
+	cmd.Flags().BoolVarP(&clip, "clip", "c", false, "copy the password to the clipboard instead of printing it")
+	addClipFlags(cmd, &clipOpts)
+	cmd.Flags().StringVar(&attachment, "attachment", "", "write the contents of this attachment instead")
+	cmd.Flags().BoolVar(&showQR, "qr", false, "render the password (or --field) as a QR code")
+	return cmd
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newGitCredentialCmd() *cobra.Command {
+	var (
+		mapper  gitCredentialMapper
+		mapping []string
+	)
+	cmd := &cobra.Command{
+		Use:   "git-credential get|store|erase",
+		Short: "Act as a git credential helper",
+		Long: `Act as a git credential helper.
+
+Configure it with:
+
+  git config --global credential.helper '!durin git-credential'
+
+Credentials for a host are kept in the entry PREFIX/HOST (default git/HOST),
+or PREFIX/HOST/USERNAME when git asks for a specific user. --map HOST=NAME
+uses a different entry for a host; with credential.useHttpPath, HOST may
+include the repository path.`,
+		Args:      exactArgs(1),
+		ValidArgs: []string{"get", "store", "erase"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mapper.hosts = make(map[string]string)
+			for _, m := range mapping {
+				host, name, ok := strings.Cut(m, "=")
+				if !ok {
+					return usageError{fmt.Errorf("invalid --map %q: want HOST=NAME", m)}
+				}
+				mapper.hosts[host] = name
+			}
+			req, err := readGitCredential(os.Stdin)
+			if err != nil {
+				return err
+			}
+			switch args[0] {
+			case "get":
+				return gitCredentialGet(cmd, &mapper, req)
+			case "store":
+				return gitCredentialStore(cmd.Context(), &mapper, req)
+			case "erase":
+				return gitCredentialErase(cmd.Context(), &mapper, req)
+			default:
+				// git may add operations; helpers must ignore unknown ones.
+				return nil
+			}
+		},
+	}
+	cmd.Flags().StringVar(&mapper.prefix, "prefix", "git/", "prefix of entry names for unmapped hosts")
+	cmd.Flags().StringArrayVar(&mapping, "map", nil, "use entry NAME for HOST (HOST=NAME, repeatable)")
+	return cmd
+}
+
+func gitCredentialGet(cmd *cobra.Command, m *gitCredentialMapper, req gitCredential) error {
+	ctx := cmd.Context()
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	name, ok := m.lookup(db, req)
+	if !ok {
+		// Let git try other helpers or prompt.
+		return nil
+	}
+	r, err := db.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Wipe()
+	if u := req["username"]; u != "" && r.Username != "" && u != r.Username {
+		return nil
+	}
+	return gitCredential{"username": r.Username, "password": r.Password}.write(cmd.OutOrStdout())
+}
+
+func gitCredentialStore(ctx context.Context, m *gitCredentialMapper, req gitCredential) error {
+	if req["password"] == "" {
+		return nil
+	}
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	name, ok := m.lookup(db, req)
+	r := &store.Record{}
+	if ok {
+		if r, err = db.Get(ctx, name); err != nil {
+			return err
+		}
+		if r.Username == req["username"] && r.Password == req["password"] {
+			return nil
+		}
+	} else {
+		// New credentials go in the per-host entry.
+		c := m.candidates(req)
+		name = c[len(c)-1]
+	}
+	r.Username = req["username"]
+	r.SetPassword(req["password"], time.Now())
+	return db.Put(ctx, name, r)
+}
+
+func gitCredentialErase(ctx context.Context, m *gitCredentialMapper, req gitCredential) error {
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	name, ok := m.lookup(db, req)
+	if !ok {
+		return nil
+	}
+	r, err := db.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	// git erases credentials that were rejected; only remove them if they
+	// are still the ones we handed out.
+	if (req["username"] != "" && req["username"] != r.Username) || (req["password"] != "" && req["password"] != r.Password) {
+		return nil
+	}
+	return db.Delete(ctx, name)
+}
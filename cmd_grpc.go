@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/citizencloud/passwordstore/durinpb"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+)
+
+func newGRPCCmd() *cobra.Command {
+	var socket string
+	cmd := &cobra.Command{
+		Use:   "grpc",
+		Short: "Serve the gRPC API on a unix socket",
+		Long: `Serve the gRPC API on a unix socket.
+
+The durin.v1.Store service (see durinpb/store.proto) lists, searches, reads,
+writes and deletes entries; the Go package
+github.com/citizencloud/passwordstore/client connects to it. The socket,
+grpc.sock in the store by default, is only accessible to its owner, which is
+all the authentication there is. The store stays unlocked, and locked
+against other durin commands, until the server exits.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if socket == "" {
+				socket = filepath.Join(db.Dir(), "grpc.sock")
+			}
+			// A previous server would still hold the store lock, so any
+			// socket left behind is stale.
+			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			old := unix.Umask(0077)
+			ln, err := net.Listen("unix", socket)
+			unix.Umask(old)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(socket)
+			srv := grpc.NewServer()
+			durinpb.RegisterStoreServer(srv, &grpcServer{db: db})
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-sig
+				srv.GracefulStop()
+			}()
+			fmt.Fprintf(cmd.ErrOrStderr(), "Serving on %s\n", socket)
+			return srv.Serve(ln)
+		},
+	}
+	cmd.Flags().StringVar(&socket, "socket", "", "unix socket to listen on (default grpc.sock in the store)")
+	return cmd
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newHostCmd() *cobra.Command {
+	var menuCmd string
+	cmd := &cobra.Command{
+		Use:   "host [ORIGIN]",
+		Short: "Serve a browser extension as a native messaging host",
+		Long: `Serve a browser extension as a native messaging host.
+
+The browser starts durin host and exchanges length-prefixed JSON messages
+with it on stdin and stdout. Each request names the page it comes from in
+"url" and has an "action":
+
+  search  list the logins for the page: {"entries": [{"name", "username"}]}
+  get     return the login in "name": {"name", "username", "password"}
+  save    store "username" and "password", in "name" or an entry named
+          after the page's host: {"name"}
+
+  passkey-list    list the passkeys for "rp_id": {"passkeys": [{"name",
+                  "credential_id", "user_handle", "user_name"}]}
+  passkey-create  make a passkey for "rp_id", "user_handle" and
+                  "user_name": {"name", "credential_id", "public_key",
+                  "public_key_algorithm", "attestation_object"}
+  passkey-get     sign "client_data_hash" with a passkey for "rp_id", one
+                  of "credential_ids" if given: {"name", "credential_id",
+                  "user_handle", "authenticator_data", "signature"}
+
+durin acts as the passkeys' authenticator: their ES256 private keys never
+leave it. Binary values are unpadded base64url, and "rp_id" must be the
+page's host or a domain it is in.
+
+Failures are replied as {"error"}; an "id" in a request is copied to its
+reply. An entry belongs to a page if a part of its name is the page's host
+or a domain it is in, e.g. github.com or web/github.com/alice. The first
+time a page origin asks for logins, the picker (--menu-cmd, $DURIN_MENU, or
+rofi or dmenu) asks whether to allow it once, always or not at all; saving,
+creating a passkey and signing in with one are confirmed every time. The
+store is unlocked on the first request that needs it.
+
+Register the host with a manifest such as
+
+  {"name": "durin", "description": "durin", "type": "stdio",
+   "path": "/usr/bin/durin-host", "allowed_origins": ["chrome-extension://ID/"]}
+
+where durin-host is a script running "exec durin host "$@"".`,
+		Args: cobra.ArbitraryArgs,
+		// Browsers pass their own arguments, such as the calling extension.
+		FParseErrWhitelist: cobra.FParseErrWhitelist{UnknownFlags: true},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if menuCmd == "" {
+				menuCmd = os.Getenv(menuEnvCmd)
+			}
+			dir, err := store.DefaultDir()
+			if err != nil {
+				return err
+			}
+			grants, err := loadOriginGrants(dir)
+			if err != nil {
+				return err
+			}
+			h := &nativeHost{
+				dir:    dir,
+				grants: grants,
+				ask: func(question string, answers []string) (string, error) {
+					if menuCmd == "" {
+						var err error
+						if menuCmd, err = defaultMenuCmd(); err != nil {
+							return "", err
+						}
+					}
+					return askMenu(menuCmd, question, answers)
+				},
+			}
+			// stdin carries messages; keep passphrase commands and
+			// prompts from reading it.
+			in, out := os.Stdin, os.Stdout
+			if os.Stdin, err = os.Open(os.DevNull); err != nil {
+				return err
+			}
+			return h.serve(cmd.Context(), in, out)
+		},
+	}
+	cmd.Flags().StringVar(&menuCmd, "menu-cmd", "", "shell command that reads answers on stdin and prints the chosen one")
+	return cmd
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/spf13/cobra"
+)
+
+func newImportCmd() *cobra.Command {
+	var (
+		opts  importOptions
+		paper bool
+	)
+	cmd := &cobra.Command{
+		Use:   "import",
+		Short: "Import entries from another password manager",
+		Long: `Import entries from another password manager.
+
+With --paper, restore a paper backup written by durin export --paper from
+the text of its codes, read from the files given or standard input, one
+code per line in any order. It asks for the backup's passphrase.
+
+Entries whose names are already taken are skipped unless --force is given,
+so an interrupted import can simply be run again. --dry-run shows how each
+entry would be imported without storing anything.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !paper {
+				if len(args) > 0 {
+					return usageError{fmt.Errorf("unknown import source %q", args[0])}
+				}
+				return cmd.Help()
+			}
+			return importPaper(cmd.Context(), args, opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().BoolVar(&paper, "paper", false, "restore a paper backup from the text of its codes in FILE... or standard input")
+	cmd.PersistentFlags().StringVar(&opts.prefix, "prefix", "", "prepend this to the names of imported entries, e.g. pass/")
+	cmd.PersistentFlags().BoolVarP(&opts.force, "force", "f", false, "overwrite existing entries")
+	cmd.PersistentFlags().BoolVar(&opts.dryRun, "dry-run", false, "show what would be imported without storing anything")
+	cmd.AddCommand(newImportPassCmd(&opts), newImportKeepassCmd(&opts), newImportBitwardenCmd(&opts), newImportOnePasswordCmd(&opts), newImportLastPassCmd(&opts), newImportBrowserCmd(&opts), newImportCSVCmd(&opts), newImportKeychainCmd(&opts), newImportVaultCmd(&opts), newImportEnvCmd(&opts))
+	return cmd
+}
+
+// importPaper restores the paper backup whose codes are in files, or on
+// standard input if there are none.
+func importPaper(ctx context.Context, files []string, opts importOptions, out io.Writer) error {
+	codes := make(map[int]paperCode)
+	if len(files) == 0 {
+		if err := readPaperCodes(os.Stdin, codes); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		err = readPaperCodes(f, codes)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	blob, err := assemblePaper(codes)
+	if err != nil {
+		return err
+	}
+	pw, err := readSecret("Enter passphrase for the paper backup: ")
+	if err != nil {
+		return err
+	}
+	backup, err := openPaper(blob, pw)
+	secmem.Wipe(pw)
+	if err != nil {
+		return err
+	}
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	return importEntries(ctx, db, backupEntries(backup), opts, out)
+}
+
+func newImportPassCmd(opts *importOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "pass [DIR]",
+		Short: "Import a pass (password-store) tree",
+		Long: `Import the entries of pass, the standard Unix password manager, from DIR
+or else $PASSWORD_STORE_DIR or ~/.password-store.
+
+Each .gpg file is decrypted with gpg, which asks for the key's passphrase
+through gpg-agent as pass would. Folders become name prefixes, so
+email/work.gpg is imported as email/work. The first line of an entry is its
+password; "key: value" lines become fields, except that user, username and
+login set the username; otpauth:// lines are kept in the otpauth field; the
+rest become notes.`,
+		Args: maxArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			dir, err := defaultPassDir()
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			entries, err := readPassStore(ctx, dir, gpgDecrypt)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+}
+
+func newImportKeepassCmd(opts *importOptions) *cobra.Command {
+	var keyFile string
+	cmd := &cobra.Command{
+		Use:   "keepass FILE.kdbx",
+		Short: "Import a KeePass database",
+		Long: `Import the entries of a KeePass or KeePassXC database in KDBX 3.1 or 4
+format. It asks for the database's password; with --keyfile, press enter
+at the prompt if the database has a key file only.
+
+Groups become name prefixes, leaving out the root group and the recycle
+bin. Title, user name, password and notes fill the entry; the URL and
+custom strings become fields, TOTP settings an otpauth field, old
+versions the password history, and attachments are kept with the entry.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			entries, err := readKeepassFile(args[0], keyFile)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&keyFile, "keyfile", "", "key file of the database")
+	return cmd
+}
+
+// readKeepassFile reads the entries of the KeePass database at path,
+// asking for its password.
+func readKeepassFile(path, keyFile string) ([]importedEntry, error) {
+	pw, err := readSecret(fmt.Sprintf("Enter password for %s: ", path))
+	if err != nil {
+		return nil, err
+	}
+	creds, err := keepassCredentials(pw, keyFile)
+	secmem.Wipe(pw)
+	if err != nil {
+		return nil, err
+	}
+	kdbx, err := readKeepass(path, creds)
+	if err != nil {
+		return nil, err
+	}
+	return keepassEntries(kdbx)
+}
+
+func newImportBitwardenCmd(opts *importOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "bitwarden FILE.json",
+		Short: "Import a Bitwarden JSON export",
+		Long: `Import the items of a Bitwarden JSON export, either unencrypted or
+protected with a file password, which it then asks for. Exports encrypted
+with the account's key cannot be read outside Bitwarden.
+
+Folders become name prefixes. Logins keep their username, password and
+TOTP secret, with their URIs in url fields; cards and identities become
+entries of kind card and identity with a field per value; secure notes
+become notes. Custom fields and password history are kept.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			entries, err := readBitwardenFile(args[0])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+}
+
+// readBitwardenFile reads the entries of the Bitwarden JSON export at
+// path, asking for its password if it has one.
+func readBitwardenFile(path string) ([]importedEntry, error) {
+	data, err := readImportFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(data)
+	encrypted, err := bitwardenEncrypted(data)
+	if err != nil {
+		return nil, err
+	}
+	var pw []byte
+	if encrypted {
+		if pw, err = readSecret(fmt.Sprintf("Enter password for %s: ", path)); err != nil {
+			return nil, err
+		}
+		defer secmem.Wipe(pw)
+	}
+	return readBitwarden(data, pw)
+}
+
+func newImportOnePasswordCmd(opts *importOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "1password FILE.1pux",
+		Short: "Import a 1Password 1PUX export",
+		Long: `Import the items of a 1Password export in the 1PUX format, which 1Password
+8 writes unencrypted.
+
+Vaults become name prefixes, so the item GitHub in the vault Work is
+imported as Work/GitHub. Categories become kinds: logins and passwords are
+logins, secure notes notes, credit cards cards and identities identities,
+and the others keep their name, such as server or bank-account. Section
+fields are kept by title, TOTP secrets in the otpauth field, and documents
+and file fields as attachments. Archived items are tagged archived.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			entries, err := readOnePUX(args[0])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+}
+
+func newImportLastPassCmd(opts *importOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "lastpass FILE.csv",
+		Short: "Import a LastPass CSV export",
+		Long: `Import the sites and secure notes of a LastPass CSV export, as written by
+Advanced Options > Export in the LastPass browser extension.
+
+Groupings become name prefixes. Sites keep their URL in the url field, the
+TOTP secret in the otpauth field and the extra column as notes. Secure
+notes become notes; structured ones such as credit cards become entries of
+kind card and so on, with a field per value. Favorites are tagged favorite.
+
+Try it with --dry-run first to see how each entry would be mapped.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			entries, err := readLastPass(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+}
+
+func newImportBrowserCmd(opts *importOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "browser FILE.csv",
+		Short: "Import passwords exported from a web browser",
+		Long: `Import the passwords a web browser exported as CSV: Chrome, Edge, Brave and
+other Chromium based browsers, Firefox and Safari.
+
+Browsers save a login for every page they saw its form on, so logins with
+the same origin and username are imported once, as the one changed last.
+Entries are named after the site's host without www., such as github.com,
+or github.com/USERNAME when there are several logins for the host. The
+URL is kept in the url field.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			entries, err := readBrowserCSV(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+}
+
+func newImportVaultCmd(opts *importOptions) *cobra.Command {
+	var f vaultFlags
+	cmd := &cobra.Command{
+		Use:   "vault --path MOUNT/PATH/",
+		Short: "Import the secrets of a HashiCorp Vault KV v2 mount",
+		Long: `Import the latest version of every secret under --path in a HashiCorp Vault
+KV version 2 mount, such as secret/ or secret/team/, whose first element
+is the mount. Paths below --path become entry names, so secret/team/db/prod
+under --path secret/team/ is imported as db/prod.
+
+The keys password, username (or user or login), url and notes become those
+parts of the entry, and the other keys fields; values that are not strings
+are kept as JSON. Log in with a token from --token-file, $VAULT_TOKEN or
+~/.vault-token, or with AppRole through --role-id and --secret-id-file.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			entries, err := readVault(ctx, &f)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+	addVaultFlags(cmd, &f)
+	return cmd
+}
+
+func newImportEnvCmd(opts *importOptions) *cobra.Command {
+	var (
+		from         string
+		all, rewrite bool
+	)
+	cmd := &cobra.Command{
+		Use:   "env [--from FILE]",
+		Short: "Import the secrets of a .env file",
+		Long: `Import the variables of a .env file, by default .env in the current
+directory, that look like secrets as durin scan --dotenv finds them, or
+every variable with --all. Each becomes an entry named after the variable
+holding its value as the password, under --prefix or else env/DIR/, DIR
+being the name of the file's directory.
+
+With --rewrite, the lines of the imported variables are then commented out
+of the file, so that the secrets no longer sit in it in plaintext, and a
+line at its top tells how to run the project with them instead:
+
+    durin exec env/DIR/ --bare -- COMMAND
+
+Lines are only rewritten once their values are in the store, so variables
+skipped because their entries exist keep their lines unless the entries
+hold the same values.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			o := *opts
+			if !cmd.Flag("prefix").Changed {
+				abs, err := filepath.Abs(from)
+				if err != nil {
+					return err
+				}
+				o.prefix = "env/" + filepath.Base(filepath.Dir(abs)) + "/"
+			}
+			if rewrite && !strings.HasSuffix(o.prefix, "/") {
+				return usageError{errors.New("--rewrite needs a --prefix ending in /, for durin exec PREFIX")}
+			}
+			entries, vars, err := readDotenv(from, all)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if err := importEntries(ctx, db, entries, o, cmd.OutOrStdout()); err != nil {
+				return err
+			}
+			if !rewrite || o.dryRun {
+				return nil
+			}
+			n, err := rewriteDotenv(ctx, db, from, o.prefix, vars)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "rewrote %d of %d variables in %s\n", n, len(vars), from)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", ".env", "the .env file to import")
+	cmd.Flags().BoolVar(&all, "all", false, "import every variable, not just those that look like secrets")
+	cmd.Flags().BoolVar(&rewrite, "rewrite", false, "comment the imported variables out of the file")
+	return cmd
+}
+
+func newImportCSVCmd(opts *importOptions) *cobra.Command {
+	var (
+		mapping  string
+		noHeader bool
+	)
+	cmd := &cobra.Command{
+		Use:   "csv FILE.csv",
+		Short: "Import a CSV file with columns of your choosing",
+		Long: `Import the rows of a CSV file exported by any password manager, mapping its
+columns to the parts of an entry with --map, such as
+
+    --map name=1,username=2,password=3,url=Website
+
+Columns are given by number, counting from 1, or by the name in the
+file's header row. The parts are name, which is required, folder, which
+becomes a name prefix, username, password, url, notes, otpauth for TOTP
+secrets and tags, separated by commas or semicolons; any other name maps
+a column to a field of that name, e.g. pin=5.
+
+Without --map, durin guesses the mapping from the header and asks for
+each part on the terminal, showing the --map value to reuse afterwards.
+Use --dry-run to check the result.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			t, err := readCSV(f)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", args[0], err)
+			}
+			if noHeader {
+				t.withoutHeader()
+			}
+			var m csvMapping
+			switch {
+			case mapping != "":
+				if m, err = parseCSVMapping(t, mapping); err != nil {
+					return usageError{err}
+				}
+			case canPrompt():
+				if m, err = promptCSVMapping(t, guessCSVMapping(t), os.Stdin, os.Stderr); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Using --map %s\n", m)
+			default:
+				m = guessCSVMapping(t)
+				if _, ok := m["name"]; !ok {
+					return usageError{fmt.Errorf("cannot tell which column holds the names; use --map")}
+				}
+			}
+			entries, err := readMappedCSV(t, m)
+			if err != nil {
+				return usageError{err}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&mapping, "map", "", "map parts of an entry to columns, e.g. name=1,username=2,password=3")
+	cmd.Flags().BoolVar(&noHeader, "no-header", false, "the first row holds data, not column names")
+	return cmd
+}
+
+func newImportKeychainCmd(opts *importOptions) *cobra.Command {
+	var keychain string
+	cmd := &cobra.Command{
+		Use:   "keychain",
+		Short: "Import internet passwords from the macOS Keychain",
+		Long: `Import the internet passwords of the macOS Keychain, such as those Safari
+saved, with the security tool, so that they never pass through a CSV file
+on disk. macOS asks whether durin may read each password; items it is not
+allowed to read are skipped with a warning. Passwords kept only in iCloud
+Keychain are not visible to the security tool.
+
+Logins are named after their server like with durin import browser, and
+keep their URL in the url field.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			entries, err := readKeychain(ctx, keychain, cmd.ErrOrStderr())
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return importEntries(ctx, db, entries, *opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&keychain, "keychain", "", "keychain file to read instead of the default keychains")
+	return cmd
+}
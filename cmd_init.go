@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newInitCmd() *cobra.Command {
+	var holders []string
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a new store",
+		Long: `Create a new store, asking for its passphrase twice.
+
+With --keyfile, the store also needs that file to be opened, such as one on
+a USB stick, so that the passphrase alone is not enough; it is created with
+random contents if it does not exist. Every later command then needs
+--keyfile or DURIN_KEYFILE too.
+
+With --holders, such as --holders alice,bob for a break-glass vault of root
+credentials, the store is under dual control: it has no passphrase of its
+own, but one for each holder, asked for in turn, and it takes all of them
+to open it. Each holder types their own, on the terminal or through
+--pinentry; $DURIN_PASSPHRASE_CMD is run once for each, with $DURIN_HOLDER
+set to the holder.
+
+Other commands do not create a store by default; set DURIN_AUTO_INIT=1 to
+let them create one on first use.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(cmd.Context(), dir); err != nil {
+				return err
+			}
+			exists, err := store.Exists(dir)
+			if err != nil {
+				return err
+			}
+			shared, err := store.IsShared(dir)
+			if err != nil {
+				return err
+			}
+			if exists || shared {
+				return fmt.Errorf("a store already exists in %s", dir)
+			}
+			// A new keyset would leave the entries of one that lost its
+			// own undecryptable.
+			if err := store.CheckKeyset(dir); err != nil {
+				return err
+			}
+			if len(holders) == 1 {
+				return usageError{errors.New("dual control needs at least two --holders")}
+			}
+			var pws [][]byte
+			defer func() {
+				for _, pw := range pws {
+					secmem.Wipe(pw)
+				}
+			}()
+			if holders == nil {
+				pw, err := readNewPassphrase()
+				if err != nil {
+					return fmt.Errorf("failed to read password: %v", err)
+				}
+				pws = append(pws, pw)
+			}
+			for _, h := range holders {
+				pw, err := readNewHolderPassphrase(h)
+				if err != nil {
+					return fmt.Errorf("failed to read the passphrase of %s: %v", h, err)
+				}
+				pws = append(pws, pw)
+			}
+			for i, pw := range pws {
+				whose := "the passphrase"
+				if holders != nil {
+					whose = "the passphrase of " + holders[i]
+				}
+				if len(pw) == 0 {
+					return fmt.Errorf("%s must not be empty", whose)
+				}
+				if s := passwordStrength(string(pw)); s.weak() {
+					fmt.Fprintf(os.Stderr, "Warning: %s is %s (estimated crack time: %s).\n", whose, s.Label, s.CrackTime)
+				}
+			}
+			if keyFile != "" {
+				if err := store.NewKeyFile(keyFile); err == nil {
+					fmt.Fprintf(os.Stderr, "Created keyfile %s.\n", keyFile)
+				} else if !os.IsExist(err) {
+					return err
+				}
+			}
+			if holders != nil {
+				err = store.CreateDualControl(dir, holders, pws, keyFile)
+			} else {
+				err = store.CreateWithKeyFile(dir, pws[0], keyFile)
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Initialized store in %s\n", dir)
+			if keyFile != "" {
+				fmt.Fprintf(os.Stderr, `
+The store cannot be opened without the keyfile %s either. Keep a
+copy of it apart from the store, such as on a second USB stick.
+`, keyFile)
+			}
+			if holders != nil {
+				fmt.Fprintf(os.Stderr, `
+The passphrases cannot be recovered or reset: without the one of any
+holder, nothing in the store can be decrypted. Each holder should write
+theirs down and keep it somewhere safe of their own.
+`)
+			} else {
+				fmt.Fprintf(os.Stderr, `
+The passphrase cannot be recovered or reset: without it, nothing in the
+store can be decrypted. Write it down and keep it somewhere safe.
+`)
+			}
+			fmt.Fprintf(os.Stderr, `
+Back up %s, in particular the salt and master files, which
+every copy of the store needs; durin sync keeps a copy in git.
+`, dir)
+			return nil
+		},
+	}
+	cmd.Flags().StringSliceVar(&holders, "holders", nil, "put the store under the dual control of these holders, each with a passphrase of their own")
+	return cmd
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newK8sProviderCmd() *cobra.Command {
+	var listen, prefix, tokenFile, certFile, keyFile string
+	cmd := &cobra.Command{
+		Use:   "k8s-provider",
+		Short: "Serve entries under a prefix to the External Secrets Operator",
+		Long: `Serve the entries under --prefix to the External Secrets Operator's webhook
+provider, or a sidecar speaking the same JSON, so that they can be
+materialized as Kubernetes Secrets from a store on a server:
+
+  GET /v1/secrets/KEY[?property=FIELD]   {"value", "data"}
+  GET /v1/secrets                        the keys
+
+KEY is the name of the entry without the prefix. value is its FIELD, by
+default the password, and data all its fields by name. Every request needs
+"Authorization: Bearer TOKEN", TOKEN being the first line of --token-file;
+GET /healthz and GET /metrics need none, as with durin serve. Nothing can
+be written.
+
+A SecretStore for it looks like:
+
+  provider:
+    webhook:
+      url: "http://durin:7991/v1/secrets/{{ .remoteRef.key }}?property={{ .remoteRef.property }}"
+      headers:
+        Authorization: "Bearer {{ print .auth.token }}"
+      result:
+        jsonPath: "$.value"
+      secrets:
+        - name: auth
+          secretRef:
+            name: durin-token
+
+Use jsonPath "$.data" for dataFrom. The store stays unlocked, and locked
+against other durin commands, while this runs; the passphrase comes from
+--passphrase-file or $DURIN_PASSPHRASE_CMD as usual. Without --tls-cert and
+--tls-key it speaks plain HTTP, meant for a sidecar on localhost or a
+cluster network that encrypts by itself.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (certFile == "") != (keyFile == "") {
+				return usageError{errors.New("--tls-cert and --tls-key must be given together")}
+			}
+			if tokenFile == "" {
+				return usageError{errors.New("give the file holding the bearer token with --token-file")}
+			}
+			token, err := passphraseFromFile(tokenFile)()
+			if err != nil {
+				return err
+			}
+			if len(token) < 16 {
+				return fmt.Errorf("the token in %s is too short; use at least 16 characters", tokenFile)
+			}
+			if prefix != "" && !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+			db, err := openStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			p := newK8sProvider(db, prefix, string(token))
+			srv := &http.Server{Handler: p.handler(), ReadHeaderTimeout: 10 * time.Second}
+			ln, err := net.Listen("tcp", listen)
+			if err != nil {
+				return err
+			}
+			if certFile != "" {
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					return fmt.Errorf("failed to load TLS certificate: %v", err)
+				}
+				srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+				fmt.Fprintf(cmd.ErrOrStderr(), "Serving %s on https://%s\n", prefix, ln.Addr())
+				return srv.ServeTLS(ln, "", "")
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Serving %s on http://%s\n", prefix, ln.Addr())
+			return srv.Serve(ln)
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:7991", "address to listen on")
+	cmd.Flags().StringVar(&prefix, "prefix", "k8s/", "serve only the entries under this prefix")
+	cmd.Flags().StringVar(&tokenFile, "token-file", "", "file holding the bearer token clients must send")
+	cmd.Flags().StringVar(&certFile, "tls-cert", "", "PEM certificate to serve HTTPS with")
+	cmd.Flags().StringVar(&keyFile, "tls-key", "", "PEM private key for --tls-cert")
+	return cmd
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage the keys protecting the store",
+		Long: `Manage the keys protecting the store.
+
+The entries are encrypted with the master keyset, kept in master wrapped
+with a key derived from the passphrase and the random salt in salt.
+Without master, they cannot be decrypted: durin key backup writes a
+backup of it, or recovery words to write down, from which durin key
+recover restores it.`,
+		Args: exactArgs(0),
+	}
+	cmd.AddCommand(newKeyResaltCmd(), newKeyUpgradeCmd(), newKeyRekeyCmd(), newKeyBackupCmd(), newKeyRecoverCmd())
+	return cmd
+}
+
+func newKeyResaltCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resalt",
+		Short: "Wrap the master keyset under a new salt",
+		Long: `Generate a new salt and wrap the master keyset again with the key
+derived from it and the passphrase, which it asks for. Do this if the salt
+may have been exposed, or to derive the key with the current settings after
+durin changed them.
+
+The entries are encrypted with the master keyset itself, so they are not
+rewritten, and the passphrase stays the same. A key cached in the OS
+keyring is replaced; copies of the store elsewhere pick up the new salt
+with durin sync.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if db.Shared() {
+				return fmt.Errorf("%s is a shared vault, which has no passphrase or salt", db.Dir())
+			}
+			pw, err := storePassphrase(db)
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(pw)
+			if err := db.Resalt(ctx, pw); err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, "Wrapped the master keyset under a new salt.")
+			return nil
+		},
+	}
+}
+
+func newKeyUpgradeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "upgrade",
+		Short: "Bring the store to the current format",
+		Long: `Give a store made by an older durin an ID of its own and encrypt the
+master keyset and every entry again with the ID and the format version
+authenticated along with them, so that entries cannot be moved in from
+another store with the same passphrase, nor replaced with copies from
+before the upgrade. It asks for the passphrase.
+
+Stores made by this version are already in the current format. Run durin
+sync afterwards so that other copies of the store are upgraded too; an
+older durin cannot read the upgraded store.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if db.Shared() {
+				return fmt.Errorf("%s is a shared vault, whose entries have keys of their own", db.Dir())
+			}
+			if version, _ := db.Format(); version == store.CurrentFormat {
+				fmt.Fprintln(os.Stderr, "The store is already in the current format.")
+				return nil
+			}
+			pw, err := storePassphrase(db)
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(pw)
+			if err := db.Upgrade(ctx, pw); err != nil {
+				return err
+			}
+			_, id := db.Format()
+			fmt.Fprintf(os.Stderr, "Upgraded the store to format %d, with ID %s.\n", store.CurrentFormat, id)
+			return nil
+		},
+	}
+}
+
+func newKeyRekeyCmd() *cobra.Command {
+	var (
+		resume, status bool
+		batch          int
+		format         string
+	)
+	cmd := &cobra.Command{
+		Use:   "rekey",
+		Short: "Replace the master keyset's key and encrypt every entry again",
+		Long: `Add a new key to the master keyset, encrypt every entry again with it and
+then drop the old keys, e.g. when an old copy of master and the passphrase
+may both have leaked. It asks for the passphrase, which stays the same.
+
+Entries are encrypted again in batches of --batch-size, each written out
+before the next, so that a large store can be rekeyed bit by bit: a rekey
+that was interrupted, or stopped with Ctrl-C, is continued with --resume.
+Until it is finished, entries under the old and the new key both open.
+--status shows how many entries each key encrypts and whether a rekey is
+under way.
+
+A running durin agent is locked first, so that it does not go on with the
+old keyset; unlock it again afterwards. Other processes that hold the
+store unlocked lock themselves once they notice the new keyset. Run durin
+sync afterwards so that other copies of the store get the new keyset.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if resume && status {
+				return usageError{errors.New("--resume and --status are mutually exclusive")}
+			}
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if db.Shared() {
+				return fmt.Errorf("%s is a shared vault, whose entries have keys of their own", db.Dir())
+			}
+			if status {
+				u, err := db.KeyUsage()
+				if err != nil {
+					return err
+				}
+				return writeOutput(cmd.OutOrStdout(), format, u, func(w io.Writer) error {
+					ids := make([]uint32, 0, len(u.Entries))
+					for id := range u.Entries {
+						ids = append(ids, id)
+					}
+					sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+					for _, id := range ids {
+						mark := ""
+						if id == u.Primary {
+							mark = " (primary)"
+						}
+						fmt.Fprintf(w, "key %d: %d entries%s\n", id, u.Entries[id], mark)
+					}
+					if u.Rekey == nil {
+						fmt.Fprintln(w, "no rekey under way")
+						return nil
+					}
+					left := 0
+					for id, n := range u.Entries {
+						if id != u.Rekey.To {
+							left += n
+						}
+					}
+					fmt.Fprintf(w, "rekey to key %d begun %s: %d entries left; continue with durin key rekey --resume\n", u.Rekey.To, u.Rekey.Started.Local().Format("2006-01-02 15:04"), left)
+					return nil
+				})
+			}
+			pw, err := storePassphrase(db)
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(pw)
+			// An agent holding the keyset from before would go on
+			// encrypting new entries with keys the rekey drops.
+			if err := agentLock(ctx, db.Dir()); err != nil {
+				return fmt.Errorf("%v; stop it before rekeying", err)
+			}
+			// Stop between batches rather than in the middle of one.
+			ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			errOut := cmd.ErrOrStderr()
+			err = db.Rekey(ctx, pw, store.RekeyOptions{
+				Resume:    resume,
+				BatchSize: batch,
+				Progress: func(done, total int) {
+					fmt.Fprintf(errOut, "Encrypted %d of %d entries with the new key.\n", done, total)
+				},
+			})
+			if errors.Is(err, context.Canceled) {
+				return fmt.Errorf("rekey interrupted; continue it with durin key rekey --resume")
+			} else if err != nil {
+				return err
+			}
+			fmt.Fprintln(errOut, "Rekeyed the store; the old keys are dropped from the master keyset.")
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&resume, "resume", false, "continue an interrupted rekey")
+	cmd.Flags().BoolVar(&status, "status", false, "show which keys encrypt the entries instead of rekeying")
+	cmd.Flags().IntVar(&batch, "batch-size", 1000, "encrypt this many entries again before writing them out")
+	addFormatFlag(cmd, &format)
+	return cmd
+}
+
+func newKeyBackupCmd() *cobra.Command {
+	var words bool
+	cmd := &cobra.Command{
+		Use:   "backup [FILE]",
+		Short: "Back up the master keyset, or print it as recovery words",
+		Long: `Write a backup of the master keyset to FILE, or to standard output, for
+durin key recover to restore should master be lost. The keyset stays
+wrapped with the key derived from the passphrase, so the backup is no use
+without the passphrase, nor the keyfile if the store needs one, and the
+store opens with them again once it is restored. A backup made before
+durin key rekey lacks the new key; make another one afterwards.
+
+With --words, print the master keyset itself instead, as some 40 words to
+write down and keep on paper. It asks for the passphrase. The words need
+neither passphrase nor keyfile: whoever has them can decrypt every entry,
+so keep them as safe as the store itself, and apart from it.`,
+		Args: maxArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			out := cmd.OutOrStdout()
+			if words {
+				if len(args) > 0 {
+					return usageError{errors.New("--words prints to standard output and takes no FILE")}
+				}
+				db, err := openStore(ctx)
+				if err != nil {
+					return err
+				}
+				if db.Shared() {
+					return fmt.Errorf("%s is a shared vault, which has no master keyset", db.Dir())
+				}
+				pw, err := storePassphrase(db)
+				if err != nil {
+					return err
+				}
+				defer secmem.Wipe(pw)
+				key, err := db.RecoveryKey(ctx, pw)
+				if err != nil {
+					return err
+				}
+				defer secmem.Wipe(key)
+				list := recoveryWords(key)
+				for i := 0; i < len(list); i += recoveryWordsPerLine {
+					end := i + recoveryWordsPerLine
+					if end > len(list) {
+						end = len(list)
+					}
+					fmt.Fprintf(out, "%2d. %s\n", i/recoveryWordsPerLine+1, strings.Join(list[i:end], " "))
+				}
+				fmt.Fprintln(os.Stderr, `
+Whoever has these words can decrypt every entry, without the passphrase.
+Write them down, keep them somewhere safe and apart from the store, and
+restore a lost master from them with durin key recover.`)
+				return nil
+			}
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(ctx, dir); err != nil {
+				return err
+			}
+			b, err := store.BackupKeyset(dir)
+			if err != nil {
+				return storeError(err)
+			}
+			if len(args) == 0 {
+				_, err := out.Write(b)
+				return err
+			}
+			f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Write(b); err != nil {
+				f.Close()
+				os.Remove(args[0])
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Wrote a backup of the master keyset to %s; durin key recover %s restores it.\n", args[0], args[0])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&words, "words", false, "print the master keyset as recovery words to write down")
+	return cmd
+}
+
+func newKeyRecoverCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "recover [FILE]",
+		Short: "Restore a lost master keyset",
+		Long: `Restore the master keyset of a store that lost its master file, from the
+backup durin key backup wrote to FILE or, without FILE, from the recovery
+words durin key backup --words printed, read from standard input. A
+backup or words of another store, or lacking a key that entries are
+encrypted with, are refused, and nothing is written then.
+
+A backup is restored as it was: the store opens with the passphrase, and
+the keyfile, it had when the backup was made. From the recovery words, a
+new master is made, wrapped with a new passphrase that it asks for, one
+for each holder of a store under dual control, and with the keyfile given
+with --keyfile, if any.
+
+A copy of master and salt from any backup of the store serves as well,
+such as the last one durin sync committed, which git -C ~/.durin checkout
+HEAD -- master salt restores. durin sync refuses to run while master is
+missing, so that its removal does not spread to other copies.`,
+		Args: maxArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			if err := lockStore(cmd.Context(), dir); err != nil {
+				return err
+			}
+			if err := store.CheckKeyset(dir); err == nil {
+				if exists, err := store.Exists(dir); err != nil {
+					return err
+				} else if !exists {
+					return storeError(&store.NoStoreError{Dir: dir})
+				}
+				return fmt.Errorf("the store in %s has its master keyset; there is nothing to recover", dir)
+			} else if !errors.Is(err, store.ErrNoKeyset) {
+				return err
+			}
+			if len(args) == 1 {
+				b, err := ioutil.ReadFile(args[0])
+				if err != nil {
+					return err
+				}
+				if err := store.RestoreKeyset(dir, b); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Restored the master keyset of the store in %s from %s.\n", dir, args[0])
+				return nil
+			}
+			key, err := readRecoveryWords()
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(key)
+			pw, err := readRecoveredPassphrase(dir)
+			if err != nil {
+				return err
+			}
+			defer secmem.Wipe(pw)
+			if err := store.RecoverKeyset(dir, key, pw, keyFile); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, `Made a new master keyset for the store in %s from the recovery words; it
+opens with the new passphrase. Run durin sync so that other copies of the
+store get it, and write down the passphrase.
+`, dir)
+			return nil
+		},
+	}
+}
+
+// readRecoveryWords reads the recovery words durin key recover is given,
+// up to an empty line or the end of standard input, and the recovery key
+// they stand for.
+func readRecoveryWords() ([]byte, error) {
+	if isTerminal(os.Stdin.Fd()) {
+		fmt.Fprintln(os.Stderr, "Type the recovery words, then an empty line:")
+	}
+	var text []string
+	for {
+		line, err := readLine(os.Stdin)
+		if err == io.ErrUnexpectedEOF || err == nil && len(strings.TrimSpace(string(line))) == 0 && len(text) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		text = append(text, string(line))
+	}
+	return parseRecoveryWords(strings.Join(text, " "))
+}
+
+// readRecoveredPassphrase asks for the new passphrase of the store in dir,
+// whose master keyset is made anew from recovery words: one of each holder
+// if it is under dual control.
+func readRecoveredPassphrase(dir string) ([]byte, error) {
+	holders, err := store.Holders(dir)
+	if err != nil {
+		return nil, err
+	}
+	if holders == nil {
+		pw, err := readNewPassphrase()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read password: %v", err)
+		}
+		if len(pw) == 0 {
+			secmem.Wipe(pw)
+			return nil, errors.New("the passphrase must not be empty")
+		}
+		return pw, nil
+	}
+	pws := make([][]byte, 0, len(holders))
+	defer func() {
+		for _, pw := range pws {
+			secmem.Wipe(pw)
+		}
+	}()
+	for _, h := range holders {
+		pw, err := readNewHolderPassphrase(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the passphrase of %s: %v", h, err)
+		}
+		pws = append(pws, pw)
+		if len(pw) == 0 {
+			return nil, fmt.Errorf("the passphrase of %s must not be empty", h)
+		}
+	}
+	return store.CombinePassphrases(pws), nil
+}
+
+// lostKeysetHelp tells how to recover the master keyset the store in dir
+// lost.
+func lostKeysetHelp(dir string) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "The entries are still there; restore the master keyset with one of:")
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		fmt.Fprintf(&b, "  git -C %s checkout HEAD -- master salt, the copy durin sync last committed\n", dir)
+	}
+	fmt.Fprintf(&b, "  a copy of master and salt from a backup of %s\n", dir)
+	fmt.Fprintln(&b, "  durin key recover FILE, with a backup durin key backup wrote")
+	fmt.Fprintln(&b, "  durin key recover, with the recovery words durin key backup --words printed")
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newListCmd() *cobra.Command {
+	var (
+		format      string
+		long, score bool
+		unusedSince string
+		regex       bool
+		tf          tableFlags
+	)
+	cmd := &cobra.Command{
+		Use:     "list [PATTERN...]",
+		Aliases: []string{"ls"},
+		Short:   "List entry names",
+		Long: `List entry names, or those matching any PATTERN: a glob such as 'aws/*',
+where * does not match across a slash, or with --regex a regular
+expression such as '^old-.*'.
+
+With --long, each entry's kind, last modification, age since it was
+created and tags are shown too. They are read from the store without
+decrypting any entry; entries written by older versions of durin have none
+until they are next changed. --strength adds the strength of each password,
+which does decrypt them.
+
+With --unused-since, only entries neither read nor changed for that long
+are listed, e.g. --unused-since 1y, to find accounts no longer in use.
+Reads are tracked since durin began recording them, per copy of the store.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if score && !long {
+				return usageError{errors.New("--strength needs --long")}
+			}
+			var m *nameMatcher
+			if len(args) > 0 {
+				var err error
+				if m, err = newNameMatcher(args, regex); err != nil {
+					return err
+				}
+			}
+			var cutoff time.Time
+			if unusedSince != "" {
+				d, err := parseAge(unusedSince)
+				if err != nil {
+					return usageError{err}
+				}
+				cutoff = time.Now().Add(-d)
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if format == formatText && !tf.porcelain {
+				noteReadOnly(db)
+			}
+			entries := db.ListEntries()
+			if m != nil {
+				matched := []store.EntryInfo{}
+				for _, e := range entries {
+					if m.match(e.Name) {
+						matched = append(matched, e)
+					}
+				}
+				entries = matched
+			}
+			if unusedSince != "" {
+				read, err := db.LastRead(ctx)
+				if err != nil {
+					return err
+				}
+				entries = unusedEntries(entries, read, cutoff)
+			}
+			if !long {
+				names := make([]string, 0, len(entries))
+				for _, e := range entries {
+					names = append(names, e.Name)
+				}
+				return writeOutput(cmd.OutOrStdout(), format, names, func(w io.Writer) error {
+					for _, name := range names {
+						fmt.Fprintln(w, name)
+					}
+					return nil
+				})
+			}
+			if !score {
+				return writeOutput(cmd.OutOrStdout(), format, entries, func(w io.Writer) error {
+					return entryTable(entries, nil).write(w, tf)
+				})
+			}
+			scored := make([]scoredEntry, 0, len(entries))
+			for _, e := range entries {
+				r, err := db.Peek(ctx, e.Name)
+				if err != nil {
+					return err
+				}
+				s := passwordStrength(r.Password, e.Name, r.Username)
+				r.Wipe()
+				scored = append(scored, scoredEntry{EntryInfo: e, Strength: s.Label})
+			}
+			return writeOutput(cmd.OutOrStdout(), format, scored, func(w io.Writer) error {
+				return entryTable(entries, scored).write(w, tf)
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().BoolVarP(&long, "long", "l", false, "also show each entry's kind, modification date, age and tags")
+	cmd.Flags().BoolVar(&score, "strength", false, "with --long, also show the strength of each password")
+	addTableFlags(cmd, &tf)
+	addRegexFlag(cmd, &regex)
+	cmd.Flags().StringVar(&unusedSince, "unused-since", "", "only list entries not read or changed for this long, e.g. 1y")
+	return cmd
+}
+
+// scoredEntry is an entry listed with list --long --strength.
+type scoredEntry struct {
+	store.EntryInfo `yaml:",inline"`
+	Strength        string `json:"strength" yaml:"strength"`
+}
+
+// entryTable returns the table list --long prints for entries, with their
+// strengths from scored if not nil.
+func entryTable(entries []store.EntryInfo, scored []scoredEntry) *table {
+	header := []string{"NAME", "KIND", "MODIFIED", "AGE", "TAGS"}
+	if scored != nil {
+		header = append(header, "STRENGTH")
+	}
+	t := newTable(header...)
+	now := time.Now()
+	for i, e := range entries {
+		var modified, age string
+		if e.Modified != nil {
+			modified = e.Modified.Format("2006-01-02")
+		}
+		if e.Created != nil {
+			age = formatAge(now.Sub(*e.Created))
+		}
+		cells := []string{e.Name, e.Kind, modified, age, strings.Join(e.Tags, ",")}
+		if scored != nil {
+			cells = append(cells, scored[i].Strength)
+		}
+		t.row(cells...)
+	}
+	return t
+}
+
+// unusedEntries returns the entries that were neither read, going by read,
+// nor written since cutoff.
+func unusedEntries(entries []store.EntryInfo, read map[string]time.Time, cutoff time.Time) []store.EntryInfo {
+	unused := []store.EntryInfo{}
+	for _, e := range entries {
+		last := read[e.Name]
+		for _, t := range []*time.Time{e.Modified, e.Created} {
+			if t != nil && t.After(last) {
+				last = *t
+			}
+		}
+		if last.Before(cutoff) {
+			unused = append(unused, e)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newLogCmd() *cobra.Command {
+	var (
+		format string
+		limit  int
+	)
+	cmd := &cobra.Command{
+		Use:   "log",
+		Short: "Show the audit log of changes to the store",
+		Long: `Show the audit log, which records every change to the entries of the
+store. Each record is signed and chained to the one before; use durin log
+verify to check that none was altered or removed.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			entries, err := store.ReadLog(dir)
+			if err != nil {
+				return err
+			}
+			if limit > 0 && len(entries) > limit {
+				entries = entries[len(entries)-limit:]
+			}
+			return writeOutput(cmd.OutOrStdout(), format, entries, func(w io.Writer) error {
+				for _, e := range entries {
+					name := e.Name
+					if e.To != "" {
+						name += " -> " + e.To
+					}
+					fmt.Fprintf(w, "%6d  %s  %-6s  %s\n", e.Seq, e.Time.Local().Format(time.RFC3339), e.Op, name)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().IntVar(&limit, "limit", 0, "show only the last this many records")
+	addFormatFlag(cmd, &format)
+	cmd.AddCommand(newLogVerifyCmd())
+	return cmd
+}
+
+func newLogVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Check the audit log for tampering or rollback",
+		Long: `Check the signatures and hash chain of the audit log.
+
+The last record verified is remembered outside the store, in the user's
+configuration directory, so that a later verify notices if records were
+cut off the end of the log or an older copy of the store was restored.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			anchor, err := logAnchorPath(db.Dir())
+			if err != nil {
+				return err
+			}
+			since, err := readLogAnchor(anchor)
+			if err != nil {
+				return err
+			}
+			head, err := db.VerifyLog(since)
+			if err != nil {
+				return err
+			}
+			if err := writeLogAnchor(anchor, head); err != nil {
+				return fmt.Errorf("the log verified, but failed to remember its head: %v", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Verified %d records; the last is %.16s\n", head.Seq, head.Hash)
+			if since == nil {
+				fmt.Fprintln(os.Stderr, "No head was recorded before, so a rollback could not be checked for this time.")
+			}
+			return nil
+		},
+	}
+}
+
+// logAnchorPath returns the file remembering the last verified head of the
+// audit log of the store in dir.
+func logAnchorPath(dir string) (string, error) {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(config, "durin", "log-head-"+hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+func readLogAnchor(path string) (*store.LogHead, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var head store.LogHead
+	if err := json.Unmarshal(b, &head); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return &head, nil
+}
+
+func writeLogAnchor(path string, head store.LogHead) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(b, '\n'))
+}
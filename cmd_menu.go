@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newMenuCmd() *cobra.Command {
+	var (
+		menuCmd  string
+		typeIt   bool
+		clipOpts clipOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "menu",
+		Short: "Pick an entry with dmenu, rofi or fzf and copy or type its password",
+		Long: `Pick an entry with dmenu, rofi or fzf and copy or type its password.
+
+The picker is --menu-cmd, $DURIN_MENU, or the first of rofi, dmenu and fzf
+that is installed. Entry names are offered before the store is unlocked.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if menuCmd == "" {
+				menuCmd = os.Getenv(menuEnvCmd)
+			}
+			if menuCmd == "" {
+				var err error
+				if menuCmd, err = defaultMenuCmd(); err != nil {
+					return err
+				}
+			}
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			names, err := store.ListNames(dir)
+			if err != nil {
+				return err
+			}
+			name, err := pickName(menuCmd, names)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			if typeIt {
+				return typeText(r.Password)
+			}
+			return clipEntry(name, r, &clipOpts)
+		},
+	}
+	cmd.Flags().StringVar(&menuCmd, "menu-cmd", "", "shell command that reads names on stdin and prints the chosen one")
+	cmd.Flags().BoolVar(&typeIt, "type", false, "type the password into the focused window instead of copying it")
+	addClipFlags(cmd, &clipOpts)
+	return cmd
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newMigrateCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "Move to durin from the password managers on this machine",
+		Long: `Look for other password managers on this machine and walk through
+importing each into the store, then offer to set up sync and a backup.
+
+durin migrate finds a pass store, KeePass databases (.kdbx) and Bitwarden
+and 1Password (.1pux) exports in the first levels of your home directory,
+and the profiles of Chrome, Chromium, Brave, Edge and Firefox. For each it
+asks whether to import it and under which name prefix, imports it as the
+durin import command for it would and then checks that every entry read is
+in the store. Browsers encrypt the passwords in their profiles with keys of
+their own, so for those it tells how to export them as CSV and imports the
+file; delete it afterwards.
+
+It then offers to make the store a git repository pushing to a remote, for
+durin sync, and to write a paper backup as durin export --paper does.
+
+durin migrate asks questions as it goes, so it needs a terminal.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := promptAllowed("durin migrate"); err != nil {
+				return err
+			}
+			if !isTerminal(os.Stdin.Fd()) {
+				return usageError{errors.New("durin migrate asks questions as it goes; run it on a terminal")}
+			}
+			ctx, out := cmd.Context(), cmd.OutOrStdout()
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			sources := findMigrationSources(home)
+			if len(sources) == 0 {
+				fmt.Fprintln(out, "Found no other password managers; durin import reads the exports of others.")
+			} else {
+				fmt.Fprintln(out, "Found:")
+				for _, s := range sources {
+					fmt.Fprintf(out, "  %s\n", describeSource(s))
+				}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			for _, s := range sources {
+				fmt.Fprintln(out)
+				if err := migrateSource(ctx, db, s, home, out); err != nil {
+					fmt.Fprintf(out, "Failed to import the %s: %v\n", s.Name, err)
+				}
+			}
+			fmt.Fprintln(out)
+			if err := offerPaperBackup(ctx, db, home, out); err != nil {
+				return err
+			}
+			if err := closeStore(db); err != nil {
+				return err
+			}
+			return offerSync(ctx, out)
+		},
+	}
+}
+
+func describeSource(s migrationSource) string {
+	if s.Count >= 0 {
+		return fmt.Sprintf("%s with %d entries in %s", s.Name, s.Count, s.Path)
+	}
+	return fmt.Sprintf("%s %s", s.Name, s.Path)
+}
+
+// migrateSource asks whether and how to import s into db, imports it and
+// checks the result.
+func migrateSource(ctx context.Context, db *store.DB, s migrationSource, home string, out io.Writer) error {
+	if ok, err := confirm(fmt.Sprintf("Import the %s?", describeSource(s))); err != nil || !ok {
+		return err
+	}
+	prefix, err := ask("Prefix for the names of its entries", s.Prefix)
+	if err != nil {
+		return err
+	}
+	var entries []importedEntry
+	switch s.Kind {
+	case "pass":
+		entries, err = readPassStore(ctx, s.Path, gpgDecrypt)
+	case "keepass":
+		var keyFile string
+		if keyFile, err = ask("Key file of the database, if it has one", ""); err == nil {
+			entries, err = readKeepassFile(s.Path, keyFile)
+		}
+	case "bitwarden":
+		entries, err = readBitwardenFile(s.Path)
+	case "1password":
+		entries, err = readOnePUX(s.Path)
+	case "browser":
+		entries, err = readBrowserExport(s, home, out)
+	}
+	if err != nil {
+		return err
+	}
+	if s.Count >= 0 && len(entries) != s.Count {
+		fmt.Fprintf(out, "Warning: the %s holds %d entries, but %d were read\n", s.Name, s.Count, len(entries))
+	}
+	if err := importEntries(ctx, db, entries, importOptions{prefix: prefix}, out); err != nil {
+		return err
+	}
+	var missing []string
+	for _, e := range entries {
+		if !db.Has(prefix + e.Name) {
+			missing = append(missing, prefix+e.Name)
+		}
+	}
+	fmt.Fprintf(out, "Verified: %d of %d entries are in durin\n", len(entries)-len(missing), len(entries))
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// readBrowserExport tells how to export the passwords of the browser s and
+// reads the CSV file that gives.
+func readBrowserExport(s migrationSource, home string, out io.Writer) ([]importedEntry, error) {
+	fmt.Fprintf(out, "To export its passwords, %s.\n", s.Export)
+	path, err := ask("Path of the exported CSV file", newestPasswordCSV(filepath.Join(home, "Downloads")))
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, errors.New("no CSV file given")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readBrowserCSV(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The file holds every password in the clear.
+	if ok, err := confirm(fmt.Sprintf("Delete %s once read?", path)); err != nil {
+		return nil, err
+	} else if ok {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// offerPaperBackup offers to write a paper backup of db.
+func offerPaperBackup(ctx context.Context, db *store.DB, home string, out io.Writer) error {
+	if ok, err := confirm("Write a paper backup of the store to print?"); err != nil || !ok {
+		return err
+	}
+	path, err := ask("File to write it to", filepath.Join(home, "durin-backup.html"))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writePaperBackup(ctx, db, f, nil); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Print %s and keep it safe; durin import --paper restores it.\n", path)
+	return nil
+}
+
+// offerSync offers to set up durin sync for the store unless it has it.
+func offerSync(ctx context.Context, out io.Writer) error {
+	dir, err := storeDir()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		fmt.Fprintln(out, "The store is a git repository already; durin sync exchanges changes with its remote.")
+		return nil
+	}
+	if ok, err := confirm("Sync the store with other machines through a git repository?"); err != nil || !ok {
+		return err
+	}
+	remote, err := ask("URL of an empty git repository", "")
+	if err != nil {
+		return err
+	}
+	if remote == "" {
+		return errors.New("no repository given")
+	}
+	if err := lockStore(ctx, dir); err != nil {
+		return err
+	}
+	if err := gitSetup(ctx, dir, remote, out); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Pushed the store; run durin sync to exchange changes, and git clone it into ~/.durin on other machines.")
+	return nil
+}
+
+// ask asks question on the terminal and returns the answer, or def if the
+// answer is empty.
+func ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+	line, err := readLine(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	if answer := strings.TrimSpace(string(line)); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
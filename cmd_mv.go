@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+func newMvCmd() *cobra.Command {
+	var pattern, dryRun bool
+	cmd := &cobra.Command{
+		Use:   "mv OLD NEW",
+		Short: "Rename entries",
+		Long: `Rename the entry OLD to NEW.
+
+With --pattern, OLD and NEW are patterns and every entry matching OLD is
+renamed, as in durin mv --pattern 'old-prefix/*' 'new-prefix/*'. In OLD,
+* matches any text but a slash, ** any text and ? one character but a
+slash; each wildcard of NEW is replaced by what the same wildcard of OLD
+matched. With --dry-run, the renames are listed but not made.
+
+The entries are renamed all at once, or not at all. Each is encrypted
+again, since an entry's name is authenticated along with its contents. In
+a shared vault, an entry's own ACL moves with it, while folder ACLs apply
+by the new name.`,
+		Args:              exactArgs(2),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			renames := map[string]string{args[0]: args[1]}
+			if pattern {
+				rename, err := renamePattern(args[0], args[1])
+				if err != nil {
+					return usageError{err}
+				}
+				renames = make(map[string]string)
+				for _, name := range db.List() {
+					if to, ok := rename(name); ok && to != name {
+						renames[name] = to
+					}
+				}
+				if len(renames) == 0 {
+					return fmt.Errorf("no entry matches %q", args[0])
+				}
+			}
+			if dryRun {
+				olds := make([]string, 0, len(renames))
+				for old := range renames {
+					olds = append(olds, old)
+				}
+				sort.Strings(olds)
+				for _, old := range olds {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s -> %s\n", old, renames[old])
+				}
+				return nil
+			}
+			if err := db.Rename(ctx, renames); err != nil {
+				return err
+			}
+			if len(renames) > 1 {
+				fmt.Fprintf(os.Stderr, "Renamed %d entries.\n", len(renames))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&pattern, "pattern", false, "take OLD and NEW as patterns and rename every entry matching OLD")
+	cmd.Flags().BoolVarP(&dryRun, "dry-run", "n", false, "list the renames without making them")
+	return cmd
+}
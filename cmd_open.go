@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+func newOpenCmd() *cobra.Command {
+	var opts clipOptions
+	cmd := &cobra.Command{
+		Use:   "open NAME",
+		Short: "Open an entry's URL in the browser and copy its password",
+		Long: `Open the URL of an entry in the web browser and copy its password to the
+clipboard, to be cleared again after --timeout. The browser is the one
+$BROWSER names, or the desktop's default.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			raw := r.LoginURL()
+			if raw == "" {
+				return fmt.Errorf("%s has no URL; set one with durin put --url", args[0])
+			}
+			// Only web URLs are opened, so that an entry cannot make the
+			// browser's handler run a file or another program.
+			if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s has no web URL: %q", args[0], raw)
+			}
+			if err := clipEntry(args[0], r, &opts); err != nil {
+				return err
+			}
+			return openBrowser(raw)
+		},
+	}
+	addClipFlags(cmd, &opts)
+	return cmd
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newOTPCmd() *cobra.Command {
+	var (
+		clip     bool
+		clipOpts clipOptions
+		resync   []string
+	)
+	cmd := &cobra.Command{
+		Use:   "otp NAME",
+		Short: "Print an entry's one-time password",
+		Long: `Print the current code of an entry's TOTP secret, or the next code of its
+counter-based HOTP secret, as from a hardware token; see durin put --totp
+and --hotp.
+
+For HOTP, the counter is advanced and the entry stored before the code is
+printed, so that no code is given twice. Should the other side lose track,
+e.g. after codes were made that were never used, pass the two next codes it
+accepts, or two consecutive codes from the token the secret was copied
+from, to --resync; the counter is then set past them.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			field := hotpField(r)
+			if field == "" {
+				if len(resync) > 0 {
+					return fmt.Errorf("%s has no HOTP secret to resynchronize", name)
+				}
+				uri := r.TOTPURI()
+				if uri == "" {
+					return fmt.Errorf("%s has no TOTP or HOTP secret", name)
+				}
+				if clip {
+					return clipField(name, r, "otp", &clipOpts)
+				}
+				code, err := totpCode(uri, time.Now())
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), code)
+				return nil
+			}
+			p, err := parseOTP(r.Fields[field])
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if len(resync) > 0 {
+				counter, err := p.resync(resync)
+				if err != nil {
+					return fmt.Errorf("%s: %v", name, err)
+				}
+				if r.Fields[field], err = withCounter(r.Fields[field], counter); err != nil {
+					return err
+				}
+				if err := db.Put(ctx, name, r); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Resynchronized %s; skipped %d codes.\n", name, counter-p.counter-uint64(len(resync)))
+				return nil
+			}
+			code := p.code(p.counter)
+			if r.Fields[field], err = withCounter(r.Fields[field], p.counter+1); err != nil {
+				return err
+			}
+			if err := db.Put(ctx, name, r); err != nil {
+				return fmt.Errorf("the HOTP counter of %s could not be advanced, so no code is given: %w", name, err)
+			}
+			if clip {
+				secret := secmem.NewBuffer([]byte(code))
+				defer secret.Wipe()
+				if err := copyWithTimeout(secret.Bytes(), &clipOpts); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Copied the HOTP code of %s to clipboard. Will clear in %v.\n", name, clipOpts.timeout)
+				return nil
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), code)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&clip, "clip", "c", false, "copy the code to the clipboard instead of printing it")
+	cmd.Flags().StringSliceVar(&resync, "resync", nil, "resynchronize the HOTP counter with these consecutive codes, e.g. 123456,654321")
+	addClipFlags(cmd, &clipOpts)
+	return cmd
+}
+
+// hotpField returns the field of r holding an otpauth://hotp/ URI: its
+// otpauth field, else the first in name order. It is empty if there is
+// none.
+func hotpField(r *store.Record) string {
+	const prefix = "otpauth://hotp/"
+	isHOTP := func(v string) bool {
+		return len(v) >= len(prefix) && strings.EqualFold(v[:len(prefix)], prefix)
+	}
+	if isHOTP(r.Fields[totpField]) {
+		return totpField
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for k, v := range r.Fields {
+		if isHOTP(v) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	return keys[0]
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newPolicyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Manage the password policy of an entry",
+		Long: `Manage the password policy of an entry.
+
+generate --force and rotate follow an entry's policy unless policy flags are
+given, and audit reports passwords that violate it.`,
+		Args: exactArgs(0),
+	}
+	cmd.AddCommand(newPolicySetCmd(), newPolicyShowCmd(), newPolicyClearCmd())
+	return cmd
+}
+
+func newPolicySetCmd() *cobra.Command {
+	var (
+		policy store.PasswordPolicy
+		maxAge string
+	)
+	cmd := &cobra.Command{
+		Use:               "set NAME",
+		Short:             "Attach a password policy to an entry",
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if maxAge != "" {
+				d, err := parseAge(maxAge)
+				if err != nil {
+					return usageError{err}
+				}
+				policy.MaxAgeDays = int(d.Hours() / 24)
+			}
+			if _, err := policyClasses(&policy); err != nil {
+				return usageError{err}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			r.Policy = &policy
+			return db.Put(ctx, args[0], r)
+		},
+	}
+	addPolicyFlags(cmd, &policy)
+	cmd.Flags().StringVar(&maxAge, "max-age", "", "maximum age of the password, e.g. 90d")
+	return cmd
+}
+
+func newPolicyShowCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:               "show NAME",
+		Short:             "Print the password policy of an entry",
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if r.Policy == nil {
+				return fmt.Errorf("%s has no password policy", args[0])
+			}
+			p := r.Policy
+			return writeOutput(cmd.OutOrStdout(), format, p, func(w io.Writer) error {
+				switch {
+				case p.Words > 0:
+					fmt.Fprintf(w, "passphrase of %d words separated by %q\n", p.Words, p.Separator)
+				case p.Pronounceable:
+					fmt.Fprintf(w, "pronounceable, %d characters\n", p.Length)
+				default:
+					fmt.Fprintf(w, "length: %d\n", p.Length)
+					fmt.Fprintf(w, "lowercase: %v\nuppercase: %v\ndigits: %v\nsymbols: %v\n", !p.NoLower, !p.NoUpper, !p.NoDigits, p.Symbols)
+					if p.NoAmbiguous {
+						fmt.Fprintln(w, "no ambiguous characters")
+					}
+					if p.Exclude != "" {
+						fmt.Fprintf(w, "excluded: %s\n", p.Exclude)
+					}
+				}
+				if p.MaxAgeDays > 0 {
+					fmt.Fprintf(w, "max age: %d days\n", p.MaxAgeDays)
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
+
+func newPolicyClearCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:               "clear NAME",
+		Short:             "Remove the password policy of an entry",
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			r.Policy = nil
+			return db.Put(ctx, args[0], r)
+		},
+	}
+}
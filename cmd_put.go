@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newPutCmd() *cobra.Command {
+	var (
+		r                 store.Record
+		force             bool
+		expires, template string
+		totp              totpOptions
+	)
+	cmd := &cobra.Command{
+		Use:   "put NAME",
+		Short: "Store an entry, prompting for its password",
+		Long: `Store an entry, prompting for its password.
+
+With --template, prompts instead for each field of a template defined in
+the templates section of the configuration file (see DURIN_CONFIG), such
+as a database credential's host, port, username and password, and gives
+the entry the template's kind and tags. Fields set with flags are not
+asked for again; without a terminal, the others are read from stdin one
+per line.
+
+--totp stores a TOTP secret in the otpauth field, for durin clip --field otp
+and autotype. Sites that do not use the usual settings, such as some
+company sign-ins and Steam, tell them along with the secret; give them with
+the --totp-* flags, or as the parameters of an otpauth:// URI.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			if db.Has(name) && !force {
+				return fmt.Errorf("entry %q already exists; use --force to overwrite", name)
+			}
+			now := time.Now()
+			if template != "" {
+				t, err := lookupTemplate(template)
+				if err != nil {
+					return err
+				}
+				if err := fillTemplate(&r, t, name); err != nil {
+					return err
+				}
+				if r.Password != "" {
+					r.Changed = &now
+				}
+			} else {
+				pw, err := readEntryPassword(name)
+				if err != nil {
+					return err
+				}
+				r.SetPassword(string(pw), now)
+			}
+			if err := setExpiry(&r, expires, now); err != nil {
+				return err
+			}
+			if err := setTOTP(&r, &totp, name); err != nil {
+				return err
+			}
+			if s := passwordStrength(r.Password, name, r.Username); r.Password != "" && s.weak() {
+				fmt.Fprintf(os.Stderr, "Warning: the password for %s is %s (estimated crack time: %s).\n", name, s.Label, s.CrackTime)
+				if canPrompt() || assumeYes {
+					ok, err := confirm("Store it anyway?")
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return fmt.Errorf("weak password for %s not stored", name)
+					}
+				}
+			}
+			return db.Put(ctx, name, &r)
+		},
+	}
+	cmd.Flags().StringVarP(&r.Username, "username", "u", "", "username to store with the entry")
+	cmd.Flags().StringVarP(&r.Notes, "notes", "n", "", "free-form notes to store with the entry")
+	cmd.Flags().StringVar(&r.URL, "url", "", "URL of the site the entry logs in to")
+	cmd.Flags().StringArrayVarP(&r.Tags, "tag", "t", nil, "tag to store with the entry (repeatable)")
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "overwrite an existing entry")
+	cmd.Flags().StringVar(&template, "template", "", "prompt for the fields of this template from the configuration file")
+	addExpiresFlag(cmd, &expires)
+	addTOTPFlags(cmd, &totp)
+	return cmd
+}
+
+// readEntryPassword prompts for the password of the entry called name, or
+// reads it from stdin when that is not a terminal.
+func readEntryPassword(name string) ([]byte, error) {
+	if !isTerminal(os.Stdin.Fd()) {
+		return readLine(os.Stdin)
+	}
+	return readSecret("Enter Password for " + name + ": ")
+}
+
+// addExpiresFlag registers the --expires flag on cmd.
+func addExpiresFlag(cmd *cobra.Command, expires *string) {
+	cmd.Flags().StringVar(expires, "expires", "", "date (YYYY-MM-DD) or age (e.g. 90d) after which the password should be replaced")
+}
+
+// setExpiry sets the expiry of r from the --expires flag value, if any.
+func setExpiry(r *store.Record, expires string, now time.Time) error {
+	if expires == "" {
+		return nil
+	}
+	t, err := parseExpiry(expires, now)
+	if err != nil {
+		return usageError{err}
+	}
+	r.Expires = &t
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/spf13/cobra"
+)
+
+func newRenderCmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "render TEMPLATE",
+		Short: "Render a template, substituting secrets from the store",
+		Long: `Render a template, substituting secrets from the store.
+
+TEMPLATE uses Go text/template syntax. {{ secret "NAME" }} expands to the
+password of NAME and {{ secret "NAME" "FIELD" }} to another field. The result
+is written to stdout, or atomically to --output with mode 0600.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			text, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			out, err := renderTemplate(ctx, db, filepath.Base(args[0]), string(text))
+			if err != nil {
+				return err
+			}
+			if output != "" {
+				return atomicfile.WriteFile(output, out)
+			}
+			_, err = cmd.OutOrStdout().Write(out)
+			return err
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write to this file (mode 0600) instead of stdout")
+	return cmd
+}
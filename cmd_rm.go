@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newRmCmd() *cobra.Command {
+	var regex, force bool
+	cmd := &cobra.Command{
+		Use:   "rm NAME|PATTERN...",
+		Short: "Remove entries",
+		Long: `Remove the entries named, or those matching a PATTERN: a glob such as
+'aws/*', where * does not match across a slash, or with --regex a regular
+expression such as '^old-.*'. Patterns list the entries they match and ask
+before removing them unless --force is given.`,
+		Args:              minArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			var names, patterns []string
+			for _, a := range args {
+				if regex || isGlob(a) {
+					patterns = append(patterns, a)
+				} else {
+					names = append(names, a)
+				}
+			}
+			if len(patterns) > 0 {
+				m, err := newNameMatcher(patterns, regex)
+				if err != nil {
+					return err
+				}
+				matched := m.filter(db.List())
+				if len(matched) == 0 {
+					return fmt.Errorf("no entry matches %s", strings.Join(patterns, " "))
+				}
+				if !force {
+					fmt.Fprintf(os.Stderr, "This removes %d entries:\n", len(matched))
+					for _, name := range matched {
+						fmt.Fprintf(os.Stderr, "  %s\n", name)
+					}
+					ok, err := confirm("Remove them?")
+					if err != nil {
+						return err
+					}
+					if !ok {
+						return fmt.Errorf("nothing removed")
+					}
+				}
+				for _, name := range matched {
+					if !contains(names, name) {
+						names = append(names, name)
+					}
+				}
+			}
+			for _, name := range names {
+				if err := db.Delete(ctx, name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	addRegexFlag(cmd, &regex)
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "remove the entries patterns match without asking")
+	return cmd
+}
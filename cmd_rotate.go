@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newRotateCmd() *cobra.Command {
+	var (
+		policy   store.PasswordPolicy
+		clipOpts clipOptions
+		expires  string
+	)
+	cmd := &cobra.Command{
+		Use:   "rotate NAME",
+		Short: "Replace an entry's password with a freshly generated one",
+		Long: `Replace an entry's password with a freshly generated one.
+
+The password follows the entry's policy (see durin policy) unless policy
+flags are given. The old password is kept in the entry's history and the
+new one is copied to the clipboard. Derived entries (see durin generate
+--derived) get theirs by bumping their counter instead, and keep no
+history, as their old passwords follow from the counter.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			if r.Derived != nil {
+				if policyFlagsChanged(cmd) {
+					p := policy
+					r.Policy = &p
+				}
+				r.Derived.Counter++
+				r.Password = ""
+				r.Changed = &now
+			} else {
+				pw, err := generatePassword(effectivePolicy(cmd, &policy, r))
+				if err != nil {
+					return usageError{err}
+				}
+				r.SetPassword(pw, now)
+			}
+			// An expiry set for the old password does not carry over.
+			r.Expires = nil
+			if err := setExpiry(r, expires, now); err != nil {
+				return err
+			}
+			if err := db.Put(ctx, name, r); err != nil {
+				return err
+			}
+			if err := db.Derive(r); err != nil {
+				return err
+			}
+			if err := clipEntry(name, r, &clipOpts); err != nil {
+				return fmt.Errorf("rotated %s, but could not copy the new password: %v", name, err)
+			}
+			return nil
+		},
+	}
+	addPolicyFlags(cmd, &policy)
+	addClipFlags(cmd, &clipOpts)
+	addExpiresFlag(cmd, &expires)
+	return cmd
+}
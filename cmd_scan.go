@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newScanCmd() *cobra.Command {
+	var (
+		format string
+		dotenv bool
+	)
+	cmd := &cobra.Command{
+		Use:   "scan [DIR|FILE...]",
+		Short: "Find plaintext secrets in project files",
+		Long: `Find plaintext secrets in the files under each DIR, by default the current
+directory, without opening the store. With --dotenv, the only kind of
+file scanned so far, look in .env files such as .env, .env.local and
+prod.env, but not examples such as .env.example; .git, node_modules and
+vendor directories are skipped.
+
+A value is reported if it has the shape of a well-known credential, such
+as a private key, a GitHub or AWS token or a URL with a password, or if
+its variable is named like a secret (TOKEN, PASSWORD, API_KEY...) and it
+is not a placeholder. Values are never printed. Move what is found into
+the store with durin import env --from FILE --rewrite.
+
+Exits with status 10 if anything was found, so that it can guard commits.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !dotenv {
+				return usageError{errors.New("choose what to scan for with --dotenv")}
+			}
+			if len(args) == 0 {
+				args = []string{"."}
+			}
+			var findings []dotenvFinding
+			for _, root := range args {
+				f, err := scanDotenv(root)
+				if err != nil {
+					return err
+				}
+				findings = append(findings, f...)
+			}
+			if findings == nil {
+				findings = []dotenvFinding{}
+			}
+			err := writeOutput(cmd.OutOrStdout(), format, findings, func(w io.Writer) error {
+				for _, f := range findings {
+					fmt.Fprintf(w, "%s:%d: %s (%s)\n", f.Path, f.Line, f.Key, f.Reason)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(findings) > 0 {
+				fmt.Fprintf(os.Stderr, "Found %d secrets; move them into the store with durin import env --from FILE --rewrite.\n", len(findings))
+				return exitStatusError(exitFindings)
+			}
+			return nil
+		},
+	}
+	addFormatFlag(cmd, &format)
+	cmd.Flags().BoolVar(&dotenv, "dotenv", false, "scan .env files")
+	return cmd
+}
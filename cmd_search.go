@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/citizencloud/passwordstore/internal/workpool"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newSearchCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "search QUERY...",
+		Short: "List entries matching a query",
+		Long: `List the entries matching QUERY.
+
+A bare word matches the entries whose names contain it, ignoring case.
+KEY:VALUE matches the entries whose KEY contains VALUE:
+
+  name:   the entry's name
+  user:   the username
+  url:    the URL
+  note:   the notes
+  field:  any custom field
+  tag:    a tag, which must equal VALUE
+  kind:   the kind (login, note, card or identity), which must equal VALUE
+
+Terms next to each other must all match; put OR between terms to match
+either, - before a term to exclude the entries it matches, and parentheses
+around terms to group them, as in
+
+  durin search user:alice tag:work note:"backup code"
+  durin search '(tag:work OR tag:home) -kind:note'
+  durin search -- tag:work -kind:note
+
+An argument starting with - is taken for a flag unless it follows --.
+
+Names, tags and kinds are indexed and need no decryption. Queries using
+the other keys decrypt the entries they look at.`,
+		Args: minArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			q, err := parseQuery(args)
+			if err != nil {
+				return usageError{err}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			var names []string
+			if t, ok := q.(termQuery); ok && t.key == "name" {
+				names = db.Search(t.value)
+			} else {
+				// Entries are matched on a pool of goroutines, as matching may
+				// mean decrypting them.
+				entries := db.ListEntries()
+				matched := make([]bool, len(entries))
+				err := workpool.Run(ctx, len(entries), func(ctx context.Context, i int) error {
+					e := &queryEntry{EntryInfo: entries[i]}
+					name := e.Name
+					e.load = func() (*store.Record, error) { return db.Peek(ctx, name) }
+					ok, err := q.match(e)
+					if e.record != nil {
+						e.record.Wipe()
+					}
+					if err != nil {
+						return fmt.Errorf("failed to decrypt %q: %w", name, err)
+					}
+					matched[i] = ok
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				names = []string{}
+				for i, ok := range matched {
+					if ok {
+						names = append(names, entries[i].Name)
+					}
+				}
+			}
+			return writeOutput(cmd.OutOrStdout(), format, names, func(w io.Writer) error {
+				for _, name := range names {
+					fmt.Fprintln(w, name)
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
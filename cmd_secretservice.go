@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/spf13/cobra"
+)
+
+func newSecretServiceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "secret-service",
+		Short: "Serve the freedesktop Secret Service API on the session bus",
+		Long: `Serve the freedesktop Secret Service API on the session bus.
+
+Applications using libsecret (NetworkManager, Evolution, browsers) then store
+their secrets in durin instead of gnome-keyring, which must not be running.
+Items are kept as entries under secret-service/, named after their labels.
+
+The store is unlocked when the service starts and stays locked against other
+durin commands until it exits. Clients locking the collection drop the key;
+unlocking it reads the passphrase again, so run the service with
+DURIN_PASSPHRASE_CMD or --passphrase-fd if there is no terminal.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			conn, err := dbus.ConnectSessionBus()
+			if err != nil {
+				return fmt.Errorf("failed to connect to the session bus: %v", err)
+			}
+			defer conn.Close()
+			if err := serveSecretService(ctx, conn, db); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Serving %s\n", ssBusName)
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			<-sig
+			return nil
+		},
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	var (
+		listen, certFile, keyFile string
+		ttl, lockAfter            time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve a local REST API over HTTPS",
+		Long: `Serve a local REST API over HTTPS.
+
+Clients first exchange the master passphrase for a token that expires after
+--token-ttl, then send it as "Authorization: Bearer TOKEN":
+
+  POST   /v1/token          {"passphrase": "..."} -> {"token", "expires"}
+  GET    /v1/entries        entry names
+  GET    /v1/entries/NAME   the entry, as get --format json prints it
+  PUT    /v1/entries/NAME   store the record in the body, replacing NAME
+  DELETE /v1/entries/NAME   remove NAME
+
+A token request may also give "prefixes", a list of name prefixes the
+token is limited to, "read_only": true, and a "ttl" in seconds shorter
+than --token-ttl. Instead of the passphrase, the request may carry a token
+without such limits, so that, for example, a CI job can be handed a token
+that only reads ci/:
+
+  POST /v1/token  {"prefixes": ["ci/"], "read_only": true, "ttl": 600}
+
+Entries outside a token's prefixes are left out of the list and not found;
+a read-only token gets 403 for PUT and DELETE, and limited tokens cannot
+issue others.
+
+GET /v1/shares/ID hands out a link made by durin share --link, once, and
+needs no token. Links are deleted when fetched and as they expire.
+
+Errors are replied as {"error"}. For monitoring, GET /healthz and GET
+/metrics need no token: the first replies {"status", "unlocked",
+"relock_in_seconds"}, with status 503 if the store cannot be read, and the
+second request counts, the lock state, the seconds until the server locks
+and the time of the last sync in the Prometheus text format.
+
+Without --tls-cert and --tls-key, a self-signed certificate for localhost
+is created in the store as serve.crt; clients should trust or pin it.
+
+The server drops the master key and all tokens after --lock-after without
+requests, on SIGHUP, and when systemd-logind reports a suspend or the
+session being locked; the next token request unlocks it again. The store
+stays locked against other durin commands until the server exits.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if (certFile == "") != (keyFile == "") {
+				return usageError{fmt.Errorf("--tls-cert and --tls-key must be given together")}
+			}
+			if ttl <= 0 {
+				return usageError{fmt.Errorf("--token-ttl must be positive")}
+			}
+			db, err := openStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			var cert tls.Certificate
+			if certFile != "" {
+				cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+			} else {
+				cert, err = serverCertificate(db.Dir())
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load TLS certificate: %v", err)
+			}
+			fp, err := certFingerprint(cert)
+			if err != nil {
+				return err
+			}
+			ln, err := net.Listen("tcp", listen)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Serving on https://%s (certificate SHA-256 %s)\n", ln.Addr(), fp)
+			api := newAPIServer(db, ttl, lockAfter)
+			go func() {
+				for {
+					if err := expireShareLinks(db.Dir(), time.Now()); err != nil {
+						fmt.Fprintf(cmd.ErrOrStderr(), "Warning: failed to delete expired links: %v\n", err)
+					}
+					time.Sleep(10 * time.Minute)
+				}
+			}()
+			events, stop := watchLockEvents(syscall.SIGHUP)
+			defer stop()
+			go func() {
+				for range events {
+					api.lock()
+				}
+			}()
+			srv := &http.Server{
+				Handler:           api.handler(),
+				TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			return srv.ServeTLS(ln, "", "")
+		},
+	}
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:7989", "address to listen on")
+	cmd.Flags().DurationVar(&ttl, "token-ttl", 15*time.Minute, "how long issued tokens stay valid")
+	cmd.Flags().DurationVar(&lockAfter, "lock-after", 15*time.Minute, "lock after this much inactivity (0 disables)")
+	cmd.Flags().StringVar(&certFile, "tls-cert", "", "PEM certificate to serve instead of the self-signed one")
+	cmd.Flags().StringVar(&keyFile, "tls-key", "", "PEM private key for --tls-cert")
+	return cmd
+}
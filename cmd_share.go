@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newShareCmd() *cobra.Command {
+	var (
+		expires, base string
+		link, noPin   bool
+	)
+	cmd := &cobra.Command{
+		Use:   "share [NAME]",
+		Short: "Hand one entry to a colleague, or manage shared vaults",
+		Long: `With NAME, encrypt that entry for handing to a colleague once: durin share
+writes it as a line of text, encrypted with a passphrase it makes up and
+prints to standard error. Send the two by different channels; the
+colleague adds the entry to their store with durin share open. The entry
+expires after --expires, a date or an age such as 24h or 7d, and durin
+share open refuses it after. Since anyone with the text and passphrase can
+still decrypt it, prefer --link, which saves the entry in the store for
+durin serve to hand out at the printed link once and deletes it when
+fetched or expired. Make links before starting durin serve, which keeps
+the store locked while it runs; --url is where the colleague reaches it.
+The link pins the certificate of durin serve unless --no-pin is given, as
+needed with --tls-cert. To share an entry named like a subcommand, write
+durin share -- NAME.
+
+The subcommands manage shared vaults, stores that a team opens with keys
+of their own. Each member has an identity, a key pair kept in their own
+store; durin share key prints its public key. A shared vault lists its
+members' public keys, and every entry in it is encrypted with a data key
+of its own, wrapped to each member. Use a shared vault with --vault DIR or
+DURIN_VAULT, and exchange changes through a git remote with durin --vault
+DIR sync.`,
+		Args:              maxArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Help()
+			}
+			until, err := parseExpiry(expires, time.Now())
+			if err != nil {
+				return usageError{err}
+			}
+			if !until.After(time.Now()) {
+				return usageError{fmt.Errorf("--expires %s is in the past", expires)}
+			}
+			if !link && (cmd.Flags().Changed("url") || noPin) {
+				return usageError{errors.New("--url and --no-pin only apply to --link")}
+			}
+			return shareEntry(cmd.Context(), cmd.OutOrStdout(), args[0], until, link, base, noPin)
+		},
+	}
+	cmd.Flags().StringVar(&expires, "expires", "24h", "date or age after which the entry cannot be opened")
+	cmd.Flags().BoolVar(&link, "link", false, "print a link for durin serve to hand the entry out at once")
+	cmd.Flags().StringVar(&base, "url", "https://localhost:7989", "address colleagues reach durin serve at, for --link")
+	cmd.Flags().BoolVar(&noPin, "no-pin", false, "leave the certificate fingerprint of durin serve out of the link")
+	cmd.AddCommand(
+		newShareOpenCmd(),
+		newShareKeyCmd(),
+		newShareInitCmd(),
+		newShareAddRecipientCmd(),
+		newShareRemoveRecipientCmd(),
+		newShareRecipientsCmd(),
+	)
+	return cmd
+}
+
+// shareEntry writes the entry called name for a colleague to w, or with
+// link saves it for durin serve and writes the link.
+func shareEntry(ctx context.Context, w io.Writer, name string, expires time.Time, link bool, base string, noPin bool) error {
+	db, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	r, err := db.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Wipe()
+	pw, err := generatePassphrase(shareWords, "-")
+	if err != nil {
+		return err
+	}
+	text, err := sealShare(&sharedEntry{Name: name, Created: time.Now().UTC(), Expires: expires.UTC(), Record: r}, []byte(pw))
+	if err != nil {
+		return err
+	}
+	if link {
+		var fp string
+		if !noPin {
+			cert, err := serverCertificate(db.Dir())
+			if err != nil {
+				return fmt.Errorf("failed to load the certificate of durin serve: %v", err)
+			}
+			if fp, err = certFingerprint(cert); err != nil {
+				return err
+			}
+		}
+		id, err := addShareLink(db.Dir(), text, expires)
+		if err != nil {
+			return err
+		}
+		if text, err = shareLinkURL(base, id, fp); err != nil {
+			return usageError{err}
+		}
+	}
+	fmt.Fprintln(w, text)
+	fmt.Fprintf(os.Stderr, "Passphrase: %s\nSend it separately. The entry expires on %s.\n", pw, expires.Local().Format(time.RFC1123))
+	return nil
+}
+
+func newShareOpenCmd() *cobra.Command {
+	var opts importOptions
+	cmd := &cobra.Command{
+		Use:   "open [TEXT|FILE|LINK]",
+		Short: "Add an entry a colleague shared with durin share",
+		Long: `Add an entry a colleague shared with durin share to your store under
+--prefix, asking for the passphrase they sent along. Give the text, a file
+holding it, or the link; without an argument, or with -, the text is read
+from standard input. A link can only be opened once.`,
+		Args: maxArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			text, err := readSharedText(ctx, args)
+			if err != nil {
+				return err
+			}
+			pw, err := readSecret("Enter passphrase for the shared entry: ")
+			if err != nil {
+				return err
+			}
+			e, err := openShare(text, pw, time.Now())
+			secmem.Wipe(pw)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				e.Record.Wipe()
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Opened %s, shared on %s.\n", e.Name, e.Created.Local().Format("2006-01-02"))
+			return importEntries(ctx, db, []importedEntry{{Name: e.Name, Record: e.Record}}, opts, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&opts.prefix, "prefix", "received/", "prepend this to the name of the entry")
+	cmd.Flags().BoolVarP(&opts.force, "force", "f", false, "overwrite an existing entry")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false, "show what would be added without storing anything")
+	return cmd
+}
+
+// readSharedText returns the shared entry that args of durin share open
+// name.
+func readSharedText(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 || args[0] == "-" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		return string(b), err
+	}
+	arg := args[0]
+	switch {
+	case strings.HasPrefix(arg, sharePrefix):
+		return arg, nil
+	case strings.HasPrefix(arg, "https://"):
+		return fetchShareLink(ctx, arg)
+	case strings.HasPrefix(arg, "http://"):
+		return "", usageError{errors.New("durin serve links use https")}
+	}
+	b, err := ioutil.ReadFile(arg)
+	return string(b), err
+}
+
+// openSharedVault opens the store selected with --vault, which must be a
+// shared vault.
+func openSharedVault(ctx context.Context) (*store.DB, error) {
+	db, err := openStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !db.Shared() {
+		return nil, fmt.Errorf("%s is not a shared vault; select one with --vault", db.Dir())
+	}
+	return db, nil
+}
+
+func newShareKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "key",
+		Short: "Print the public key of your identity",
+		Long: `Print the public key of your identity, creating the identity first if
+your store has none. Give it to a member of a shared vault to be added.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openOwnStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			id, err := db.Identity(true)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), id.PublicKey())
+			return nil
+		},
+	}
+}
+
+func newShareInitCmd() *cobra.Command {
+	var name string
+	cmd := &cobra.Command{
+		Use:   "init DIR",
+		Short: "Create a shared vault with you as its first member",
+		Args:  exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if name == "" {
+				u, err := user.Current()
+				if err != nil {
+					return usageError{fmt.Errorf("cannot tell your user name (%v); give one with --name", err)}
+				}
+				name = u.Username
+			}
+			db, err := openOwnStore(ctx)
+			if err != nil {
+				return err
+			}
+			id, err := db.Identity(true)
+			if err != nil {
+				return err
+			}
+			dir := args[0]
+			if err := store.CreateShared(dir, store.Recipient{Name: name, Key: id.PublicKey()}); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Initialized shared vault in %s\n", dir)
+			fmt.Fprintf(os.Stderr, "Use it with --vault %s, and add members with durin --vault %s share add-recipient NAME KEY.\n", dir, dir)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&name, "name", "", "your name in the vault (default your user name)")
+	return cmd
+}
+
+func newShareAddRecipientCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add-recipient NAME KEY",
+		Short: "Add a member to the shared vault",
+		Long: `Add a member to the shared vault, wrapping the data key of every entry to
+their public key, which they print with durin share key.`,
+		Args: exactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			r, err := store.ParseRecipient(args[0], args[1])
+			if err != nil {
+				return usageError{err}
+			}
+			db, err := openSharedVault(ctx)
+			if err != nil {
+				return err
+			}
+			skipped, err := db.AddRecipient(ctx, r)
+			if err != nil {
+				return err
+			}
+			for _, name := range skipped {
+				fmt.Fprintf(os.Stderr, "Warning: %s is not shared with you, so it was not shared with %s either\n", name, r.Name)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Added %s (%s)\n", r.Name, r.ID())
+			return nil
+		},
+	}
+}
+
+func newShareRemoveRecipientCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove-recipient NAME",
+		Short: "Remove a member from the shared vault",
+		Long: `Remove a member from the shared vault. Every entry is encrypted again with
+a new data key wrapped to the remaining members, so that keys the removed
+member kept open nothing written from now on. They may still have copied
+the secrets they could read: change those, e.g. with durin rotate.`,
+		Args: exactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openSharedVault(ctx)
+			if err != nil {
+				return err
+			}
+			skipped, err := db.RemoveRecipient(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			for _, name := range skipped {
+				fmt.Fprintf(os.Stderr, "Warning: %s is not shared with you, so it could not be encrypted again\n", name)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed %s\n", args[0])
+			fmt.Fprintf(os.Stderr, "%s may have copied the secrets in the vault; change them.\n", args[0])
+			return nil
+		},
+	}
+}
+
+// recipientInfo describes a member of a shared vault in durin share
+// recipients.
+type recipientInfo struct {
+	store.Recipient `yaml:",inline"`
+	ID              string `json:"id" yaml:"id"`
+	You             bool   `json:"you,omitempty" yaml:"you,omitempty"`
+}
+
+func newShareRecipientsCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "recipients",
+		Short: "List the members of the shared vault",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openSharedVault(ctx)
+			if err != nil {
+				return err
+			}
+			rs, err := db.Recipients()
+			if err != nil {
+				return err
+			}
+			id, err := ownIdentity(ctx)
+			if err != nil {
+				return err
+			}
+			infos := make([]recipientInfo, 0, len(rs))
+			for _, r := range rs {
+				infos = append(infos, recipientInfo{Recipient: r, ID: r.ID(), You: r.ID() == id.ID()})
+			}
+			return writeOutput(cmd.OutOrStdout(), format, infos, func(w io.Writer) error {
+				for _, r := range infos {
+					you := ""
+					if r.You {
+						you = " (you)"
+					}
+					fmt.Fprintf(w, "%s  %s%s\n", r.ID, r.Name, you)
+				}
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
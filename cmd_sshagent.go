@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	sshagent "golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+func newSSHAgentCmd() *cobra.Command {
+	var socket string
+	cmd := &cobra.Command{
+		Use:   "ssh-agent [PREFIX...]",
+		Short: "Serve the SSH keys in the store to ssh",
+		Long: `Serve the SSH keys stored with durin ssh-agent add, those under the given
+name prefixes or all of them, as an ssh-agent, so that ssh, git and the
+like sign with them without key files in ~/.ssh.
+
+The keys are decrypted once, when the agent starts, and held in memory; the
+store is then released for other durin commands. The agent listens on
+ssh-agent.sock in the store, or --socket, which only its owner can use, and
+prints the SSH_AUTH_SOCK line to evaluate in the shell. It stops, forgetting
+the keys, when it gets SIGHUP or systemd-logind reports a suspend or the
+session being locked.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if socket == "" {
+				socket = filepath.Join(db.Dir(), "ssh-agent.sock")
+			}
+			keys, err := loadSSHKeys(ctx, db, args)
+			if err != nil {
+				return err
+			}
+			if err := closeStore(db); err != nil {
+				return err
+			}
+			if len(keys) == 0 {
+				return errors.New("no SSH keys in the store; add one with durin ssh-agent add")
+			}
+			keyring := sshagent.NewKeyring()
+			for _, k := range keys {
+				if err := keyring.Add(k); err != nil {
+					return fmt.Errorf("%s: %v", k.Comment, err)
+				}
+			}
+
+			if conn, err := net.Dial("unix", socket); err == nil {
+				conn.Close()
+				return fmt.Errorf("an agent is already listening on %s", socket)
+			}
+			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			old := unix.Umask(0077)
+			ln, err := net.Listen("unix", socket)
+			unix.Umask(old)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(socket)
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			events, stop := watchLockEvents(syscall.SIGHUP)
+			defer stop()
+			go func() {
+				select {
+				case <-sig:
+				case ev := <-events:
+					fmt.Fprintf(os.Stderr, "Forgetting the SSH keys: %s.\n", ev)
+				}
+				keyring.RemoveAll()
+				ln.Close()
+			}()
+			fmt.Fprintf(cmd.OutOrStdout(), "SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK\n", socket)
+			fmt.Fprintf(os.Stderr, "Serving %d SSH keys.\n", len(keys))
+			for {
+				conn, err := ln.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				go func() {
+					defer conn.Close()
+					sshagent.ServeAgent(keyring, conn)
+				}()
+			}
+		},
+	}
+	cmd.Flags().StringVar(&socket, "socket", "", "unix socket to listen on (default ssh-agent.sock in the store)")
+	cmd.AddCommand(newSSHAgentAddCmd())
+	return cmd
+}
+
+func newSSHAgentAddCmd() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "add NAME FILE",
+		Short: "Store the SSH private key in FILE as an entry",
+		Long: `Store the SSH private key in FILE, such as ~/.ssh/id_ed25519, as the entry
+NAME of kind ssh-key, for durin ssh-agent. A key protected by a passphrase
+is decrypted with it once, as the store protects it from then on. The
+public key is kept in the entry's public_key field, for authorized_keys.
+
+FILE can be removed once the key is stored.`,
+		Args: exactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			name, file := args[0], args[1]
+			pemBytes, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			if db.Has(name) && !force {
+				return fmt.Errorf("entry %q already exists; use --force to overwrite", name)
+			}
+			r, err := sshKeyRecord(pemBytes, name, func() ([]byte, error) {
+				return readSecret("Passphrase of " + file + ": ")
+			})
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			defer r.Wipe()
+			if err := db.Put(ctx, name, r); err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), r.Fields[sshPublicKeyField])
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "overwrite an existing entry")
+	return cmd
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+func newStatsCmd() *cobra.Command {
+	var format string
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show an overview of the store",
+		Args:  exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			st, err := collectStats(ctx, db)
+			if err != nil {
+				return err
+			}
+			return writeOutput(cmd.OutOrStdout(), format, st, func(w io.Writer) error {
+				fmt.Fprintf(w, "store:       %s\n", st.Dir)
+				if st.ReadOnly != nil {
+					fmt.Fprintf(w, "status:      %s\n", readOnlyLabel(st.ReadOnly))
+				}
+				fmt.Fprintf(w, "records:     %d\n", st.Records)
+				kinds := make([]string, 0, len(st.Kinds))
+				for k := range st.Kinds {
+					kinds = append(kinds, k)
+				}
+				sort.Strings(kinds)
+				for _, k := range kinds {
+					fmt.Fprintf(w, "  %-10s %d\n", k+":", st.Kinds[k])
+				}
+				fmt.Fprintf(w, "db size:     %d bytes (%d bytes on disk in total)\n", st.DBBytes, st.DirBytes)
+				if st.Oldest != nil {
+					fmt.Fprintf(w, "oldest:      %s (%s)\n", st.Oldest.Name, st.Oldest.Changed.Format("2006-01-02"))
+					fmt.Fprintf(w, "newest:      %s (%s)\n", st.Newest.Name, st.Newest.Changed.Format("2006-01-02"))
+				}
+				if st.Undated > 0 {
+					fmt.Fprintf(w, "undated:     %d\n", st.Undated)
+				}
+				if st.LastSync != nil {
+					fmt.Fprintf(w, "last sync:   %s\n", st.LastSync.Format("2006-01-02 15:04"))
+				} else {
+					fmt.Fprintln(w, "last sync:   never")
+				}
+				fmt.Fprintf(w, "keyset keys: %d\n", st.Keys)
+				return nil
+			})
+		},
+	}
+	addFormatFlag(cmd, &format)
+	return cmd
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+func newSystemdCredCmd() *cobra.Command {
+	var (
+		field, id, withKey string
+		plain              bool
+	)
+	cmd := &cobra.Command{
+		Use:   "systemd-cred NAME",
+		Short: "Give an entry to a systemd service as a credential",
+		Long: `Print the password of the entry NAME, or --field, as a SetCredentialEncrypted=
+setting for a systemd unit, encrypted with systemd-creds to this machine's
+credential key, or --with-key, so that it can be pasted into the unit
+without the secret ever being on disk in the clear. The credential is
+called --id, by default the last part of NAME; the service reads it from
+$CREDENTIALS_DIRECTORY/ID.
+
+--plain prints the bare value instead, to pipe to systemd-creds or another
+tool yourself. See durin systemd-cred serve to hand credentials to services
+as they start instead.`,
+		Args:              exactArgs(1),
+		ValidArgsFunction: completeNames,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			name := args[0]
+			if id == "" {
+				id = path.Base(name)
+			}
+			if err := checkCredentialID(id); err != nil {
+				return usageError{err}
+			}
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			r, err := db.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			defer r.Wipe()
+			v, err := recordField(r, field)
+			if err != nil {
+				return err
+			}
+			if v == "" {
+				return fmt.Errorf("%s has no %s", name, field)
+			}
+			secret := secmem.NewBuffer([]byte(v))
+			defer secret.Wipe()
+			if plain {
+				_, err := cmd.OutOrStdout().Write(secret.Bytes())
+				return err
+			}
+			encArgs := []string{"encrypt", "--pretty", "--name=" + id}
+			if withKey != "" {
+				encArgs = append(encArgs, "--with-key="+withKey)
+			}
+			enc := exec.CommandContext(ctx, "systemd-creds", append(encArgs, "-", "-")...)
+			enc.Stdin = bytes.NewReader(secret.Bytes())
+			enc.Stdout, enc.Stderr = cmd.OutOrStdout(), os.Stderr
+			if err := enc.Run(); err != nil {
+				return fmt.Errorf("systemd-creds encrypt: %v", err)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&field, "field", "password", "give this field instead (username, notes, url or a custom field)")
+	cmd.Flags().StringVar(&id, "id", "", "name of the credential (default the last part of NAME)")
+	cmd.Flags().StringVar(&withKey, "with-key", "", "key systemd-creds encrypts with, e.g. host, tpm2 or host+tpm2")
+	cmd.Flags().BoolVar(&plain, "plain", false, "print the bare value instead of a unit setting")
+	cmd.AddCommand(newSystemdCredServeCmd())
+	return cmd
+}
+
+func newSystemdCredServeCmd() *cobra.Command {
+	var socket, prefix string
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Hand credentials to systemd services as they start",
+		Long: `Listen on --socket for systemd loading credentials with
+LoadCredential=ID:SOCKET, and give each unit the password of the entry
+PREFIX/UNIT/ID, such as systemd/nginx.service/tls-key for
+
+  [Service]
+  LoadCredential=tls-key:/run/durin-creds.sock
+
+in nginx.service. systemd tells which unit and credential it loads when it
+connects, so a unit only gets the entries under its own name; requests for
+others are refused.
+
+The entries are decrypted once, when the server starts, and held in
+memory; the store is then released for other durin commands. Restart the
+server after changing them. It stops, forgetting them, when it gets SIGHUP
+or systemd-logind reports a suspend.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if socket == "" {
+				return usageError{errors.New("no socket given; use --socket")}
+			}
+			base := strings.TrimSuffix(prefix, "/") + "/"
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			creds := make(map[string][]byte)
+			defer func() {
+				for _, v := range creds {
+					secmem.Wipe(v)
+				}
+			}()
+			for _, name := range db.ListPrefix(base) {
+				unit, id := path.Split(strings.TrimPrefix(name, base))
+				if unit == "" || strings.Count(unit, "/") != 1 || checkCredentialID(id) != nil {
+					fmt.Fprintf(os.Stderr, "Skipping %s, which is not named %sUNIT/ID.\n", name, base)
+					continue
+				}
+				r, err := db.Get(ctx, name)
+				if err != nil {
+					return err
+				}
+				v := []byte(r.Password)
+				secmem.Lock(v)
+				r.Wipe()
+				creds[unit+id] = v
+			}
+			if err := closeStore(db); err != nil {
+				return err
+			}
+			if len(creds) == 0 {
+				return fmt.Errorf("no entries under %s to hand out", base)
+			}
+
+			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// systemd connects as root; nobody else needs to.
+			old := unix.Umask(0077)
+			ln, err := net.Listen("unix", socket)
+			unix.Umask(old)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(socket)
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			events, stop := watchLockEvents(syscall.SIGHUP)
+			defer stop()
+			go func() {
+				select {
+				case <-sig:
+				case ev := <-events:
+					fmt.Fprintf(os.Stderr, "Forgetting the credentials: %s.\n", ev)
+				}
+				ln.Close()
+			}()
+			fmt.Fprintf(os.Stderr, "Serving %d credentials on %s.\n", len(creds), socket)
+			for {
+				conn, err := ln.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				unit, id, ok := credentialRequest(conn.RemoteAddr())
+				v, found := creds[unit+"/"+id]
+				switch {
+				case !ok:
+					fmt.Fprintf(os.Stderr, "Refused a connection that is not from systemd loading a credential.\n")
+				case !found:
+					fmt.Fprintf(os.Stderr, "Refused credential %s of %s: there is no %s%s/%s.\n", id, unit, base, unit, id)
+				default:
+					if _, err := io.Copy(conn, bytes.NewReader(v)); err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to hand credential %s to %s: %v\n", id, unit, err)
+					}
+				}
+				conn.Close()
+			}
+		},
+	}
+	cmd.Flags().StringVar(&socket, "socket", "", "unix socket to listen on, e.g. /run/durin-creds.sock")
+	cmd.Flags().StringVar(&prefix, "prefix", "systemd/", "name prefix of the entries to hand out")
+	return cmd
+}
+
+// credentialRequest returns the unit and credential a connection from
+// systemd asks for. systemd binds the socket it connects from to the
+// abstract address "\0RANDOM/unit/UNIT/ID".
+func credentialRequest(addr net.Addr) (unit, id string, ok bool) {
+	a, isUnix := addr.(*net.UnixAddr)
+	if !isUnix || !strings.HasPrefix(a.Name, "@") {
+		return "", "", false
+	}
+	parts := strings.Split(a.Name[1:], "/")
+	if len(parts) != 4 || parts[1] != "unit" || parts[2] == "" || checkCredentialID(parts[3]) != nil {
+		return "", "", false
+	}
+	return parts[2], parts[3], true
+}
+
+// checkCredentialID reports whether id can name a systemd credential.
+func checkCredentialID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, "/\x00") || len(id) > 255 {
+		return fmt.Errorf("%q cannot name a systemd credential", id)
+	}
+	return nil
+}
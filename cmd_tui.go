@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newTUICmd() *cobra.Command {
+	var lockAfter time.Duration
+	cmd := &cobra.Command{
+		Use:   "tui",
+		Short: "Browse and edit entries in a full-screen terminal interface",
+		Long: `Browse and edit entries in a full-screen terminal interface.
+
+The TUI locks after --lock-after without input and when systemd-logind
+reports a suspend or the session being locked. Unlocking asks for the
+passphrase again.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := openStore(ctx)
+			if err != nil {
+				return err
+			}
+			return runTUI(ctx, db, lockAfter)
+		},
+	}
+	cmd.Flags().DurationVar(&lockAfter, "lock-after", 5*time.Minute, "lock the store after this much inactivity (0 disables)")
+	return cmd
+}
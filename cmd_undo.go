@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newUndoCmd() *cobra.Command {
+	var within time.Duration
+	cmd := &cobra.Command{
+		Use:   "undo",
+		Short: "Reverse the last put, delete or rename",
+		Long: `Reverse the last change to the entries: a put, rm, mv or anything else
+writing or removing entries, made less than --within ago.
+
+Only the very last change can be undone, and only if nothing changed the
+entries it touched since, e.g. a sync. Changes to who can read the entries,
+such as adding or removing a recipient of a shared vault, cannot be
+undone, and neither can undo itself.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openStore(cmd.Context())
+			if err != nil {
+				return err
+			}
+			u, err := db.Undo(within)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Undid the %s of %s made at %s.\n", u.Op, strings.Join(u.Names, ", "), u.Time.Local().Format(time.Kitchen))
+			return nil
+		},
+	}
+	cmd.Flags().DurationVar(&within, "within", 10*time.Minute, "only undo a change made less than this long ago")
+	return cmd
+}
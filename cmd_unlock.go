@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+func newUnlockCmd() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Show who holds the store lock and remove a stale one",
+		Long: `Show which process holds the store lock.
+
+The lock is released when its holder exits, even if it crashes. It can
+outlive the process that recorded its PID when a child inherited it or the
+store is on a network file system. --force removes such a lock, but only
+if the recorded process is no longer running.`,
+		Args: exactArgs(0),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, err := storeDir()
+			if err != nil {
+				return err
+			}
+			held, pid, err := store.LockState(dir)
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			if !held {
+				fmt.Fprintln(out, "The store is not locked.")
+				return nil
+			}
+			switch {
+			case pid == 0:
+				return errors.New("the store is locked by an unknown process; cannot tell whether it is still running")
+			case processAlive(pid):
+				return fmt.Errorf("the store is locked by %s, which is still running", describeProcess(pid))
+			case !force:
+				return fmt.Errorf("the store is locked, but pid %d, which took the lock, is no longer running; remove the lock with --force", pid)
+			}
+			if err := store.RemoveLock(dir); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Removed the stale lock of pid %d.\n", pid)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "remove the lock if the process that took it is gone")
+	return cmd
+}
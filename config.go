@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configEnv names the environment variable overriding where the
+// configuration file is read from.
+const configEnv = "DURIN_CONFIG"
+
+// config is the user's configuration file, config.yaml in durin's
+// directory under the user configuration directory, e.g.
+// ~/.config/durin/config.yaml.
+type config struct {
+	// Templates are the record templates put --template fills in.
+	Templates map[string]*recordTemplate `yaml:"templates"`
+	// Offline makes --offline the default.
+	Offline bool `yaml:"offline"`
+}
+
+// configPath returns where the configuration file is.
+func configPath() (string, error) {
+	if p := os.Getenv(configEnv); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "durin", "config.yaml"), nil
+}
+
+// loadConfig reads the configuration file. Not having one is the same as
+// having an empty one.
+func loadConfig() (*config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	// Misspelt settings would otherwise be ignored without a word.
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && len(bytes.TrimSpace(b)) > 0 {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return &c, nil
+}
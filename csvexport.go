@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// Formats of durin export.
+const (
+	exportCSV  = "csv"
+	exportJSON = "json"
+)
+
+// exportPlainFields are the fields export writes without
+// --include-secrets. Every other field, such as password, notes and the
+// custom fields, may hold a secret.
+var exportPlainFields = map[string]bool{
+	"name":     true,
+	"username": true,
+	"url":      true,
+	"kind":     true,
+	"tags":     true,
+	"changed":  true,
+	"expires":  true,
+	"created":  true,
+	"modified": true,
+}
+
+// defaultExportFields are the fields export writes if --fields is not
+// given.
+const defaultExportFields = "name,username,url"
+
+// parseExportFields parses the comma separated list of fields to export,
+// refusing secret fields unless secrets says they may be included.
+func parseExportFields(list string, secrets bool) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !secrets && !exportPlainFields[f] {
+			return nil, fmt.Errorf("field %q may hold a secret; add --include-secrets to export it", f)
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to export")
+	}
+	return fields, nil
+}
+
+// exportValue returns field of the entry called name with record r as
+// text. Custom fields the entry does not have are empty.
+func exportValue(name string, r *store.Record, field string) string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	switch field {
+	case "name":
+		return name
+	case "kind":
+		return r.KindOrDefault()
+	case "tags":
+		return strings.Join(r.Tags, ",")
+	case "changed":
+		return formatTime(r.Changed)
+	case "expires":
+		return formatTime(r.Expires)
+	case "created":
+		return formatTime(r.Created)
+	case "modified":
+		return formatTime(r.Modified)
+	}
+	v, _ := recordField(r, field)
+	return v
+}
+
+// writeExport writes fields of the entries called names from db to w as
+// CSV, with a header row, or as a JSON array of objects.
+func writeExport(ctx context.Context, db *store.DB, w io.Writer, format string, fields, names []string) error {
+	var (
+		cw   *csv.Writer
+		rows []map[string]string
+	)
+	switch format {
+	case exportCSV:
+		cw = csv.NewWriter(w)
+		if err := cw.Write(fields); err != nil {
+			return err
+		}
+	case exportJSON:
+		rows = make([]map[string]string, 0, len(names))
+	default:
+		return usageError{fmt.Errorf("unknown export format %q; use csv or json", format)}
+	}
+	// The values share the records' strings, so the records are wiped
+	// once everything is written.
+	var records []*store.Record
+	defer func() {
+		for _, r := range records {
+			r.Wipe()
+		}
+	}()
+	err := db.ForEachOf(ctx, names, func(name string, r *store.Record) error {
+		records = append(records, r)
+		values := make([]string, len(fields))
+		for i, f := range fields {
+			values[i] = exportValue(name, r, f)
+		}
+		if cw != nil {
+			return cw.Write(values)
+		}
+		row := make(map[string]string, len(fields))
+		for i, f := range fields {
+			row[f] = values[i]
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cw != nil {
+		cw.Flush()
+		return cw.Error()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
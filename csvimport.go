@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// csvTable is a CSV file whose first row names its columns, as password
+// managers and browsers export them.
+type csvTable struct {
+	header []string
+	// cols maps the lower-cased column names to their indices.
+	cols map[string]int
+	rows [][]string
+}
+
+// readCSV reads a CSV file with a header row. Exports are not always
+// valid CSV, so the reader is lenient about quoting and about rows of
+// different lengths, skips a byte order mark and leaves out empty rows.
+func readCSV(r io.Reader) (*csvTable, error) {
+	br := bufio.NewReader(r)
+	// Skip the byte order mark Windows tools add.
+	if b, err := br.Peek(3); err == nil && string(b) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	cr := csv.NewReader(br)
+	cr.LazyQuotes = true
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	t := &csvTable{header: header, cols: make(map[string]int)}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if _, dup := t.cols[h]; !dup {
+			t.cols[h] = i
+		}
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) == 1 && row[0] == "" {
+			continue
+		}
+		t.rows = append(t.rows, row)
+	}
+}
+
+// withoutHeader treats the header of t as its first row, for files that
+// have none. The columns can then only be referred to by number.
+func (t *csvTable) withoutHeader() {
+	t.rows = append([][]string{t.header}, t.rows...)
+	t.header = make([]string, len(t.header))
+	t.cols = make(map[string]int)
+}
+
+// missing returns the first of cols the table does not have, or "".
+func (t *csvTable) missing(cols ...string) string {
+	for _, c := range cols {
+		if _, ok := t.cols[c]; !ok {
+			return c
+		}
+	}
+	return ""
+}
+
+// value returns the value of column col in row, or "" if there is none.
+func (t *csvTable) value(row []string, col string) string {
+	if i, ok := t.cols[col]; ok && i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+// csvTargets are the parts of an entry a generic CSV import can map
+// columns to, in the order they are asked for, with the column names that
+// suggest them. Any other target names a field.
+var csvTargets = []struct {
+	name    string
+	aliases []string
+}{
+	{"name", []string{"name", "title", "account", "site", "entry"}},
+	{"folder", []string{"folder", "group", "grouping", "category", "path"}},
+	{"username", []string{"username", "user", "login", "user name", "login name", "email"}},
+	{"password", []string{"password", "pass", "passwd", "secret"}},
+	{"url", []string{"url", "website", "web site", "uri", "login_uri", "address"}},
+	{"notes", []string{"notes", "note", "comments", "comment", "extra", "description"}},
+	{totpField, []string{"otpauth", "totp", "otp", "one-time password", "2fa"}},
+	{"tags", []string{"tags", "tag", "labels"}},
+}
+
+// csvMapping maps the targets of a generic CSV import to column indices.
+type csvMapping map[string]int
+
+// String returns m as a --map value.
+func (m csvMapping) String() string {
+	targets := make([]string, 0, len(m))
+	for target := range m {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return m[targets[i]] < m[targets[j]] })
+	parts := make([]string, len(targets))
+	for i, target := range targets {
+		parts[i] = fmt.Sprintf("%s=%d", target, m[target]+1)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseCSVMapping parses a --map value, TARGET=COLUMN pairs separated by
+// commas, where COLUMN is a column number counting from 1 or a column
+// name.
+func parseCSVMapping(t *csvTable, spec string) (csvMapping, error) {
+	m := make(csvMapping)
+	for _, pair := range strings.Split(spec, ",") {
+		target, col, ok := strings.Cut(pair, "=")
+		target, col = strings.TrimSpace(target), strings.TrimSpace(col)
+		if !ok || target == "" || col == "" {
+			return nil, fmt.Errorf("invalid mapping %q: want TARGET=COLUMN", pair)
+		}
+		i, err := t.column(col)
+		if err != nil {
+			return nil, err
+		}
+		m[strings.ToLower(target)] = i
+	}
+	return m, nil
+}
+
+// column returns the index of the column numbered or named col.
+func (t *csvTable) column(col string) (int, error) {
+	if n, err := strconv.Atoi(col); err == nil {
+		if n < 1 || n > len(t.header) {
+			return 0, fmt.Errorf("no column %d; the file has %d", n, len(t.header))
+		}
+		return n - 1, nil
+	}
+	if i, ok := t.cols[strings.ToLower(col)]; ok {
+		return i, nil
+	}
+	return 0, fmt.Errorf("no column named %q", col)
+}
+
+// guessCSVMapping maps the targets whose usual column names appear in the
+// header.
+func guessCSVMapping(t *csvTable) csvMapping {
+	m := make(csvMapping)
+	for _, target := range csvTargets {
+		for _, alias := range target.aliases {
+			if i, ok := t.cols[alias]; ok {
+				m[target.name] = i
+				break
+			}
+		}
+	}
+	return m
+}
+
+// promptCSVMapping asks which column to use for every target, offering
+// the guessed mapping as defaults, and returns the chosen mapping.
+func promptCSVMapping(t *csvTable, guess csvMapping, in io.Reader, out io.Writer) (csvMapping, error) {
+	fmt.Fprintln(out, "Columns:")
+	for i, h := range t.header {
+		if h == "" && len(t.rows) > 0 && i < len(t.rows[0]) {
+			// Without a header, show the start of the first row instead.
+			h = fmt.Sprintf("(%.20s)", t.rows[0][i])
+		}
+		fmt.Fprintf(out, "  %2d  %s\n", i+1, h)
+	}
+	fmt.Fprintln(out, "For each part of an entry, enter a column number or name, or - for none.")
+	m := make(csvMapping)
+	for _, target := range csvTargets {
+		def := "-"
+		if i, ok := guess[target.name]; ok {
+			def = strconv.Itoa(i + 1)
+		}
+		for {
+			fmt.Fprintf(out, "%s [%s]: ", target.name, def)
+			line, err := readLine(in)
+			if err != nil {
+				return nil, err
+			}
+			answer := strings.TrimSpace(string(line))
+			if answer == "" {
+				answer = def
+			}
+			if answer == "-" {
+				break
+			}
+			i, err := t.column(answer)
+			if err != nil {
+				fmt.Fprintln(out, err)
+				continue
+			}
+			m[target.name] = i
+			break
+		}
+	}
+	return m, nil
+}
+
+// readMappedCSV maps the rows of t to entries as m says. name is
+// required; folder becomes a name prefix, tags are split at commas and
+// semicolons, and targets other than those of csvTargets become fields.
+func readMappedCSV(t *csvTable, m csvMapping) ([]importedEntry, error) {
+	if _, ok := m["name"]; !ok {
+		return nil, fmt.Errorf("no column is mapped to name")
+	}
+	entries := make([]importedEntry, 0, len(t.rows))
+	taken := make(map[string]bool)
+	for _, row := range t.rows {
+		get := func(target string) string {
+			if i, ok := m[target]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		r := &store.Record{Username: get("username"), Password: get("password"), Notes: get("notes")}
+		targets := make([]string, 0, len(m))
+		for target := range m {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		for _, target := range targets {
+			v := get(target)
+			switch target {
+			case "name", "folder", "username", "password", "notes":
+			case "tags":
+				for _, tag := range strings.FieldsFunc(v, func(c rune) bool { return c == ',' || c == ';' }) {
+					if tag = strings.TrimSpace(tag); tag != "" {
+						r.Tags = append(r.Tags, tag)
+					}
+				}
+			case "url":
+				if v != "" {
+					setURL(r, v)
+				}
+			case totpField:
+				if v != "" && !strings.Contains(v, "://") {
+					v = totpURI(v, get("name"), r.Username, nil)
+				}
+				fallthrough
+			default:
+				if v != "" {
+					setField(r, target, v)
+				}
+			}
+		}
+		name := importNamePart(get("name"))
+		if folder := get("folder"); folder != "" {
+			name = folder + "/" + name
+		}
+		entries = append(entries, importedEntry{Name: uniqueName(importName(name), taken), Record: r})
+	}
+	return entries, nil
+}
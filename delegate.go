@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// delegationsFile, in the delegating store, records the sub-vaults made
+// from it and what both sides held when they last agreed. It holds names
+// and times, no secrets, and is not synced.
+const delegationsFile = "delegations"
+
+// delegation is a sub-vault made with durin delegate export.
+type delegation struct {
+	Dir     string    `json:"dir"`
+	Prefix  string    `json:"prefix"`
+	Created time.Time `json:"created"`
+	// Synced is when changes were last exchanged.
+	Synced time.Time `json:"synced"`
+	// Base holds the entries both sides had then, by name.
+	Base map[string]delegatedEntry `json:"base"`
+}
+
+// delegatedEntry is when an entry was last written on either side, as
+// EntryMeta.Modified tells, once both sides agreed on it.
+type delegatedEntry struct {
+	Parent *time.Time `json:"parent,omitempty"`
+	Sub    *time.Time `json:"sub,omitempty"`
+}
+
+func readDelegations(dir string) ([]*delegation, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, delegationsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ds []*delegation
+	if err := json.Unmarshal(b, &ds); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, delegationsFile), err)
+	}
+	return ds, nil
+}
+
+func writeDelegations(dir string, ds []*delegation) error {
+	sort.Slice(ds, func(i, j int) bool { return ds[i].Dir < ds[j].Dir })
+	b, err := json.MarshalIndent(ds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, delegationsFile), append(b, '\n'))
+}
+
+// findDelegation returns the delegation of the sub-vault in sub, an
+// absolute path, or nil.
+func findDelegation(ds []*delegation, sub string) *delegation {
+	for _, d := range ds {
+		if d.Dir == sub {
+			return d
+		}
+	}
+	return nil
+}
+
+// modifiedTimes returns when each entry of db was last written.
+func modifiedTimes(db *store.DB) map[string]*time.Time {
+	m := make(map[string]*time.Time)
+	for _, e := range db.ListEntries() {
+		m[e.Name] = e.Modified
+	}
+	return m
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// Sides of a delegation, for --prefer.
+const (
+	preferNone   = ""
+	preferParent = "parent"
+	preferSub    = "sub"
+)
+
+// copyEntry writes the entry called name from src to dst, keeping its
+// times, or deletes it from dst if src has none.
+func copyEntry(ctx context.Context, src, dst *store.DB, name string) error {
+	if !src.Has(name) {
+		return dst.Delete(ctx, name)
+	}
+	r, err := src.Peek(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Wipe()
+	detachDerived(r)
+	return dst.Restore(ctx, name, r)
+}
+
+// absorbOptions configures absorbDelegation.
+type absorbOptions struct {
+	prefer string
+	dryRun bool
+}
+
+// absorbDelegation exchanges the changes made to the entries of d since
+// they were last exchanged between parent and sub: an entry changed, added
+// or removed on one side only is changed likewise on the other. An entry
+// changed on both sides is a conflict and left alone, unless opts.prefer
+// names the side to take it from. It reports what it does to out and
+// returns the number of conflicts that remain.
+func absorbDelegation(ctx context.Context, parent, sub *store.DB, d *delegation, opts absorbOptions, out io.Writer) (int, error) {
+	pm, sm := modifiedTimes(parent), modifiedTimes(sub)
+	names := make(map[string]bool)
+	for name := range d.Base {
+		names[name] = true
+	}
+	for _, name := range parent.ListPrefix(d.Prefix) {
+		names[name] = true
+	}
+	for name := range sm {
+		if !strings.HasPrefix(name, d.Prefix) {
+			fmt.Fprintf(out, "skipped %s: outside %s\n", name, d.Prefix)
+			continue
+		}
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	conflicts := make(map[string]bool)
+	verb := func(s string) string {
+		if opts.dryRun {
+			return "would " + s
+		}
+		return s
+	}
+	for _, name := range sorted {
+		base, known := d.Base[name]
+		pt, inParent := pm[name]
+		st, inSub := sm[name]
+		parentChanged, subChanged := inParent, inSub
+		if known {
+			parentChanged = !inParent || !sameTime(pt, base.Parent)
+			subChanged = !inSub || !sameTime(st, base.Sub)
+		}
+		from, to, what := sub, parent, "your store"
+		switch {
+		case !parentChanged && !subChanged:
+			continue
+		case parentChanged && subChanged:
+			if !inParent && !inSub {
+				continue
+			}
+			switch opts.prefer {
+			case preferParent:
+				from, to, what = parent, sub, "the sub-vault"
+			case preferSub:
+			default:
+				fmt.Fprintf(out, "conflict: %s changed in both stores\n", name)
+				conflicts[name] = true
+				continue
+			}
+		case parentChanged:
+			from, to, what = parent, sub, "the sub-vault"
+		}
+		action := "update %s in %s"
+		if !from.Has(name) {
+			action = "delete %s from %s"
+		} else if !to.Has(name) {
+			action = "add %s to %s"
+		}
+		fmt.Fprintf(out, verb(action)+"\n", name, what)
+		if opts.dryRun {
+			continue
+		}
+		if err := copyEntry(ctx, from, to, name); err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if opts.dryRun {
+		return len(conflicts), nil
+	}
+
+	pm, sm = modifiedTimes(parent), modifiedTimes(sub)
+	next := make(map[string]delegatedEntry)
+	for _, name := range sorted {
+		if conflicts[name] {
+			if base, ok := d.Base[name]; ok {
+				next[name] = base
+			}
+			continue
+		}
+		pt, inParent := pm[name]
+		st, inSub := sm[name]
+		if inParent && inSub {
+			next[name] = delegatedEntry{Parent: pt, Sub: st}
+		}
+	}
+	d.Base = next
+	d.Synced = time.Now().UTC()
+	return len(conflicts), nil
+}
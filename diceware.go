@@ -0,0 +1,59 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// effLargeWordlist is EFF's large diceware list, one "roll<TAB>word" per
+// line. See https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases.
+//
+//go:embed wordlists/eff_large_wordlist.txt
+var effLargeWordlist string
+
+var (
+	effWordsOnce sync.Once
+	effWords     []string
+)
+
+func dicewareWords() []string {
+	effWordsOnce.Do(func() {
+		for _, line := range strings.Split(strings.TrimSpace(effLargeWordlist), "\n") {
+			if i := strings.IndexByte(line, '\t'); i >= 0 {
+				effWords = append(effWords, line[i+1:])
+			}
+		}
+	})
+	return effWords
+}
+
+// generatePassphrase returns n words picked uniformly from the EFF list and
+// joined with sep.
+func generatePassphrase(n int, sep string) (string, error) {
+	return pickPassphrase(n, sep, randomIndex)
+}
+
+// pickPassphrase is generatePassphrase drawing words with pick.
+func pickPassphrase(n int, sep string, pick func(n int) (int, error)) (string, error) {
+	if n <= 0 {
+		return "", fmt.Errorf("invalid word count %d", n)
+	}
+	words := dicewareWords()
+	picked := make([]string, n)
+	for i := range picked {
+		j, err := pick(len(words))
+		if err != nil {
+			return "", err
+		}
+		picked[i] = words[j]
+	}
+	return strings.Join(picked, sep), nil
+}
+
+// passphraseEntropy returns the entropy in bits of an n word passphrase.
+func passphraseEntropy(n int) float64 {
+	return float64(n) * math.Log2(float64(len(dicewareWords())))
+}
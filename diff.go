@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// Changes diff reports.
+const (
+	diffAdded    = "added"
+	diffRemoved  = "removed"
+	diffModified = "modified"
+)
+
+// entryDiff is an entry that differs between a backup and the store.
+type entryDiff struct {
+	Name   string `json:"name" yaml:"name"`
+	Change string `json:"change" yaml:"change"`
+	// Fields are the fields that differ, with the values of those that
+	// may hold secrets left out.
+	Fields []fieldDiff `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// fieldDiff is a field that differs between two versions of an entry.
+type fieldDiff struct {
+	Field  string `json:"field" yaml:"field"`
+	Old    string `json:"old,omitempty" yaml:"old,omitempty"`
+	New    string `json:"new,omitempty" yaml:"new,omitempty"`
+	Secret bool   `json:"secret,omitempty" yaml:"secret,omitempty"`
+}
+
+// flatEntries are entries as their fields' values, keyed by entry name and
+// then by the field names of durin export.
+type flatEntries map[string]map[string]string
+
+// flattenRecord returns the fields of r under the names export uses, with
+// each attachment as the SHA-256 of its contents.
+func flattenRecord(r *store.Record) map[string]string {
+	fields := make(map[string]string)
+	for _, f := range []string{"username", "password", "notes", "url", "kind", "tags", "changed", "expires"} {
+		if v := exportValue("", r, f); v != "" {
+			fields[f] = v
+		}
+	}
+	for k, v := range r.Fields {
+		if k == "url" && r.URL == "" {
+			continue
+		}
+		fields[k] = v
+	}
+	for _, a := range r.Attachments {
+		sum := sha256.Sum256(a.Data)
+		fields["attachment:"+a.Name] = hex.EncodeToString(sum[:])
+	}
+	return fields
+}
+
+// flattenStore returns the entries of db, and their records, which share
+// the values' strings and are to be wiped once done with both.
+func flattenStore(ctx context.Context, db *store.DB) (flatEntries, []*store.Record, error) {
+	entries := make(flatEntries)
+	var records []*store.Record
+	err := db.ForEach(ctx, func(name string, r *store.Record) error {
+		records = append(records, r)
+		entries[name] = flattenRecord(r)
+		return nil
+	})
+	return entries, records, err
+}
+
+// readExport reads entries written by durin export, as CSV or JSON, and
+// returns them with the fields the export holds.
+func readExport(path string) (flatEntries, []string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows []map[string]string
+	if t := bytes.TrimSpace(b); len(t) > 0 && t[0] == '[' {
+		if err := json.Unmarshal(b, &rows); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else {
+		records, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if len(records) == 0 {
+			return nil, nil, fmt.Errorf("%s is empty", path)
+		}
+		for _, rec := range records[1:] {
+			row := make(map[string]string, len(records[0]))
+			for i, f := range records[0] {
+				if i < len(rec) {
+					row[f] = rec[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	entries := make(flatEntries, len(rows))
+	columns := make(map[string]bool)
+	for _, row := range rows {
+		name, ok := row["name"]
+		if !ok || name == "" {
+			return nil, nil, errors.New(path + " is not a durin export: an entry has no name")
+		}
+		fields := make(map[string]string, len(row))
+		for k, v := range row {
+			columns[k] = true
+			if k != "name" && v != "" {
+				fields[k] = v
+			}
+		}
+		entries[name] = fields
+	}
+	delete(columns, "name")
+	var fields []string
+	for f := range columns {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return entries, fields, nil
+}
+
+// diffEntries compares the entries of a backup with those of the store. If
+// only is set, just those fields are compared, as an export holds no
+// others.
+func diffEntries(backup, current flatEntries, only []string) []entryDiff {
+	names := make(map[string]bool, len(current))
+	for name := range backup {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	diffs := []entryDiff{}
+	for _, name := range sorted {
+		old, inBackup := backup[name]
+		cur, inStore := current[name]
+		switch {
+		case !inBackup:
+			diffs = append(diffs, entryDiff{Name: name, Change: diffAdded})
+		case !inStore:
+			diffs = append(diffs, entryDiff{Name: name, Change: diffRemoved})
+		default:
+			if fields := diffFields(old, cur, only); len(fields) > 0 {
+				diffs = append(diffs, entryDiff{Name: name, Change: diffModified, Fields: fields})
+			}
+		}
+	}
+	return diffs
+}
+
+func diffFields(old, cur map[string]string, only []string) []fieldDiff {
+	keys := only
+	if keys == nil {
+		seen := make(map[string]bool)
+		for k := range old {
+			seen[k] = true
+		}
+		for k := range cur {
+			seen[k] = true
+		}
+		for k := range seen {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	}
+	var diffs []fieldDiff
+	for _, k := range keys {
+		if old[k] == cur[k] {
+			continue
+		}
+		d := fieldDiff{Field: k, Secret: !exportPlainFields[k]}
+		if !d.Secret {
+			d.Old, d.New = old[k], cur[k]
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// String describes the change to the field, without secret values.
+func (d fieldDiff) String() string {
+	switch {
+	case d.Secret:
+		return d.Field + ": changed"
+	case d.Old == "":
+		return fmt.Sprintf("%s: set to %s", d.Field, d.New)
+	case d.New == "":
+		return fmt.Sprintf("%s: %s removed", d.Field, d.Old)
+	}
+	return fmt.Sprintf("%s: %s -> %s", d.Field, d.Old, d.New)
+}
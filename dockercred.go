@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// dockerHelperName is the executable name docker looks for when
+// credsStore is set to "durin".
+const dockerHelperName = "docker-credential-durin"
+
+// dockerPrefix is the prefix of entries holding docker credentials.
+const dockerPrefix = "docker/"
+
+// dockerServerField is the custom field recording the exact server URL,
+// which cannot be recovered from the entry name.
+const dockerServerField = "docker_server_url"
+
+// errDockerNotFound is the message docker recognizes as a missing
+// credential.
+var errDockerNotFound = errors.New("credentials not found in native keychain")
+
+// dockerCredentials is the JSON payload of the docker credential helper
+// protocol.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// dockerEntryName returns the entry holding credentials for serverURL, e.g.
+// docker/index.docker.io/v1 for https://index.docker.io/v1/.
+func dockerEntryName(serverURL string) string {
+	s := serverURL
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	return dockerPrefix + strings.Trim(s, "/")
+}
+
+func readServerURL(in io.Reader) (string, error) {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return "", err
+	}
+	url := strings.TrimSpace(string(b))
+	if url == "" {
+		return "", errors.New("no server URL given")
+	}
+	return url, nil
+}
+
+func dockerStore(ctx context.Context, db *store.DB, in io.Reader) error {
+	var c dockerCredentials
+	if err := json.NewDecoder(in).Decode(&c); err != nil {
+		return err
+	}
+	if c.ServerURL == "" {
+		return errors.New("no server URL given")
+	}
+	name := dockerEntryName(c.ServerURL)
+	r := &store.Record{}
+	if db.Has(name) {
+		var err error
+		if r, err = db.Get(ctx, name); err != nil {
+			return err
+		}
+	}
+	r.Username = c.Username
+	r.SetPassword(c.Secret, time.Now())
+	if r.Fields == nil {
+		r.Fields = make(map[string]string)
+	}
+	r.Fields[dockerServerField] = c.ServerURL
+	return db.Put(ctx, name, r)
+}
+
+func dockerGet(ctx context.Context, db *store.DB, in io.Reader, out io.Writer) error {
+	url, err := readServerURL(in)
+	if err != nil {
+		return err
+	}
+	name := dockerEntryName(url)
+	if !db.Has(name) {
+		return errDockerNotFound
+	}
+	r, err := db.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Wipe()
+	return json.NewEncoder(out).Encode(dockerCredentials{ServerURL: url, Username: r.Username, Secret: r.Password})
+}
+
+func dockerErase(ctx context.Context, db *store.DB, in io.Reader) error {
+	url, err := readServerURL(in)
+	if err != nil {
+		return err
+	}
+	name := dockerEntryName(url)
+	if !db.Has(name) {
+		return errDockerNotFound
+	}
+	return db.Delete(ctx, name)
+}
+
+// dockerList prints a JSON object mapping server URLs to usernames.
+func dockerList(ctx context.Context, db *store.DB, out io.Writer) error {
+	list := make(map[string]string)
+	for _, name := range db.ListPrefix(dockerPrefix) {
+		r, err := db.Get(ctx, name)
+		if err != nil {
+			return err
+		}
+		url := r.Fields[dockerServerField]
+		if url == "" {
+			url = "https://" + strings.TrimPrefix(name, dockerPrefix)
+		}
+		list[url] = r.Username
+	}
+	return json.NewEncoder(out).Encode(list)
+}
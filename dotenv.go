@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// dotenvVar is an assignment in a .env file.
+type dotenvVar struct {
+	// Line is the number of the line it is on, from 1.
+	Line       int
+	Key, Value string
+}
+
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// parseDotenv returns the assignments in a .env file, KEY=VALUE lines
+// optionally starting with export. Values may be quoted: single quotes keep
+// everything, double quotes allow \n, \" and \\ escapes, and unquoted values
+// end at a " #" comment. Values spanning several lines are not supported;
+// their first line is returned as it is.
+func parseDotenv(b []byte) []dotenvVar {
+	var vars []dotenvVar
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !dotenvKey.MatchString(key) {
+			continue
+		}
+		vars = append(vars, dotenvVar{Line: n, Key: key, Value: dotenvValue(strings.TrimSpace(value))})
+	}
+	return vars
+}
+
+func dotenvValue(v string) string {
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		return v[1 : len(v)-1]
+	}
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		return strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1])
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v
+}
+
+// secretValues are the shapes of well-known credentials, by what they are.
+var secretValues = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`), "private key"},
+	{regexp.MustCompile(`^(AKIA|ASIA)[0-9A-Z]{16}$`), "AWS access key"},
+	{regexp.MustCompile(`^(gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{60,})$`), "GitHub token"},
+	{regexp.MustCompile(`^glpat-[A-Za-z0-9_-]{20}$`), "GitLab token"},
+	{regexp.MustCompile(`^xox[abprs]-[A-Za-z0-9-]{10,}$`), "Slack token"},
+	{regexp.MustCompile(`^[rs]k_live_[A-Za-z0-9]{20,}$`), "Stripe key"},
+	{regexp.MustCompile(`^npm_[A-Za-z0-9]{36}$`), "npm token"},
+	{regexp.MustCompile(`^eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+$`), "JSON web token"},
+	{regexp.MustCompile(`^[a-z][a-z0-9+.-]*://[^/:@\s]*:[^/@\s]+@`), "password in URL"},
+}
+
+// secretKey matches the names of variables that usually hold secrets.
+var secretKey = regexp.MustCompile(`(?i)(SECRET|TOKEN|PASSWORD|PASSWD|(^|_)PASS($|_)|(^|_)PWD($|_)|API_?KEY|PRIVATE_?KEY|ACCESS_?KEY|CREDENTIAL|(^|_)AUTH($|_)|SIGNING_?KEY|ENCRYPTION_?KEY)`)
+
+// dotenvPlaceholder matches values left to be filled in, as in
+// .env.example files, and those that are not secret whatever the name.
+var dotenvPlaceholder = regexp.MustCompile(`(?i)^(|changeme|change_me|change-me|secret|password|x+|\*+|<.*>|\$\{.*\}|\$[A-Z_]+|your[-_ ].*|todo|none|null|true|false|[0-9]+|example.*)$`)
+
+// secretReason tells why the value of the variable key looks like a
+// secret, or returns "" if it does not.
+func secretReason(key, value string) string {
+	if dotenvPlaceholder.MatchString(value) {
+		return ""
+	}
+	for _, s := range secretValues {
+		if s.re.MatchString(value) {
+			return s.reason
+		}
+	}
+	if len(value) >= 6 && secretKey.MatchString(key) {
+		return "named like a secret"
+	}
+	return ""
+}
+
+// dotenvFinding is a secret found in a .env file; its value is left out.
+type dotenvFinding struct {
+	Path   string `json:"path" yaml:"path"`
+	Line   int    `json:"line" yaml:"line"`
+	Key    string `json:"key" yaml:"key"`
+	Reason string `json:"reason" yaml:"reason"`
+}
+
+// dotenvSkipDirs are not descended into by scanDotenv: they hold other
+// people's code, or nothing of the project's own.
+var dotenvSkipDirs = map[string]bool{".git": true, ".hg": true, ".svn": true, "node_modules": true, "vendor": true, ".venv": true, "venv": true, "__pycache__": true}
+
+// isDotenv reports whether name is that of a .env file with real values:
+// .env, .env.local, production.env and the like, but not the examples
+// meant to be committed.
+func isDotenv(name string) bool {
+	if name != ".env" && !strings.HasPrefix(name, ".env.") && !strings.HasSuffix(name, ".env") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".example", ".sample", ".template", ".dist", ".tpl":
+		return false
+	}
+	return true
+}
+
+// scanDotenv returns the secrets in the .env files under root, which may
+// also be a .env file itself.
+func scanDotenv(root string) ([]dotenvFinding, error) {
+	var findings []dotenvFinding
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && dotenvSkipDirs[d.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path != root && !isDotenv(d.Name()) || !d.Type().IsRegular() {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, v := range parseDotenv(b) {
+			if reason := secretReason(v.Key, v.Value); reason != "" {
+				findings = append(findings, dotenvFinding{Path: path, Line: v.Line, Key: v.Key, Reason: reason})
+			}
+		}
+		return nil
+	})
+	return findings, err
+}
+
+// readDotenv returns the variables of the .env file at path as entries
+// named after them, only those that look like secrets unless all is set.
+func readDotenv(path string, all bool) ([]importedEntry, []dotenvVar, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		entries []importedEntry
+		vars    []dotenvVar
+	)
+	for _, v := range parseDotenv(b) {
+		if v.Value == "" || !all && secretReason(v.Key, v.Value) == "" {
+			continue
+		}
+		// The record gets a copy, as importing wipes it.
+		entries = append(entries, importedEntry{Name: v.Key, Record: &store.Record{Password: string([]byte(v.Value))}})
+		vars = append(vars, v)
+	}
+	return entries, vars, nil
+}
+
+// rewriteDotenv comments out the lines of vars in the .env file at path
+// whose values are now in db under prefix, so that they come from durin
+// exec PREFIX --bare instead. Variables whose entries hold something else,
+// such as those skipped by the import, and those durin exec would name
+// differently are left as they are. It returns how many lines it changed.
+func rewriteDotenv(ctx context.Context, db *store.DB, path, prefix string, vars []dotenvVar) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	n := 0
+	for _, v := range vars {
+		if envName(v.Key) != v.Key {
+			continue
+		}
+		r, err := db.Peek(ctx, prefix+v.Key)
+		if err != nil {
+			return 0, err
+		}
+		same := r.Password == v.Value
+		r.Wipe()
+		if !same {
+			continue
+		}
+		lines[v.Line-1] = fmt.Sprintf("# %s is in durin as %s\n", v.Key, prefix+v.Key)
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	header := fmt.Sprintf("# Secrets are kept in durin; run with: durin exec %s --bare -- COMMAND\n", prefix)
+	if len(lines) == 0 || lines[0] != header {
+		lines = append([]string{header}, lines...)
+	}
+	return n, atomicfile.WriteFile(path, []byte(strings.Join(lines, "")))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// Reasons entries are reported as duplicates.
+const (
+	duplicateIdentical = "identical"
+	duplicateSameLogin = "same login"
+)
+
+// duplicateGroup is a set of entries that look like copies of one another:
+// identical if their usernames, passwords, URLs, notes and fields all
+// match, or the same login if they share a username and the host of their
+// URL.
+type duplicateGroup struct {
+	Reason string   `json:"reason" yaml:"reason"`
+	Names  []string `json:"names" yaml:"names"`
+}
+
+// loginKey returns what entries for the same login have in common: the
+// username, ignoring case, and the host of the URL without any www.
+// prefix. It is empty if r lacks either.
+func loginKey(r *store.Record) string {
+	raw := r.LoginURL()
+	if r.Username == "" || raw == "" {
+		return ""
+	}
+	host := raw
+	if u, err := url.Parse(raw); err == nil && u.Host != "" {
+		host = u.Hostname()
+	} else if u, err := url.Parse("//" + raw); err == nil && u.Host != "" {
+		// Imports often drop the scheme.
+		host = u.Hostname()
+	}
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	return strings.ToLower(r.Username) + "\x00" + host
+}
+
+// contentKey returns the contents two identical entries share, each part
+// ending in a NUL so that no two records give the same key.
+func contentKey(r *store.Record) []byte {
+	var b strings.Builder
+	for _, s := range []string{r.Username, r.Password, r.LoginURL(), r.Notes} {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	for _, k := range sortedKeys(r.Fields) {
+		if k == "url" && r.URL == "" {
+			continue
+		}
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(r.Fields[k])
+		b.WriteByte(0)
+	}
+	return []byte(b.String())
+}
+
+// findDuplicates returns the groups of entries that look like copies of
+// one another, ordered by their first name. Like findReused, it compares
+// contents only through an HMAC with a key that lives for the call.
+func findDuplicates(ctx context.Context, db *store.DB) ([]duplicateGroup, error) {
+	key := random.GetRandomBytes(32)
+	digest := func(b []byte) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(b)
+		return string(mac.Sum(nil))
+	}
+	var (
+		byContent = make(map[string][]string)
+		byLogin   = make(map[string][]string)
+		content   = make(map[string]string)
+	)
+	err := db.ForEach(ctx, func(name string, r *store.Record) error {
+		defer r.Wipe()
+		d := digest(contentKey(r))
+		byContent[d] = append(byContent[d], name)
+		content[name] = d
+		if k := loginKey(r); k != "" {
+			d := digest([]byte(k))
+			byLogin[d] = append(byLogin[d], name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []duplicateGroup{}
+	grouped := make(map[string]bool)
+	for _, names := range byLogin {
+		if len(names) < 2 {
+			continue
+		}
+		reason := duplicateIdentical
+		for _, n := range names[1:] {
+			if content[n] != content[names[0]] {
+				reason = duplicateSameLogin
+			}
+		}
+		for _, n := range names {
+			grouped[n] = true
+		}
+		groups = append(groups, duplicateGroup{Reason: reason, Names: names})
+	}
+	for _, names := range byContent {
+		if len(names) < 2 || grouped[names[0]] {
+			continue
+		}
+		groups = append(groups, duplicateGroup{Reason: duplicateIdentical, Names: names})
+	}
+	for _, g := range groups {
+		sort.Strings(g.Names)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Names[0] < groups[j].Names[0] })
+	return groups, nil
+}
+
+// mergeRecords folds from into into: the password history of both, with
+// from's password if it differs, ordered by when each was retired; the
+// username, URL and notes into lacks; fields, tags and attachments into
+// does not have, keeping differing values of the same field, and a
+// differing URL, under a numbered key; and the earlier creation time.
+func mergeRecords(into, from *store.Record) {
+	history := append(append([]store.HistoryEntry(nil), into.History...), from.History...)
+	if from.Password != "" && from.Password != into.Password {
+		retired := from.Changed
+		if retired == nil {
+			retired = into.Changed
+		}
+		h := store.HistoryEntry{Password: from.Password}
+		if retired != nil {
+			h.Retired = *retired
+		}
+		history = append(history, h)
+	}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Retired.Before(history[j].Retired) })
+	into.History = history[:0]
+	seen := map[string]bool{into.Password: true}
+	for _, h := range history {
+		if !seen[h.Password] {
+			seen[h.Password] = true
+			into.History = append(into.History, h)
+		}
+	}
+
+	if into.Username == "" {
+		into.Username = from.Username
+	}
+	switch {
+	case into.URL == "":
+		into.URL = from.URL
+	case from.URL != "" && from.URL != into.URL:
+		setField(into, "url", from.URL)
+	}
+	switch {
+	case into.Notes == "":
+		into.Notes = from.Notes
+	case from.Notes != "" && from.Notes != into.Notes:
+		into.Notes += "\n\n" + from.Notes
+	}
+	for _, k := range sortedKeys(from.Fields) {
+		v := from.Fields[k]
+		if cur, ok := into.Fields[k]; ok && cur == v {
+			continue
+		}
+		setField(into, k, v)
+	}
+	for _, t := range from.Tags {
+		if !contains(into.Tags, t) {
+			into.Tags = append(into.Tags, t)
+		}
+	}
+	for _, a := range from.Attachments {
+		dup := false
+		for _, b := range into.Attachments {
+			dup = dup || a.Name == b.Name
+		}
+		if !dup {
+			into.Attachments = append(into.Attachments, a)
+		}
+	}
+	if from.Created != nil && (into.Created == nil || from.Created.Before(*into.Created)) {
+		into.Created = from.Created
+	}
+}
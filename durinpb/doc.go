@@ -0,0 +1,5 @@
+// Package durinpb holds the protocol buffer definitions of durin's gRPC API.
+// Use package client to connect to a running "durin grpc".
+package durinpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative store.proto
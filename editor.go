@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+)
+
+// plaintextDir returns where to keep the temporary files editors are given
+// plaintext in: the per-user runtime directory or /dev/shm, which are kept
+// in RAM, if there is one. ramBacked is false if the files will be written
+// to disk instead.
+//
+// O_TMPFILE is of no use here: editors reopen files and save them by
+// renaming a new one over them, which needs a name in the file system.
+func plaintextDir() (dir string, ramBacked bool) {
+	candidates := []string{os.Getenv("XDG_RUNTIME_DIR")}
+	if runtime.GOOS == "linux" {
+		candidates = append(candidates, "/dev/shm")
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if info, err := os.Stat(c); err == nil && info.IsDir() {
+			return c, true
+		}
+	}
+	return os.TempDir(), false
+}
+
+// editorCmd returns the user's editor, from $VISUAL or $EDITOR, and
+// arguments keeping it from writing copies of the file it edits outside
+// of the file's directory, where it knows how to.
+func editorCmd() (editor string, args []string) {
+	editor = os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	switch filepath.Base(strings.Fields(editor)[0]) {
+	case "vi", "vim", "nvim", "gvim":
+		// No swap file, viminfo, backups or undo file, which vim may keep
+		// in the user's home directory.
+		args = []string{"-n", "-i", "NONE", "-c", "setlocal nobackup nowritebackup noundofile"}
+	case "emacs", "emacsclient":
+		args = []string{"--eval", "(setq make-backup-files nil auto-save-default nil)"}
+	}
+	return editor, args
+}
+
+// editPlaintext lets the user edit content, a secret called name, and
+// returns what they saved; the caller should wipe it. The file lives in a
+// directory of its own, private to the user and in RAM where possible.
+// Afterwards every file in that directory, including any swap or backup
+// files the editor left, is overwritten and removed.
+func editPlaintext(name string, content []byte) (edited []byte, err error) {
+	if err := promptAllowed("editing " + name); err != nil {
+		return nil, err
+	}
+	parent, ramBacked := plaintextDir()
+	if !ramBacked {
+		fmt.Fprintf(os.Stderr, "Warning: no RAM-backed directory found; %s will be written to %s while it is edited.\n", name, parent)
+	}
+	dir, err := ioutil.TempDir(parent, "durin-edit-")
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, strings.ReplaceAll(name, "/", "-")+".yaml")
+	defer func() {
+		if serr := shredDir(dir, path); err == nil {
+			err = serr
+		}
+		if err != nil {
+			// Callers do not wipe what comes with an error.
+			secmem.Wipe(edited)
+			edited = nil
+		}
+	}()
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return nil, err
+	}
+	editor, args := editorCmd()
+	cmd := exec.Command("/bin/sh", append([]string{"-c", editor + ` "$@"`, "sh"}, append(args, path)...)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s: %v", editor, err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, fmt.Errorf("the edited file is gone: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("the editor replaced %s with something other than a file", path)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the editor made %s readable by others (mode %v).\n", path, info.Mode().Perm())
+	}
+	return ioutil.ReadFile(path)
+}
+
+// shredDir overwrites the files in dir with zeros and removes dir, noting
+// any other than edited the editor left. Blocks the file system moved
+// elsewhere, as copy-on-write ones do, may survive on disk, which is why
+// plaintextDir prefers RAM.
+func shredDir(dir, edited string) error {
+	var first error
+	note := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			note(err)
+			return nil
+		}
+		if path == dir || info.IsDir() {
+			return nil
+		}
+		if path != edited {
+			fmt.Fprintf(os.Stderr, "Removing %s, which the editor left behind.\n", info.Name())
+		}
+		if info.Mode().IsRegular() {
+			note(overwriteFile(path, info.Size()))
+		}
+		return nil
+	})
+	note(err)
+	note(os.RemoveAll(dir))
+	return first
+}
+
+// overwriteFile overwrites the first size bytes of the file at path with
+// zeros and flushes them to storage.
+func overwriteFile(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 32*1024)
+	for left := size; left > 0; {
+		n := int64(len(zeros))
+		if left < n {
+			n = left
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			f.Close()
+			return err
+		}
+		left -= n
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/subtle/random"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// An emergency bundle gives a trusted contact the entries under some
+// prefixes, should its owner no longer be able to. The entries are
+// encrypted with a key made of two shares: one is encrypted to the
+// contact's public key, the other hidden behind a time lock and encrypted
+// to the owner's identity as well. So the contact can open the bundle only
+// with their own identity and either days of computing or a release code
+// from the owner, and nobody who steals the bundle can open it at all.
+type emergencyBundle struct {
+	Version int    `json:"version"`
+	Owner   string `json:"owner"`
+	// OwnerID is the fingerprint of the identity OwnerShare is encrypted
+	// to.
+	OwnerID  string          `json:"owner_id"`
+	Contact  store.Recipient `json:"contact"`
+	Prefixes []string        `json:"prefixes,omitempty"`
+	Delay    string          `json:"delay"`
+	Created  time.Time       `json:"created"`
+	Entries  int             `json:"entries"`
+
+	ContactShare []byte    `json:"contact_share"`
+	OwnerShare   []byte    `json:"owner_share"`
+	TimeLock     *timeLock `json:"time_lock"`
+	// Data is the nonce and ciphertext of the packed entries.
+	Data []byte `json:"data"`
+}
+
+const emergencyVersion = 1
+
+var (
+	emergencyShareAD = []byte("durin emergency share")
+	emergencyDataAD  = []byte("durin emergency bundle")
+	releaseEncoding  = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// emergencyKey returns the key the entries are encrypted with from its
+// shares.
+func emergencyKey(contactShare, lockedShare []byte) []byte {
+	h := sha256.New()
+	h.Write(emergencyDataAD)
+	h.Write(contactShare)
+	h.Write(lockedShare)
+	return h.Sum(nil)
+}
+
+// sealEmergency fills b, whose Owner, Contact, Prefixes and Delay are set,
+// with the entries called names of db, encrypted anew. owner is the
+// identity that can release the bundle.
+func sealEmergency(ctx context.Context, b *emergencyBundle, db *store.DB, names []string, owner *store.Identity, delay time.Duration) error {
+	self, err := store.ParseRecipient(b.Owner, owner.PublicKey())
+	if err != nil {
+		return err
+	}
+	z, err := packEntries(ctx, db, names)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(z)
+
+	contactShare := random.GetRandomBytes(32)
+	defer secmem.Wipe(contactShare)
+	lockedShare := random.GetRandomBytes(32)
+	defer secmem.Wipe(lockedShare)
+	key := emergencyKey(contactShare, lockedShare)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := random.GetRandomBytes(chacha20poly1305.NonceSizeX)
+
+	if b.ContactShare, err = b.Contact.Encrypt(contactShare, emergencyShareAD); err != nil {
+		return err
+	}
+	if b.OwnerShare, err = self.Encrypt(lockedShare, emergencyShareAD); err != nil {
+		return err
+	}
+	if b.TimeLock, err = lockSecret(lockedShare, delay); err != nil {
+		return err
+	}
+	b.Version, b.OwnerID = emergencyVersion, owner.ID()
+	b.Created, b.Entries = time.Now().UTC(), len(names)
+	b.Data = aead.Seal(nonce, nonce, z, emergencyDataAD)
+	return nil
+}
+
+// readEmergency reads the bundle in file.
+func readEmergency(file string) (*emergencyBundle, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var b emergencyBundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s is not an emergency bundle: %v", file, err)
+	}
+	if b.Version != emergencyVersion || b.TimeLock == nil {
+		return nil, fmt.Errorf("%s is not an emergency bundle, or one from a newer version", file)
+	}
+	return &b, nil
+}
+
+// writeEmergency writes b to file.
+func writeEmergency(file string, b *emergencyBundle) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(file, append(data, '\n'))
+}
+
+// releaseCode returns the code that lets the contact open b without
+// solving its time lock. Only the owner's identity can tell it.
+func releaseCode(b *emergencyBundle, owner *store.Identity) (string, error) {
+	if owner.ID() != b.OwnerID {
+		return "", fmt.Errorf("the bundle was made by %s with another identity than yours", b.Owner)
+	}
+	share, err := owner.Decrypt(b.OwnerShare, emergencyShareAD)
+	if err != nil {
+		return "", fmt.Errorf("%w: the bundle's release share cannot be decrypted", store.ErrCorrupt)
+	}
+	defer secmem.Wipe(share)
+	code := releaseEncoding.EncodeToString(share)
+	var groups []string
+	for len(code) > 4 {
+		groups = append(groups, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(groups, code), "-"), nil
+}
+
+// parseReleaseCode returns the share a release code holds.
+func parseReleaseCode(code string) ([]byte, error) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	share, err := releaseEncoding.DecodeString(code)
+	if err != nil || len(share) != 32 {
+		return nil, errors.New("malformed release code")
+	}
+	return share, nil
+}
+
+// openEmergency decrypts the entries of b with the contact's identity id
+// and lockedShare, from the time lock or the release code.
+func openEmergency(b *emergencyBundle, id *store.Identity, lockedShare []byte) (*entryBackup, error) {
+	if id.ID() != b.Contact.ID() {
+		return nil, fmt.Errorf("the bundle is for %s, not for your identity", b.Contact.Name)
+	}
+	contactShare, err := id.Decrypt(b.ContactShare, emergencyShareAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the bundle's share for you cannot be decrypted", store.ErrCorrupt)
+	}
+	defer secmem.Wipe(contactShare)
+	key := emergencyKey(contactShare, lockedShare)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Data) < chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("%w: the bundle holds no entries", store.ErrCorrupt)
+	}
+	nonce, c := b.Data[:chacha20poly1305.NonceSizeX], b.Data[chacha20poly1305.NonceSizeX:]
+	z, err := aead.Open(nil, nonce, c, emergencyDataAD)
+	if err != nil {
+		return nil, errors.New("the release code does not open the bundle, or the bundle is damaged")
+	}
+	defer secmem.Wipe(z)
+	backup, err := unpackEntries(z)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the bundle's entries: %v", store.ErrCorrupt, err)
+	}
+	return backup, nil
+}
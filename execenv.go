@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// envName turns an entry name such as "aws/prod-key" into an environment
+// variable name such as "AWS_PROD_KEY".
+func envName(name string) string {
+	s := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return unicode.ToUpper(r)
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Trim(name, "/"))
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return s
+}
+
+// selectEntries returns the entries named by arg: every entry under it if
+// it ends in "/", or just arg otherwise. Each is paired with the part of
+// its name used to derive variable names.
+func selectEntries(db *store.DB, arg string) (map[string]string, error) {
+	out := make(map[string]string)
+	if !strings.HasSuffix(arg, "/") {
+		if !db.Has(arg) {
+			return nil, fmt.Errorf("password %q %w", arg, store.ErrNotFound)
+		}
+		base := arg
+		if i := strings.LastIndexByte(arg, '/'); i >= 0 {
+			base = arg[i+1:]
+		}
+		out[arg] = base
+		return out, nil
+	}
+	for _, name := range db.ListPrefix(arg) {
+		out[name] = strings.TrimPrefix(name, arg)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no entries under %q", arg)
+	}
+	return out, nil
+}
+
+// secretEnv decrypts the entries selected by arg and returns them as
+// VAR=value pairs. Each entry contributes BASE_USERNAME and BASE_PASSWORD,
+// or just BASE set to the password when bare is set.
+func secretEnv(ctx context.Context, db *store.DB, arg string, bare bool) ([]string, error) {
+	entries, err := selectEntries(db, arg)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	set := func(name, v string) error {
+		if name == "" || v == "" {
+			return nil
+		}
+		if _, dup := vars[name]; dup {
+			return fmt.Errorf("more than one entry maps to $%s", name)
+		}
+		vars[name] = v
+		return nil
+	}
+	for name, base := range entries {
+		r, err := db.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		base = envName(base)
+		if bare {
+			err = set(base, r.Password)
+		} else if err = set(base+"_USERNAME", r.Username); err == nil {
+			err = set(base+"_PASSWORD", r.Password)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env, nil
+}
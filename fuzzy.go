@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// fuzzyMatch reports whether the runes of pattern appear in s in order,
+// ignoring case. The score is the length of the span covered by the leftmost
+// match, so tighter matches score lower.
+func fuzzyMatch(pattern, s string) (score int, ok bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	p := []rune(strings.ToLower(pattern))
+	start, i := -1, 0
+	for j, r := range []rune(s) {
+		if unicode.ToLower(r) != p[i] {
+			continue
+		}
+		if start < 0 {
+			start = j
+		}
+		i++
+		if i == len(p) {
+			return j - start + 1, true
+		}
+	}
+	return 0, false
+}
+
+// fuzzyFilter returns the names matching pattern, best matches first.
+func fuzzyFilter(pattern string, names []string) []string {
+	type match struct {
+		name  string
+		score int
+	}
+	var matches []match
+	for _, name := range names {
+		if score, ok := fuzzyMatch(pattern, name); ok {
+			matches = append(matches, match{name, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].score < matches[j].score })
+	out := make([]string, len(matches))
+	for i, m := range matches {
+		out[i] = m.name
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+const (
+	lowerChars  = "abcdefghijklmnopqrstuvwxyz"
+	upperChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars  = "0123456789"
+	symbolChars = "!#$%&()*+,-./:;<=>?@[]^_{|}~"
+
+	// ambiguousChars are easily confused with one another when read.
+	ambiguousChars = "0O1lI|"
+)
+
+// defaultPolicy is used when no flags are given.
+var defaultPolicy = store.PasswordPolicy{Length: 24, Separator: "-"}
+
+// policyClasses returns the character classes allowed by p, with excluded
+// characters removed. Every class is non-empty.
+func policyClasses(p *store.PasswordPolicy) ([]string, error) {
+	var classes []string
+	add := func(enabled bool, chars string) {
+		if !enabled {
+			return
+		}
+		chars = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(p.Exclude, r) || (p.NoAmbiguous && strings.ContainsRune(ambiguousChars, r)) {
+				return -1
+			}
+			return r
+		}, chars)
+		if chars != "" {
+			classes = append(classes, chars)
+		}
+	}
+	add(!p.NoLower, lowerChars)
+	add(!p.NoUpper, upperChars)
+	add(!p.NoDigits, digitChars)
+	add(p.Symbols, symbolChars)
+	if len(classes) == 0 {
+		return nil, errors.New("password policy excludes every character")
+	}
+	return classes, nil
+}
+
+// randomIndex returns a uniformly random integer in [0, n).
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// generatePassword returns a random password complying with p. Characters
+// are drawn uniformly from the union of allowed classes, and passwords
+// missing a class are rejected so each class occurs at least once.
+func generatePassword(p *store.PasswordPolicy) (string, error) {
+	return policyPassword(p, randomIndex)
+}
+
+// derivedPassword computes the password of the derived record r under its
+// policy, or the default one, with pick in place of randomIndex. For
+// store.Options.DerivePassword; the passwords it makes must never change,
+// so neither must it, nor what it calls.
+func derivedPassword(r *store.Record, pick func(n int) (int, error)) (string, error) {
+	p := r.Policy
+	if p == nil {
+		p = &defaultPolicy
+	}
+	return policyPassword(p, pick)
+}
+
+// policyPassword is generatePassword drawing with pick.
+func policyPassword(p *store.PasswordPolicy, pick func(n int) (int, error)) (string, error) {
+	switch {
+	case p.Words > 0:
+		return pickPassphrase(p.Words, p.Separator, pick)
+	case p.Pronounceable:
+		return pickPronounceable(p.Length, pick)
+	}
+	classes, err := policyClasses(p)
+	if err != nil {
+		return "", err
+	}
+	if p.Length < len(classes) {
+		return "", fmt.Errorf("password length %d is too short to include all %d character classes", p.Length, len(classes))
+	}
+	alphabet := strings.Join(classes, "")
+
+	for {
+		b := make([]byte, p.Length)
+		for i := range b {
+			n, err := pick(len(alphabet))
+			if err != nil {
+				return "", err
+			}
+			b[i] = alphabet[n]
+		}
+		pw := string(b)
+		if hasAllClasses(pw, classes) {
+			return pw, nil
+		}
+	}
+}
+
+// policyEntropy returns the approximate entropy in bits of passwords generated
+// under p. For character passwords this ignores the small loss from
+// rejecting candidates that miss a class.
+func policyEntropy(p *store.PasswordPolicy) float64 {
+	switch {
+	case p.Words > 0:
+		return passphraseEntropy(p.Words)
+	case p.Pronounceable:
+		return pronounceableEntropy(p.Length)
+	}
+	classes, err := policyClasses(p)
+	if err != nil {
+		return 0
+	}
+	return float64(p.Length) * math.Log2(float64(len(strings.Join(classes, ""))))
+}
+
+// policyViolations returns the ways in which pw, last changed at changed,
+// breaks p. Passphrase policies only constrain the age of the password.
+func policyViolations(p *store.PasswordPolicy, pw string, changed *time.Time, now time.Time) []string {
+	var out []string
+	if p.Words == 0 {
+		if n := len([]rune(pw)); n < p.Length {
+			out = append(out, fmt.Sprintf("shorter than %d characters", p.Length))
+		}
+		forbidden := []struct {
+			banned bool
+			chars  string
+			what   string
+		}{
+			{p.NoLower, lowerChars, "lowercase letters"},
+			{p.NoUpper, upperChars, "uppercase letters"},
+			{p.NoDigits, digitChars, "digits"},
+			{!p.Symbols && !p.Pronounceable, symbolChars, "symbols"},
+			{p.NoAmbiguous, ambiguousChars, "ambiguous characters"},
+			{p.Exclude != "", p.Exclude, "excluded characters"},
+		}
+		for _, f := range forbidden {
+			if f.banned && strings.ContainsAny(pw, f.chars) {
+				out = append(out, "contains "+f.what)
+			}
+		}
+	}
+	if p.MaxAgeDays > 0 && changed != nil && now.Sub(*changed) > time.Duration(p.MaxAgeDays)*24*time.Hour {
+		out = append(out, fmt.Sprintf("older than %d days", p.MaxAgeDays))
+	}
+	return out
+}
+
+func hasAllClasses(pw string, classes []string) bool {
+	for _, c := range classes {
+		if !strings.ContainsAny(pw, c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// gitCredential is a request or response in git's credential helper
+// protocol: key=value lines terminated by a blank line or EOF.
+type gitCredential map[string]string
+
+func readGitCredential(r io.Reader) (gitCredential, error) {
+	c := make(gitCredential)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed credential line %q", line)
+		}
+		c[k] = v
+	}
+	return c, s.Err()
+}
+
+func (c gitCredential) write(w io.Writer) error {
+	for _, k := range []string{"username", "password"} {
+		if v := c[k]; v != "" {
+			if _, err := fmt.Fprintf(w, "%s=%s\n", k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gitCredentialMapper maps git hosts to entry names.
+type gitCredentialMapper struct {
+	// prefix is prepended to the host for unmapped hosts.
+	prefix string
+	// hosts maps a host, or host/path with credential.useHttpPath, to an
+	// entry name.
+	hosts map[string]string
+}
+
+// candidates returns entry names that may hold the credential for c, most
+// specific first.
+func (m *gitCredentialMapper) candidates(c gitCredential) []string {
+	host := c["host"]
+	if p := c["path"]; p != "" {
+		host += "/" + strings.TrimSuffix(p, ".git")
+	}
+	if name, ok := m.hosts[host]; ok {
+		return []string{name}
+	}
+	if name, ok := m.hosts[c["host"]]; ok {
+		return []string{name}
+	}
+	var names []string
+	if u := c["username"]; u != "" {
+		names = append(names, m.prefix+host+"/"+u)
+	}
+	return append(names, m.prefix+host)
+}
+
+// lookup returns the first existing entry for c.
+func (m *gitCredentialMapper) lookup(db *store.DB, c gitCredential) (string, bool) {
+	for _, name := range m.candidates(c) {
+		if db.Has(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// gitSync commits any local changes to the store in dir and exchanges them
+// with the repository's upstream remote.
+func gitSync(ctx context.Context, dir string, out io.Writer) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("store %s is not a git repository; run 'git init' there and add a remote to enable sync", dir)
+		}
+		return err
+	}
+	git := gitIn(ctx, dir, out)
+	if err := gitCommit(ctx, dir, git); err != nil {
+		return err
+	}
+	if err := egressAllowed("git pull and push"); err != nil {
+		return err
+	}
+	if err := git("pull", "--rebase", "--quiet"); err != nil {
+		return err
+	}
+	return git("push", "--quiet")
+}
+
+// gitSetup makes the store in dir a git repository syncing with the empty
+// repository at remote, and pushes the store there.
+func gitSetup(ctx context.Context, dir, remote string, out io.Writer) error {
+	git := gitIn(ctx, dir, out)
+	if err := git("init", "--quiet"); err != nil {
+		return err
+	}
+	if err := git("remote", "add", "origin", remote); err != nil {
+		return err
+	}
+	if err := gitCommit(ctx, dir, git); err != nil {
+		return err
+	}
+	if err := egressAllowed("git push"); err != nil {
+		return err
+	}
+	return git("push", "--quiet", "--set-upstream", "origin", "HEAD")
+}
+
+// gitIn returns a function running git in dir.
+func gitIn(ctx context.Context, dir string, out io.Writer) func(args ...string) error {
+	return func(args ...string) error {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Stdout = out
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("git %s: %v", strings.Join(args, " "), err)
+		}
+		return nil
+	}
+}
+
+// gitCommit commits the files of the store in dir that belong in git, if
+// they changed.
+func gitCommit(ctx context.Context, dir string, git func(args ...string) error) error {
+	// Committing a lost master would remove it from every copy as well.
+	if err := store.CheckKeyset(dir); err != nil {
+		return err
+	}
+	// Only pw.db is committed, so fold the journal into it first.
+	if _, _, err := store.Compact(dir); err != nil {
+		return err
+	}
+	files := []string{"pw.db", "salt", "master"}
+	if shared, err := store.IsShared(dir); err != nil {
+		return err
+	} else if shared {
+		files = []string{"pw.db", "recipients"}
+	} else {
+		if uses, err := store.UsesKeyFile(dir); err != nil {
+			return err
+		} else if uses {
+			// Every copy needs to know to ask for the keyfile, but not the
+			// keyfile itself, which stays on its own media.
+			files = append(files, "keyfile")
+		}
+		if holders, err := store.Holders(dir); err != nil {
+			return err
+		} else if holders != nil {
+			files = append(files, "holders")
+		}
+		// Derived passwords need the same key in every copy.
+		if _, err := os.Stat(filepath.Join(dir, "derive.key")); err == nil {
+			files = append(files, "derive.key")
+		}
+		// Stores from before formats were recorded have none.
+		if _, err := os.Stat(filepath.Join(dir, "format")); err == nil {
+			files = append(files, "format")
+		}
+	}
+	// The read-only mark goes with the store, and so does its removal.
+	if _, err := os.Stat(filepath.Join(dir, "readonly")); err == nil {
+		files = append(files, "readonly")
+	} else if err := git("rm", "--cached", "--quiet", "--ignore-unmatch", "--", "readonly"); err != nil {
+		return err
+	}
+	if err := git(append([]string{"add", "--"}, files...)...); err != nil {
+		return err
+	}
+	// diff --quiet exits non-zero when there is something to commit.
+	if err := exec.CommandContext(ctx, "git", "-C", dir, "diff", "--cached", "--quiet").Run(); err != nil {
+		if err := git("commit", "--quiet", "-m", "durin sync"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/durinpb"
+	"github.com/citizencloud/passwordstore/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer implements durinpb.StoreServer over a DB. Calls run
+// concurrently, which the DB allows; mu only makes the existence check and
+// the write of a Put atomic.
+type grpcServer struct {
+	durinpb.UnimplementedStoreServer
+
+	mu sync.Mutex
+	db *store.DB
+}
+
+func timestampOrNil(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func timeOrNil(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+// getRecord decrypts the entry called name. Only reads that hand out the
+// secret are tracked; describing entries uses Peek so that listing does not
+// count as reading every entry listed.
+func (s *grpcServer) getRecord(ctx context.Context, name string, track bool) (*store.Record, error) {
+	if !s.db.Has(name) {
+		return nil, status.Errorf(codes.NotFound, "password %q not found", name)
+	}
+	get := s.db.Peek
+	if track {
+		get = s.db.Get
+	}
+	r, err := get(ctx, name)
+	if err != nil {
+		return nil, storeStatus(err)
+	}
+	return r, nil
+}
+
+// storeStatus converts an error from the store to a status, keeping the
+// codes for missing entries and cancelled and timed out requests.
+func storeStatus(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// entries describes the named entries.
+func (s *grpcServer) entries(ctx context.Context, names []string) ([]*durinpb.Entry, error) {
+	out := make([]*durinpb.Entry, 0, len(names))
+	for _, name := range names {
+		r, err := s.getRecord(ctx, name, false)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &durinpb.Entry{
+			Name:     name,
+			Username: r.Username,
+			Kind:     r.KindOrDefault(),
+			Changed:  timestampOrNil(r.Changed),
+			Expires:  timestampOrNil(r.Expires),
+		})
+		r.Wipe()
+	}
+	return out, nil
+}
+
+func (s *grpcServer) names() []string {
+	return s.db.List()
+}
+
+func (s *grpcServer) List(req *durinpb.ListRequest, stream durinpb.Store_ListServer) error {
+	entries, err := s.entries(stream.Context(), s.db.ListPrefix(req.Prefix))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *grpcServer) Search(req *durinpb.SearchRequest, stream durinpb.Store_SearchServer) error {
+	entries, err := s.entries(stream.Context(), fuzzyFilter(req.Query, s.names()))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *durinpb.GetRequest) (*durinpb.Record, error) {
+	r, err := s.getRecord(ctx, req.Name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &durinpb.Record{
+		Name:     req.Name,
+		Username: r.Username,
+		Password: r.Password,
+		Notes:    r.Notes,
+		Fields:   r.Fields,
+		Kind:     r.Kind,
+		Changed:  timestampOrNil(r.Changed),
+		Expires:  timestampOrNil(r.Expires),
+	}, nil
+}
+
+// Put stores req.Record, replacing the whole entry like put --force does.
+func (s *grpcServer) Put(ctx context.Context, req *durinpb.PutRequest) (*durinpb.PutResponse, error) {
+	pr := req.Record
+	if pr == nil || pr.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "no entry name given")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db.Has(pr.Name) && !req.Overwrite {
+		return nil, status.Errorf(codes.AlreadyExists, "entry %q already exists", pr.Name)
+	}
+	r := &store.Record{
+		Username: pr.Username,
+		Notes:    pr.Notes,
+		Fields:   pr.Fields,
+		Kind:     pr.Kind,
+		Expires:  timeOrNil(pr.Expires),
+	}
+	if pr.Password != "" {
+		r.SetPassword(pr.Password, time.Now())
+	}
+	if pr.Changed != nil {
+		r.Changed = timeOrNil(pr.Changed)
+	}
+	if err := s.db.Put(ctx, pr.Name, r); err != nil {
+		return nil, storeStatus(err)
+	}
+	return &durinpb.PutResponse{}, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *durinpb.DeleteRequest) (*durinpb.DeleteResponse, error) {
+	if err := s.db.Delete(ctx, req.Name); err != nil {
+		return nil, storeStatus(err)
+	}
+	return &durinpb.DeleteResponse{}, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// importLimits bound the JSON exports importers decode. Exports hold much
+// that durin has no place for, so unknown fields are fine, but not files
+// crafted to exhaust memory.
+var importLimits = strictjson.Limits{MaxSize: 256 << 20, MaxDepth: 64, AllowUnknownFields: true}
+
+// readImportFile reads the file to import at path, refusing ones over
+// importLimits.
+func readImportFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := strictjson.ReadAll(f, importLimits.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// totpField is the field imported TOTP secrets are kept in, as otpauth://
+// URIs like those pass-otp writes.
+const totpField = "otpauth"
+
+// totpURI returns an otpauth:// URI for a base32 TOTP secret, with the
+// optional digits, period and algorithm parameters in params. Password
+// managers that store bare secrets label them with the entry's title and
+// username.
+func totpURI(secret, title, user string, params url.Values) string {
+	return otpURI("totp", secret, title, user, params)
+}
+
+// otpURI is totpURI for secrets of kind, totp or hotp.
+func otpURI(kind, secret, title, user string, params url.Values) string {
+	q := url.Values{"secret": {strings.ToUpper(strings.ReplaceAll(secret, " ", ""))}}
+	for k, v := range params {
+		if len(v) > 0 && v[0] != "" {
+			q.Set(k, v[0])
+		}
+	}
+	label := title
+	if user != "" {
+		label += ":" + user
+	}
+	return (&url.URL{Scheme: "otpauth", Host: kind, Path: "/" + label, RawQuery: q.Encode()}).String()
+}
+
+// importedEntry is an entry read from another password manager.
+type importedEntry struct {
+	Name   string
+	Record *store.Record
+}
+
+// importOptions are the options shared by the import commands.
+type importOptions struct {
+	// prefix is prepended to the imported names, e.g. "pass/".
+	prefix string
+	// force overwrites existing entries instead of skipping them.
+	force bool
+	// dryRun reports what would be imported without storing anything.
+	dryRun bool
+}
+
+// importEntries stores entries in db and reports what it did on out.
+// Entries whose names are taken are skipped unless opts.force is set, so
+// that running an import twice does no harm. With opts.dryRun it only
+// describes each entry.
+func importEntries(ctx context.Context, db *store.DB, entries []importedEntry, opts importOptions, out io.Writer) error {
+	var imported, skipped int
+	for _, e := range entries {
+		name := opts.prefix + e.Name
+		if !opts.force && db.Has(name) {
+			fmt.Fprintf(out, "skipped %s: already exists\n", name)
+			e.Record.Wipe()
+			skipped++
+			continue
+		}
+		if opts.dryRun {
+			fmt.Fprintf(out, "would import %s: %s\n", name, describeImport(e.Record))
+			e.Record.Wipe()
+			imported++
+			continue
+		}
+		detachDerived(e.Record)
+		err := db.Restore(ctx, name, e.Record)
+		e.Record.Wipe()
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", name, err)
+		}
+		imported++
+	}
+	verb := "imported"
+	if opts.dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(out, "%s %d of %d entries", verb, imported, len(entries))
+	if skipped > 0 {
+		fmt.Fprintf(out, ", skipped %d existing (use --force to overwrite)", skipped)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+// detachDerived turns the derived record r into one storing its password,
+// for copying it to another store, whose derivation key differs.
+func detachDerived(r *store.Record) {
+	if r.Derived == nil {
+		return
+	}
+	r.Derived = nil
+	if r.Kind == store.KindDerived {
+		r.Kind = ""
+	}
+}
+
+// describeImport summarizes how r was mapped, without revealing secrets:
+// its kind, username and which fields it has.
+func describeImport(r *store.Record) string {
+	parts := []string{r.KindOrDefault()}
+	if r.Username != "" {
+		parts = append(parts, "username "+r.Username)
+	}
+	if r.Password != "" {
+		parts = append(parts, "password")
+	}
+	if len(r.Fields) > 0 {
+		keys := make([]string, 0, len(r.Fields))
+		for k := range r.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts = append(parts, "fields "+strings.Join(keys, ", "))
+	}
+	if r.Notes != "" {
+		parts = append(parts, "notes")
+	}
+	if len(r.Tags) > 0 {
+		parts = append(parts, "tags "+strings.Join(r.Tags, ", "))
+	}
+	if len(r.History) > 0 {
+		parts = append(parts, fmt.Sprintf("%d old passwords", len(r.History)))
+	}
+	if len(r.Attachments) > 0 {
+		parts = append(parts, fmt.Sprintf("%d attachments", len(r.Attachments)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// importName turns a path from another tool into an entry name: slash
+// separated, without leading or trailing slashes.
+func importName(p string) string {
+	return strings.Trim(path.Clean(strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// importNamePart makes a title, group or folder name usable as part of
+// an entry name.
+func importNamePart(s string) string {
+	s = strings.TrimSpace(strings.ReplaceAll(s, "/", "_"))
+	if s == "" {
+		return "untitled"
+	}
+	return s
+}
+
+// uniqueName returns name, or name followed by a number if it is taken,
+// and marks the result as taken.
+func uniqueName(name string, taken map[string]bool) string {
+	unique := name
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s (%d)", name, i)
+	}
+	taken[unique] = true
+	return unique
+}
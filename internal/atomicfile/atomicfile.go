@@ -1,5 +1,6 @@
-// package main....
-package main
+// Package atomicfile replaces files so that readers see either the old or
+// the new contents, even across a crash.
+package atomicfile
 
 import (
 	"io"
@@ -21,7 +22,7 @@ import (
 // The fsyncs probably aren't necessary on COS since we'll probably be writing
 // to tmpfs (or overlayfs on tmpfs), but they should be close to a noop and
 // quick, so we can be over paranoid.
-func writeFile(path string, data []byte) error {
+func WriteFile(path string, data []byte) error {
 	return writeFileAtomic(path+".tmp", path, data)
 }
 
@@ -0,0 +1,54 @@
+package secmem
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Harden keeps secrets out of core dumps and swap. Core dumps are disabled
+// outright, which also stops other processes of the same user from
+// attaching with ptrace. If the memlock limit allows it, all memory is
+// locked; otherwise Lock locks the pages holding secrets as they are
+// created. Failures are ignored: this is defense in depth.
+func Harden() {
+	unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: 0, Max: 0})
+	unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+
+	// Locking future mappings beyond the limit would make allocations
+	// fail, so only lock everything when there is no limit.
+	var lim unix.Rlimit
+	if unix.Getrlimit(unix.RLIMIT_MEMLOCK, &lim) == nil && lim.Cur == unix.RLIM_INFINITY {
+		unix.Mlockall(unix.MCL_CURRENT | unix.MCL_FUTURE)
+	}
+}
+
+var pageSize = uintptr(os.Getpagesize())
+
+// Lock keeps the pages holding b out of swap and core dumps. Go's garbage
+// collector does not move heap objects, so the pages stay put.
+func Lock(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	lockRange(unsafe.Pointer(&b[0]), uintptr(len(b)))
+}
+
+// LockString is Lock for the bytes of s.
+func LockString(s string) {
+	if s == "" {
+		return
+	}
+	// The first word of a string header points at its bytes.
+	lockRange(*(*unsafe.Pointer)(unsafe.Pointer(&s)), uintptr(len(s)))
+}
+
+func lockRange(p unsafe.Pointer, n uintptr) {
+	// mlock rounds the start down to a page boundary itself; madvise wants
+	// it aligned. A slice over the whole pages would point outside the
+	// allocation, so the calls are made with bare addresses.
+	start := uintptr(p) &^ (pageSize - 1)
+	unix.Syscall(unix.SYS_MLOCK, uintptr(p), n, 0)
+	unix.Syscall(unix.SYS_MADVISE, start, uintptr(p)+n-start, unix.MADV_DONTDUMP)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package secmem
+
+// Harden and Lock only do something on Linux.
+
+func Harden() {}
+
+func Lock(b []byte) {}
+
+func LockString(s string) {}
@@ -0,0 +1,54 @@
+// Package secmem keeps secrets out of swap and core dumps and wipes them
+// once they are no longer needed.
+package secmem
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// Buffer holds a decrypted plaintext or derived key in locked memory until
+// Wipe overwrites it. Use it for secrets that are only needed briefly, and
+// defer Wipe right after creating it.
+type Buffer struct {
+	b []byte
+}
+
+// NewBuffer takes ownership of b.
+func NewBuffer(b []byte) *Buffer {
+	Lock(b)
+	return &Buffer{b: b}
+}
+
+// Bytes returns the secret. It must not be used after Wipe.
+func (s *Buffer) Bytes() []byte {
+	return s.b
+}
+
+// Wipe zeroes the secret.
+func (s *Buffer) Wipe() {
+	Wipe(s.b)
+	s.b = nil
+}
+
+// Wipe zeroes b. The KeepAlive keeps the compiler from treating the stores
+// as dead and dropping them.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// WipeString zeroes the bytes of s in place. Only use it on strings this
+// process allocated itself, such as those json.Unmarshal returns: string
+// constants live in read-only memory, and the bytes may be shared with
+// anything sliced from s. One-byte strings are skipped, as the runtime
+// points those at a shared read-only table instead of allocating them.
+func WipeString(s string) {
+	if len(s) <= 1 {
+		return
+	}
+	// The first word of a string header points at its bytes.
+	Wipe(unsafe.Slice(*(**byte)(unsafe.Pointer(&s)), len(s)))
+}
@@ -0,0 +1,103 @@
+// Package strictjson decodes JSON that may have been crafted to do harm,
+// such as a pw.db delivered by sync or a file to import. Unlike
+// json.Unmarshal, it refuses inputs larger or nested deeper than the caller
+// allows before decoding anything, data after the value and, unless told
+// otherwise, fields the value has no place for, which would otherwise be
+// dropped without a word.
+package strictjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	// ErrTooLarge is returned for inputs over Limits.MaxSize.
+	ErrTooLarge = errors.New("input too large")
+	// ErrTooDeep is returned for inputs nested over Limits.MaxDepth.
+	ErrTooDeep = errors.New("input nested too deeply")
+)
+
+// Limits bound what Unmarshal accepts.
+type Limits struct {
+	// MaxSize is the largest input accepted, in bytes.
+	MaxSize int64
+	// MaxDepth is the deepest nesting of objects and arrays accepted.
+	MaxDepth int
+	// AllowUnknownFields accepts fields the value has no place for, as in
+	// files other programs write, which hold much durin has no use for.
+	AllowUnknownFields bool
+}
+
+// Unmarshal decodes the JSON value in b into v, within l.
+func Unmarshal(b []byte, v interface{}, l Limits) error {
+	if int64(len(b)) > l.MaxSize {
+		return fmt.Errorf("%w: %d bytes, over the %d accepted", ErrTooLarge, len(b), l.MaxSize)
+	}
+	if err := checkDepth(b, l.MaxDepth); err != nil {
+		return err
+	}
+	if l.AllowUnknownFields {
+		// The decoder copies its input, so json.Unmarshal is used where it
+		// can be.
+		return json.Unmarshal(b, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after the JSON value")
+	}
+	return nil
+}
+
+// ReadAll reads r to its end, failing with ErrTooLarge once it read more
+// than max bytes.
+func ReadAll(r io.Reader, max int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("%w: over the %d bytes accepted", ErrTooLarge, max)
+	}
+	return b, nil
+}
+
+// checkDepth checks that b nests objects and arrays at most max deep. It
+// only tracks brackets outside strings; whatever else is wrong with b is
+// for the decoder to find.
+func checkDepth(b []byte, max int) error {
+	depth := 0
+	inString, escaped := false, false
+	for i, c := range b {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			if depth++; depth > max {
+				return fmt.Errorf("%w: over %d levels at offset %d", ErrTooDeep, max, i)
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package workpool spreads work over a bounded pool of goroutines, for the
+// operations that decrypt every entry of a store, such as audits, searches,
+// exports and rekeys, which would otherwise spend minutes on a large store
+// using one core.
+package workpool
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Size returns the number of goroutines n pieces of work are spread over:
+// one for each CPU Go may use, but no more than n.
+func Size(n int) int {
+	size := runtime.GOMAXPROCS(0)
+	if n < size {
+		size = n
+	}
+	return size
+}
+
+// Run calls fn for every i below n on a pool of Size(n) goroutines and
+// returns the error of the lowest i it failed for. Once it failed, work not
+// yet started is not, and the context fn was given is canceled.
+func Run(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	return Ordered(ctx, n, func(ctx context.Context, i int) (interface{}, error) {
+		return nil, fn(ctx, i)
+	}, func(int, interface{}) error { return nil }, nil)
+}
+
+// Ordered calls work for every i below n on a pool like Run does, and
+// deliver with what it returned in order of i, from the calling goroutine,
+// so that deliver needs no locking. Work runs at most a few pieces ahead of
+// deliver, so that results do not pile up in memory.
+//
+// Ordered stops at the first error of work or deliver and returns it. The
+// results of work not delivered by then are passed to discard, if it is
+// not nil, such as to wipe them.
+func Ordered(ctx context.Context, n int, work func(ctx context.Context, i int) (interface{}, error), deliver func(i int, v interface{}) error, discard func(v interface{})) error {
+	if n == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	type result struct {
+		v   interface{}
+		err error
+	}
+	results := make([]chan result, n)
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	size := Size(n)
+	// ahead holds a token for every piece of work started and not yet
+	// delivered.
+	ahead := make(chan struct{}, 2*size)
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(size)
+	for w := 0; w < size; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				v, err := work(ctx, i)
+				results[i] <- result{v, err}
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		wg.Wait()
+		if discard == nil {
+			return
+		}
+		for _, c := range results {
+			select {
+			case r := <-c:
+				if r.v != nil {
+					discard(r.v)
+				}
+			default:
+			}
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-ahead
+		if r.err != nil {
+			if r.v != nil && discard != nil {
+				discard(r.v)
+			}
+			return r.err
+		}
+		if err := deliver(i, r.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// k8sProvider answers the External Secrets Operator's webhook provider, or
+// any sidecar speaking the same JSON, with the entries under a prefix. It
+// only reads: Kubernetes is told what the store holds, never the reverse.
+type k8sProvider struct {
+	db     *store.DB
+	prefix string
+	// token is the SHA-256 of the bearer token clients must send.
+	token   [sha256.Size]byte
+	metrics *daemonMetrics
+}
+
+// k8sSecret is the reply for an entry. value is the requested property,
+// by default the password; data holds every field, for ESO's dataFrom.
+type k8sSecret struct {
+	Value string            `json:"value"`
+	Data  map[string]string `json:"data"`
+}
+
+func newK8sProvider(db *store.DB, prefix, token string) *k8sProvider {
+	p := &k8sProvider{db: db, prefix: prefix, token: sha256.Sum256([]byte(token))}
+	p.metrics = newDaemonMetrics(db.Dir(), func() (bool, time.Time) { return !db.Locked(), time.Time{} })
+	return p
+}
+
+func (p *k8sProvider) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/secrets", p.metrics.instrument("list", false, p.authorized(p.handleList)))
+	mux.HandleFunc("/v1/secrets/", p.metrics.instrument("secret", false, p.authorized(p.handleSecret)))
+	p.metrics.register(mux)
+	return mux
+}
+
+func (p *k8sProvider) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		tok := strings.TrimPrefix(auth, "Bearer ")
+		sum := sha256.Sum256([]byte(tok))
+		if tok == auth || subtle.ConstantTimeCompare(sum[:], p.token[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleList replies with the keys under the prefix, for tooling.
+func (p *k8sProvider) handleList(w http.ResponseWriter, r *http.Request) {
+	keys := []string{}
+	for _, name := range p.db.ListPrefix(p.prefix) {
+		keys = append(keys, strings.TrimPrefix(name, p.prefix))
+	}
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// handleSecret replies with the entry called prefix+KEY for
+// /v1/secrets/KEY, and in value its ?property=, a field recordField knows.
+func (p *k8sProvider) handleSecret(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/secrets/")
+	if key == "" {
+		writeAPIError(w, http.StatusNotFound, "no such secret")
+		return
+	}
+	rec, err := p.db.Get(r.Context(), p.prefix+key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer rec.Wipe()
+	property := r.URL.Query().Get("property")
+	if property == "" {
+		property = "password"
+	}
+	value, err := recordField(rec, property)
+	var usage usageError
+	if errors.As(err, &usage) || err == nil && value == "" {
+		writeAPIError(w, http.StatusNotFound, "%s has no %s", key, property)
+		return
+	} else if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, k8sSecret{Value: value, Data: k8sData(rec)})
+}
+
+// k8sData returns the non-empty fields of rec by name, as keys of a
+// Kubernetes Secret.
+func k8sData(rec *store.Record) map[string]string {
+	data := make(map[string]string)
+	for _, f := range []string{"username", "password", "url", "notes"} {
+		if v, _ := recordField(rec, f); v != "" {
+			data[f] = v
+		}
+	}
+	for name, v := range rec.Fields {
+		if _, ok := data[name]; !ok && v != "" {
+			data[name] = v
+		}
+	}
+	return data
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/tobischo/gokeepasslib/v3"
+)
+
+// keepassCredentials returns the credentials for a KDBX file: a password,
+// a key file, or both.
+func keepassCredentials(password []byte, keyFile string) (*gokeepasslib.DBCredentials, error) {
+	switch {
+	case keyFile != "" && len(password) > 0:
+		return gokeepasslib.NewPasswordAndKeyCredentials(string(password), keyFile)
+	case keyFile != "":
+		return gokeepasslib.NewKeyCredentials(keyFile)
+	default:
+		return gokeepasslib.NewPasswordCredentials(string(password)), nil
+	}
+}
+
+// readKeepass decrypts the KDBX 3.1 or 4 file at path. The library
+// supports the ciphers, AES and ChaCha20, and key derivations, AES-KDF and
+// Argon2, that KeePass and KeePassXC write.
+func readKeepass(path string, creds *gokeepasslib.DBCredentials) (*gokeepasslib.Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	db := gokeepasslib.NewDatabase()
+	db.Credentials = creds
+	if err := gokeepasslib.NewDecoder(f).Decode(db); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if err := db.UnlockProtectedEntries(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt the protected values in %s: %v", path, err)
+	}
+	return db, nil
+}
+
+// keepassEntries maps the entries of a KeePass database to records. Groups
+// below the root become name prefixes; the recycle bin is left out.
+func keepassEntries(db *gokeepasslib.Database) ([]importedEntry, error) {
+	var (
+		entries []importedEntry
+		taken   = make(map[string]bool)
+		meta    = db.Content.Meta
+	)
+	var walk func(g *gokeepasslib.Group, prefix string) error
+	walk = func(g *gokeepasslib.Group, prefix string) error {
+		for i := range g.Entries {
+			r, err := keepassRecord(db, &g.Entries[i])
+			if err != nil {
+				return err
+			}
+			name := uniqueName(prefix+importNamePart(g.Entries[i].GetTitle()), taken)
+			entries = append(entries, importedEntry{Name: name, Record: r})
+		}
+		for i := range g.Groups {
+			sub := &g.Groups[i]
+			if meta != nil && meta.RecycleBinEnabled.Bool && sub.UUID.Compare(meta.RecycleBinUUID) {
+				continue
+			}
+			if err := walk(sub, prefix+importNamePart(sub.Name)+"/"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if db.Content.Root != nil {
+		// The root group is named after the database, so it adds no prefix.
+		for i := range db.Content.Root.Groups {
+			if err := walk(&db.Content.Root.Groups[i], ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// keepassRecord maps a KeePass entry to a record. The standard values fill
+// the record's fields and URL, TOTP settings in any of the ways KeePass and
+// KeePassXC store them become an otpauth:// URI, and other values become
+// fields of their own.
+func keepassRecord(db *gokeepasslib.Database, e *gokeepasslib.Entry) (*store.Record, error) {
+	r := &store.Record{Fields: make(map[string]string)}
+	values := make(map[string]string)
+	for _, v := range e.Values {
+		values[v.Key] = v.Value.Content
+	}
+	for _, v := range e.Values {
+		switch v.Key {
+		case "Title":
+		case "UserName":
+			r.Username = v.Value.Content
+		case "Password":
+			r.Password = v.Value.Content
+		case "Notes":
+			r.Notes = v.Value.Content
+		case "URL":
+			if v.Value.Content != "" {
+				r.URL = v.Value.Content
+			}
+		case "otp", "TOTP Seed", "TOTP Settings",
+			"TimeOtp-Secret-Base32", "TimeOtp-Length", "TimeOtp-Period", "TimeOtp-Algorithm":
+			// Handled below.
+		default:
+			if v.Value.Content != "" {
+				setField(r, v.Key, v.Value.Content)
+			}
+		}
+	}
+	if uri := keepassTOTP(values, e.GetTitle(), r.Username); uri != "" {
+		r.Fields[totpField] = uri
+	}
+	if len(r.Fields) == 0 {
+		r.Fields = nil
+	}
+	for _, tag := range strings.FieldsFunc(e.Tags, func(c rune) bool { return c == ';' || c == ',' }) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			r.Tags = append(r.Tags, tag)
+		}
+	}
+	if t := e.Times.CreationTime; t != nil && !t.Time.IsZero() {
+		created := t.Time
+		r.Created = &created
+	}
+	if t := e.Times.LastModificationTime; t != nil && !t.Time.IsZero() {
+		changed := t.Time
+		r.Changed, r.Modified = &changed, &changed
+	}
+	if t := e.Times.ExpiryTime; e.Times.Expires.Bool && t != nil {
+		expires := t.Time
+		r.Expires = &expires
+	}
+	// KeePass keeps whole old versions of an entry; durin only their
+	// passwords.
+	for _, h := range e.Histories {
+		for i := range h.Entries {
+			old := &h.Entries[i]
+			pw := old.GetPassword()
+			if pw == "" || pw == r.Password || (len(r.History) > 0 && r.History[len(r.History)-1].Password == pw) {
+				continue
+			}
+			entry := store.HistoryEntry{Password: pw}
+			if t := old.Times.LastModificationTime; t != nil {
+				entry.Retired = t.Time
+			}
+			r.History = append(r.History, entry)
+		}
+	}
+	for _, ref := range e.Binaries {
+		bin := db.FindBinary(ref.Value.ID)
+		if bin == nil {
+			return nil, fmt.Errorf("entry %q refers to a missing attachment %q", e.GetTitle(), ref.Name)
+		}
+		data, err := bin.GetContentBytes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read attachment %q of %q: %v", ref.Name, e.GetTitle(), err)
+		}
+		r.Attachments = append(r.Attachments, store.Attachment{Name: ref.Name, Data: data})
+	}
+	return r, nil
+}
+
+// keepassTOTP returns the TOTP settings among an entry's values as an
+// otpauth:// URI, or "". KeePassXC stores a URI in otp, or a seed and
+// "period;digits" settings in older versions; KeePass 2.47 and later use
+// TimeOtp-* values.
+func keepassTOTP(values map[string]string, title, user string) string {
+	if uri := values["otp"]; uri != "" {
+		return uri
+	}
+	secret, digits, period, algorithm := values["TimeOtp-Secret-Base32"], values["TimeOtp-Length"], values["TimeOtp-Period"], values["TimeOtp-Algorithm"]
+	if secret == "" {
+		secret = values["TOTP Seed"]
+		if p, d, ok := strings.Cut(values["TOTP Settings"], ";"); ok {
+			period, digits = p, d
+		}
+	}
+	if secret == "" {
+		return ""
+	}
+	// KeePass writes HMAC-SHA-1 and the like.
+	algorithm = strings.ReplaceAll(strings.TrimPrefix(algorithm, "HMAC-"), "-", "")
+	return totpURI(secret, title, user, url.Values{"digits": {digits}, "period": {period}, "algorithm": {algorithm}})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/tobischo/gokeepasslib/v3"
+	w "github.com/tobischo/gokeepasslib/v3/wrappers"
+)
+
+// keepassValue returns a string value of a KeePass entry. Protected values
+// are kept encrypted in the file, and KeePass hides them by default.
+func keepassValue(key, value string, protected bool) gokeepasslib.ValueData {
+	return gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value, Protected: w.NewBoolWrapper(protected)}}
+}
+
+// keepassTimeOf returns t for a KeePass time value.
+func keepassTimeOf(t time.Time) *w.TimeWrapper {
+	return &w.TimeWrapper{Time: t.In(time.UTC)}
+}
+
+// keepassEntry maps a record to a KeePass entry called title, the reverse
+// of keepassRecord: the otpauth field becomes the otp value KeePassXC
+// reads TOTP settings from, and password history older versions of the
+// entry.
+func keepassEntry(kdbx *gokeepasslib.Database, title string, r *store.Record) gokeepasslib.Entry {
+	e := gokeepasslib.NewEntry()
+	e.Values = append(e.Values,
+		keepassValue("Title", title, false),
+		keepassValue("UserName", r.Username, false),
+		keepassValue("Password", r.Password, true),
+		keepassValue("Notes", r.Notes, false),
+		keepassValue("URL", r.LoginURL(), false))
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch {
+		case k == "url" && r.URL == "":
+			// Exported as the URL.
+		case k == totpField:
+			e.Values = append(e.Values, keepassValue("otp", r.Fields[k], true))
+		default:
+			e.Values = append(e.Values, keepassValue(k, r.Fields[k], true))
+		}
+	}
+	e.Tags = strings.Join(r.Tags, ";")
+	if r.Created != nil {
+		e.Times.CreationTime = keepassTimeOf(*r.Created)
+	}
+	if r.Modified != nil {
+		e.Times.LastModificationTime = keepassTimeOf(*r.Modified)
+	} else if r.Changed != nil {
+		e.Times.LastModificationTime = keepassTimeOf(*r.Changed)
+	}
+	if r.Expires != nil {
+		e.Times.ExpiryTime = keepassTimeOf(*r.Expires)
+		e.Times.Expires = w.NewBoolWrapper(true)
+	}
+	if len(r.History) > 0 {
+		var h gokeepasslib.History
+		for _, old := range r.History {
+			he := gokeepasslib.NewEntry()
+			he.UUID = e.UUID
+			he.Values = append(he.Values,
+				keepassValue("Title", title, false),
+				keepassValue("UserName", r.Username, false),
+				keepassValue("Password", old.Password, true))
+			he.Times.LastModificationTime = keepassTimeOf(old.Retired)
+			h.Entries = append(h.Entries, he)
+		}
+		e.Histories = append(e.Histories, h)
+	}
+	for _, a := range r.Attachments {
+		e.Binaries = append(e.Binaries, kdbx.AddBinary(a.Data).CreateReference(a.Name))
+	}
+	return e
+}
+
+// keepassGroup returns the group for the folder path below g, creating
+// the groups that do not exist yet.
+func keepassGroup(g *gokeepasslib.Group, path []string) *gokeepasslib.Group {
+	for _, name := range path {
+		i := 0
+		for i < len(g.Groups) && g.Groups[i].Name != name {
+			i++
+		}
+		if i == len(g.Groups) {
+			sub := gokeepasslib.NewGroup()
+			sub.Name = name
+			g.Groups = append(g.Groups, sub)
+		}
+		g = &g.Groups[i]
+	}
+	return g
+}
+
+// writeKeepass writes the entries called names from db to a new KDBX 4
+// file, encrypted with ChaCha20 under an Argon2 key derived from password,
+// and returns how many it wrote. Name prefixes become groups, so that
+// email/work is the entry work in the group email. file must not exist.
+func writeKeepass(ctx context.Context, db *store.DB, file string, password []byte, names []string) (int, error) {
+	if _, err := os.Lstat(file); err == nil {
+		return 0, fmt.Errorf("%s already exists", file)
+	}
+	kdbx := gokeepasslib.NewDatabase(gokeepasslib.WithDatabaseKDBXVersion4())
+	kdbx.Credentials = gokeepasslib.NewPasswordCredentials(string(password))
+	kdbx.Content.Meta.DatabaseName = "durin"
+	root := gokeepasslib.NewGroup()
+	root.Name = "durin"
+	// The entries share the records' strings, so the records can only be
+	// wiped once the file is encoded.
+	var records []*store.Record
+	defer func() {
+		for _, r := range records {
+			r.Wipe()
+		}
+	}()
+	err := db.ForEachOf(ctx, names, func(name string, r *store.Record) error {
+		records = append(records, r)
+		parts := strings.Split(name, "/")
+		g := keepassGroup(&root, parts[:len(parts)-1])
+		g.Entries = append(g.Entries, keepassEntry(kdbx, parts[len(parts)-1], r))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	kdbx.Content.Root = &gokeepasslib.RootData{Groups: []gokeepasslib.Group{root}}
+	if err := kdbx.LockProtectedEntries(); err != nil {
+		return 0, err
+	}
+	var b bytes.Buffer
+	if err := gokeepasslib.NewEncoder(&b).Encode(kdbx); err != nil {
+		return 0, fmt.Errorf("failed to encode %s: %v", file, err)
+	}
+	if err := atomicfile.WriteFile(file, b.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// keyCacheEnv names the environment variable enabling the key cache. It
+// holds how long the key unwrapping the master keyset may be kept in the OS
+// keyring, such as "10m".
+const keyCacheEnv = "DURIN_KEY_CACHE"
+
+// keyCacheTTL returns how long to cache the key for, or 0 if the cache is
+// disabled.
+func keyCacheTTL() (time.Duration, error) {
+	s := os.Getenv(keyCacheEnv)
+	if s == "" {
+		return 0, nil
+	}
+	ttl, err := parseAge(s)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid $%s %q", keyCacheEnv, s)
+	}
+	return ttl, nil
+}
+
+// keyCacheName returns the name under which the key of the store in dir is
+// cached.
+func keyCacheName(dir string) string {
+	return "durin:" + dir
+}
+
+// unlockCachedKey unlocks the master keyset with the key cached in the OS
+// keyring. A cached key that no longer works, e.g. after the passphrase
+// changed, is dropped.
+func unlockCachedKey(dir string) (*keyset.Handle, tink.AEAD, error) {
+	name := keyCacheName(dir)
+	b, err := cachedKey(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rawKey := secmem.NewBuffer(b)
+	defer rawKey.Wipe()
+	ks, err := store.UnlockKeysetWithKey(dir, rawKey.Bytes())
+	if err != nil {
+		dropCachedKey(name)
+		return nil, nil, err
+	}
+	key, err := aead.New(ks)
+	return ks, key, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The key is kept in the login Keychain with the security tool. The
+// Keychain has no expiry, so the deadline is stored with the key and checked
+// on reading. Commands are fed to "security -i" on stdin so that the key
+// never appears in an argument list.
+
+func security(commands string) ([]byte, error) {
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(commands + "\n")
+	return cmd.Output()
+}
+
+func cacheKey(name string, key []byte, ttl time.Duration) error {
+	value := fmt.Sprintf("%s:%d", hex.EncodeToString(key), time.Now().Add(ttl).Unix())
+	_, err := security(fmt.Sprintf("add-generic-password -U -s durin -a %q -w %s", name, value))
+	return err
+}
+
+func cachedKey(name string) ([]byte, error) {
+	out, err := security(fmt.Sprintf("find-generic-password -s durin -a %q -w", name))
+	if err != nil {
+		return nil, err
+	}
+	key, deadline, ok := strings.Cut(string(bytes.TrimSpace(out)), ":")
+	if !ok {
+		return nil, errors.New("malformed cached key")
+	}
+	unix, err := strconv.ParseInt(deadline, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= unix {
+		dropCachedKey(name)
+		return nil, errors.New("cached key expired")
+	}
+	return hex.DecodeString(key)
+}
+
+func dropCachedKey(name string) error {
+	_, err := security(fmt.Sprintf("delete-generic-password -s durin -a %q", name))
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The key is kept in the user keyring with the kernel's key retention
+// service, which removes it when its timeout expires. Only processes of the
+// same user can read it.
+
+// keyPerm grants the possessor and the owning user everything.
+const keyPerm = 0x3f3f0000
+
+func cacheKey(name string, key []byte, ttl time.Duration) error {
+	id, err := unix.AddKey("user", name, key, unix.KEY_SPEC_USER_KEYRING)
+	if err != nil {
+		return err
+	}
+	if err := unix.KeyctlSetperm(id, keyPerm); err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, int(ttl/time.Second)+1, 0, 0)
+	return err
+}
+
+func cachedKey(name string) ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", name, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 64)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func dropCachedKey(name string) error {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", name, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
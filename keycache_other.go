@@ -0,0 +1,22 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoKeyring = errors.New("no OS keyring support on this platform")
+
+func cacheKey(name string, key []byte, ttl time.Duration) error {
+	return errNoKeyring
+}
+
+func cachedKey(name string) ([]byte, error) {
+	return nil, errNoKeyring
+}
+
+func dropCachedKey(name string) error {
+	return errNoKeyring
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// keychainItem is an item listed by "security dump-keychain": its class,
+// such as inet for internet passwords, and its attributes by their
+// four-letter names.
+type keychainItem struct {
+	class string
+	attrs map[string]string
+}
+
+// keychainAttr matches an attribute line of "security dump-keychain", such
+// as
+//
+//	"srvr"<blob>="github.com"
+//	"acct"<blob>=0x6AC3B6726E  "j\303\266rn"
+//	"port"<uint32>=0x000001BB
+//	"svce"<blob>=<NULL>
+var keychainAttr = regexp.MustCompile(`^\s+"(\w{4})"<(\w+)>=(.*)$`)
+
+// parseKeychainDump parses the output of "security dump-keychain", which
+// leaves out the secrets. Values that are not plain ASCII are printed in
+// hex, followed by a quoted form that is decoded from the hex instead.
+func parseKeychainDump(out []byte) []keychainItem {
+	var (
+		items []keychainItem
+		cur   *keychainItem
+	)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "class: ") {
+			class := strings.Trim(strings.TrimPrefix(line, "class: "), `"`)
+			items = append(items, keychainItem{class: class, attrs: make(map[string]string)})
+			cur = &items[len(items)-1]
+			continue
+		}
+		m := keychainAttr.FindStringSubmatch(line)
+		if m == nil || cur == nil {
+			continue
+		}
+		typ, v := m[2], m[3]
+		switch {
+		case v == "<NULL>":
+			continue
+		case typ == "uint32" && strings.HasPrefix(v, "0x"):
+			n, err := strconv.ParseUint(v[2:], 16, 32)
+			if err != nil {
+				continue
+			}
+			v = strconv.FormatUint(n, 10)
+		case strings.HasPrefix(v, "0x"):
+			hexValue, _, _ := strings.Cut(v[2:], " ")
+			b, err := hex.DecodeString(hexValue)
+			if err != nil {
+				continue
+			}
+			v = string(b)
+		default:
+			v = strings.TrimSuffix(strings.TrimPrefix(v, `"`), `"`)
+		}
+		cur.attrs[m[1]] = strings.TrimRight(v, "\x00")
+	}
+	return items
+}
+
+// keychainProtocols maps the Keychain's four-letter protocol codes to URL
+// schemes.
+var keychainProtocols = map[string]string{
+	"htps": "https",
+	"http": "http",
+	"ftp ": "ftp",
+	"ftps": "ftps",
+	"imap": "imap",
+	"imps": "imaps",
+	"smtp": "smtp",
+	"ssh ": "ssh",
+}
+
+// keychainLogin maps an internet password item with its password to a
+// login.
+func keychainLogin(item keychainItem, password string) *browserLogin {
+	a := item.attrs
+	u := url.URL{Scheme: keychainProtocols[a["ptcl"]], Host: a["srvr"], Path: a["path"]}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	if port, _ := strconv.Atoi(a["port"]); port != 0 && !(port == 443 && u.Scheme == "https" || port == 80 && u.Scheme == "http") {
+		u.Host += ":" + strconv.Itoa(port)
+	}
+	r := &store.Record{Kind: store.KindLogin, Username: a["acct"], Password: password}
+	if u.Host != "" {
+		setURL(r, u.String())
+	}
+	if a["icmt"] != "" {
+		r.Notes = a["icmt"]
+	}
+	l := &browserLogin{origin: u.Scheme + "://" + u.Host, host: strings.TrimPrefix(a["srvr"], "www."), record: r}
+	if t, err := time.Parse("20060102150405Z", a["mdat"]); err == nil {
+		l.changed = &t
+		r.Changed = &t
+	}
+	return l
+}
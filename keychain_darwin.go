@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// readKeychain reads the internet passwords of keychain, or of the default
+// keychains if it is "", with the security tool. macOS asks whether durin
+// may read each password; items it is not allowed to read are reported on
+// warn and left out.
+func readKeychain(ctx context.Context, keychain string, warn io.Writer) ([]importedEntry, error) {
+	args := []string{"dump-keychain"}
+	if keychain != "" {
+		args = append(args, keychain)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "security", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security dump-keychain failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var logins []*browserLogin
+	for _, item := range parseKeychainDump(out) {
+		if item.class != "inet" {
+			continue
+		}
+		pw, err := keychainPassword(ctx, item, keychain)
+		if err != nil {
+			fmt.Fprintf(warn, "skipped %s for %s: %v\n", item.attrs["acct"], item.attrs["srvr"], err)
+			continue
+		}
+		logins = append(logins, keychainLogin(item, pw))
+	}
+	return nameLogins(logins), nil
+}
+
+// keychainPassword returns the password of an internet password item.
+func keychainPassword(ctx context.Context, item keychainItem, keychain string) (string, error) {
+	args := []string{"find-internet-password", "-s", item.attrs["srvr"], "-a", item.attrs["acct"]}
+	if p := item.attrs["ptcl"]; p != "" {
+		args = append(args, "-r", p)
+	}
+	if p := item.attrs["path"]; p != "" {
+		args = append(args, "-p", p)
+	}
+	args = append(args, "-w")
+	if keychain != "" {
+		args = append(args, keychain)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "security", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
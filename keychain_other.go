@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+func readKeychain(ctx context.Context, keychain string, warn io.Writer) ([]importedEntry, error) {
+	return nil, errors.New("the Keychain can only be read on macOS")
+}
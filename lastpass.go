@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// lastPassNoteURL is the URL LastPass gives secure notes in its exports.
+const lastPassNoteURL = "http://sn"
+
+// lastPassNoteKinds maps the note types of structured secure notes to
+// record kinds.
+var lastPassNoteKinds = map[string]string{
+	"Credit Card": store.KindCard,
+	"Address":     store.KindIdentity,
+}
+
+// readLastPass reads a LastPass CSV export. Its columns are named in the
+// header, which older exports write without totp:
+//
+//	url,username,password,totp,extra,name,grouping,fav
+//
+// LastPass does not escape quotes inside values consistently and escapes
+// some characters as HTML entities, so the reader is lenient about
+// quoting and unescapes the entities. Groupings, whose folders LastPass
+// separates with backslashes, become name prefixes.
+func readLastPass(r io.Reader) ([]importedEntry, error) {
+	t, err := readCSV(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the LastPass export: %v", err)
+	}
+	if c := t.missing("url", "username", "password", "extra", "name", "grouping"); c != "" {
+		return nil, fmt.Errorf("not a LastPass export: no %s column", c)
+	}
+	entries := make([]importedEntry, 0, len(t.rows))
+	taken := make(map[string]bool)
+	for _, row := range t.rows {
+		row := row
+		get := func(col string) string { return html.UnescapeString(t.value(row, col)) }
+		name := importNamePart(get("name"))
+		if g := get("grouping"); g != "" && g != "(none)" {
+			var parts []string
+			for _, p := range strings.Split(g, "\\") {
+				parts = append(parts, importNamePart(p))
+			}
+			name = strings.Join(parts, "/") + "/" + name
+		}
+		entries = append(entries, importedEntry{Name: uniqueName(importName(name), taken), Record: lastPassRecord(get)})
+	}
+	return entries, nil
+}
+
+// lastPassRecord maps a row of a LastPass export, whose columns get
+// returns, to a record. Sites keep the extra column as notes. Secure notes
+// keep it too, unless they are structured notes such as credit cards,
+// where it holds "Key:Value" lines that become fields.
+func lastPassRecord(get func(string) string) *store.Record {
+	r := &store.Record{Username: get("username"), Password: get("password")}
+	if get("fav") == "1" {
+		r.Tags = []string{"favorite"}
+	}
+	extra := strings.ReplaceAll(get("extra"), "\r\n", "\n")
+	if url := get("url"); url != lastPassNoteURL {
+		r.Kind = store.KindLogin
+		r.Notes = extra
+		if url != "" {
+			setURL(r, url)
+		}
+		if secret := get("totp"); secret != "" {
+			setField(r, totpField, totpURI(secret, get("name"), r.Username, nil))
+		}
+		return r
+	}
+	r.Kind = store.KindNote
+	if !strings.HasPrefix(extra, "NoteType:") {
+		r.Notes = extra
+		return r
+	}
+	lines := strings.Split(extra, "\n")
+	for i, line := range lines {
+		key, value, _ := strings.Cut(line, ":")
+		switch {
+		case key == "NoteType":
+			if kind, ok := lastPassNoteKinds[value]; ok {
+				r.Kind = kind
+			}
+		case key == "Notes":
+			// The notes come last and may span lines.
+			r.Notes = strings.Join(append([]string{value}, lines[i+1:]...), "\n")
+			return r
+		case key == "Username" && r.Username == "":
+			r.Username = value
+		case key == "Password" && r.Password == "":
+			r.Password = value
+		case value != "":
+			setField(r, key, value)
+		}
+	}
+	return r
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// watchLockEvents reports events after which long-running commands should
+// drop their keys: the machine preparing to suspend or the session being
+// locked, where systemd-logind is available, and receiving any of signals.
+// Each event is sent as a short description. Call stop to stop watching.
+func watchLockEvents(signals ...os.Signal) (events <-chan string, stop func()) {
+	ch := make(chan string, 1)
+	send := func(reason string) {
+		select {
+		case ch <- reason:
+		default:
+			// A lock is already pending.
+		}
+	}
+	done := make(chan struct{})
+
+	sig := make(chan os.Signal, 1)
+	if len(signals) > 0 {
+		signal.Notify(sig, signals...)
+	}
+	go func() {
+		for {
+			select {
+			case s := <-sig:
+				send(s.String())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	conn := watchLogind(send, done)
+	return ch, func() {
+		signal.Stop(sig)
+		close(done)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+const (
+	logindName    = "org.freedesktop.login1"
+	logindManager = logindName + ".Manager"
+	logindSession = logindName + ".Session"
+)
+
+// watchLogind subscribes to logind's suspend and session lock signals. It
+// returns nil if there is no system bus or logind; signals are then all
+// there is.
+func watchLogind(send func(string), done <-chan struct{}) *dbus.Conn {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil
+	}
+	if err := conn.AddMatchSignal(dbus.WithMatchInterface(logindManager), dbus.WithMatchMember("PrepareForSleep")); err != nil {
+		conn.Close()
+		return nil
+	}
+	var session dbus.ObjectPath
+	err = conn.Object(logindName, "/org/freedesktop/login1").Call(logindManager+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&session)
+	if err == nil {
+		conn.AddMatchSignal(dbus.WithMatchObjectPath(session), dbus.WithMatchInterface(logindSession), dbus.WithMatchMember("Lock"))
+	}
+	signals := make(chan *dbus.Signal, 8)
+	conn.Signal(signals)
+	go func() {
+		for {
+			select {
+			case s, ok := <-signals:
+				if !ok {
+					return
+				}
+				switch s.Name {
+				case logindManager + ".PrepareForSleep":
+					// The signal is sent with true before suspending and
+					// false after resuming.
+					if len(s.Body) > 0 && s.Body[0] == true {
+						send("suspend")
+					}
+				case logindSession + ".Lock":
+					if s.Path == session {
+						send("session lock")
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return conn
+}
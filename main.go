@@ -1,9 +1,346 @@
 package main
 
-func main() {
-	db, err := Open()
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes returned by the durin binary. Scripts rely on them, so they
+// never change meaning; new ones get new numbers.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+	// exitNotFound reports that a named entry does not exist.
+	exitNotFound = 3
+	// exitBadPassphrase reports that the master passphrase was wrong.
+	exitBadPassphrase = 4
+	// exitLocked reports that the store is locked or in use by another
+	// process.
+	exitLocked = 5
+	// exitCorrupt reports that the store failed to parse or decrypt, or
+	// lost its master keyset, or its audit log or a signed statement
+	// failed to verify.
+	exitCorrupt = 6
+	// exitPromptNeeded reports that durin would have prompted in --batch
+	// mode.
+	exitPromptNeeded = 7
+	// exitReadOnly reports that the store is read-only; see durin archive.
+	exitReadOnly = 8
+	// exitFindings reports that audit --fail-on or scan found problems.
+	exitFindings = 10
+)
+
+// exitStatusError makes run exit with the given status without printing
+// anything, for commands that report their own errors.
+type exitStatusError int
+
+func (e exitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// usageError marks errors caused by invalid command line usage rather than a
+// failed operation.
+type usageError struct {
+	error
+}
+
+// exactArgs is cobra.ExactArgs, but reports failures as usage errors.
+func exactArgs(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.ExactArgs(n)(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// maxArgs is like exactArgs, but accepts up to n arguments.
+func maxArgs(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.MaximumNArgs(n)(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// minArgs is like exactArgs, but accepts n or more arguments.
+func minArgs(n int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := cobra.MinimumNArgs(n)(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// completeNames completes the first positional argument with entry names.
+// It never prompts for the passphrase.
+func completeNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	dir, err := storeDir()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	names, err := store.ListNames(dir)
 	if err != nil {
-		panic(err)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var out []string
+	for _, name := range names {
+		if strings.HasPrefix(name, toComplete) {
+			out = append(out, name)
+		}
+	}
+	return out, cobra.ShellCompDirectiveNoFileComp
+}
+
+func newRootCmd() *cobra.Command {
+	root := &cobra.Command{
+		Use:   "durin",
+		Short: "durin is an encrypted password store",
+		Long: `durin is an encrypted password store.
+
+Environment:
+  DURIN_PASSPHRASE_CMD  shell command printing the master passphrase
+  DURIN_HOLDER          set for DURIN_PASSPHRASE_CMD to the holder whose
+                        passphrase to print, for a store under dual control
+  DURIN_PINENTRY        pinentry program asking for the master passphrase,
+                        like --pinentry
+  DURIN_KEY_CACHE       cache the unlocked key in the OS keyring for this
+                        long, e.g. 10m, so that commands in that window do
+                        not ask for the passphrase
+  DURIN_AGENT_SOCK      socket of the agent (see durin agent)
+  DURIN_MENU            picker for durin menu and access prompts
+  DURIN_AUTO_INIT       set to 1 to create the store on first use instead
+                        of requiring durin init
+  DURIN_COMPRESS        set to 1 to compress large entries, such as ones
+                        with long notes, before encrypting them
+  DURIN_VAULT           store to use instead of ~/.durin, like --vault
+  DURIN_KEYFILE         keyfile of the store, like --keyfile
+  DURIN_CONFIG          configuration file to use instead of
+                        ~/.config/durin/config.yaml
+
+With --offline, or offline: true in the configuration file, durin never
+connects out: commands that would, such as sync and audit breach without
+--corpus, fail instead. --offline=false overrides the configuration.
+
+With --batch, durin never prompts: where it would ask for a passphrase,
+a confirmation, a menu choice or an editor, it fails with status 7, so a
+script can supply the passphrase with --passphrase-fd, --passphrase-file
+or $DURIN_PASSPHRASE_CMD and answer confirmations with --yes.
+
+Exit status (stable; scripts may rely on it):
+  0   success
+  1   other errors
+  2   invalid usage
+  3   entry not found
+  4   wrong master passphrase
+  5   store locked or in use by another process
+  6   store corrupt or its master keyset lost, its audit log tampered
+      with, or a bad signature
+  7   --batch given and a prompt was needed
+  8   store read-only (see durin archive)
+  10  audit --fail-on or scan found problems`,
+		Args: cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) > 0 {
+				return usageError{fmt.Errorf("unknown command %q for %q", args[0], cmd.CommandPath())}
+			}
+			return cmd.Help()
+		},
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	var (
+		passphraseFD   int
+		passphraseFile string
+		pinentry       string
+	)
+	root.PersistentFlags().BoolVar(&batchMode, "batch", false, "never prompt; fail with status 7 instead")
+	root.PersistentFlags().BoolVar(&offlineMode, "offline", false, "never connect out: no breach checks against HaveIBeenPwned, sync, share link fetches or Vault")
+	root.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "answer yes to confirmation questions, such as before removing entries")
+	root.PersistentFlags().IntVar(&passphraseFD, "passphrase-fd", -1, "read the master passphrase from this file descriptor")
+	root.PersistentFlags().StringVar(&passphraseFile, "passphrase-file", "", "read the master passphrase from this file")
+	root.PersistentFlags().StringVar(&vaultDir, "vault", os.Getenv(vaultEnv), "use the store or shared vault in this directory instead of ~/.durin")
+	root.PersistentFlags().DurationVar(&lockWait, "lock-wait", 0, "wait this long for another durin process to release the store, e.g. 5s")
+	root.PersistentFlags().StringVar(&keyFile, "keyfile", os.Getenv(keyFileEnv), "keyfile of a store that needs one besides its passphrase")
+	root.PersistentFlags().StringVar(&pinentry, "pinentry", os.Getenv(pinentryEnv), "ask for the master passphrase with this pinentry program, e.g. pinentry-gnome3")
+	root.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if !cmd.Flags().Changed("offline") {
+			c, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			offlineMode = c.Offline
+		}
+		switch {
+		case passphraseFD >= 0 && passphraseFile != "":
+			return usageError{errors.New("--passphrase-fd and --passphrase-file are mutually exclusive")}
+		case passphraseFD >= 0:
+			readPassphrase = passphraseFromFD(passphraseFD)
+			readNewPassphrase = readPassphrase
+			readHolderPassphrase, readNewHolderPassphrase = noHolderPassphrase("--passphrase-fd"), noHolderPassphrase("--passphrase-fd")
+		case passphraseFile != "":
+			readPassphrase = passphraseFromFile(passphraseFile)
+			readNewPassphrase = readPassphrase
+			readHolderPassphrase, readNewHolderPassphrase = noHolderPassphrase("--passphrase-file"), noHolderPassphrase("--passphrase-file")
+		case os.Getenv(passphraseEnvCmd) != "":
+			readPassphrase = passphraseFromCommand(os.Getenv(passphraseEnvCmd))
+			readNewPassphrase = readPassphrase
+			readHolderPassphrase = holderPassphraseFromCommand(os.Getenv(passphraseEnvCmd))
+			readNewHolderPassphrase = readHolderPassphrase
+		case pinentry != "" && !batchMode:
+			readPassphrase = passphraseFromPinentry(pinentry)
+			readNewPassphrase = newPassphraseFromPinentry(pinentry)
+			readHolderPassphrase = holderPassphraseFromPinentry(pinentry)
+			readNewHolderPassphrase = newHolderPassphraseFromPinentry(pinentry)
+		}
+		return nil
+	}
+	root.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+	root.AddCommand(
+		newInitCmd(),
+		newGetCmd(),
+		newPutCmd(),
+		newEditCmd(),
+		newListCmd(),
+		newSearchCmd(),
+		newRmCmd(),
+		newMvCmd(),
+		newDiffCmd(),
+		newUndoCmd(),
+		newEmergencyCmd(),
+		newKeyCmd(),
+		newOTPCmd(),
+		newSSHAgentCmd(),
+		newSystemdCredCmd(),
+		newK8sProviderCmd(),
+		newGenerateCmd(),
+		newSyncCmd(),
+		newShareCmd(),
+		newDelegateCmd(),
+		newACLCmd(),
+		newCompactCmd(),
+		newImportCmd(),
+		newExportCmd(),
+		newUnlockCmd(),
+		newClipCmd(),
+		newOpenCmd(),
+		newAutotypeCmd(),
+		newClipRestoreCmd(),
+		newTUICmd(),
+		newMenuCmd(),
+		newRotateCmd(),
+		newAuditCmd(),
+		newLogCmd(),
+		newPolicyCmd(),
+		newStatsCmd(),
+		newExecCmd(),
+		newScanCmd(),
+		newRenderCmd(),
+		newGitCredentialCmd(),
+		newDockerCredentialCmd(),
+		newAskpassCmd(),
+		newSecretServiceCmd(),
+		newHostCmd(),
+		newServeCmd(),
+		newGRPCCmd(),
+		newAgentCmd(),
+		newMigrateCmd(),
+		newArchiveCmd(),
+	)
+	return root
+}
+
+func run(args []string) int {
+	root := newRootCmd()
+	root.SetArgs(args)
+	cmd, err := root.ExecuteC()
+	if err == nil {
+		return exitOK
+	}
+	var serr exitStatusError
+	if errors.As(err, &serr) {
+		return int(serr)
+	}
+	fmt.Fprintf(os.Stderr, "durin: %v\n", err)
+	var (
+		uerr usageError
+		ferr findingsError
+	)
+	switch {
+	case errors.As(err, &uerr):
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+		return exitUsage
+	case errors.As(err, &ferr):
+		return exitFindings
+	case errors.Is(err, store.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, store.ErrBadPassphrase):
+		return exitBadPassphrase
+	case errors.Is(err, store.ErrLocked), errors.Is(err, store.ErrInUse):
+		return exitLocked
+	case errors.Is(err, store.ErrNoKeyset):
+		var lost *store.LostKeysetError
+		if errors.As(err, &lost) {
+			fmt.Fprint(os.Stderr, lostKeysetHelp(lost.Dir))
+		}
+		return exitCorrupt
+	case errors.Is(err, store.ErrCorrupt), errors.Is(err, store.ErrTampered), errors.Is(err, store.ErrBadSignature):
+		return exitCorrupt
+	case errors.Is(err, errPromptNeeded):
+		return exitPromptNeeded
+	case errors.Is(err, store.ErrReadOnly):
+		fmt.Fprintln(os.Stderr, "Run 'durin archive --undo' to make it writable.")
+		return exitReadOnly
+	}
+	return exitError
+}
+
+func main() {
+	secmem.Harden()
+	args := os.Args[1:]
+	// Helpers that other programs find by executable name can be symlinks
+	// to durin.
+	switch filepath.Base(os.Args[0]) {
+	case dockerHelperName:
+		args = append([]string{"docker-credential"}, args...)
+	case askpassHelperName:
+		args = append([]string{"askpass"}, args...)
 	}
-	db.List()
+	os.Exit(run(args))
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// menuEnvCmd names the environment variable overriding the picker command.
+const menuEnvCmd = "DURIN_MENU"
+
+// menuEnvQuestion names the environment variable holding the question the
+// picker is asked, for commands that can show a prompt.
+const menuEnvQuestion = "DURIN_QUESTION"
+
+// defaultMenuCmd returns the picker to use when none is configured: rofi or
+// dmenu in a graphical session, fzf otherwise.
+func defaultMenuCmd() (string, error) {
+	var candidates []string
+	if os.Getenv("WAYLAND_DISPLAY") != "" || os.Getenv("DISPLAY") != "" {
+		candidates = append(candidates,
+			`rofi -dmenu -i -p "${DURIN_QUESTION:-durin}"`,
+			`dmenu -i ${DURIN_QUESTION:+-p "$DURIN_QUESTION"}`)
+	}
+	candidates = append(candidates, "fzf")
+	for _, c := range candidates {
+		if _, err := exec.LookPath(strings.Fields(c)[0]); err == nil {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("no menu program found; install one of rofi, dmenu or fzf, or set $%s", menuEnvCmd)
+}
+
+// pickName runs the shell command menuCmd with names on its stdin, one per
+// line, and returns the line it prints.
+func pickName(menuCmd string, names []string) (string, error) {
+	name, err := runMenu(menuCmd, "", names)
+	if err == errNoChoice {
+		return "", errors.New("no entry selected")
+	}
+	return name, err
+}
+
+// errNoChoice is returned by runMenu when the picker was dismissed.
+var errNoChoice = errors.New("nothing selected")
+
+// askMenu asks question with the picker menuCmd and returns the chosen
+// answer, which is one of answers.
+func askMenu(menuCmd, question string, answers []string) (string, error) {
+	answer, err := runMenu(menuCmd, question, answers)
+	if err != nil {
+		return "", err
+	}
+	if !contains(answers, answer) {
+		return "", errNoChoice
+	}
+	return answer, nil
+}
+
+func runMenu(menuCmd, question string, lines []string) (string, error) {
+	if err := promptAllowed("a choice from the menu"); err != nil {
+		return "", err
+	}
+	cmd := exec.Command("/bin/sh", "-c", menuCmd)
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+	if question != "" {
+		cmd.Env = append(os.Environ(), menuEnvQuestion+"="+question)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", errNoChoice
+		}
+		return "", err
+	}
+	choice := string(bytes.TrimRight(out, "\r\n"))
+	if choice == "" {
+		return "", errNoChoice
+	}
+	return choice, nil
+}
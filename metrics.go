@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// daemonMetrics counts the requests a long-running durin, the agent or the
+// REST server, answers and serves them with its state on /healthz and
+// /metrics, so that it can be monitored like any other service. Neither
+// endpoint needs authentication, and neither tells anything about the
+// entries.
+type daemonMetrics struct {
+	dir   string
+	start time.Time
+	// state reports whether the daemon holds the master key and when it
+	// locks for being idle, zero if it does not.
+	state func() (unlocked bool, relock time.Time)
+	now   func() time.Time
+
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+}
+
+type requestKey struct {
+	op     string
+	failed bool
+}
+
+func newDaemonMetrics(dir string, state func() (bool, time.Time)) *daemonMetrics {
+	return &daemonMetrics{dir: dir, start: time.Now(), state: state, now: time.Now, requests: make(map[requestKey]uint64)}
+}
+
+// count records a request for op.
+func (m *daemonMetrics) count(op string, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{op, failed}]++
+}
+
+// instrument wraps h so that its requests are counted as op, or as op
+// followed by the method when byMethod is set. Replies of 400 and up count
+// as failed.
+func (m *daemonMetrics) instrument(op string, byMethod bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+		name := op
+		if byMethod {
+			name += " " + r.Method
+		}
+		m.count(name, sw.status >= 400)
+	}
+}
+
+// statusWriter remembers the status an http.Handler replied with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// register adds /healthz and /metrics to mux.
+func (m *daemonMetrics) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", m.handleHealth)
+	mux.HandleFunc("/metrics", m.handleMetrics)
+}
+
+// relockIn returns how long until the daemon locks, 0 if it is locked or
+// never locks by itself.
+func (m *daemonMetrics) relockIn() (bool, time.Duration) {
+	unlocked, relock := m.state()
+	if !unlocked || relock.IsZero() {
+		return unlocked, 0
+	}
+	d := relock.Sub(m.now())
+	if d < 0 {
+		d = 0
+	}
+	return unlocked, d
+}
+
+// handleHealth replies whether the daemon can still read the store, with
+// its lock state, as {"status", "unlocked", "relock_in_seconds"}.
+func (m *daemonMetrics) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	unlocked, relock := m.relockIn()
+	resp := struct {
+		Status   string  `json:"status"`
+		Error    string  `json:"error,omitempty"`
+		Unlocked bool    `json:"unlocked"`
+		RelockIn float64 `json:"relock_in_seconds,omitempty"`
+	}{Status: "ok", Unlocked: unlocked, RelockIn: relock.Seconds()}
+	status := http.StatusOK
+	if _, err := store.ListNames(m.dir); err != nil {
+		resp.Status, resp.Error = "failing", err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// handleMetrics replies the metrics in the Prometheus text format.
+func (m *daemonMetrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("durin_requests_total", "counter", "Requests answered, by operation and result.")
+	m.mu.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return !keys[i].failed
+	})
+	for _, k := range keys {
+		result := "ok"
+		if k.failed {
+			result = "error"
+		}
+		fmt.Fprintf(&b, "durin_requests_total{op=%q,result=%q} %d\n", k.op, result, m.requests[k])
+	}
+	m.mu.Unlock()
+
+	unlocked, relock := m.relockIn()
+	metric("durin_unlocked", "gauge", "Whether the master key is held.")
+	if unlocked {
+		b.WriteString("durin_unlocked 1\n")
+	} else {
+		b.WriteString("durin_unlocked 0\n")
+	}
+	metric("durin_relock_seconds", "gauge", "Seconds until the master key is dropped for being idle, 0 if it is not held or never dropped.")
+	fmt.Fprintf(&b, "durin_relock_seconds %g\n", relock.Seconds())
+	metric("durin_start_time_seconds", "gauge", "When the daemon started, in seconds since the epoch.")
+	fmt.Fprintf(&b, "durin_start_time_seconds %d\n", m.start.Unix())
+	if t := lastSyncTime(m.dir); t != nil {
+		metric("durin_last_sync_time_seconds", "gauge", "When the store was last synced, in seconds since the epoch.")
+		fmt.Fprintf(&b, "durin_last_sync_time_seconds %d\n", t.Unix())
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// migrationSource is another password manager's data durin migrate found.
+type migrationSource struct {
+	// Kind is what it is: pass, keepass, bitwarden, 1password or browser.
+	Kind string
+	// Name describes it to the user, and Path is where it is.
+	Name, Path string
+	// Count is the number of entries it holds if that is known without
+	// unlocking it, and -1 otherwise.
+	Count int
+	// Prefix is the name prefix suggested for its entries.
+	Prefix string
+	// Export tells how to export a browser's passwords.
+	Export string
+}
+
+// How deep and how much findMigrationSources looks for exported files
+// under the home directory.
+const (
+	migrationDepth = 3
+	migrationFiles = 20000
+)
+
+// findMigrationSources looks for other password managers' data in home: a
+// pass store, KeePass databases and Bitwarden and 1Password exports near
+// the top of home, and browser profiles.
+func findMigrationSources(home string) []migrationSource {
+	var sources []migrationSource
+	if dir, err := defaultPassDir(); err == nil {
+		if n := countPassEntries(dir); n > 0 {
+			sources = append(sources, migrationSource{Kind: "pass", Name: "pass store", Path: dir, Count: n, Prefix: "pass/"})
+		}
+	}
+	sources = append(sources, findExportFiles(home)...)
+	return append(sources, findBrowsers(home)...)
+}
+
+// countPassEntries returns the number of entries of the pass store in dir.
+func countPassEntries(dir string) int {
+	n := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != dir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".gpg") {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// findExportFiles finds KeePass databases and Bitwarden and 1Password
+// exports in the first few levels of home, leaving out hidden directories
+// and others only programs keep files in.
+func findExportFiles(home string) []migrationSource {
+	var (
+		sources []migrationSource
+		seen    int
+	)
+	filepath.Walk(home, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if seen++; seen > migrationFiles {
+			return errWalkDone
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path == home {
+				return nil
+			}
+			rel, _ := filepath.Rel(home, path)
+			if strings.HasPrefix(name, ".") || name == "node_modules" || name == "Library" || strings.Count(rel, string(filepath.Separator)) >= migrationDepth-1 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		lower := strings.ToLower(name)
+		switch {
+		case strings.HasSuffix(lower, ".kdbx"):
+			sources = append(sources, migrationSource{Kind: "keepass", Name: "KeePass database", Path: path, Count: -1, Prefix: "keepass/"})
+		case strings.HasPrefix(lower, "bitwarden_") && strings.HasSuffix(lower, ".json"):
+			sources = append(sources, migrationSource{Kind: "bitwarden", Name: "Bitwarden export", Path: path, Count: -1, Prefix: "bitwarden/"})
+		case strings.HasSuffix(lower, ".1pux"):
+			sources = append(sources, migrationSource{Kind: "1password", Name: "1Password export", Path: path, Count: -1, Prefix: "1password/"})
+		}
+		return nil
+	})
+	return sources
+}
+
+// errWalkDone ends findExportFiles' walk once it looked at enough files.
+var errWalkDone = errors.New("looked at enough files")
+
+// browser is a web browser whose profiles durin migrate looks for.
+type browser struct {
+	name string
+	// linux and darwin are where it keeps its profiles, relative to the
+	// configuration directory, ~/.config and ~/Library/Application Support.
+	linux, darwin string
+	// export tells how to export its passwords as CSV.
+	export string
+}
+
+var browsers = []browser{
+	{"Google Chrome", "google-chrome", "Google/Chrome", "open chrome://password-manager/settings and choose Export passwords"},
+	{"Chromium", "chromium", "Chromium", "open chrome://password-manager/settings and choose Export passwords"},
+	{"Brave", "BraveSoftware/Brave-Browser", "BraveSoftware/Brave-Browser", "open brave://password-manager/settings and choose Export passwords"},
+	{"Microsoft Edge", "microsoft-edge", "Microsoft Edge", "open edge://wallet/passwords, then the ... menu, and choose Export passwords"},
+	{"Firefox", "../.mozilla/firefox", "Firefox", "open about:logins, then the ... menu, and choose Export Passwords"},
+}
+
+// findBrowsers finds the profiles of the browsers durin knows on this
+// platform.
+func findBrowsers(home string) []migrationSource {
+	var sources []migrationSource
+	for _, b := range browsers {
+		var dir string
+		switch runtime.GOOS {
+		case "linux":
+			dir = filepath.Join(home, ".config", b.linux)
+		case "darwin":
+			dir = filepath.Join(home, "Library", "Application Support", b.darwin)
+		default:
+			return nil
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			sources = append(sources, migrationSource{Kind: "browser", Name: b.name + " profile", Path: dir, Count: -1, Prefix: "browser/", Export: b.export})
+		}
+	}
+	return sources
+}
+
+// newestPasswordCSV returns the newest CSV file in dir that is named like
+// the ones browsers export passwords to, or "" if there is none.
+func newestPasswordCSV(dir string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.csv"))
+	if err != nil {
+		return ""
+	}
+	type found struct {
+		path string
+		mod  int64
+	}
+	var csvs []found
+	for _, f := range files {
+		name := strings.ToLower(filepath.Base(f))
+		if !strings.Contains(name, "password") && !strings.Contains(name, "logins") {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			csvs = append(csvs, found{f, info.ModTime().UnixNano()})
+		}
+	}
+	if len(csvs) == 0 {
+		return ""
+	}
+	sort.Slice(csvs, func(i, j int) bool { return csvs[i].mod > csvs[j].mod })
+	return csvs[0].path
+}
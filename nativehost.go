@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// maxHostMessage is the largest message browsers send to a native host.
+const maxHostMessage = 4 << 20
+
+// hostRequest is a message from the browser extension.
+type hostRequest struct {
+	ID       interface{} `json:"id,omitempty"`
+	Action   string      `json:"action"`
+	URL      string      `json:"url,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Password string      `json:"password,omitempty"`
+
+	// Passkey requests name the relying party and, for passkey-create,
+	// the account; binary values are in unpadded base64url, as WebAuthn
+	// has them.
+	RPID           string   `json:"rp_id,omitempty"`
+	UserHandle     string   `json:"user_handle,omitempty"`
+	UserName       string   `json:"user_name,omitempty"`
+	CredentialIDs  []string `json:"credential_ids,omitempty"`
+	ClientDataHash string   `json:"client_data_hash,omitempty"`
+}
+
+// hostEntry describes an entry matching a page.
+type hostEntry struct {
+	Name     string `json:"name"`
+	Username string `json:"username,omitempty"`
+}
+
+// hostResponse is the reply to a hostRequest.
+type hostResponse struct {
+	ID       interface{} `json:"id,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Entries  []hostEntry `json:"entries,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Password string      `json:"password,omitempty"`
+
+	Passkeys          []hostPasskey `json:"passkeys,omitempty"`
+	CredentialID      string        `json:"credential_id,omitempty"`
+	UserHandle        string        `json:"user_handle,omitempty"`
+	PublicKey         string        `json:"public_key,omitempty"`
+	Algorithm         int           `json:"public_key_algorithm,omitempty"`
+	AttestationObject string        `json:"attestation_object,omitempty"`
+	AuthenticatorData string        `json:"authenticator_data,omitempty"`
+	Signature         string        `json:"signature,omitempty"`
+}
+
+// hostPasskey describes a passkey for a relying party.
+type hostPasskey struct {
+	Name         string `json:"name"`
+	CredentialID string `json:"credential_id"`
+	UserHandle   string `json:"user_handle"`
+	UserName     string `json:"user_name,omitempty"`
+}
+
+// readHostMessage reads one length-prefixed JSON message. Browsers use the
+// native byte order, which is little endian on every platform durin runs on.
+func readHostMessage(r io.Reader, v interface{}) error {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if n > maxHostMessage {
+		return fmt.Errorf("message of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeHostMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// pageOrigin returns the origin (scheme://host[:port]) and host name of a
+// page URL.
+func pageOrigin(page string) (origin, host string, err error) {
+	u, err := url.Parse(page)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", "", fmt.Errorf("invalid page URL %q", page)
+	}
+	return u.Scheme + "://" + u.Host, strings.ToLower(u.Hostname()), nil
+}
+
+// nameMatchesHost reports whether an entry name refers to host: some part
+// of the name is host or a domain it belongs to, as in github.com or
+// web/github.com/alice for gist.github.com.
+func nameMatchesHost(name, host string) bool {
+	for _, part := range strings.Split(strings.ToLower(name), "/") {
+		if !strings.Contains(part, ".") {
+			continue
+		}
+		if host == part || strings.HasSuffix(host, "."+part) {
+			return true
+		}
+	}
+	return false
+}
+
+// originGrants records the page origins the user always allows, in
+// host-origins.json in the store. Origins are not secret, so the file is
+// plain JSON.
+type originGrants struct {
+	path    string
+	allowed map[string]bool
+}
+
+func loadOriginGrants(dir string) (*originGrants, error) {
+	g := &originGrants{path: filepath.Join(dir, "host-origins.json"), allowed: make(map[string]bool)}
+	b, err := ioutil.ReadFile(g.path)
+	if os.IsNotExist(err) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", g.path, err)
+	}
+	for _, o := range list {
+		g.allowed[o] = true
+	}
+	return g, nil
+}
+
+func (g *originGrants) allow(origin string) error {
+	g.allowed[origin] = true
+	list := make([]string, 0, len(g.allowed))
+	for o := range g.allowed {
+		list = append(list, o)
+	}
+	sort.Strings(list)
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(g.path, b)
+}
+
+// Answers offered by access prompts.
+const (
+	answerOnce   = "Allow once"
+	answerAlways = "Always allow"
+	answerDeny   = "Deny"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// nativeHost serves native messaging requests from a browser extension.
+type nativeHost struct {
+	dir    string
+	grants *originGrants
+	// ask shows the user a question and returns the chosen answer.
+	ask func(question string, answers []string) (string, error)
+
+	db *store.DB
+}
+
+// open unlocks the store on first use, so that starting the browser does
+// not prompt for the passphrase.
+func (h *nativeHost) open(ctx context.Context) (*store.DB, error) {
+	if h.db == nil {
+		db, err := openStore(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.db = db
+	}
+	return h.db, nil
+}
+
+// authorize asks the user whether origin may perform action, unless it was
+// always allowed before.
+func (h *nativeHost) authorize(origin, action string) error {
+	if h.grants.allowed[origin] {
+		return nil
+	}
+	answer, err := h.ask(fmt.Sprintf("Allow %s to %s?", origin, action), []string{answerOnce, answerAlways, answerDeny})
+	if err != nil {
+		return errAccessDenied
+	}
+	switch answer {
+	case answerOnce:
+		return nil
+	case answerAlways:
+		return h.grants.allow(origin)
+	default:
+		return errAccessDenied
+	}
+}
+
+func (h *nativeHost) handle(ctx context.Context, req *hostRequest) (*hostResponse, error) {
+	origin, host, err := pageOrigin(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Action {
+	case "search":
+		return h.search(ctx, origin, host)
+	case "get":
+		return h.get(ctx, origin, host, req.Name)
+	case "save":
+		return h.save(ctx, origin, host, req)
+	case "passkey-list", "passkey-create", "passkey-get":
+		if err := checkRPID(origin, host, req.RPID); err != nil {
+			return nil, err
+		}
+		switch req.Action {
+		case "passkey-list":
+			return h.listPasskeys(ctx, origin, req)
+		case "passkey-create":
+			return h.createPasskey(ctx, origin, req)
+		default:
+			return h.getAssertion(ctx, origin, req)
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", req.Action)
+	}
+}
+
+func (h *nativeHost) search(ctx context.Context, origin, host string) (*hostResponse, error) {
+	names, err := store.ListNames(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, name := range names {
+		if nameMatchesHost(name, host) {
+			matches = append(matches, name)
+		}
+	}
+	resp := &hostResponse{}
+	if len(matches) == 0 {
+		return resp, nil
+	}
+	if err := h.authorize(origin, "see your logins"); err != nil {
+		return nil, err
+	}
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range matches {
+		r, err := db.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if r.KindOrDefault() == store.KindLogin {
+			resp.Entries = append(resp.Entries, hostEntry{Name: name, Username: r.Username})
+		}
+	}
+	return resp, nil
+}
+
+// get returns the credentials in name, which must match the page so that
+// one site cannot read another's logins.
+func (h *nativeHost) get(ctx context.Context, origin, host, name string) (*hostResponse, error) {
+	if !nameMatchesHost(name, host) {
+		return nil, fmt.Errorf("entry %q does not belong to %s", name, origin)
+	}
+	if err := h.authorize(origin, "fill your login"); err != nil {
+		return nil, err
+	}
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := db.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &hostResponse{Name: name, Username: r.Username, Password: r.Password}, nil
+}
+
+// save stores a new login for the page in an entry named after its host,
+// or HOST/USERNAME if that is taken.
+func (h *nativeHost) save(ctx context.Context, origin, host string, req *hostRequest) (*hostResponse, error) {
+	if req.Password == "" {
+		return nil, errors.New("no password given")
+	}
+	name := req.Name
+	if name != "" && !nameMatchesHost(name, host) {
+		return nil, fmt.Errorf("entry %q does not belong to %s", name, origin)
+	}
+	// Saving is always confirmed: a page must not be able to add entries
+	// silently.
+	answer, err := h.ask(fmt.Sprintf("Save the login for %s from %s?", req.Username, origin), []string{answerOnce, answerDeny})
+	if err != nil || answer != answerOnce {
+		return nil, errAccessDenied
+	}
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = host
+		if db.Has(name) && req.Username != "" {
+			name = host + "/" + req.Username
+		}
+		if db.Has(name) {
+			return nil, fmt.Errorf("entry %q already exists", name)
+		}
+	}
+	r := &store.Record{}
+	if db.Has(name) {
+		if r, err = db.Get(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	r.Username = req.Username
+	r.SetPassword(req.Password, time.Now())
+	if err := db.Put(ctx, name, r); err != nil {
+		return nil, err
+	}
+	return &hostResponse{Name: name}, nil
+}
+
+// passkeys returns the names and records of the passkeys for rpID, or of
+// those among them with the credential IDs in ids if there are any. The
+// records are to be wiped.
+func (h *nativeHost) passkeys(ctx context.Context, rpID string, ids []string) ([]string, []*store.Record, error) {
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	var (
+		names   []string
+		records []*store.Record
+	)
+	for _, e := range db.ListEntries() {
+		if e.Kind != store.KindPasskey {
+			continue
+		}
+		r, err := db.Peek(ctx, e.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		p := r.Passkey
+		if p == nil || !strings.EqualFold(p.RPID, rpID) || len(want) > 0 && !want[base64.RawURLEncoding.EncodeToString(p.CredentialID)] {
+			r.Wipe()
+			continue
+		}
+		names = append(names, e.Name)
+		records = append(records, r)
+	}
+	return names, records, nil
+}
+
+func (h *nativeHost) listPasskeys(ctx context.Context, origin string, req *hostRequest) (*hostResponse, error) {
+	if err := h.authorize(origin, "see your passkeys"); err != nil {
+		return nil, err
+	}
+	names, records, err := h.passkeys(ctx, req.RPID, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &hostResponse{}
+	for i, r := range records {
+		resp.Passkeys = append(resp.Passkeys, hostPasskey{
+			Name:         names[i],
+			CredentialID: base64.RawURLEncoding.EncodeToString(r.Passkey.CredentialID),
+			UserHandle:   base64.RawURLEncoding.EncodeToString(r.Passkey.UserHandle),
+			UserName:     r.Passkey.UserName,
+		})
+		r.Wipe()
+	}
+	return resp, nil
+}
+
+// createPasskey makes a passkey for the account in req and stores it in
+// an entry named passkeys/RPID/USER_NAME, numbered if that is taken.
+func (h *nativeHost) createPasskey(ctx context.Context, origin string, req *hostRequest) (*hostResponse, error) {
+	handle, err := base64.RawURLEncoding.DecodeString(req.UserHandle)
+	if err != nil || len(handle) == 0 || len(handle) > 64 {
+		return nil, errors.New("invalid user handle")
+	}
+	// Like saving a login, creating a passkey is always confirmed.
+	answer, err := h.ask(fmt.Sprintf("Create a passkey for %s on %s from %s?", req.UserName, req.RPID, origin), []string{answerOnce, answerDeny})
+	if err != nil || answer != answerOnce {
+		return nil, errAccessDenied
+	}
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user := req.UserName
+	if user == "" || strings.Contains(user, "/") {
+		user = req.UserHandle
+	}
+	base := "passkeys/" + strings.ToLower(req.RPID) + "/" + user
+	name := base
+	for i := 2; db.Has(name); i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	r, att, err := newPasskey(strings.ToLower(req.RPID), handle, req.UserName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Wipe()
+	if err := db.Put(ctx, name, r); err != nil {
+		return nil, err
+	}
+	key, err := parseCOSEKey(r.Passkey.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &hostResponse{
+		Name:              name,
+		CredentialID:      base64.RawURLEncoding.EncodeToString(r.Passkey.CredentialID),
+		PublicKey:         base64.RawURLEncoding.EncodeToString(coseKey(key, false)),
+		Algorithm:         coseAlgES256,
+		AttestationObject: base64.RawURLEncoding.EncodeToString(att),
+	}, nil
+}
+
+// getAssertion signs in with a passkey for the relying party: the one in
+// req.CredentialIDs, or the one the user picks.
+func (h *nativeHost) getAssertion(ctx context.Context, origin string, req *hostRequest) (*hostResponse, error) {
+	hash, err := base64.RawURLEncoding.DecodeString(req.ClientDataHash)
+	if err != nil {
+		return nil, errors.New("invalid client data hash")
+	}
+	names, records, err := h.passkeys(ctx, req.RPID, req.CredentialIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, r := range records {
+			r.Wipe()
+		}
+	}()
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no passkey for %s: %w", req.RPID, store.ErrNotFound)
+	}
+	// Every sign-in is confirmed, as the user touching a security key
+	// would.
+	answers := make([]string, 0, len(names)+1)
+	for i, r := range records {
+		answers = append(answers, fmt.Sprintf("%s (%s)", r.Passkey.UserName, names[i]))
+	}
+	answer, err := h.ask(fmt.Sprintf("Sign in to %s from %s as", req.RPID, origin), append(answers, answerDeny))
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	i := 0
+	for i < len(answers) && answers[i] != answer {
+		i++
+	}
+	if i == len(answers) {
+		return nil, errAccessDenied
+	}
+	name, r := names[i], records[i]
+	authData, sig, err := signAssertion(r.Passkey, hash)
+	if err != nil {
+		return nil, err
+	}
+	// Storing the count lets relying parties that check it notice a
+	// cloned key; a store copied elsewhere still counts on its own.
+	db, err := h.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Put(ctx, name, r); err != nil {
+		return nil, err
+	}
+	return &hostResponse{
+		Name:              name,
+		CredentialID:      base64.RawURLEncoding.EncodeToString(r.Passkey.CredentialID),
+		UserHandle:        base64.RawURLEncoding.EncodeToString(r.Passkey.UserHandle),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(sig),
+	}, nil
+}
+
+// serve answers requests from in until the browser closes it.
+func (h *nativeHost) serve(ctx context.Context, in io.Reader, out io.Writer) error {
+	for {
+		var req hostRequest
+		err := readHostMessage(in, &req)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := h.handle(ctx, &req)
+		if err != nil {
+			resp = &hostResponse{Error: err.Error()}
+		}
+		resp.ID = req.ID
+		if err := writeHostMessage(out, resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errOffline is returned where durin would use the network in offline mode.
+var errOffline = errors.New("--offline: not using the network")
+
+// offlineMode, set by --offline or offline: true in the configuration file,
+// makes durin fail wherever it would connect out: breach checks, sync,
+// share links and Vault. Servers durin runs still accept connections.
+var offlineMode bool
+
+// egressAllowed returns an error in offline mode, where durin must not
+// reach out for what. Everything that connects out goes through it, HTTP
+// through newHTTPClient, so that offline mode covers it.
+func egressAllowed(what string) error {
+	if offlineMode {
+		return fmt.Errorf("%w for %s", errOffline, what)
+	}
+	return nil
+}
+
+// newHTTPClient returns the client to make outgoing requests with, which
+// refuses them in offline mode. config may be nil.
+func newHTTPClient(timeout time.Duration, config *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: egressTransport{&http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}},
+	}
+}
+
+// egressTransport checks egressAllowed before every request, redirects
+// included.
+type egressTransport struct {
+	http.RoundTripper
+}
+
+func (t egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := egressAllowed(req.URL.Host); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
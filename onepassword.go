@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// onePUXData is export.data, the JSON document in a 1PUX archive.
+type onePUXData struct {
+	Accounts []struct {
+		Vaults []struct {
+			Attrs struct {
+				Name string `json:"name"`
+			} `json:"attrs"`
+			Items []onePUXItem `json:"items"`
+		} `json:"vaults"`
+	} `json:"accounts"`
+}
+
+// onePUXItem is an item of a 1Password vault.
+type onePUXItem struct {
+	CategoryUUID string `json:"categoryUuid"`
+	State        string `json:"state"`
+	CreatedAt    int64  `json:"createdAt"`
+	UpdatedAt    int64  `json:"updatedAt"`
+	Details      struct {
+		LoginFields []struct {
+			Name        string `json:"name"`
+			Value       string `json:"value"`
+			Designation string `json:"designation"`
+		} `json:"loginFields"`
+		NotesPlain string `json:"notesPlain"`
+		Password   string `json:"password"`
+		Sections   []struct {
+			Fields []struct {
+				Title string                     `json:"title"`
+				ID    string                     `json:"id"`
+				Value map[string]json.RawMessage `json:"value"`
+			} `json:"fields"`
+		} `json:"sections"`
+		PasswordHistory []struct {
+			Value string `json:"value"`
+			Time  int64  `json:"time"`
+		} `json:"passwordHistory"`
+		DocumentAttributes *onePUXFile `json:"documentAttributes"`
+	} `json:"details"`
+	Overview struct {
+		Title string   `json:"title"`
+		URL   string   `json:"url"`
+		Tags  []string `json:"tags"`
+		URLs  []struct {
+			URL string `json:"url"`
+		} `json:"urls"`
+	} `json:"overview"`
+}
+
+// onePUXFile refers to a file in the files folder of a 1PUX archive.
+type onePUXFile struct {
+	FileName   string `json:"fileName"`
+	DocumentID string `json:"documentId"`
+}
+
+// onePUXKinds maps 1Password's category UUIDs to record kinds. The
+// categories durin has no kind for keep their own name as the kind.
+var onePUXKinds = map[string]string{
+	"001": store.KindLogin,
+	"002": store.KindCard,
+	"003": store.KindNote,
+	"004": store.KindIdentity,
+	"005": store.KindLogin,
+	"006": "document",
+	"100": "software-license",
+	"101": "bank-account",
+	"102": "database",
+	"103": "driver-license",
+	"104": "outdoor-license",
+	"105": "membership",
+	"106": "passport",
+	"107": "reward-program",
+	"108": "social-security-number",
+	"109": "wireless-router",
+	"110": "server",
+	"111": "email-account",
+	"112": "api-credential",
+	"113": "medical-record",
+	"114": "ssh-key",
+	"115": "crypto-wallet",
+}
+
+// readOnePUX reads the 1PUX archive at path and maps its items to entries.
+// Vaults become name prefixes; documents and file fields become
+// attachments.
+func readOnePUX(path string) ([]importedEntry, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("not a 1PUX archive: %v", err)
+	}
+	defer zr.Close()
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	f := files["export.data"]
+	if f == nil {
+		return nil, fmt.Errorf("%s has no export.data; is it a 1PUX archive?", path)
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var data onePUXData
+	err = strictjson.Unmarshal(b, &data, importLimits)
+	secmem.Wipe(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export.data in %s: %v", path, err)
+	}
+
+	var entries []importedEntry
+	fail := func(err error) ([]importedEntry, error) {
+		for _, e := range entries {
+			e.Record.Wipe()
+		}
+		return nil, err
+	}
+	taken := make(map[string]bool)
+	for _, acct := range data.Accounts {
+		for _, vault := range acct.Vaults {
+			for i := range vault.Items {
+				item := &vault.Items[i]
+				r, refs := onePUXRecord(item)
+				for _, ref := range refs {
+					a, err := onePUXAttachment(files, ref)
+					if err != nil {
+						r.Wipe()
+						return fail(err)
+					}
+					r.Attachments = append(r.Attachments, a)
+				}
+				name := importName(importNamePart(vault.Attrs.Name) + "/" + importNamePart(item.Overview.Title))
+				entries = append(entries, importedEntry{Name: uniqueName(name, taken), Record: r})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// onePUXAttachment reads the file ref refers to. 1Password stores it as
+// files/DOCUMENTID__FILENAME.
+func onePUXAttachment(files map[string]*zip.File, ref onePUXFile) (store.Attachment, error) {
+	f := files["files/"+ref.DocumentID+"__"+ref.FileName]
+	if f == nil {
+		for name, zf := range files {
+			if strings.HasPrefix(name, "files/"+ref.DocumentID) {
+				f = zf
+				break
+			}
+		}
+	}
+	if f == nil {
+		return store.Attachment{}, fmt.Errorf("attachment %s is missing from the archive", ref.FileName)
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return store.Attachment{}, err
+	}
+	return store.Attachment{Name: ref.FileName, Data: data}, nil
+}
+
+// readZipFile returns the contents of f.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// The sizes in the archive are not to be trusted.
+	return strictjson.ReadAll(rc, importLimits.MaxSize)
+}
+
+// onePUXRecord maps a 1Password item to a record and returns the files it
+// refers to. The username and password come from the login fields, or
+// from section fields with those IDs for categories such as servers and
+// databases; other fields are kept by title, with values such as dates and
+// addresses formatted as text.
+func onePUXRecord(item *onePUXItem) (*store.Record, []onePUXFile) {
+	d := &item.Details
+	r := &store.Record{Notes: d.NotesPlain, Password: d.Password, Tags: item.Overview.Tags}
+	r.Kind = onePUXKinds[item.CategoryUUID]
+	if item.State == "archived" {
+		r.Tags = append(r.Tags, "archived")
+	}
+	if item.CreatedAt > 0 {
+		created := time.Unix(item.CreatedAt, 0).UTC()
+		r.Created = &created
+	}
+	if item.UpdatedAt > 0 {
+		changed := time.Unix(item.UpdatedAt, 0).UTC()
+		r.Changed, r.Modified = &changed, &changed
+	}
+	for _, f := range d.LoginFields {
+		switch {
+		case f.Value == "":
+		case f.Designation == "username" && r.Username == "":
+			r.Username = f.Value
+		case f.Designation == "password" && r.Password == "":
+			r.Password = f.Value
+		default:
+			setField(r, f.Name, f.Value)
+		}
+	}
+	for _, u := range item.Overview.URLs {
+		if u.URL != "" {
+			setURL(r, u.URL)
+		}
+	}
+	if len(item.Overview.URLs) == 0 && item.Overview.URL != "" {
+		setURL(r, item.Overview.URL)
+	}
+	var refs []onePUXFile
+	if d.DocumentAttributes != nil {
+		refs = append(refs, *d.DocumentAttributes)
+	}
+	for _, s := range d.Sections {
+		for _, f := range s.Fields {
+			for typ, raw := range f.Value {
+				if typ == "file" {
+					var ref onePUXFile
+					if json.Unmarshal(raw, &ref) == nil && ref.DocumentID != "" {
+						refs = append(refs, ref)
+					}
+					continue
+				}
+				v := onePUXValue(typ, raw)
+				switch {
+				case v == "":
+				case typ == "totp":
+					if !strings.Contains(v, "://") {
+						v = totpURI(v, item.Overview.Title, r.Username, nil)
+					}
+					setField(r, totpField, v)
+				case f.ID == "username" && r.Username == "":
+					r.Username = v
+				case f.ID == "password" && r.Password == "":
+					r.Password = v
+				default:
+					key := f.Title
+					if key == "" {
+						key = f.ID
+					}
+					setField(r, key, v)
+				}
+			}
+		}
+	}
+	sort.Slice(d.PasswordHistory, func(i, j int) bool { return d.PasswordHistory[i].Time < d.PasswordHistory[j].Time })
+	for _, h := range d.PasswordHistory {
+		r.History = append(r.History, store.HistoryEntry{Password: h.Value, Retired: time.Unix(h.Time, 0).UTC()})
+	}
+	return r, refs
+}
+
+// onePUXValue formats a section field's value of type typ as text.
+func onePUXValue(typ string, raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	switch typ {
+	case "date":
+		var t int64
+		if json.Unmarshal(raw, &t) == nil && t != 0 {
+			return time.Unix(t, 0).UTC().Format("2006-01-02")
+		}
+	case "monthYear":
+		// YYYYMM, as card expiry dates.
+		var ym int
+		if json.Unmarshal(raw, &ym) == nil && ym != 0 {
+			return fmt.Sprintf("%02d/%04d", ym%100, ym/100)
+		}
+	case "email":
+		var e struct {
+			Address string `json:"email_address"`
+		}
+		if json.Unmarshal(raw, &e) == nil {
+			return e.Address
+		}
+	case "address":
+		var a struct {
+			Street, City, State, Zip, Country string
+		}
+		if json.Unmarshal(raw, &a) == nil {
+			var parts []string
+			for _, p := range []string{a.Street, a.City, a.State, a.Zip, a.Country} {
+				if p != "" {
+					parts = append(parts, p)
+				}
+			}
+			return strings.Join(parts, ", ")
+		}
+	case "sshKey":
+		var k struct {
+			PrivateKey string `json:"privateKey"`
+		}
+		if json.Unmarshal(raw, &k) == nil {
+			return k.PrivateKey
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// autoInitEnv names the environment variable that, set to 1, lets commands
+// create a new store on first use instead of requiring durin init.
+const autoInitEnv = "DURIN_AUTO_INIT"
+
+// compressEnv names the environment variable that, set to 1, compresses
+// large entries when they are written.
+const compressEnv = "DURIN_COMPRESS"
+
+// vaultEnv names the environment variable that, like --vault, selects the
+// store to use instead of ~/.durin.
+const vaultEnv = "DURIN_VAULT"
+
+// keyFileEnv names the environment variable that, like --keyfile, gives
+// the keyfile of a store that needs one.
+const keyFileEnv = "DURIN_KEYFILE"
+
+// keyFile is the keyfile of the store, if it needs one; set by --keyfile.
+var keyFile string
+
+// lockWait is how long to wait for another process to release the store;
+// set by --lock-wait.
+var lockWait time.Duration
+
+// vaultDir is the store commands use instead of ~/.durin, such as a shared
+// vault; set by --vault.
+var vaultDir string
+
+// storeDir returns the directory of the store commands use: the one given
+// with --vault, or the user's own.
+func storeDir() (string, error) {
+	if vaultDir == "" {
+		return store.DefaultDir()
+	}
+	if err := os.MkdirAll(vaultDir, 0700); err != nil {
+		return "", err
+	}
+	return vaultDir, nil
+}
+
+// ownStore is the user's own store once it is open, which holds the
+// identity that opens shared vaults. A process can only lock a store once.
+var ownStore *store.DB
+
+// openStore opens the store commands use; see storeDir. A running agent's
+// key or the key cached in the OS keyring is used instead of prompting if
+// there is one. Either way, a passphrase typed here is handed to the agent
+// and the key cached, if enabled, so that later commands need not ask for
+// it. A shared vault is opened with the identity in the user's own store.
+func openStore(ctx context.Context) (*store.DB, error) {
+	dir, err := storeDir()
+	if err != nil {
+		return nil, err
+	}
+	return openStoreDir(ctx, dir)
+}
+
+// openOwnStore opens the user's own store, in ~/.durin, whatever --vault
+// says.
+func openOwnStore(ctx context.Context) (*store.DB, error) {
+	if ownStore != nil {
+		return ownStore, nil
+	}
+	dir, err := store.DefaultDir()
+	if err != nil {
+		return nil, err
+	}
+	return openStoreDir(ctx, dir)
+}
+
+// ownIdentity returns the identity in the user's own store.
+func ownIdentity(ctx context.Context) (*store.Identity, error) {
+	db, err := openOwnStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := db.Identity(false)
+	if errors.Is(err, store.ErrNoIdentity) {
+		return nil, fmt.Errorf("your store holds %w for shared vaults; create one with durin share key", err)
+	}
+	return id, err
+}
+
+// cliPrompter asks for passphrases the way the command line flags and
+// environment say: on the terminal, with pinentry, from a file descriptor,
+// a file or a command.
+type cliPrompter struct{}
+
+func (cliPrompter) Passphrase() ([]byte, error)    { return readPassphrase() }
+func (cliPrompter) NewPassphrase() ([]byte, error) { return readNewPassphrase() }
+func (cliPrompter) HolderPassphrase(holder string) ([]byte, error) {
+	return readHolderPassphrase(holder)
+}
+
+func openStoreDir(ctx context.Context, dir string) (*store.DB, error) {
+	if ownStore != nil && ownStore.Dir() == dir {
+		return ownStore, nil
+	}
+	ttl, err := keyCacheTTL()
+	if err != nil {
+		return nil, err
+	}
+	db, err := store.Open(ctx, dir, store.Options{
+		Prompter:   cliPrompter{},
+		AutoCreate: os.Getenv(autoInitEnv) == "1",
+		Compress:   os.Getenv(compressEnv) == "1",
+		LockWait:   lockWait,
+		CachedKey: func(ctx context.Context, dir string) (*keyset.Handle, tink.AEAD) {
+			if key := agentKey(ctx, dir); key != nil {
+				return nil, key
+			}
+			if ttl > 0 {
+				if ks, key, err := unlockCachedKey(dir); err == nil {
+					return ks, key
+				}
+			}
+			return nil, nil
+		},
+		Unlocked: func(dir string, pw, key []byte) {
+			agentUnlock(dir, pw)
+			if ttl > 0 {
+				if err := cacheKey(keyCacheName(dir), key, ttl); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: failed to cache the key in the OS keyring: %v\n", err)
+				}
+			}
+		},
+		Identity:       ownIdentity,
+		KeyFile:        keyFile,
+		DerivePassword: derivedPassword,
+	})
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if own, err := store.DefaultDir(); err == nil && own == dir {
+		ownStore = db
+	}
+	return db, nil
+}
+
+// closeStore closes db, releasing the store lock for the rest of a long
+// running command.
+func closeStore(db *store.DB) error {
+	if ownStore == db {
+		ownStore = nil
+	}
+	return db.Close()
+}
+
+// lockStore locks the store in dir for commands that use it without
+// opening it.
+func lockStore(ctx context.Context, dir string) error {
+	return storeError(store.LockDir(ctx, dir, lockWait))
+}
+
+// storeError adds hints for the command line to errors from the store
+// package.
+func storeError(err error) error {
+	var (
+		locked  *store.LockedError
+		noStore *store.NoStoreError
+	)
+	switch {
+	case errors.As(err, &locked):
+		return fmt.Errorf("failed to acquire DB lock: the %w by %s; wait with --lock-wait or see durin unlock", store.ErrInUse, describeProcess(locked.PID))
+	case errors.As(err, &noStore):
+		return fmt.Errorf("%w; create one with durin init", err)
+	case errors.Is(err, store.ErrNoKeyFile):
+		return fmt.Errorf("%w; give it with --keyfile or $%s", err, keyFileEnv)
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats accepted by --format.
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+// addFormatFlag registers the --format flag on cmd.
+func addFormatFlag(cmd *cobra.Command, format *string) {
+	cmd.Flags().StringVar(format, "format", formatText, "output format: text, json or yaml")
+	cmd.RegisterFlagCompletionFunc("format", func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+		return []string{formatText, formatJSON, formatYAML}, cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+// writeOutput writes v to w in the requested format, using text to render
+// the human readable form.
+func writeOutput(w io.Writer, format string, v interface{}, text func(io.Writer) error) error {
+	switch format {
+	case formatText:
+		return text(w)
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case formatYAML:
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(v)
+	default:
+		return usageError{fmt.Errorf("unknown output format %q", format)}
+	}
+}
+
+// recordField returns the named field of r, which is either a built-in
+// field or one of its custom fields.
+func recordField(r *store.Record, field string) (string, error) {
+	switch field {
+	case "username":
+		return r.Username, nil
+	case "password":
+		return r.Password, nil
+	case "notes":
+		return r.Notes, nil
+	case "url":
+		return r.LoginURL(), nil
+	}
+	if v, ok := r.Fields[field]; ok {
+		return v, nil
+	}
+	return "", usageError{fmt.Errorf("unknown field %q", field)}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/crypto/chacha20poly1305"
+	"rsc.io/qr"
+)
+
+// A paper backup is the entries as JSON, compressed with zstd and
+// encrypted with XChaCha20-Poly1305 under a key derived from a passphrase
+// of its own, then split into QR codes. Each code holds
+//
+//	DURIN1:SEQ/TOTAL:SET:CRC:DATA
+//
+// where SET is the start of the SHA-256 of the whole backup, telling codes
+// of different backups apart, CRC the CRC-32 of everything between the
+// first and last colons, and DATA a run of the backup in base32. Every part
+// is in the QR alphanumeric alphabet, which packs denser than bytes.
+const (
+	paperPrefix  = "DURIN1:"
+	paperVersion = 1
+	// paperChunk is the number of base32 characters in each code, keeping
+	// them small enough to print and scan reliably.
+	paperChunk = 800
+)
+
+var (
+	paperAD       = []byte("durin paper backup")
+	paperEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// entryBackup is the entries a paper backup or an emergency bundle holds
+// once decrypted.
+type entryBackup struct {
+	Created time.Time     `json:"created"`
+	Entries []backupEntry `json:"entries"`
+}
+
+type backupEntry struct {
+	Name   string        `json:"name"`
+	Record *store.Record `json:"record"`
+}
+
+// packEntries returns the entries called names as a zstd compressed
+// entryBackup, to be encrypted.
+func packEntries(ctx context.Context, db *store.DB, names []string) ([]byte, error) {
+	backup := entryBackup{Created: time.Now().UTC()}
+	defer func() {
+		for _, e := range backup.Entries {
+			e.Record.Wipe()
+		}
+	}()
+	err := db.ForEachOf(ctx, names, func(name string, r *store.Record) error {
+		backup.Entries = append(backup.Entries, backupEntry{name, r})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(b)
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(b, nil), nil
+}
+
+// unpackEntries reverses packEntries.
+func unpackEntries(z []byte) (*entryBackup, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	b, err := dec.DecodeAll(z, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(b)
+	var backup entryBackup
+	if err := json.Unmarshal(b, &backup); err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// backupEntries returns the entries of a decrypted backup, sorted by name,
+// for importEntries.
+func backupEntries(backup *entryBackup) []importedEntry {
+	entries := make([]importedEntry, 0, len(backup.Entries))
+	for _, e := range backup.Entries {
+		if e.Name == "" || e.Record == nil {
+			continue
+		}
+		entries = append(entries, importedEntry{Name: e.Name, Record: e.Record})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// sealPaper encrypts the entries called names with pw into the backup the
+// codes are cut from.
+func sealPaper(ctx context.Context, db *store.DB, names []string, pw []byte) ([]byte, error) {
+	z, err := packEntries(ctx, db, names)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(z)
+
+	salt := random.GetRandomBytes(16)
+	key := store.DeriveKey(pw, salt)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := random.GetRandomBytes(chacha20poly1305.NonceSizeX)
+	out := append([]byte{paperVersion}, salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, z, paperAD), nil
+}
+
+// openPaper decrypts a backup sealed by sealPaper.
+func openPaper(blob, pw []byte) (*entryBackup, error) {
+	const header = 1 + 16 + chacha20poly1305.NonceSizeX
+	if len(blob) < header || blob[0] != paperVersion {
+		return nil, errors.New("not a durin paper backup, or one from a newer version")
+	}
+	salt, nonce := blob[1:17], blob[17:header]
+	key := store.DeriveKey(pw, salt)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	z, err := aead.Open(nil, nonce, blob[header:], paperAD)
+	if err != nil {
+		return nil, errors.New("wrong passphrase for the paper backup")
+	}
+	defer secmem.Wipe(z)
+	backup, err := unpackEntries(z)
+	if err != nil {
+		return nil, fmt.Errorf("damaged paper backup: %v", err)
+	}
+	return backup, nil
+}
+
+// paperSet returns the identifier the codes of blob share.
+func paperSet(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return strings.ToUpper(hex.EncodeToString(sum[:4]))
+}
+
+// paperCodes splits blob into the texts of its codes.
+func paperCodes(blob []byte) []string {
+	data := paperEncoding.EncodeToString(blob)
+	set := paperSet(blob)
+	total := (len(data) + paperChunk - 1) / paperChunk
+	codes := make([]string, 0, total)
+	for seq := 1; len(data) > 0; seq++ {
+		n := paperChunk
+		if n > len(data) {
+			n = len(data)
+		}
+		body := fmt.Sprintf("%d/%d:%s", seq, total, set)
+		codes = append(codes, fmt.Sprintf("%s%s:%08X:%s", paperPrefix, body, crc32.ChecksumIEEE([]byte(body+":"+data[:n])), data[:n]))
+		data = data[n:]
+	}
+	return codes
+}
+
+// paperCode is a code read back by readPaperCodes.
+type paperCode struct {
+	seq, total int
+	set, data  string
+}
+
+// parsePaperCode parses the text of one code, as a scanner reads it or as
+// typed from the print, ignoring whitespace and case.
+func parsePaperCode(s string) (paperCode, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	if !strings.HasPrefix(s, paperPrefix) {
+		return paperCode{}, errors.New("not a durin paper backup code")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, paperPrefix), ":")
+	if len(parts) != 4 {
+		return paperCode{}, errors.New("malformed durin paper backup code")
+	}
+	var c paperCode
+	seq, total, ok := strings.Cut(parts[0], "/")
+	var err1, err2 error
+	c.seq, err1 = strconv.Atoi(seq)
+	c.total, err2 = strconv.Atoi(total)
+	if !ok || err1 != nil || err2 != nil || c.seq < 1 || c.seq > c.total {
+		return paperCode{}, fmt.Errorf("malformed sequence %q in durin paper backup code", parts[0])
+	}
+	body := parts[0] + ":" + parts[1] + ":" + parts[3]
+	if want := fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(body))); parts[2] != want {
+		return paperCode{}, fmt.Errorf("code %d of %d of paper backup %s is damaged: its checksum does not match", c.seq, c.total, parts[1])
+	}
+	c.set, c.data = parts[1], parts[3]
+	return c, nil
+}
+
+// readPaperCodes adds the codes in r, one per line in any order, to codes,
+// keyed by their sequence number. A code read twice is fine, but all must
+// be of the same backup.
+func readPaperCodes(r io.Reader, codes map[int]paperCode) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		c, err := parsePaperCode(sc.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		for _, other := range codes {
+			if other.set != c.set || other.total != c.total {
+				return fmt.Errorf("line %d: code of paper backup %s, but the codes before are of %s", line, c.set, other.set)
+			}
+			break
+		}
+		if other, ok := codes[c.seq]; ok && other.data != c.data {
+			return fmt.Errorf("line %d: code %d of %d read twice with different contents", line, c.seq, c.total)
+		}
+		codes[c.seq] = c
+	}
+	return sc.Err()
+}
+
+// assemblePaper joins the codes read into the backup, checking that none
+// is missing and that the whole matches the backup's identifier.
+func assemblePaper(codes map[int]paperCode) ([]byte, error) {
+	if len(codes) == 0 {
+		return nil, errors.New("no paper backup codes given")
+	}
+	var c paperCode
+	for _, c = range codes {
+		break
+	}
+	var missing []string
+	var data strings.Builder
+	for seq := 1; seq <= c.total; seq++ {
+		code, ok := codes[seq]
+		if !ok {
+			missing = append(missing, strconv.Itoa(seq))
+			continue
+		}
+		data.WriteString(code.data)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("paper backup %s is incomplete: missing code %s of %d", c.set, strings.Join(missing, ", "), c.total)
+	}
+	blob, err := paperEncoding.DecodeString(data.String())
+	if err != nil || paperSet(blob) != c.set {
+		return nil, fmt.Errorf("paper backup %s is damaged: its codes do not add up to it", c.set)
+	}
+	return blob, nil
+}
+
+var paperPage = template.Must(template.New("paper").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>durin paper backup {{.Set}}</title>
+<style>
+body { font-family: sans-serif; margin: 1.5cm; }
+.code { page-break-inside: avoid; margin-bottom: 1cm; }
+.code img { width: 9cm; image-rendering: pixelated; }
+.code pre { font-size: 7pt; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>durin paper backup {{.Set}}</h1>
+<p>{{.Entries}} entries, printed {{.Created}} as {{len .Codes}} codes. The
+backup is encrypted with the passphrase chosen when it was printed; keep
+the two apart.</p>
+<p>To restore it, scan every code, in any order, into a file with one code
+per line and run <code>durin import --paper FILE</code>. Should a code not
+scan, type the text under it on a line of its own instead; spaces and
+case do not matter.</p>
+{{range .Codes}}<div class="code">
+<h2>Code {{.Seq}} of {{.Total}}</h2>
+<img alt="code {{.Seq}} of {{.Total}}" src="{{.Image}}">
+<pre>{{.Text}}</pre>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// writePaper writes the codes of blob to w as an HTML page to print, each
+// with its text under it in case it no longer scans.
+func writePaper(w io.Writer, blob []byte, entries int) error {
+	type code struct {
+		Seq, Total int
+		Image      template.URL
+		Text       string
+	}
+	page := struct {
+		Set, Created string
+		Entries      int
+		Codes        []code
+	}{Set: paperSet(blob), Created: time.Now().Format("2006-01-02"), Entries: entries}
+	texts := paperCodes(blob)
+	for i, text := range texts {
+		c, err := qr.Encode(text, qr.M)
+		if err != nil {
+			return err
+		}
+		img := "data:image/png;base64," + base64.StdEncoding.EncodeToString(c.PNG())
+		page.Codes = append(page.Codes, code{Seq: i + 1, Total: len(texts), Image: template.URL(img), Text: text})
+	}
+	var b bytes.Buffer
+	if err := paperPage.Execute(&b, page); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// gpgEncrypt encrypts plain to file for recipients with gpg.
+func gpgEncrypt(ctx context.Context, file string, recipients []string, plain []byte) error {
+	args := []string{"--quiet", "--yes", "--batch", "--encrypt", "--output", file}
+	for _, r := range recipients {
+		args = append(args, "--recipient", r)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gpg", args...)
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(plain), &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("gpg failed to encrypt %s: %v: %s", file, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// formatPassEntry writes r the way parsePassEntry reads it: the password,
+// then the username and fields as "key: value" lines, otpauth:// URIs on
+// their own, and the notes.
+func formatPassEntry(r *store.Record) []byte {
+	var b bytes.Buffer
+	b.WriteString(r.Password)
+	b.WriteByte('\n')
+	if r.Username != "" {
+		fmt.Fprintf(&b, "login: %s\n", r.Username)
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := r.Fields[k]; strings.HasPrefix(strings.ToLower(v), "otpauth://") {
+			fmt.Fprintf(&b, "%s\n", v)
+		} else {
+			fmt.Fprintf(&b, "%s: %s\n", k, v)
+		}
+	}
+	if r.Notes != "" {
+		b.WriteString(r.Notes)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// passPath returns the file under dir that pass keeps the entry called name
+// in, refusing names that would leave dir.
+func passPath(dir, name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("entry %q cannot be a pass file name", name)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)+".gpg"), nil
+}
+
+// writePassStore writes the entries called names from db as a password
+// store in dir, encrypted for recipients, and returns how many it wrote.
+// dir must be empty or not exist.
+func writePassStore(ctx context.Context, db *store.DB, dir string, recipients, names []string) (int, error) {
+	if len(recipients) == 0 {
+		return 0, errors.New("no gpg key given")
+	}
+	if f, err := os.Open(dir); err == nil {
+		_, err := f.Readdirnames(1)
+		f.Close()
+		if err == nil {
+			return 0, fmt.Errorf("%s is not empty", dir)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, ".gpg-id"), []byte(strings.Join(recipients, "\n")+"\n")); err != nil {
+		return 0, err
+	}
+	files := make([]string, len(names))
+	for i, name := range names {
+		file, err := passPath(dir, name)
+		if err != nil {
+			return 0, err
+		}
+		files[i] = file
+	}
+	written := 0
+	err := db.ForEachOf(ctx, names, func(name string, r *store.Record) error {
+		plain := secmem.NewBuffer(formatPassEntry(r))
+		r.Wipe()
+		file := files[written]
+		err := os.MkdirAll(filepath.Dir(file), 0700)
+		if err == nil {
+			err = gpgEncrypt(ctx, file, recipients, plain.Bytes())
+		}
+		plain.Wipe()
+		if err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	return written, err
+}
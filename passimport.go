@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// defaultPassDir returns the directory pass uses: $PASSWORD_STORE_DIR or
+// ~/.password-store.
+func defaultPassDir() (string, error) {
+	if dir := os.Getenv("PASSWORD_STORE_DIR"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".password-store"), nil
+}
+
+// gpgDecrypt decrypts file with gpg, which asks for the key's passphrase
+// through gpg-agent if it needs to.
+func gpgDecrypt(ctx context.Context, file string) ([]byte, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "gpg", "--quiet", "--yes", "--batch", "--decrypt", "--", file)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := cmd.Run(); err != nil {
+		secmem.Wipe(out.Bytes())
+		return nil, fmt.Errorf("gpg failed to decrypt %s: %v: %s", file, err, strings.TrimSpace(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// readPassStore reads every entry of the password store in dir, decrypting
+// each file with decrypt. Entry names are the paths of the .gpg files
+// relative to dir, so folders become name prefixes.
+func readPassStore(ctx context.Context, dir string, decrypt func(context.Context, string) ([]byte, error)) ([]importedEntry, error) {
+	var entries []importedEntry
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip .git, .extensions and the like.
+		if strings.HasPrefix(fi.Name(), ".") && p != dir {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || filepath.Ext(p) != ".gpg" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		b, err := decrypt(ctx, p)
+		if err != nil {
+			return err
+		}
+		r := parsePassEntry(string(b))
+		secmem.Wipe(b)
+		modified := fi.ModTime()
+		r.Changed, r.Modified = &modified, &modified
+		entries = append(entries, importedEntry{Name: importName(strings.TrimSuffix(rel, ".gpg")), Record: r})
+		return nil
+	})
+	if err != nil {
+		for _, e := range entries {
+			e.Record.Wipe()
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parsePassEntry maps a decrypted pass entry to a record, following the
+// conventions of pass and its extensions: the first line is the password,
+// "key: value" lines are fields, with user, username and login naming the
+// username, and otpauth:// lines are TOTP secrets. Other lines are notes.
+func parsePassEntry(s string) *store.Record {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	r := &store.Record{Password: lines[0]}
+	var notes []string
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(strings.ToLower(line), "otpauth://") {
+			setField(r, totpField, line)
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !isPassKey(key) || strings.HasPrefix(value, "//") {
+			notes = append(notes, line)
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "user", "username", "login":
+			if r.Username == "" {
+				r.Username = value
+				continue
+			}
+		}
+		setField(r, key, value)
+	}
+	r.Notes = strings.TrimRight(strings.Join(notes, "\n"), "\n")
+	return r
+}
+
+// isPassKey reports whether key looks like the key of a "key: value" line
+// rather than the start of a sentence.
+func isPassKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// setURL sets the URL of r, or adds u as a url field if r has one already.
+func setURL(r *store.Record, u string) {
+	if r.URL == "" {
+		r.URL = u
+		return
+	}
+	setField(r, "url", u)
+}
+
+// setField sets field key of r, numbering the key if it is taken.
+func setField(r *store.Record, key, value string) {
+	if r.Fields == nil {
+		r.Fields = make(map[string]string)
+	}
+	k := key
+	for i := 2; ; i++ {
+		if _, taken := r.Fields[k]; !taken {
+			break
+		}
+		k = fmt.Sprintf("%s%d", key, i)
+	}
+	r.Fields[k] = value
+}
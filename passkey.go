@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// durin is a WebAuthn authenticator for the passkeys in the store: it
+// makes their keys and signs with them, so that the browser extension only
+// ever sees public keys and signatures. Keys are ES256, ECDSA on P-256 with
+// SHA-256, which every relying party accepts, and are kept as COSE_Keys
+// (RFC 9052) in the CBOR subset encoded here.
+
+// COSE values for ES256 keys.
+const (
+	coseKty      = 1
+	coseAlg      = 3
+	coseCrv      = -1
+	coseX        = -2
+	coseY        = -3
+	coseD        = -4
+	coseKtyEC2   = 2
+	coseAlgES256 = -7
+	coseCrvP256  = 1
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	// A passkey in durin can be backed up, and is whenever the store is
+	// synced or copied.
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttested       = 0x40
+)
+
+// CBOR major types.
+const (
+	cborUint  = 0
+	cborNeg   = 1
+	cborBytes = 2
+	cborText  = 3
+	cborMap   = 5
+)
+
+func cborHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major<<5|byte(n))
+	case n <= 0xff:
+		return append(b, major<<5|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, major<<5|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, major<<5|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major<<5|27), n)
+	}
+}
+
+func cborInt(b []byte, v int64) []byte {
+	if v < 0 {
+		return cborHead(b, cborNeg, uint64(-1-v))
+	}
+	return cborHead(b, cborUint, uint64(v))
+}
+
+func cborByteString(b, v []byte) []byte {
+	return append(cborHead(b, cborBytes, uint64(len(v))), v...)
+}
+
+func cborTextString(b []byte, v string) []byte {
+	return append(cborHead(b, cborText, uint64(len(v))), v...)
+}
+
+// coseKey encodes key as a COSE_Key, with its private part if private is
+// set. The members are in the canonical CTAP2 order.
+func coseKey(key *ecdsa.PrivateKey, private bool) []byte {
+	n := 5
+	if private {
+		n++
+	}
+	b := cborHead(nil, cborMap, uint64(n))
+	b = cborInt(cborInt(b, coseKty), coseKtyEC2)
+	b = cborInt(cborInt(b, coseAlg), coseAlgES256)
+	b = cborInt(cborInt(b, coseCrv), coseCrvP256)
+	b = cborByteString(cborInt(b, coseX), key.X.FillBytes(make([]byte, 32)))
+	b = cborByteString(cborInt(b, coseY), key.Y.FillBytes(make([]byte, 32)))
+	if private {
+		b = cborByteString(cborInt(b, coseD), key.D.FillBytes(make([]byte, 32)))
+	}
+	return b
+}
+
+// parseCOSEKey decodes a private ES256 COSE_Key made by coseKey.
+func parseCOSEKey(b []byte) (*ecdsa.PrivateKey, error) {
+	errBad := errors.New("invalid passkey private key")
+	// next reads a head, returning the major type and argument.
+	next := func() (byte, uint64, error) {
+		if len(b) == 0 {
+			return 0, 0, errBad
+		}
+		major, info := b[0]>>5, b[0]&0x1f
+		b = b[1:]
+		if info < 24 {
+			return major, uint64(info), nil
+		}
+		size := 1 << (info - 24)
+		if info > 27 || len(b) < size {
+			return 0, 0, errBad
+		}
+		var n uint64
+		for _, c := range b[:size] {
+			n = n<<8 | uint64(c)
+		}
+		b = b[size:]
+		return major, n, nil
+	}
+	major, n, err := next()
+	if err != nil || major != cborMap {
+		return nil, errBad
+	}
+	ints := make(map[int64]int64)
+	bstrs := make(map[int64][]byte)
+	for i := uint64(0); i < n; i++ {
+		major, k, err := next()
+		if err != nil || major > cborNeg {
+			return nil, errBad
+		}
+		label := int64(k)
+		if major == cborNeg {
+			label = -1 - label
+		}
+		major, v, err := next()
+		if err != nil {
+			return nil, err
+		}
+		switch major {
+		case cborUint:
+			ints[label] = int64(v)
+		case cborNeg:
+			ints[label] = -1 - int64(v)
+		case cborBytes:
+			if uint64(len(b)) < v {
+				return nil, errBad
+			}
+			bstrs[label], b = b[:v], b[v:]
+		default:
+			return nil, errBad
+		}
+	}
+	if ints[coseKty] != coseKtyEC2 || ints[coseAlg] != coseAlgES256 || ints[coseCrv] != coseCrvP256 {
+		return nil, errors.New("unsupported passkey: want an ES256 key")
+	}
+	x, y, d := bstrs[coseX], bstrs[coseY], bstrs[coseD]
+	if len(x) != 32 || len(y) != 32 || len(d) != 32 {
+		return nil, errBad
+	}
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)},
+		D:         new(big.Int).SetBytes(d),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errBad
+	}
+	return key, nil
+}
+
+// authenticatorData returns the authenticator data for rpID, with the
+// attested credential data if attested is not nil.
+func authenticatorData(rpID string, flags byte, count uint32, attested []byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	b := append(h[:], flags)
+	b = binary.BigEndian.AppendUint32(b, count)
+	return append(b, attested...)
+}
+
+// newPasskey makes a passkey for the account userHandle, called userName,
+// at rpID. It returns the record to store and the attestation object to
+// hand the relying party, in the "none" format: durin has no attestation
+// key to vouch for itself with.
+func newPasskey(rpID string, userHandle []byte, userName string) (*store.Record, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	// The AAGUID is all zeros, as for authenticators without attestation.
+	attested := make([]byte, 16, 16+2+len(id)+80)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	attested = append(attested, coseKey(key, false)...)
+	authData := authenticatorData(rpID, flagUserPresent|flagUserVerified|flagBackupEligible|flagBackedUp|flagAttested, 0, attested)
+
+	att := cborHead(nil, cborMap, 3)
+	att = cborTextString(att, "fmt")
+	att = cborTextString(att, "none")
+	att = cborTextString(att, "attStmt")
+	att = cborHead(att, cborMap, 0)
+	att = cborTextString(att, "authData")
+	att = cborByteString(att, authData)
+
+	r := &store.Record{
+		Kind:     store.KindPasskey,
+		Username: userName,
+		URL:      "https://" + rpID,
+		Passkey: &store.Passkey{
+			CredentialID: id,
+			RPID:         rpID,
+			UserHandle:   userHandle,
+			UserName:     userName,
+			PrivateKey:   coseKey(key, true),
+		},
+	}
+	return r, att, nil
+}
+
+// signAssertion signs clientDataHash for a login with the passkey p,
+// counting the signature in p. It returns the authenticator data and the
+// signature over it and clientDataHash.
+func signAssertion(p *store.Passkey, clientDataHash []byte) (authData, sig []byte, err error) {
+	if len(clientDataHash) != sha256.Size {
+		return nil, nil, errors.New("the client data hash must be a SHA-256")
+	}
+	key, err := parseCOSEKey(p.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.SignCount++
+	authData = authenticatorData(p.RPID, flagUserPresent|flagUserVerified|flagBackupEligible|flagBackedUp, p.SignCount, nil)
+	h := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash...))
+	sig, err = ecdsa.SignASN1(rand.Reader, key, h[:])
+	return authData, sig, err
+}
+
+// checkRPID checks that origin, whose host name is host, may use passkeys
+// for rpID: as WebAuthn requires, rpID must be host or a domain it is in,
+// and the page must be served over HTTPS unless on localhost. Unlike
+// browsers, durin has no public suffix list, so it only refuses bare top
+// level domains.
+func checkRPID(origin, host, rpID string) error {
+	rpID = strings.ToLower(rpID)
+	if !strings.HasPrefix(origin, "https://") && host != "localhost" {
+		return fmt.Errorf("%s is not a secure origin", origin)
+	}
+	if rpID == "" || rpID != host && !strings.HasSuffix(host, "."+rpID) || !strings.Contains(rpID, ".") && rpID != "localhost" {
+		return fmt.Errorf("%s cannot use passkeys for %q", origin, rpID)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"golang.org/x/sys/unix"
+)
+
+// passphraseEnvCmd names the environment variable holding a shell command
+// that prints the master passphrase.
+const passphraseEnvCmd = "DURIN_PASSPHRASE_CMD"
+
+// readPassphrase supplies the master passphrase to Read. It prompts on the
+// terminal unless the CLI configured a non-interactive source.
+var readPassphrase = func() ([]byte, error) {
+	pw, err := readSecret("Enter Password: ")
+	if err != nil {
+		return nil, fmt.Errorf("%w; supply the passphrase with --passphrase-fd, --passphrase-file, --pinentry or $%s", err, passphraseEnvCmd)
+	}
+	return pw, nil
+}
+
+// readNewPassphrase supplies the passphrase of a new store. On the terminal
+// it asks twice, so that a typo cannot lock the user out; scripted sources
+// are read once.
+var readNewPassphrase = func() ([]byte, error) {
+	pw, err := readSecret("Enter new passphrase: ")
+	if err != nil {
+		return nil, fmt.Errorf("%w; supply the passphrase with --passphrase-fd, --passphrase-file, --pinentry or $%s", err, passphraseEnvCmd)
+	}
+	again, err := readSecret("Confirm passphrase: ")
+	if err != nil {
+		secmem.Wipe(pw)
+		return nil, err
+	}
+	defer secmem.Wipe(again)
+	if !bytes.Equal(pw, again) {
+		secmem.Wipe(pw)
+		return nil, errors.New("passphrases do not match")
+	}
+	return pw, nil
+}
+
+// readHolderPassphrase supplies the passphrase of holder of a store under
+// dual control, in place of readPassphrase.
+var readHolderPassphrase = func(holder string) ([]byte, error) {
+	pw, err := readSecret(fmt.Sprintf("Passphrase of %s: ", holder))
+	if err != nil {
+		return nil, fmt.Errorf("%w; supply the passphrases with --pinentry or $%s, which is run with $%s set", err, passphraseEnvCmd, holderEnv)
+	}
+	return pw, nil
+}
+
+// readNewHolderPassphrase is readNewPassphrase for holder of a new store
+// under dual control.
+var readNewHolderPassphrase = func(holder string) ([]byte, error) {
+	pw, err := readSecret(fmt.Sprintf("New passphrase of %s: ", holder))
+	if err != nil {
+		return nil, fmt.Errorf("%w; supply the passphrases with --pinentry or $%s, which is run with $%s set", err, passphraseEnvCmd, holderEnv)
+	}
+	again, err := readSecret(fmt.Sprintf("Confirm the passphrase of %s: ", holder))
+	if err != nil {
+		secmem.Wipe(pw)
+		return nil, err
+	}
+	defer secmem.Wipe(again)
+	if !bytes.Equal(pw, again) {
+		secmem.Wipe(pw)
+		return nil, fmt.Errorf("the passphrases of %s do not match", holder)
+	}
+	return pw, nil
+}
+
+// noHolderPassphrase returns the holder passphrase source for flag, which
+// gives a single passphrase and so cannot supply those of several holders.
+func noHolderPassphrase(flag string) func(string) ([]byte, error) {
+	return func(holder string) ([]byte, error) {
+		return nil, fmt.Errorf("%s gives a single passphrase, but the store takes one of each of its holders; supply them with --pinentry or $%s, which is run with $%s set", flag, passphraseEnvCmd, holderEnv)
+	}
+}
+
+// holderEnv names the environment variable $DURIN_PASSPHRASE_CMD finds the
+// name of the holder whose passphrase to print in.
+const holderEnv = "DURIN_HOLDER"
+
+// storePassphrase reads the passphrase of the store db, from each of its
+// holders if it is under dual control, for commands that need it besides
+// the unlocked store.
+func storePassphrase(db *store.DB) ([]byte, error) {
+	holders, err := store.Holders(db.Dir())
+	if err != nil || holders == nil {
+		if err != nil {
+			return nil, err
+		}
+		return readPassphrase()
+	}
+	pws := make([][]byte, 0, len(holders))
+	defer func() {
+		for _, pw := range pws {
+			secmem.Wipe(pw)
+		}
+	}()
+	for _, h := range holders {
+		pw, err := readHolderPassphrase(h)
+		if err != nil {
+			return nil, err
+		}
+		pws = append(pws, pw)
+	}
+	return store.CombinePassphrases(pws), nil
+}
+
+// isTerminal reports whether fd refers to a terminal.
+func isTerminal(fd uintptr) bool {
+	_, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
+	return err == nil
+}
+
+// readLine reads a single line from r, without the line terminator. It reads
+// one byte at a time so that nothing past the newline is consumed.
+func readLine(r io.Reader) ([]byte, error) {
+	var (
+		line []byte
+		buf  [1]byte
+	)
+	for {
+		n, err := r.Read(buf[:])
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// passphraseFromFD returns a passphrase source reading the first line of the
+// already open file descriptor fd. The line is read once and a copy handed
+// out on every call, as later reads would find the descriptor drained; fd is
+// left open since it may be stdin.
+func passphraseFromFD(fd int) func() ([]byte, error) {
+	var (
+		mu   sync.Mutex
+		pw   []byte
+		err  error
+		read bool
+	)
+	return func() ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !read {
+			read = true
+			pw, err = readFD(fd)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), pw...), nil
+	}
+}
+
+// readFD reads the first line of the file descriptor fd without closing it.
+// It reads with unix.Read rather than through an *os.File, whose finalizer
+// would close fd.
+func readFD(fd int) ([]byte, error) {
+	pw, err := readLine(fdReader(fd))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase from fd %d: %v", fd, err)
+	}
+	return pw, nil
+}
+
+// fdReader is an io.Reader reading a raw file descriptor.
+type fdReader int
+
+func (fd fdReader) Read(p []byte) (int, error) {
+	for {
+		n, err := unix.Read(int(fd), p)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// passphraseFromFile returns a passphrase source reading the first line of
+// the file at path.
+func passphraseFromFile(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		pw, err := readLine(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase from %q: %v", path, err)
+		}
+		return pw, nil
+	}
+}
+
+// passphraseFromCommand returns a passphrase source running command with
+// the shell and reading the first line of its output.
+func passphraseFromCommand(command string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return runPassphraseCommand(command, nil)
+	}
+}
+
+// holderPassphraseFromCommand is passphraseFromCommand for the holders of a
+// store under dual control: command is run with $DURIN_HOLDER set to the
+// holder whose passphrase to print.
+func holderPassphraseFromCommand(command string) func(string) ([]byte, error) {
+	return func(holder string) ([]byte, error) {
+		return runPassphraseCommand(command, []string{holderEnv + "=" + holder})
+	}
+}
+
+// runPassphraseCommand runs command with the shell, with env added to the
+// environment, and returns the first line of its output.
+func runPassphraseCommand(command string, env []string) ([]byte, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("$%s failed: %v", passphraseEnvCmd, err)
+		}
+		return nil, err
+	}
+	pw, err := readLine(bytes.NewReader(out))
+	if err != nil {
+		return nil, fmt.Errorf("$%s printed no passphrase", passphraseEnvCmd)
+	}
+	return pw, nil
+}
@@ -3,14 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
-	"github.com/google/tink/go/aead"
-	"github.com/google/tink/go/keyset"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/google/tink/go/subtle/random"
-	"github.com/google/tink/go/tink"
 	"golang.org/x/sys/unix"
 )
 
@@ -19,7 +18,7 @@ const (
 )
 
 func setSecretInputTermMode(fd uintptr) (func(), error) {
-	termios, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+	termios, err := unix.IoctlGetTermios(int(fd), ioctlGetTermios)
 	if err != nil {
 		return nil, err
 	}
@@ -28,26 +27,26 @@ func setSecretInputTermMode(fd uintptr) (func(), error) {
 	newState.Lflag &^= unix.ECHO | unix.ICANON
 	newState.Lflag |= unix.ISIG
 	newState.Iflag |= unix.ICRNL
-	if err := unix.IoctlSetTermios(int(fd), unix.TCSETS, &newState); err != nil {
+	if err := unix.IoctlSetTermios(int(fd), ioctlSetTermios, &newState); err != nil {
 		return nil, err
 	}
 
 	return func() {
-		if err := unix.IoctlSetTermios(int(fd), unix.TCSETS, termios); err != nil {
+		if err := unix.IoctlSetTermios(int(fd), ioctlSetTermios, termios); err != nil {
 			panic(err)
 		}
 	}, nil
 }
 
-func readPasswordFromUser(in io.Reader, out io.Writer) []byte {
+func readPasswordFromUser(in io.Reader, out io.Writer, label string) []byte {
 	var b bytes.Buffer
-	prompt := &pwPrompt{o: bufio.NewWriter(out), rr: &runeReader{r: in}}
+	prompt := &pwPrompt{label: label, o: bufio.NewWriter(out), rr: &runeReader{r: in}}
 
 	prompt.writePasswordPrompt()
 
 Read:
 	for {
-		char, err := prompt.ReadRune()
+		char, _, err := prompt.ReadRune()
 		if err != nil {
 			panic(err)
 		}
@@ -71,17 +70,18 @@ Read:
 }
 
 type pwPrompt struct {
-	read int
-	rr   *runeReader
-	o    *bufio.Writer
+	label string
+	read  int
+	rr    *runeReader
+	o     *bufio.Writer
 }
 
-func (pw *pwPrompt) ReadRune() (rune, error) {
-	r, err := pw.rr.ReadRune()
+func (pw *pwPrompt) ReadRune() (rune, int, error) {
+	r, size, err := pw.rr.ReadRune()
 	if err != nil || r == '\n' {
 		pw.o.WriteRune('\n')
 		pw.o.Flush()
-		return r, err
+		return r, size, err
 	}
 	if r == backspaceChar {
 		if pw.read > 0 {
@@ -91,7 +91,7 @@ func (pw *pwPrompt) ReadRune() (rune, error) {
 		pw.read++
 	}
 	pw.writePasswordPrompt()
-	return r, err
+	return r, size, err
 }
 
 func (pw *pwPrompt) writePasswordPrompt() {
@@ -107,7 +107,7 @@ func (pw *pwPrompt) writePasswordPrompt() {
 	if _, err := pw.o.WriteRune('\r'); err != nil {
 		panic(err)
 	}
-	if _, err := pw.o.WriteString("Enter Password: "); err != nil {
+	if _, err := pw.o.WriteString(pw.label); err != nil {
 		panic(err)
 	}
 	for i := 0; i < length; i++ {
@@ -126,34 +126,82 @@ type runeReader struct {
 	r   io.Reader
 }
 
-func (rr *runeReader) ReadRune() (rune, error) {
+func (rr *runeReader) ReadRune() (rune, int, error) {
 	if _, err := rr.r.Read(rr.buf[:]); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return rune(rr.buf[0]), nil
+	return rune(rr.buf[0]), 1, nil
 }
 
-func Read(salt []byte) (tink.AEAD, error) {
-	if len(salt) < 16 {
-		panic(fmt.Sprintf("salt is too small: %d", salt))
+// readSecret prompts for a secret on the controlling terminal without
+// echoing it back. It uses stdin if that is a terminal, and /dev/tty
+// otherwise, so it also works when stdin carries data such as a credential
+// helper request.
+func readSecret(label string) ([]byte, error) {
+	if err := promptAllowed(fmt.Sprintf("%q", strings.TrimSuffix(label, ": "))); err != nil {
+		return nil, err
 	}
-
-	done, err := setSecretInputTermMode(os.Stdin.Fd())
+	in, out := os.Stdin, os.Stderr
+	if !isTerminal(in.Fd()) {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("no terminal to prompt on: %v", err)
+		}
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	done, err := setSecretInputTermMode(in.Fd())
 	if err != nil {
 		return nil, err
 	}
 	defer done()
 
-	const (
-		time    = 1
-		mem     = 64 * 1024
-		threads = 4
-	)
+	return readPasswordFromUser(in, out, label), nil
+}
 
-	kh, err := keyset.NewHandle(aead.ChaCha20Poly1305KeyTemplate())
-	if err != nil {
-		panic(err)
+// errPromptNeeded is returned where durin would prompt in --batch mode.
+var errPromptNeeded = errors.New("--batch: not prompting")
+
+// batchMode, set by --batch, makes durin fail wherever it would prompt,
+// and assumeYes, set by --yes, answers confirmation questions yes.
+var batchMode, assumeYes bool
+
+// promptAllowed returns an error in --batch mode, where durin must not ask
+// for what.
+func promptAllowed(what string) error {
+	if batchMode {
+		return fmt.Errorf("%w for %s", errPromptNeeded, what)
 	}
-	return aead.New(kh)
+	return nil
+}
+
+// canPrompt reports whether durin may prompt on stdin: it is a terminal and
+// --batch was not given.
+func canPrompt() bool {
+	return !batchMode && isTerminal(os.Stdin.Fd())
+}
 
+// confirm asks a yes/no question on the terminal and reports whether the
+// answer was yes. With --yes it answers yes without asking; without a
+// terminal it answers no, and in --batch mode it fails.
+func confirm(question string) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+	if err := promptAllowed(fmt.Sprintf("%q (use --yes)", question)); err != nil {
+		return false, err
+	}
+	if !isTerminal(os.Stdin.Fd()) {
+		return false, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	line, err := readLine(os.Stdin)
+	if err != nil {
+		return false, err
+	}
+	switch string(bytes.ToLower(bytes.TrimSpace(line))) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// addRegexFlag registers the --regex flag on cmd.
+func addRegexFlag(cmd *cobra.Command, regex *bool) {
+	cmd.Flags().BoolVar(regex, "regex", false, "take patterns as regular expressions rather than globs")
+}
+
+// isGlob reports whether name is a glob pattern rather than an entry name.
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// nameMatcher matches entry names against the patterns given as arguments:
+// regular expressions with --regex, and otherwise globs as path.Match
+// understands them, where * does not cross a slash, or plain names.
+type nameMatcher struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+func newNameMatcher(patterns []string, regex bool) (*nameMatcher, error) {
+	m := &nameMatcher{}
+	for _, p := range patterns {
+		if regex {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, usageError{fmt.Errorf("invalid regular expression %q: %v", p, err)}
+			}
+			m.regexps = append(m.regexps, re)
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, usageError{fmt.Errorf("invalid pattern %q: %v", p, err)}
+		}
+		m.globs = append(m.globs, p)
+	}
+	return m, nil
+}
+
+// match reports whether name matches any of the patterns.
+func (m *nameMatcher) match(name string) bool {
+	for _, re := range m.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	for _, g := range m.globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveName returns the one entry of names that pattern matches, for
+// commands working on a single entry; a name that is not a pattern is
+// returned as it is.
+func resolveName(pattern string, regex bool, names []string) (string, error) {
+	if !regex && !isGlob(pattern) {
+		return pattern, nil
+	}
+	m, err := newNameMatcher([]string{pattern}, regex)
+	if err != nil {
+		return "", err
+	}
+	switch matched := m.filter(names); len(matched) {
+	case 0:
+		return "", fmt.Errorf("no entry matches %q", pattern)
+	case 1:
+		return matched[0], nil
+	default:
+		return "", fmt.Errorf("%q matches %d entries: %s", pattern, len(matched), strings.Join(matched, ", "))
+	}
+}
+
+// filter returns the names matching any of the patterns, in their order.
+func (m *nameMatcher) filter(names []string) []string {
+	matched := []string{}
+	for _, name := range names {
+		if m.match(name) {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+// wildcards splits a rename pattern at its wildcards: ** matching any
+// text, * any text within a path element and ? a single character other
+// than a slash. It returns the literal parts around them.
+func wildcards(pattern string) (literals, cards []string) {
+	var lit strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		card := ""
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			card = "**"
+		case pattern[i] == '*' || pattern[i] == '?':
+			card = pattern[i : i+1]
+		}
+		if card == "" {
+			lit.WriteByte(pattern[i])
+			continue
+		}
+		literals = append(literals, lit.String())
+		lit.Reset()
+		cards = append(cards, card)
+		i += len(card) - 1
+	}
+	return append(literals, lit.String()), cards
+}
+
+// renamePattern returns a function mapping the names matching from to
+// those in to, whose wildcards take what the wildcards in from matched,
+// in order, as in 'old/*' to 'new/*'.
+func renamePattern(from, to string) (func(name string) (string, bool), error) {
+	fromLits, fromCards := wildcards(from)
+	toLits, toCards := wildcards(to)
+	if len(fromCards) == 0 {
+		return nil, fmt.Errorf("%q has no wildcard", from)
+	}
+	if len(toCards) != len(fromCards) {
+		return nil, fmt.Errorf("%q has %d wildcards, but %q has %d", to, len(toCards), from, len(fromCards))
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, card := range fromCards {
+		if toCards[i] != card {
+			return nil, fmt.Errorf("wildcard %d of %q is %s, but %s in %q", i+1, to, toCards[i], card, from)
+		}
+		expr.WriteString(regexp.QuoteMeta(fromLits[i]))
+		switch card {
+		case "**":
+			expr.WriteString("(.*)")
+		case "*":
+			expr.WriteString("([^/]*)")
+		case "?":
+			expr.WriteString("([^/])")
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(fromLits[len(fromLits)-1]) + "$")
+	re := regexp.MustCompile(expr.String())
+	return func(name string) (string, bool) {
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			return "", false
+		}
+		var b strings.Builder
+		for i, lit := range toLits {
+			b.WriteString(lit)
+			if i < len(m)-1 {
+				b.WriteString(m[i+1])
+			}
+		}
+		return b.String(), true
+	}, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+)
+
+// pinentryEnv names the environment variable selecting a pinentry program
+// to ask for the master passphrase, like --pinentry.
+const pinentryEnv = "DURIN_PINENTRY"
+
+// errPinentryCancelled is returned when the user closes the pinentry dialog.
+var errPinentryCancelled = errors.New("passphrase entry was cancelled")
+
+// assuanCancelled is the gpg-error code pinentry reports on cancel.
+const assuanCancelled = "83886179"
+
+// passphraseFromPinentry returns a passphrase source asking through the
+// pinentry program, e.g. pinentry-gnome3, pinentry-mac or pinentry-curses.
+// Unlike the terminal prompt it works without a TTY, such as when durin is
+// started from a desktop launcher.
+func passphraseFromPinentry(program string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return runPinentry(program, "Enter the passphrase of your durin store.", "Passphrase:")
+	}
+}
+
+// newPassphraseFromPinentry is passphraseFromPinentry for the passphrase
+// of a new store, which it asks for twice.
+func newPassphraseFromPinentry(program string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		pw, err := runPinentry(program, "Choose a passphrase for your new durin store.", "Passphrase:")
+		if err != nil {
+			return nil, err
+		}
+		again, err := runPinentry(program, "Enter the passphrase again to confirm it.", "Passphrase:")
+		if err != nil {
+			secmem.Wipe(pw)
+			return nil, err
+		}
+		defer secmem.Wipe(again)
+		if !bytes.Equal(pw, again) {
+			secmem.Wipe(pw)
+			return nil, errors.New("passphrases do not match")
+		}
+		return pw, nil
+	}
+}
+
+// holderPassphraseFromPinentry is passphraseFromPinentry for the holders
+// of a store under dual control.
+func holderPassphraseFromPinentry(program string) func(string) ([]byte, error) {
+	return func(holder string) ([]byte, error) {
+		return runPinentry(program, fmt.Sprintf("Enter the passphrase of %s for the durin store.", holder), "Passphrase:")
+	}
+}
+
+// newHolderPassphraseFromPinentry is newPassphraseFromPinentry for the
+// holders of a new store under dual control.
+func newHolderPassphraseFromPinentry(program string) func(string) ([]byte, error) {
+	return func(holder string) ([]byte, error) {
+		pw, err := runPinentry(program, fmt.Sprintf("%s, choose your passphrase for the new durin store.", holder), "Passphrase:")
+		if err != nil {
+			return nil, err
+		}
+		again, err := runPinentry(program, fmt.Sprintf("%s, enter your passphrase again to confirm it.", holder), "Passphrase:")
+		if err != nil {
+			secmem.Wipe(pw)
+			return nil, err
+		}
+		defer secmem.Wipe(again)
+		if !bytes.Equal(pw, again) {
+			secmem.Wipe(pw)
+			return nil, fmt.Errorf("the passphrases of %s do not match", holder)
+		}
+		return pw, nil
+	}
+}
+
+// runPinentry asks for a secret through program, which speaks the Assuan
+// protocol on its stdin and stdout.
+func runPinentry(program, desc, prompt string) ([]byte, error) {
+	cmd := exec.Command(program)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pinentry: %v", err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	p := &pinentry{w: stdin, r: bufio.NewReader(stdout)}
+	if _, err := p.response(); err != nil {
+		return nil, fmt.Errorf("pinentry: %v", err)
+	}
+	cmds := []string{"SETTITLE durin", "SETDESC " + assuanEscape(desc), "SETPROMPT " + assuanEscape(prompt)}
+	// Curses pinentries draw on the terminal named here; GUI ones use it to
+	// find the display's session but ignore it otherwise.
+	tty := os.Getenv("GPG_TTY")
+	if tty == "" {
+		if f, err := os.Open("/dev/tty"); err == nil {
+			f.Close()
+			tty = "/dev/tty"
+		}
+	}
+	if tty != "" {
+		cmds = append(cmds, "OPTION ttyname="+tty)
+		if term := os.Getenv("TERM"); term != "" {
+			cmds = append(cmds, "OPTION ttytype="+term)
+		}
+	}
+	for _, c := range cmds {
+		// Options a pinentry does not know are not fatal.
+		if _, err := p.call(c); err != nil && !strings.HasPrefix(c, "OPTION") {
+			return nil, fmt.Errorf("pinentry: %v", err)
+		}
+	}
+	pin, err := p.call("GETPIN")
+	if err != nil {
+		if err == errPinentryCancelled {
+			return nil, err
+		}
+		return nil, fmt.Errorf("pinentry: %v", err)
+	}
+	p.call("BYE")
+	return pin, nil
+}
+
+// pinentry is a connection to a running pinentry program.
+type pinentry struct {
+	w io.Writer
+	r *bufio.Reader
+}
+
+// call sends one command and returns the data of its response.
+func (p *pinentry) call(command string) ([]byte, error) {
+	if _, err := io.WriteString(p.w, command+"\n"); err != nil {
+		return nil, err
+	}
+	return p.response()
+}
+
+// response reads lines up to the closing OK or ERR, returning the
+// unescaped data of any D lines.
+func (p *pinentry) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := p.r.ReadBytes('\n')
+		if err != nil {
+			secmem.Wipe(data)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		switch {
+		case bytes.Equal(line, []byte("OK")) || bytes.HasPrefix(line, []byte("OK ")):
+			return data, nil
+		case bytes.HasPrefix(line, []byte("ERR ")):
+			secmem.Wipe(data)
+			msg := string(line[len("ERR "):])
+			if strings.HasPrefix(msg, assuanCancelled+" ") || msg == assuanCancelled {
+				return nil, errPinentryCancelled
+			}
+			return nil, errors.New(msg)
+		case bytes.HasPrefix(line, []byte("D ")):
+			data = append(data, assuanUnescape(line[len("D "):])...)
+			secmem.Wipe(line)
+		}
+		// Status (S) and comment (#) lines are ignored.
+	}
+}
+
+// assuanEscape escapes s for use as a command argument.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(s)
+}
+
+// assuanUnescape decodes the %XX escapes of a data line.
+func assuanUnescape(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == '%' && i+2 < len(b) {
+			var c [1]byte
+			if _, err := hex.Decode(c[:], b[i+1:i+3]); err == nil {
+				out = append(out, c[0])
+				i += 2
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return out
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/sys/unix"
+)
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// describeProcess names a process for messages.
+func describeProcess(pid int) string {
+	if pid == 0 {
+		return "another process"
+	}
+	// Only Linux has /proc; elsewhere the PID has to do.
+	if comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+		return fmt.Sprintf("%s (pid %d)", bytes.TrimSpace(comm), pid)
+	}
+	return fmt.Sprintf("pid %d", pid)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Letters used by pronounceable passwords. Ambiguous and awkward consonants
+// (l, q, x, y) are left out so the result is easy to read aloud and type.
+const (
+	pronounceConsonants = "bcdfghjkmnprstvwz"
+	pronounceVowels     = "aeiou"
+)
+
+// generatePronounceable returns a password of the given length alternating
+// consonants and vowels, e.g. "tibomuka".
+func generatePronounceable(length int) (string, error) {
+	return pickPronounceable(length, randomIndex)
+}
+
+// pickPronounceable is generatePronounceable drawing letters with pick.
+func pickPronounceable(length int, pick func(n int) (int, error)) (string, error) {
+	if length <= 0 {
+		return "", fmt.Errorf("invalid password length %d", length)
+	}
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		set := pronounceConsonants
+		if i%2 == 1 {
+			set = pronounceVowels
+		}
+		n, err := pick(len(set))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(set[n])
+	}
+	return b.String(), nil
+}
+
+// pronounceableEntropy returns the entropy in bits of a pronounceable
+// password of the given length.
+func pronounceableEntropy(length int) float64 {
+	consonants := (length + 1) / 2
+	vowels := length / 2
+	return float64(consonants)*math.Log2(float64(len(pronounceConsonants))) +
+		float64(vowels)*math.Log2(float64(len(pronounceVowels)))
+}
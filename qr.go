@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the number of light modules surrounding a QR code, as
+// required by the spec for reliable scanning.
+const qrQuietZone = 4
+
+// writeQR renders text as a QR code using ANSI colours and half-block
+// characters, so each character cell holds two modules. The colours are set
+// explicitly so the code scans on both dark and light terminal themes.
+func writeQR(w io.Writer, text string) error {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return err
+	}
+	black := func(x, y int) bool {
+		x, y = x-qrQuietZone, y-qrQuietZone
+		return code.Black(x, y)
+	}
+	size := code.Size + 2*qrQuietZone
+
+	var b strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			// The foreground draws the upper module, the background the
+			// lower one.
+			fg, bg := "97", "107"
+			if black(x, y) {
+				fg = "30"
+			}
+			if y+1 < size && black(x, y+1) {
+				bg = "40"
+			}
+			b.WriteString("\x1b[" + fg + ";" + bg + "m▀")
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// A query selects entries. Terms are KEY:VALUE, or a bare VALUE matching
+// names; they match when the value of the key contains VALUE, ignoring
+// case, except tag and kind, which must equal it. Terms next to each other
+// must all match, OR between them lets either, a leading - negates a term
+// and parentheses group.
+type query interface {
+	match(e *queryEntry) (bool, error)
+}
+
+// queryEntry is an entry being matched, decrypted only if a term looks
+// into its record.
+type queryEntry struct {
+	store.EntryInfo
+	load   func() (*store.Record, error)
+	record *store.Record
+}
+
+func (e *queryEntry) get() (*store.Record, error) {
+	if e.record == nil {
+		r, err := e.load()
+		if err != nil {
+			return nil, err
+		}
+		e.record = r
+	}
+	return e.record, nil
+}
+
+// queryKeys are the keys terms can have.
+var queryKeys = map[string]bool{
+	"name": true, "tag": true, "kind": true, "user": true, "username": true,
+	"url": true, "note": true, "notes": true, "field": true,
+}
+
+type termQuery struct {
+	key, value string
+}
+
+func (q termQuery) match(e *queryEntry) (bool, error) {
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(q.value))
+	}
+	switch q.key {
+	case "name":
+		return contains(e.Name), nil
+	case "tag":
+		for _, t := range e.Tags {
+			if strings.EqualFold(t, q.value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "kind":
+		kind := e.Kind
+		if kind == "" {
+			kind = store.KindLogin
+		}
+		return strings.EqualFold(kind, q.value), nil
+	}
+	r, err := e.get()
+	if err != nil {
+		return false, err
+	}
+	switch q.key {
+	case "user", "username":
+		return contains(r.Username), nil
+	case "url":
+		return contains(r.LoginURL()), nil
+	case "note", "notes":
+		return contains(r.Notes), nil
+	}
+	for _, v := range r.Fields {
+		if contains(v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type notQuery struct{ q query }
+
+func (q notQuery) match(e *queryEntry) (bool, error) {
+	ok, err := q.q.match(e)
+	return !ok, err
+}
+
+type andQuery []query
+
+func (q andQuery) match(e *queryEntry) (bool, error) {
+	for _, sub := range q {
+		if ok, err := sub.match(e); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+type orQuery []query
+
+func (q orQuery) match(e *queryEntry) (bool, error) {
+	for _, sub := range q {
+		if ok, err := sub.match(e); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// queryTokens splits a query into tokens. A single argument is split at
+// spaces outside double quotes; several arguments were split by the shell,
+// which removed any quotes, so each is a token but for parentheses around
+// it.
+func queryTokens(args []string) ([]string, error) {
+	if len(args) == 1 {
+		return lexQuery(args[0])
+	}
+	var tokens []string
+	for _, a := range args {
+		var closing int
+		for strings.HasPrefix(a, "(") {
+			tokens = append(tokens, "(")
+			a = a[1:]
+		}
+		for strings.HasSuffix(a, ")") {
+			closing++
+			a = a[:len(a)-1]
+		}
+		if a != "" {
+			tokens = append(tokens, a)
+		}
+		for ; closing > 0; closing-- {
+			tokens = append(tokens, ")")
+		}
+	}
+	return tokens, nil
+}
+
+func lexQuery(s string) ([]string, error) {
+	var (
+		tokens []string
+		cur    strings.Builder
+		quoted bool
+		inTerm bool
+	)
+	end := func() {
+		if inTerm {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+			inTerm = false
+		}
+	}
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inTerm = true
+		case quoted:
+			cur.WriteRune(c)
+		case unicode.IsSpace(c):
+			end()
+		case c == '(' || c == ')':
+			end()
+			tokens = append(tokens, string(c))
+		default:
+			cur.WriteRune(c)
+			inTerm = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unclosed quote in query")
+	}
+	end()
+	return tokens, nil
+}
+
+// queryParser parses tokens by recursive descent:
+//
+//	or   = and { "OR" and }
+//	and  = not { not }
+//	not  = [ "-" ] term | "(" or ")"
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseQuery parses the query in args.
+func parseQuery(args []string) (query, error) {
+	tokens, err := queryTokens(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty query")
+	}
+	p := &queryParser{tokens: tokens}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in query", p.tokens[p.pos])
+	}
+	return q, nil
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) or() (query, error) {
+	var qs orQuery
+	for {
+		q, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(qs) == 1 {
+		return qs[0], nil
+	}
+	return qs, nil
+}
+
+func (p *queryParser) and() (query, error) {
+	var qs andQuery
+	for p.pos < len(p.tokens) && p.peek() != "OR" && p.peek() != ")" {
+		q, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+	switch len(qs) {
+	case 0:
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("unexpected %q in query", p.peek())
+		}
+		return nil, errors.New("query ends where a term was expected")
+	case 1:
+		return qs[0], nil
+	}
+	return qs, nil
+}
+
+func (p *queryParser) not() (query, error) {
+	tok := p.peek()
+	p.pos++
+	if tok == "(" {
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("unclosed ( in query")
+		}
+		p.pos++
+		return q, nil
+	}
+	if strings.HasPrefix(tok, "-") && len(tok) > 1 {
+		q, err := p.term(tok[1:])
+		if err != nil {
+			return nil, err
+		}
+		return notQuery{q}, nil
+	}
+	return p.term(tok)
+}
+
+func (p *queryParser) term(tok string) (query, error) {
+	key, value := "name", tok
+	if i := strings.IndexByte(tok, ':'); i > 0 {
+		k := strings.ToLower(tok[:i])
+		if !queryKeys[k] {
+			return nil, fmt.Errorf("unknown search key %q; use name, tag, kind, user, url, note or field", tok[:i])
+		}
+		key, value = k, tok[i+1:]
+	}
+	return termQuery{key, value}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// recoveryWordsPerLine is how many recovery words are printed on a line.
+const recoveryWordsPerLine = 6
+
+// recoveryWords writes key, a recovery key of the store, as words of the
+// EFF list, each standing for a digit of it in base 7776, followed by a
+// checksum so that mistakes copying them back are caught.
+func recoveryWords(key []byte) []string {
+	words := dicewareWords()
+	sum := recoveryChecksum(key)
+	// The leading 1 keeps leading zero bytes of key.
+	b := append(append([]byte{1}, key...), sum...)
+	n := new(big.Int).SetBytes(b)
+	base := big.NewInt(int64(len(words)))
+	var (
+		out   []string
+		digit big.Int
+	)
+	for n.Sign() > 0 {
+		n.DivMod(n, base, &digit)
+		out = append(out, words[digit.Int64()])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// parseRecoveryWords returns the recovery key that recoveryWords wrote as
+// text, which it reads ignoring case and the line numbers printed along.
+func parseRecoveryWords(text string) ([]byte, error) {
+	words := dicewareWords()
+	index := make(map[string]int64, len(words))
+	for i, w := range words {
+		index[w] = int64(i)
+	}
+	n := new(big.Int)
+	base := big.NewInt(int64(len(words)))
+	count := 0
+	for _, w := range strings.Fields(strings.ToLower(text)) {
+		if strings.Trim(w, "0123456789.:") == "" {
+			continue
+		}
+		i, ok := index[w]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a recovery word", w)
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(i))
+		count++
+	}
+	if count == 0 {
+		return nil, errors.New("no recovery words given")
+	}
+	b := n.Bytes()
+	if len(b) < 1+4 || b[0] != 1 {
+		return nil, errors.New("the recovery words are incomplete or mistyped")
+	}
+	key, sum := b[1:len(b)-4], b[len(b)-4:]
+	if !bytes.Equal(sum, recoveryChecksum(key)) {
+		return nil, errors.New("the recovery words are mistyped: their checksum does not match")
+	}
+	return key, nil
+}
+
+// recoveryChecksum returns the checksum recoveryWords appends to key.
+func recoveryChecksum(key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("durin recovery words\x00"))
+	h.Write(key)
+	return h.Sum(nil)[:4]
+}
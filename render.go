@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// renderTemplate executes the template text, resolving
+// {{ secret "NAME" "FIELD" }} references against db. The field defaults to
+// the password.
+func renderTemplate(ctx context.Context, db *store.DB, name, text string) ([]byte, error) {
+	cache := make(map[string]*store.Record)
+	// The output holds copies of the secrets it needs.
+	defer func() {
+		for _, r := range cache {
+			r.Wipe()
+		}
+	}()
+	secret := func(entry string, field ...string) (string, error) {
+		if len(field) > 1 {
+			return "", fmt.Errorf("secret takes an entry name and at most one field")
+		}
+		r, ok := cache[entry]
+		if !ok {
+			var err error
+			if r, err = db.Get(ctx, entry); err != nil {
+				return "", err
+			}
+			cache[entry] = r
+		}
+		f := "password"
+		if len(field) == 1 {
+			f = field[0]
+		}
+		return recordField(r, f)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{"secret": secret}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
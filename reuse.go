@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"sort"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// findReused returns groups of entry names whose passwords are identical.
+// Each group is sorted, and groups are ordered by their first name.
+//
+// Passwords are only compared through an HMAC keyed with a random key that
+// lives for the duration of the call, so neither the digests nor the timing
+// of the map lookups used for grouping reveal anything about the passwords.
+func findReused(ctx context.Context, db *store.DB) ([][]string, error) {
+	key := random.GetRandomBytes(32)
+	byDigest := make(map[string][]string)
+	err := db.ForEach(ctx, func(name string, r *store.Record) error {
+		defer r.Wipe()
+		if r.Password == "" {
+			return nil
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(r.Password))
+		d := string(mac.Sum(nil))
+		byDigest[d] = append(byDigest[d], name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := [][]string{}
+	for _, names := range byDigest {
+		if len(names) > 1 {
+			sort.Strings(names)
+			groups = append(groups, names)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups, nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/godbus/dbus/v5"
+)
+
+// Entries stored through the Secret Service live under this prefix.
+const secretServicePrefix = "secret-service/"
+
+const (
+	ssBusName     = "org.freedesktop.secrets"
+	ssPath        = dbus.ObjectPath("/org/freedesktop/secrets")
+	ssCollection  = ssPath + "/collection/login"
+	ssAliasPath   = ssPath + "/aliases/default"
+	ssSessionPath = ssPath + "/session"
+
+	ssServiceIface    = "org.freedesktop.Secret.Service"
+	ssCollectionIface = "org.freedesktop.Secret.Collection"
+	ssItemIface       = "org.freedesktop.Secret.Item"
+	ssSessionIface    = "org.freedesktop.Secret.Session"
+	propsIface        = "org.freedesktop.DBus.Properties"
+
+	ssLabelProp      = ssItemIface + ".Label"
+	ssAttributesProp = ssItemIface + ".Attributes"
+)
+
+// noPrompt is the path returned where the API allows a prompt, since durin
+// never needs one.
+const noPrompt = dbus.ObjectPath("/")
+
+// ssSecret is the Secret struct of the Secret Service API.
+type ssSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+func ssError(name, format string, args ...interface{}) *dbus.Error {
+	return dbus.NewError(name, []interface{}{fmt.Sprintf(format, args...)})
+}
+
+func ssFailed(err error) *dbus.Error {
+	return dbus.MakeFailedError(err)
+}
+
+func noSuchObject(path dbus.ObjectPath) *dbus.Error {
+	return ssError("org.freedesktop.Secret.Error.NoSuchObject", "no such object %s", path)
+}
+
+var errIsLocked = ssError("org.freedesktop.Secret.Error.IsLocked", "store is locked")
+
+// secretService implements the org.freedesktop.secrets D-Bus API on top of
+// a DB, which it exposes as a single collection, "login", also known by the
+// alias "default". Items are the entries under secretServicePrefix.
+//
+// godbus runs each call in its own goroutine, so every method takes mu.
+type secretService struct {
+	mu   sync.Mutex
+	conn *dbus.Conn
+	db   *store.DB
+	// ctx is the context of the serving command; D-Bus calls carry none
+	// of their own.
+	ctx      context.Context
+	sessions map[dbus.ObjectPath]bool
+	nextID   int
+}
+
+// serveSecretService claims the Secret Service bus name on conn and exports
+// the API backed by db.
+func serveSecretService(ctx context.Context, conn *dbus.Conn, db *store.DB) error {
+	s := &secretService{conn: conn, db: db, ctx: ctx, sessions: make(map[dbus.ObjectPath]bool)}
+	exports := []struct {
+		v       interface{}
+		path    dbus.ObjectPath
+		iface   string
+		subtree bool
+	}{
+		{s, ssPath, ssServiceIface, false},
+		{ssCollectionObj{s}, ssCollection, ssCollectionIface, false},
+		{ssCollectionObj{s}, ssAliasPath, ssCollectionIface, false},
+		{ssItemObj{s}, ssCollection, ssItemIface, true},
+		{ssSessionObj{s}, ssSessionPath, ssSessionIface, true},
+		{ssProps{s}, ssPath, propsIface, false},
+		{ssProps{s}, ssCollection, propsIface, true},
+		{ssProps{s}, ssAliasPath, propsIface, false},
+	}
+	for _, e := range exports {
+		var err error
+		if e.subtree {
+			err = conn.ExportSubtree(e.v, e.path, e.iface)
+		} else {
+			err = conn.Export(e.v, e.path, e.iface)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	reply, err := conn.RequestName(ssBusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return err
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return fmt.Errorf("%s is already owned, is another keyring (e.g. gnome-keyring) running?", ssBusName)
+	}
+	return nil
+}
+
+// itemPath returns the object path of the item for entry name. Object
+// paths only allow [A-Za-z0-9_], so the label is hex encoded.
+func itemPath(name string) dbus.ObjectPath {
+	return ssCollection + "/" + dbus.ObjectPath(hex.EncodeToString([]byte(strings.TrimPrefix(name, secretServicePrefix))))
+}
+
+// itemName returns the entry name for an item path.
+func itemName(path dbus.ObjectPath) (string, bool) {
+	rest := strings.TrimPrefix(string(path), string(ssCollection)+"/")
+	if rest == string(path) || strings.Contains(rest, "/") {
+		return "", false
+	}
+	label, err := hex.DecodeString(rest)
+	if err != nil {
+		return "", false
+	}
+	return secretServicePrefix + string(label), true
+}
+
+// lookupItem returns the entry behind an item path.
+func (s *secretService) lookupItem(path dbus.ObjectPath) (string, *store.Record, *dbus.Error) {
+	name, ok := itemName(path)
+	if !ok || !s.db.Has(name) {
+		return "", nil, noSuchObject(path)
+	}
+	if s.db.Locked() {
+		return "", nil, errIsLocked
+	}
+	r, err := s.db.Get(s.ctx, name)
+	if err != nil {
+		return "", nil, ssFailed(err)
+	}
+	return name, r, nil
+}
+
+func (s *secretService) itemNames() []string {
+	var names []string
+	for _, name := range s.db.List() {
+		if strings.HasPrefix(name, secretServicePrefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (s *secretService) itemPaths() []dbus.ObjectPath {
+	paths := []dbus.ObjectPath{}
+	for _, name := range s.itemNames() {
+		paths = append(paths, itemPath(name))
+	}
+	return paths
+}
+
+// search returns the items whose attributes include attrs.
+func (s *secretService) search(attrs map[string]string) ([]dbus.ObjectPath, *dbus.Error) {
+	paths := []dbus.ObjectPath{}
+	for _, name := range s.itemNames() {
+		r, err := s.db.Peek(s.ctx, name)
+		if err != nil {
+			return nil, ssFailed(err)
+		}
+		if matchAttributes(r.Attributes, attrs) {
+			paths = append(paths, itemPath(name))
+		}
+	}
+	return paths, nil
+}
+
+func matchAttributes(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// secretFor returns the secret of r encoded for session.
+func (s *secretService) secretFor(r *store.Record, session dbus.ObjectPath) (ssSecret, *dbus.Error) {
+	if !s.sessions[session] {
+		return ssSecret{}, ssError("org.freedesktop.Secret.Error.NoSession", "no such session %s", session)
+	}
+	return ssSecret{Session: session, Parameters: []byte{}, Value: []byte(r.Password), ContentType: "text/plain"}, nil
+}
+
+func (s *secretService) emit(path dbus.ObjectPath, signal string, args ...interface{}) {
+	// Signals are advisory; clients re-read state when they miss one.
+	_ = s.conn.Emit(path, signal, args...)
+}
+
+// OpenSession opens a session. Only the "plain" algorithm is supported;
+// libsecret falls back to it when others are refused.
+func (s *secretService) OpenSession(algorithm string, input dbus.Variant) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if algorithm != "plain" {
+		return dbus.Variant{}, noPrompt, ssError("org.freedesktop.DBus.Error.NotSupported", "algorithm %q is not supported", algorithm)
+	}
+	s.nextID++
+	path := ssSessionPath + "/" + dbus.ObjectPath(strconv.Itoa(s.nextID))
+	s.sessions[path] = true
+	return dbus.MakeVariant(""), path, nil
+}
+
+// CreateCollection returns the login collection; durin has only one.
+func (s *secretService) CreateCollection(props map[string]dbus.Variant, alias string) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	return ssCollection, noPrompt, nil
+}
+
+func (s *secretService) SearchItems(attrs map[string]string) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db.Locked() {
+		// Attributes are encrypted, so all a locked store can offer is
+		// every item.
+		return []dbus.ObjectPath{}, s.itemPaths(), nil
+	}
+	paths, err := s.search(attrs)
+	return paths, []dbus.ObjectPath{}, err
+}
+
+// Unlock unlocks the whole store, reading the passphrase the same way the
+// command line does.
+func (s *secretService) Unlock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db.Locked() {
+		if err := s.db.Unlock(s.ctx); err != nil {
+			return nil, noPrompt, ssFailed(err)
+		}
+	}
+	return objects, noPrompt, nil
+}
+
+func (s *secretService) Lock(objects []dbus.ObjectPath) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Lock()
+	return objects, noPrompt, nil
+}
+
+func (s *secretService) GetSecrets(items []dbus.ObjectPath, session dbus.ObjectPath) (map[dbus.ObjectPath]ssSecret, *dbus.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secrets := make(map[dbus.ObjectPath]ssSecret)
+	for _, path := range items {
+		_, r, derr := s.lookupItem(path)
+		if derr != nil {
+			// Missing and locked items are left out.
+			continue
+		}
+		secret, derr := s.secretFor(r, session)
+		if derr != nil {
+			return nil, derr
+		}
+		secrets[path] = secret
+	}
+	return secrets, nil
+}
+
+func (s *secretService) ReadAlias(name string) (dbus.ObjectPath, *dbus.Error) {
+	if name == "default" || name == "login" {
+		return ssCollection, nil
+	}
+	return noPrompt, nil
+}
+
+func (s *secretService) SetAlias(name string, collection dbus.ObjectPath) *dbus.Error {
+	if collection != ssCollection && collection != ssAliasPath {
+		return noSuchObject(collection)
+	}
+	return nil
+}
+
+// ssCollectionObj is the login collection.
+type ssCollectionObj struct{ s *secretService }
+
+func (c ssCollectionObj) Delete() (dbus.ObjectPath, *dbus.Error) {
+	return noPrompt, ssError("org.freedesktop.DBus.Error.NotSupported", "the login collection cannot be deleted")
+}
+
+func (c ssCollectionObj) SearchItems(attrs map[string]string) ([]dbus.ObjectPath, *dbus.Error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if c.s.db.Locked() {
+		return nil, errIsLocked
+	}
+	return c.s.search(attrs)
+}
+
+// CreateItem stores a secret in a new entry named after its label. With
+// replace, an item with exactly the same attributes is overwritten instead.
+func (c ssCollectionObj) CreateItem(props map[string]dbus.Variant, secret ssSecret, replace bool) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db.Locked() {
+		return noPrompt, noPrompt, errIsLocked
+	}
+	if !s.sessions[secret.Session] {
+		return noPrompt, noPrompt, ssError("org.freedesktop.Secret.Error.NoSession", "no such session %s", secret.Session)
+	}
+	label, _ := props[ssLabelProp].Value().(string)
+	attrs, _ := props[ssAttributesProp].Value().(map[string]string)
+
+	var name string
+	r := &store.Record{}
+	if replace {
+		for _, n := range s.itemNames() {
+			old, err := s.db.Peek(s.ctx, n)
+			if err != nil {
+				return noPrompt, noPrompt, ssFailed(err)
+			}
+			if len(old.Attributes) == len(attrs) && matchAttributes(old.Attributes, attrs) {
+				name, r = n, old
+				break
+			}
+		}
+	}
+	created := name == ""
+	if created {
+		name = s.newItemName(label)
+	}
+	r.Attributes = attrs
+	r.SetPassword(string(secret.Value), time.Now())
+	if err := s.db.Put(s.ctx, name, r); err != nil {
+		return noPrompt, noPrompt, ssFailed(err)
+	}
+	path := itemPath(name)
+	if created {
+		s.emit(ssCollection, ssCollectionIface+".ItemCreated", path)
+	} else {
+		s.emit(ssCollection, ssCollectionIface+".ItemChanged", path)
+	}
+	return path, noPrompt, nil
+}
+
+// newItemName returns an unused entry name for label, adding a counter if
+// an item already has that label.
+func (s *secretService) newItemName(label string) string {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		label = "unnamed"
+	}
+	name := secretServicePrefix + label
+	for i := 2; s.db.Has(name); i++ {
+		name = fmt.Sprintf("%s%s (%d)", secretServicePrefix, label, i)
+	}
+	return name
+}
+
+// ssItemObj serves every item below the collection path.
+type ssItemObj struct{ s *secretService }
+
+func msgPath(msg dbus.Message) dbus.ObjectPath {
+	path, _ := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+	return path
+}
+
+func (i ssItemObj) Delete(msg dbus.Message) (dbus.ObjectPath, *dbus.Error) {
+	s := i.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := msgPath(msg)
+	name, _, derr := s.lookupItem(path)
+	if derr != nil {
+		return noPrompt, derr
+	}
+	if err := s.db.Delete(s.ctx, name); err != nil {
+		return noPrompt, ssFailed(err)
+	}
+	s.emit(ssCollection, ssCollectionIface+".ItemDeleted", path)
+	return noPrompt, nil
+}
+
+func (i ssItemObj) GetSecret(msg dbus.Message, session dbus.ObjectPath) (ssSecret, *dbus.Error) {
+	s := i.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, r, derr := s.lookupItem(msgPath(msg))
+	if derr != nil {
+		return ssSecret{}, derr
+	}
+	return s.secretFor(r, session)
+}
+
+func (i ssItemObj) SetSecret(msg dbus.Message, secret ssSecret) *dbus.Error {
+	s := i.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := msgPath(msg)
+	name, r, derr := s.lookupItem(path)
+	if derr != nil {
+		return derr
+	}
+	if !s.sessions[secret.Session] {
+		return ssError("org.freedesktop.Secret.Error.NoSession", "no such session %s", secret.Session)
+	}
+	r.SetPassword(string(secret.Value), time.Now())
+	if err := s.db.Put(s.ctx, name, r); err != nil {
+		return ssFailed(err)
+	}
+	s.emit(ssCollection, ssCollectionIface+".ItemChanged", path)
+	return nil
+}
+
+// ssSessionObj serves every session.
+type ssSessionObj struct{ s *secretService }
+
+func (o ssSessionObj) Close(msg dbus.Message) *dbus.Error {
+	o.s.mu.Lock()
+	defer o.s.mu.Unlock()
+	delete(o.s.sessions, msgPath(msg))
+	return nil
+}
+
+// ssProps implements org.freedesktop.DBus.Properties for every object.
+type ssProps struct{ s *secretService }
+
+func (p ssProps) properties(path dbus.ObjectPath, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	s := p.s
+	switch {
+	case path == ssPath && iface == ssServiceIface:
+		return map[string]dbus.Variant{
+			"Collections": dbus.MakeVariant([]dbus.ObjectPath{ssCollection}),
+		}, nil
+	case (path == ssCollection || path == ssAliasPath) && iface == ssCollectionIface:
+		var modified uint64
+		if _, t, err := store.DataStat(s.db.Dir()); err == nil {
+			modified = uint64(t.Unix())
+		}
+		return map[string]dbus.Variant{
+			"Items":    dbus.MakeVariant(s.itemPaths()),
+			"Label":    dbus.MakeVariant("Login"),
+			"Locked":   dbus.MakeVariant(s.db.Locked()),
+			"Created":  dbus.MakeVariant(uint64(0)),
+			"Modified": dbus.MakeVariant(modified),
+		}, nil
+	case iface == ssItemIface:
+		name, ok := itemName(path)
+		if !ok || !s.db.Has(name) {
+			return nil, noSuchObject(path)
+		}
+		props := map[string]dbus.Variant{
+			"Label":      dbus.MakeVariant(strings.TrimPrefix(name, secretServicePrefix)),
+			"Locked":     dbus.MakeVariant(s.db.Locked()),
+			"Attributes": dbus.MakeVariant(map[string]string{}),
+			"Created":    dbus.MakeVariant(uint64(0)),
+			"Modified":   dbus.MakeVariant(uint64(0)),
+		}
+		if !s.db.Locked() {
+			r, err := s.db.Peek(s.ctx, name)
+			if err != nil {
+				return nil, ssFailed(err)
+			}
+			if r.Attributes != nil {
+				props["Attributes"] = dbus.MakeVariant(r.Attributes)
+			}
+			if r.Created != nil {
+				props["Created"] = dbus.MakeVariant(uint64(r.Created.Unix()))
+			}
+			if r.Modified != nil {
+				props["Modified"] = dbus.MakeVariant(uint64(r.Modified.Unix()))
+			} else if r.Changed != nil {
+				props["Modified"] = dbus.MakeVariant(uint64(r.Changed.Unix()))
+			}
+		}
+		return props, nil
+	}
+	return nil, ssError("org.freedesktop.DBus.Error.UnknownInterface", "no interface %s on %s", iface, path)
+}
+
+func (p ssProps) Get(msg dbus.Message, iface, prop string) (dbus.Variant, *dbus.Error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	props, derr := p.properties(msgPath(msg), iface)
+	if derr != nil {
+		return dbus.Variant{}, derr
+	}
+	v, ok := props[prop]
+	if !ok {
+		return dbus.Variant{}, ssError("org.freedesktop.DBus.Error.UnknownProperty", "no property %s", prop)
+	}
+	return v, nil
+}
+
+func (p ssProps) GetAll(msg dbus.Message, iface string) (map[string]dbus.Variant, *dbus.Error) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return p.properties(msgPath(msg), iface)
+}
+
+// Set supports changing an item's label, which renames its entry, and its
+// attributes.
+func (p ssProps) Set(msg dbus.Message, iface, prop string, value dbus.Variant) *dbus.Error {
+	s := p.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := msgPath(msg)
+	if iface != ssItemIface || (prop != "Label" && prop != "Attributes") {
+		return ssError("org.freedesktop.DBus.Error.PropertyReadOnly", "property %s is read-only", prop)
+	}
+	name, r, derr := s.lookupItem(path)
+	if derr != nil {
+		return derr
+	}
+	switch prop {
+	case "Attributes":
+		attrs, ok := value.Value().(map[string]string)
+		if !ok {
+			return ssError("org.freedesktop.DBus.Error.InvalidArgs", "attributes must be a{ss}")
+		}
+		r.Attributes = attrs
+		if err := s.db.Put(s.ctx, name, r); err != nil {
+			return ssFailed(err)
+		}
+		s.emit(ssCollection, ssCollectionIface+".ItemChanged", path)
+	case "Label":
+		label, ok := value.Value().(string)
+		if !ok {
+			return ssError("org.freedesktop.DBus.Error.InvalidArgs", "label must be a string")
+		}
+		if secretServicePrefix+strings.TrimSpace(label) == name {
+			return nil
+		}
+		newName := s.newItemName(label)
+		if err := s.db.Put(s.ctx, newName, r); err != nil {
+			return ssFailed(err)
+		}
+		if err := s.db.Delete(s.ctx, name); err != nil {
+			return ssFailed(err)
+		}
+		s.emit(ssCollection, ssCollectionIface+".ItemDeleted", path)
+		s.emit(ssCollection, ssCollectionIface+".ItemCreated", itemPath(newName))
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// apiToken is a bearer token handed out by the token endpoint.
+type apiToken struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+	tokenScope
+}
+
+// tokenScope limits what a token may do: with prefixes, only entries whose
+// names start with one of them exist for it, and with readOnly it may not
+// change them. The zero scope allows everything.
+type tokenScope struct {
+	Prefixes []string `json:"prefixes,omitempty"`
+	ReadOnly bool     `json:"read_only,omitempty"`
+}
+
+// scoped reports whether sc allows less than everything.
+func (sc tokenScope) scoped() bool {
+	return sc.Prefixes != nil || sc.ReadOnly
+}
+
+// allows reports whether sc covers the entry called name.
+func (sc tokenScope) allows(name string) bool {
+	if sc.Prefixes == nil {
+		return true
+	}
+	for _, p := range sc.Prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiServer serves the REST API over a DB. Handlers run concurrently, so
+// access to the tokens and idle timer goes through mu; the DB is safe for
+// concurrent use.
+type apiServer struct {
+	mu     sync.Mutex
+	db     *store.DB
+	ttl    time.Duration
+	tokens []apiToken
+	now    func() time.Time
+
+	// lockAfter is how long the server may be idle before it locks.
+	lockAfter time.Duration
+	timer     *time.Timer
+	relockAt  time.Time
+
+	metrics *daemonMetrics
+}
+
+// newAPIServer serves db, which Open left unlocked. The idle timer starts
+// right away, so that a server no request reaches still locks.
+func newAPIServer(db *store.DB, ttl, lockAfter time.Duration) *apiServer {
+	s := &apiServer{db: db, ttl: ttl, lockAfter: lockAfter, now: time.Now}
+	s.metrics = newDaemonMetrics(db.Dir(), s.state)
+	s.mu.Lock()
+	s.touch()
+	s.mu.Unlock()
+	return s
+}
+
+// state reports whether the server holds the master key and when it locks.
+func (s *apiServer) state() (bool, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db.Locked() {
+		return false, time.Time{}
+	}
+	return true, s.relockAt
+}
+
+// touch restarts the idle timer. mu must be held.
+func (s *apiServer) touch() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	if s.lockAfter > 0 {
+		s.timer = time.AfterFunc(s.lockAfter, s.lock)
+		s.relockAt = s.now().Add(s.lockAfter)
+	}
+}
+
+// lock drops the master key and every token, so that clients have to
+// authenticate with the passphrase again.
+func (s *apiServer) lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Lock()
+	s.tokens = nil
+	s.relockAt = time.Time{}
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", s.metrics.instrument("token", false, s.handleToken))
+	mux.HandleFunc("/v1/entries", s.metrics.instrument("list", false, s.authorized(s.handleList)))
+	mux.HandleFunc("/v1/entries/", s.metrics.instrument("entry", true, s.authorized(s.handleEntry)))
+	mux.HandleFunc("/v1/shares/", s.metrics.instrument("share", false, s.handleShare))
+	s.metrics.register(mux)
+	return mux
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{fmt.Sprintf(format, args...)})
+}
+
+// writeStoreError reports an error from the store. Since handlers run
+// without mu held, the server may lock, or the entry go away, while one
+// runs.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, "%v", err)
+	case errors.Is(err, store.ErrLocked):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIError(w, http.StatusUnauthorized, "store is locked; request a new token")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// issueToken returns a new token with scope sc, valid for ttl. mu must be
+// held.
+func (s *apiServer) issueToken(sc tokenScope, ttl time.Duration) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	tok := hex.EncodeToString(b)
+	now := s.now()
+	live := s.tokens[:0]
+	for _, t := range s.tokens {
+		if now.Before(t.expires) {
+			live = append(live, t)
+		}
+	}
+	expires := now.Add(ttl)
+	s.tokens = append(live, apiToken{digest: sha256.Sum256([]byte(tok)), expires: expires, tokenScope: sc})
+	return tok, expires, nil
+}
+
+// validToken returns the token tok if it was issued and has not expired.
+func (s *apiServer) validToken(tok string) (apiToken, bool) {
+	d := sha256.Sum256([]byte(tok))
+	now := s.now()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare(d[:], t.digest[:]) == 1 && now.Before(t.expires) {
+			return t, true
+		}
+	}
+	return apiToken{}, false
+}
+
+// handleToken exchanges the master passphrase, or a token it was exchanged
+// for, for a token: POST {"passphrase": "..."} returns {"token",
+// "expires"}. The request may limit the token to "prefixes" and make it
+// "read_only", and give a shorter "ttl" in seconds, so that a client such
+// as a CI job can be handed a token for just the entries it needs. A ttl
+// of 0, as when it is left out, means the server's --token-ttl.
+func (s *apiServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var req struct {
+		Passphrase string `json:"passphrase"`
+		tokenScope
+		TTL int64 `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request: %v", err)
+		return
+	}
+	ttl := s.ttl
+	if req.TTL < 0 || time.Duration(req.TTL) > s.ttl/time.Second {
+		writeAPIError(w, http.StatusBadRequest, "ttl must be between 0 (default) and %d seconds", int64(s.ttl/time.Second))
+		return
+	} else if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	for _, p := range req.Prefixes {
+		if p == "" {
+			writeAPIError(w, http.StatusBadRequest, "empty prefix; leave out prefixes for a token for every entry")
+			return
+		}
+	}
+	// Holding mu while checking also means guesses, and the memory the key
+	// derivation takes, are serialized.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if req.Passphrase == "" && r.Header.Get("Authorization") != "" {
+		// Only tokens with the full rights of the passphrase may hand out
+		// others, so that a scoped token cannot outlive its TTL by
+		// renewing itself.
+		t, msg := s.authorizeLocked(r)
+		if msg != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "%s", msg)
+			return
+		}
+		if t.scoped() {
+			writeAPIError(w, http.StatusForbidden, "a scoped token cannot issue tokens")
+			return
+		}
+	} else {
+		check := s.db.CheckPassphrase
+		if s.db.Locked() {
+			check = s.db.UnlockWith
+		}
+		if err := check(r.Context(), []byte(req.Passphrase)); err != nil {
+			writeAPIError(w, http.StatusUnauthorized, "%v", err)
+			return
+		}
+		s.touch()
+	}
+	tok, expires, err := s.issueToken(req.tokenScope, ttl)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{tok, expires})
+}
+
+// authorized wraps h so that it requires a valid bearer token, which it
+// passes on.
+func (s *apiServer) authorized(h func(http.ResponseWriter, *http.Request, apiToken)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		t, msg := s.authorizeLocked(r)
+		s.mu.Unlock()
+		if msg != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, "%s", msg)
+			return
+		}
+		h(w, r, t)
+	}
+}
+
+// authorizeLocked checks r's bearer token and restarts the idle timer. It
+// returns the token, or why r is refused. mu must be held.
+func (s *apiServer) authorizeLocked(r *http.Request) (apiToken, string) {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.db.Locked() {
+		return apiToken{}, "store is locked; request a new token"
+	}
+	t, ok := s.validToken(tok)
+	if tok == "" || !ok {
+		return apiToken{}, "missing or expired token"
+	}
+	s.touch()
+	return t, ""
+}
+
+// handleList replies with the names of the entries t covers.
+func (s *apiServer) handleList(w http.ResponseWriter, r *http.Request, t apiToken) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	names := []string{}
+	for _, name := range s.db.List() {
+		if t.allows(name) {
+			names = append(names, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, names)
+}
+
+// handleEntry serves GET, PUT and DELETE on /v1/entries/NAME. Entries
+// outside t's prefixes are not found, so that a scoped token does not
+// learn which exist.
+func (s *apiServer) handleEntry(w http.ResponseWriter, r *http.Request, t apiToken) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/entries/")
+	if name == "" {
+		writeAPIError(w, http.StatusNotFound, "no entry name given")
+		return
+	}
+	if !t.allows(name) {
+		writeAPIError(w, http.StatusNotFound, "password %q not found", name)
+		return
+	}
+	if t.ReadOnly && r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusForbidden, "the token is read-only")
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		if !s.db.Has(name) {
+			writeAPIError(w, http.StatusNotFound, "password %q not found", name)
+			return
+		}
+		rec, err := s.db.Get(ctx, name)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, namedRecord{Name: name, Record: rec})
+	case http.MethodPut:
+		var rec store.Record
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&rec); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid record: %v", err)
+			return
+		}
+		// Like put --force, the body replaces the whole record.
+		if rec.Changed == nil && rec.Password != "" {
+			now := s.now()
+			rec.Changed = &now
+		}
+		if err := s.db.Put(ctx, name, &rec); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !s.db.Has(name) {
+			writeAPIError(w, http.StatusNotFound, "password %q not found", name)
+			return
+		}
+		if err := s.db.Delete(ctx, name); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+	}
+}
+
+// handleShare hands out a link made by durin share --link, once. It needs
+// no token and works while locked: the shared entry is encrypted with a
+// passphrase of its own.
+func (s *apiServer) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	text, err := takeShareLink(s.db.Dir(), strings.TrimPrefix(r.URL.Path, "/v1/shares/"), s.now())
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, "no such link, or it was already opened")
+	case errors.Is(err, errShareExpired):
+		writeAPIError(w, http.StatusGone, "%v", err)
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "%v", err)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, text+"\n")
+	}
+}
+
+// serverCertificate loads the server's certificate from dir, creating a
+// self-signed one for localhost on first use. It is kept so that clients
+// can pin it.
+func serverCertificate(dir string) (tls.Certificate, error) {
+	certPath, keyPath := filepath.Join(dir, "serve.crt"), filepath.Join(dir, "serve.key")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil || !os.IsNotExist(err) {
+		return cert, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "durin serve"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := atomicfile.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := atomicfile.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+// certFingerprint returns the SHA-256 fingerprint of cert's leaf.
+func certFingerprint(cert tls.Certificate) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("empty certificate")
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:]), nil
+}
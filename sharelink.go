@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/google/tink/go/subtle/random"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A shared entry is a single record with its name and expiry as JSON,
+// encrypted with XChaCha20-Poly1305 under a key derived from a passphrase
+// of its own, like a paper backup, and written as
+//
+//	DURINSHARE1:BASE64URL
+//
+// Anyone with the text and the passphrase can decrypt it, so its expiry is
+// only enforced by durin share open; a link served by durin serve is
+// deleted once fetched or expired.
+const (
+	sharePrefix  = "DURINSHARE1:"
+	shareVersion = 1
+	// shareWords is the length of the passphrases durin share generates.
+	shareWords = 5
+	// sharesDir is where links wait in the store until durin serve hands
+	// them out.
+	sharesDir = "shares"
+)
+
+var shareAD = []byte("durin shared entry")
+
+type sharedEntry struct {
+	Name    string        `json:"name"`
+	Created time.Time     `json:"created"`
+	Expires time.Time     `json:"expires"`
+	Record  *store.Record `json:"record"`
+}
+
+// sealShare encrypts the entry e with pw and returns it as text.
+func sealShare(e *sharedEntry, pw []byte) (string, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	defer secmem.Wipe(b)
+	salt := random.GetRandomBytes(16)
+	key := store.DeriveKey(pw, salt)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := random.GetRandomBytes(chacha20poly1305.NonceSizeX)
+	out := append([]byte{shareVersion}, salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, b, shareAD)
+	return sharePrefix + base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// openShare decrypts text sealed by sealShare, refusing it once expired.
+func openShare(text string, pw []byte, now time.Time) (*sharedEntry, error) {
+	const header = 1 + 16 + chacha20poly1305.NonceSizeX
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, sharePrefix) {
+		return nil, errors.New("not a durin shared entry")
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(text[len(sharePrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("damaged shared entry: %v", err)
+	}
+	if len(blob) < header || blob[0] != shareVersion {
+		return nil, errors.New("not a durin shared entry, or one from a newer version")
+	}
+	salt, nonce := blob[1:17], blob[17:header]
+	key := store.DeriveKey(pw, salt)
+	defer secmem.Wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	b, err := aead.Open(nil, nonce, blob[header:], shareAD)
+	if err != nil {
+		return nil, errors.New("wrong passphrase for the shared entry")
+	}
+	defer secmem.Wipe(b)
+	var e sharedEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("damaged shared entry: %v", err)
+	}
+	if e.Record == nil {
+		return nil, errors.New("damaged shared entry: no record")
+	}
+	if !now.Before(e.Expires) {
+		e.Record.Wipe()
+		return nil, fmt.Errorf("the shared entry %s expired on %s", e.Name, e.Expires.Local().Format(time.RFC1123))
+	}
+	return &e, nil
+}
+
+// pendingShare is a link waiting in sharesDir.
+type pendingShare struct {
+	Expires time.Time `json:"expires"`
+	Text    string    `json:"text"`
+}
+
+// addShareLink saves text to be served once by durin serve until expires,
+// and returns the ID of its link.
+func addShareLink(dir, text string, expires time.Time) (string, error) {
+	d := filepath.Join(dir, sharesDir)
+	if err := os.MkdirAll(d, 0700); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(pendingShare{Expires: expires, Text: text})
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random.GetRandomBytes(16))
+	if err := atomicfile.WriteFile(filepath.Join(d, id), b); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// errShareExpired means a link was found but had expired.
+var errShareExpired = errors.New("the link has expired")
+
+// takeShareLink returns the text of the link id and deletes it, so that
+// it is served only once. It returns store.ErrNotFound for unknown, taken
+// and malformed IDs.
+func takeShareLink(dir, id string, now time.Time) (string, error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return "", store.ErrNotFound
+	}
+	path := filepath.Join(dir, sharesDir, id)
+	// Renaming first lets only one of two concurrent requests have it.
+	taken := path + ".taken"
+	if err := os.Rename(path, taken); os.IsNotExist(err) {
+		return "", store.ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	defer os.Remove(taken)
+	b, err := ioutil.ReadFile(taken)
+	if err != nil {
+		return "", err
+	}
+	var p pendingShare
+	if err := json.Unmarshal(b, &p); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if !now.Before(p.Expires) {
+		return "", errShareExpired
+	}
+	return p.Text, nil
+}
+
+// expireShareLinks deletes the expired links in dir.
+func expireShareLinks(dir string, now time.Time) error {
+	d := filepath.Join(dir, sharesDir)
+	files, err := ioutil.ReadDir(d)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(d, f.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var p pendingShare
+		if json.Unmarshal(b, &p) == nil && !now.Before(p.Expires) {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// shareLinkURL returns the link to id under base, pinning the certificate
+// fingerprint fp if not empty.
+func shareLinkURL(base, id, fp string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("invalid share URL %q: want https://HOST[:PORT]", base)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/shares/" + id
+	if fp != "" {
+		u.Fragment = "sha256=" + fp
+	}
+	return u.String(), nil
+}
+
+// fetchShareLink fetches the shared entry a link served by durin serve
+// points to. A "#sha256=FINGERPRINT" fragment pins the server's
+// certificate instead of verifying it.
+func fetchShareLink(ctx context.Context, link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if fp := strings.TrimPrefix(u.Fragment, "sha256="); fp != u.Fragment {
+		want, err := hex.DecodeString(fp)
+		if err != nil || len(want) != sha256.Size {
+			return "", fmt.Errorf("invalid certificate fingerprint %q in the link", fp)
+		}
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("the server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if subtle.ConstantTimeCompare(sum[:], want) != 1 {
+				return fmt.Errorf("the server's certificate has fingerprint %x, not %s as the link says", sum, fp)
+			}
+			return nil
+		}
+	}
+	u.Fragment = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	client := newHTTPClient(30*time.Second, config)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return "", fmt.Errorf("%s: %s", u.Host, e.Error)
+		}
+		return "", fmt.Errorf("%s: %s", u.Host, resp.Status)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// snapshotKind names snapshots to store.DB.SignStatement.
+const snapshotKind = "inventory snapshot"
+
+// snapshotChecks are the audit checks a snapshot reports. Breach checks
+// are left out: they need the network, and their answers change without
+// the store doing so.
+var snapshotChecks = []string{checkWeak, checkReuse, checkExpired, checkStale, checkPolicy}
+
+// snapshot is what export --snapshot writes: an inventory of entries,
+// without any secret, and the signature of its exact bytes.
+type snapshot struct {
+	Inventory json.RawMessage   `json:"inventory"`
+	Signature snapshotSignature `json:"signature"`
+}
+
+type snapshotSignature struct {
+	// Key is the public key of the audit log key of the store of whoever
+	// made the snapshot, and KeyID its fingerprint.
+	Key   string `json:"key"`
+	KeyID string `json:"key_id"`
+	Value []byte `json:"value"`
+}
+
+type snapshotInventory struct {
+	// StoreID is the ID of the store, empty for shared vaults and stores
+	// in format 0.
+	StoreID string    `json:"store_id,omitempty"`
+	Created time.Time `json:"created"`
+	// LogHead is the last entry of the store's audit log, which the
+	// snapshot reflects.
+	LogHead   *store.LogHead  `json:"log_head,omitempty"`
+	Checks    []string        `json:"checks"`
+	Entries   []snapshotEntry `json:"entries"`
+	Compliant int             `json:"compliant"`
+}
+
+type snapshotEntry struct {
+	Name string   `json:"name"`
+	Kind string   `json:"kind"`
+	Tags []string `json:"tags,omitempty"`
+	URL  string   `json:"url,omitempty"`
+	// Owners are the members who can read an entry of a shared vault, or
+	// the owner field of an entry of a store.
+	Owners      []string   `json:"owners,omitempty"`
+	HasPassword bool       `json:"has_password"`
+	HasTOTP     bool       `json:"has_totp,omitempty"`
+	HasPolicy   bool       `json:"has_policy,omitempty"`
+	Rotated     *time.Time `json:"last_rotated,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	// Compliant is set if no check found a problem with the entry.
+	Compliant bool              `json:"compliant"`
+	Findings  []snapshotFinding `json:"findings,omitempty"`
+}
+
+// snapshotFinding is a finding of durin audit about a snapshot entry.
+type snapshotFinding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+}
+
+// ownerField is the custom field naming who is responsible for an entry.
+const ownerField = "owner"
+
+// writeSnapshot writes a signed inventory of the entries called names in
+// db to w. It is signed with the audit log key of the user's own store,
+// which also makes durin verify-snapshot name the key.
+func writeSnapshot(ctx context.Context, db *store.DB, w io.Writer, names []string) (keyID string, err error) {
+	now := time.Now()
+	staleAfter, err := parseAge("365d")
+	if err != nil {
+		return "", err
+	}
+	opts := auditOptions{checks: make(map[string]bool), staleAfter: staleAfter, now: now}
+	for _, c := range snapshotChecks {
+		opts.checks[c] = true
+	}
+	findings, err := runAudit(ctx, db, &opts)
+	if err != nil {
+		return "", err
+	}
+	byName := make(map[string][]snapshotFinding)
+	for _, f := range findings {
+		byName[f.Name] = append(byName[f.Name], snapshotFinding{Check: f.Check, Severity: f.Severity.String(), Detail: f.Detail})
+	}
+
+	inv := snapshotInventory{Created: now.UTC(), Checks: snapshotChecks, Entries: []snapshotEntry{}}
+	_, inv.StoreID = db.Format()
+	if !db.Shared() {
+		head, err := db.VerifyLog(nil)
+		if err != nil {
+			return "", err
+		}
+		inv.LogHead = &head
+	}
+	want := make(map[string]bool, len(names))
+	for _, name := range names {
+		want[name] = true
+	}
+	err = db.ForEach(ctx, func(name string, r *store.Record) error {
+		defer r.Wipe()
+		if !want[name] {
+			return nil
+		}
+		e := snapshotEntry{
+			Name:        name,
+			Kind:        r.KindOrDefault(),
+			Tags:        r.Tags,
+			URL:         r.URL,
+			HasPassword: r.Password != "",
+			HasTOTP:     r.HasTOTP(),
+			HasPolicy:   r.Policy != nil,
+			Rotated:     r.Changed,
+			Expires:     r.Expires,
+			Findings:    byName[name],
+		}
+		e.Compliant = len(e.Findings) == 0
+		if db.Shared() {
+			acl, err := db.ACL(name)
+			if err != nil {
+				return err
+			}
+			e.Owners = acl.Readers
+		} else if o := r.Fields[ownerField]; o != "" {
+			e.Owners = []string{o}
+		}
+		if e.Compliant {
+			inv.Compliant++
+		}
+		inv.Entries = append(inv.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.MarshalIndent(inv, "  ", "  ")
+	if err != nil {
+		return "", err
+	}
+	own, err := openOwnStore(ctx)
+	if err != nil {
+		return "", err
+	}
+	sig, pub, err := own.SignStatement(snapshotKind, b)
+	if err != nil {
+		return "", err
+	}
+	s := snapshot{Inventory: b, Signature: snapshotSignature{Key: pub, KeyID: store.PublicKeyID(pub), Value: sig}}
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return s.Signature.KeyID, err
+}
+
+// verifySnapshot checks the signature of the snapshot in path and returns
+// it with its inventory.
+func verifySnapshot(path string) (*snapshot, *snapshotInventory, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a snapshot: %v", path, err)
+	}
+	if err := store.VerifyStatement(snapshotKind, s.Inventory, s.Signature.Value, s.Signature.Key); err != nil {
+		return nil, nil, err
+	}
+	if id := store.PublicKeyID(s.Signature.Key); id != s.Signature.KeyID {
+		return nil, nil, fmt.Errorf("%w: the snapshot names key %s, but is signed with %s", store.ErrBadSignature, s.Signature.KeyID, id)
+	}
+	var inv snapshotInventory
+	if err := json.Unmarshal(s.Inventory, &inv); err != nil {
+		return nil, nil, fmt.Errorf("%s is not a snapshot: %v", path, err)
+	}
+	return &s, &inv, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/store"
+	"golang.org/x/crypto/ssh"
+	sshagent "golang.org/x/crypto/ssh/agent"
+)
+
+// sshPublicKeyField is the field SSH key records keep their public key in,
+// as an authorized_keys line.
+const sshPublicKeyField = "public_key"
+
+// sshKeyRecord returns a record of kind ssh-key for the private key in
+// pemBytes, as ssh-keygen writes it, called comment. A key protected by a
+// passphrase is decrypted with the one passphrase returns and kept as
+// PKCS #8, since the store's encryption protects it from then on.
+func sshKeyRecord(pemBytes []byte, comment string, passphrase func() ([]byte, error)) (*store.Record, error) {
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		pw, perr := passphrase()
+		if perr != nil {
+			return nil, perr
+		}
+		if key, err = ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, pw); err != nil {
+			return nil, err
+		}
+		if k, ok := key.(*ed25519.PrivateKey); ok {
+			key = *k
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot store a key of type %T: %v", key, err)
+		}
+		pemBytes = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	} else if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pub := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if comment != "" {
+		pub += " " + comment
+	}
+	return &store.Record{
+		Kind:     store.KindSSHKey,
+		Password: string(pemBytes),
+		Fields:   map[string]string{sshPublicKeyField: pub},
+	}, nil
+}
+
+// loadSSHKeys decrypts the ssh-key entries of db under prefixes, or all of
+// them, for an agent, commented with their names.
+func loadSSHKeys(ctx context.Context, db *store.DB, prefixes []string) ([]sshagent.AddedKey, error) {
+	want := make(map[string]bool)
+	for _, e := range db.ListEntries() {
+		if e.Kind == store.KindSSHKey {
+			want[e.Name] = true
+		}
+	}
+	var keys []sshagent.AddedKey
+	for _, name := range exportNames(db, prefixes) {
+		if !want[name] {
+			continue
+		}
+		r, err := db.Get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ssh.ParseRawPrivateKey([]byte(r.Password))
+		r.Wipe()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		keys = append(keys, sshagent.AddedKey{PrivateKey: key, Comment: name})
+	}
+	return keys, nil
+}
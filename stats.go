@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// storeStats is an overview of the store, as shown by durin stats.
+type storeStats struct {
+	Dir      string         `json:"dir" yaml:"dir"`
+	Records  int            `json:"records" yaml:"records"`
+	Kinds    map[string]int `json:"kinds" yaml:"kinds"`
+	DBBytes  int64          `json:"db_bytes" yaml:"db_bytes"`
+	DirBytes int64          `json:"dir_bytes" yaml:"dir_bytes"`
+	Oldest   *datedEntry    `json:"oldest,omitempty" yaml:"oldest,omitempty"`
+	Newest   *datedEntry    `json:"newest,omitempty" yaml:"newest,omitempty"`
+	// Undated counts records that predate change tracking.
+	Undated  int        `json:"undated" yaml:"undated"`
+	LastSync *time.Time `json:"last_sync,omitempty" yaml:"last_sync,omitempty"`
+	Keys     int        `json:"keyset_keys" yaml:"keyset_keys"`
+	// ReadOnly is set if the store is read-only; see durin archive.
+	ReadOnly *store.ReadOnlyInfo `json:"read_only,omitempty" yaml:"read_only,omitempty"`
+}
+
+// datedEntry names an entry and when its password was last changed.
+type datedEntry struct {
+	Name    string    `json:"name" yaml:"name"`
+	Changed time.Time `json:"changed" yaml:"changed"`
+}
+
+func collectStats(ctx context.Context, db *store.DB) (*storeStats, error) {
+	st := &storeStats{Dir: db.Dir(), Kinds: make(map[string]int)}
+	err := db.ForEach(ctx, func(name string, r *store.Record) error {
+		defer r.Wipe()
+		st.Records++
+		st.Kinds[r.KindOrDefault()]++
+		if r.Changed == nil {
+			st.Undated++
+			return nil
+		}
+		if st.Oldest == nil || r.Changed.Before(st.Oldest.Changed) {
+			st.Oldest = &datedEntry{name, *r.Changed}
+		}
+		if st.Newest == nil || r.Changed.After(st.Newest.Changed) {
+			st.Newest = &datedEntry{name, *r.Changed}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if size, _, err := store.DataStat(db.Dir()); err == nil {
+		st.DBBytes = size
+	}
+	err = filepath.Walk(db.Dir(), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			st.DirBytes += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.LastSync = lastSyncTime(db.Dir())
+	st.Keys = db.NumKeys()
+	if st.ReadOnly, err = store.ReadOnly(db.Dir()); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// lastSyncTime returns the time of the last commit in the store's git
+// repository, or nil if it is not one.
+func lastSyncTime(dir string) *time.Time {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+		return nil
+	}
+	out, err := exec.Command("git", "-C", dir, "log", "-1", "--format=%cI").Output()
+	if err != nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil
+	}
+	return &t
+}
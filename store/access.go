@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/google/tink/go/tink"
+)
+
+// accessFile holds when each entry was last read with Get, encrypted with
+// the master key since it tells which accounts are in use. It is kept per
+// copy of the store and not synchronized. Shared vaults, which have no
+// master key, do not track reads.
+const accessFile = "pw.access"
+
+var accessAD = []byte("durin access times")
+
+// accessEvery is how long after a read of an entry was recorded the next
+// one is, so that frequent reads do not rewrite the file every time.
+const accessEvery = time.Minute
+
+// loadAccess reads the access times unless they were read before.
+// accessMu must be held.
+func (db *DB) loadAccess(ctx context.Context, master tink.AEAD) error {
+	if db.accessed != nil {
+		return nil
+	}
+	c, err := ioutil.ReadFile(filepath.Join(db.dir, accessFile))
+	if os.IsNotExist(err) {
+		db.accessed = make(map[string]time.Time)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b, err := decrypt(ctx, master, c, accessAD)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorrupt, accessFile, err)
+	}
+	times := make(map[string]time.Time)
+	if err := json.Unmarshal(b, &times); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCorrupt, accessFile, err)
+	}
+	db.accessed = times
+	return nil
+}
+
+// recordAccess records that the entry called name was read now.
+func (db *DB) recordAccess(ctx context.Context, master tink.AEAD, name string) error {
+	db.accessMu.Lock()
+	defer db.accessMu.Unlock()
+	if err := db.loadAccess(ctx, master); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if last, ok := db.accessed[name]; ok && now.Sub(last) < accessEvery {
+		return nil
+	}
+	db.accessed[name] = now
+	// Forget entries that were deleted meanwhile.
+	db.view(func() {
+		for n := range db.accessed {
+			if _, ok := db.records[n]; !ok {
+				delete(db.accessed, n)
+			}
+		}
+	})
+	b, err := json.Marshal(db.accessed)
+	if err != nil {
+		return err
+	}
+	c, err := encrypt(ctx, master, b, accessAD)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(db.dir, accessFile), c)
+}
+
+// LastRead returns when each entry was last read with Get, for the entries
+// read since the store began tracking reads.
+func (db *DB) LastRead(ctx context.Context) (map[string]time.Time, error) {
+	if db.shared {
+		return nil, fmt.Errorf("shared vaults do not track when entries are read")
+	}
+	db.mu.RLock()
+	master := db.master
+	db.mu.RUnlock()
+	if master == nil {
+		return nil, ErrLocked
+	}
+	db.accessMu.Lock()
+	defer db.accessMu.Unlock()
+	if err := db.loadAccess(ctx, master); err != nil {
+		return nil, err
+	}
+	times := make(map[string]time.Time, len(db.accessed))
+	for name, t := range db.accessed {
+		times[name] = t
+	}
+	return times, nil
+}
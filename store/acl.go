@@ -0,0 +1,217 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+)
+
+// ACL describes who can read an entry of a shared vault. The rules are
+// kept in the recipients file in the clear; what enforces them is which
+// recipients an entry's data key is wrapped to, so a rule only takes
+// effect for an entry once someone who can read the entry writes it.
+type ACL struct {
+	// Path is the entry, or the folder ending in a slash, whose rule
+	// applies to the entry, or empty if it is open to every recipient.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Members are the recipients the rule allows.
+	Members []string `json:"members,omitempty" yaml:"members,omitempty"`
+	// Readers are the recipients the entry's data key is wrapped to, who
+	// can decrypt it. Keys wrapped to someone no longer a recipient are
+	// listed by key ID.
+	Readers []string `json:"readers" yaml:"readers"`
+}
+
+// aclFor returns the rule governing the entry called name: its own, or
+// that of the innermost folder holding it. path is empty if there is none.
+func (l *recipientList) aclFor(name string) (path string, members []string) {
+	if m, ok := l.ACLs[name]; ok {
+		return name, m
+	}
+	for dir := name; ; {
+		i := strings.LastIndexByte(dir, '/')
+		if i < 0 {
+			return "", nil
+		}
+		dir = dir[:i]
+		if m, ok := l.ACLs[dir+"/"]; ok {
+			return dir + "/", m
+		}
+	}
+}
+
+// recipientsFor returns the recipients the data key of the entry called
+// name is wrapped to.
+func (l *recipientList) recipientsFor(name string) []Recipient {
+	path, members := l.aclFor(name)
+	if path == "" {
+		return l.Recipients
+	}
+	var rs []Recipient
+	for _, r := range l.Recipients {
+		for _, m := range members {
+			if r.Name == m {
+				rs = append(rs, r)
+				break
+			}
+		}
+	}
+	return rs
+}
+
+// without returns list without s.
+func without(list []string, s string) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ACL returns who can read the entry called name in the shared vault.
+func (db *DB) ACL(name string) (*ACL, error) {
+	if !db.shared {
+		return nil, errNotShared
+	}
+	list, err := readRecipientList(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		env Envelope
+		ok  bool
+	)
+	if err := db.view(func() { env, ok = db.records[name] }); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, notFound(name)
+	}
+	acl := &ACL{Readers: []string{}}
+	acl.Path, acl.Members = list.aclFor(name)
+	names := make(map[string]string, len(list.Recipients))
+	for _, r := range list.Recipients {
+		names[r.ID()] = r.Name
+	}
+	for id := range env.Keys {
+		if n, ok := names[id]; ok {
+			acl.Readers = append(acl.Readers, n)
+		} else {
+			acl.Readers = append(acl.Readers, id)
+		}
+	}
+	sort.Strings(acl.Readers)
+	return acl, nil
+}
+
+// SetACL restricts the entry path, or the entries in the folder path if it
+// ends in a slash, to the recipients called members, which must include
+// db's identity; with no members, it removes the rule. Entries whose data
+// keys are not wrapped to the recipients the rules now allow are encrypted
+// anew with a fresh data key wrapped to those. It returns the names of the
+// entries it could not re-encrypt because they are not shared with db's
+// identity.
+func (db *DB) SetACL(ctx context.Context, path string, members []string) (skipped []string, err error) {
+	if !db.shared {
+		return nil, errNotShared
+	}
+	if err := db.writable(); err != nil {
+		return nil, err
+	}
+	if path == "" || path == "/" {
+		return nil, errors.New("an ACL needs an entry or folder")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.identity == nil {
+		return nil, ErrLocked
+	}
+	list, err := readRecipientList(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		if _, ok := list.ACLs[path]; !ok {
+			return nil, fmt.Errorf("%s has no ACL", path)
+		}
+		delete(list.ACLs, path)
+	} else {
+		ids := make(map[string]string, len(list.Recipients))
+		for _, r := range list.Recipients {
+			ids[r.Name] = r.ID()
+		}
+		self := false
+		for _, m := range members {
+			id, ok := ids[m]
+			if !ok {
+				return nil, fmt.Errorf("there is no recipient called %s", m)
+			}
+			self = self || id == db.identity.ID()
+		}
+		if !self {
+			return nil, errors.New("the ACL must include you, or you could not read the entries it covers")
+		}
+		if list.ACLs == nil {
+			list.ACLs = make(map[string][]string)
+		}
+		list.ACLs[path] = append([]string(nil), members...)
+	}
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	// As with RemoveRecipient, the rules are written first so that no
+	// entry written from now on is wrapped to someone they exclude.
+	if err := writeRecipients(db.dir, list); err != nil {
+		return nil, err
+	}
+	records := make(map[string]Envelope, len(db.records))
+	changed := false
+	for name, env := range db.records {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		records[name] = env
+		rs := list.recipientsFor(name)
+		if wrappedTo(env.Keys, rs) {
+			continue
+		}
+		raw, err := db.identity.unwrap(name, env.Keys)
+		if errors.Is(err, ErrNotRecipient) {
+			skipped = append(skipped, name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		env, err = reseal(name, env, raw, rs)
+		secmem.Wipe(raw)
+		if err != nil {
+			return nil, err
+		}
+		records[name] = env
+		changed = true
+	}
+	sort.Strings(skipped)
+	if !changed {
+		return skipped, nil
+	}
+	return skipped, db.rewrite(records)
+}
+
+// wrappedTo reports whether keys are wrapped to rs and no one else.
+func wrappedTo(keys map[string][]byte, rs []Recipient) bool {
+	if len(keys) != len(rs) {
+		return false
+	}
+	for _, r := range rs {
+		if _, ok := keys[r.ID()]; !ok {
+			return false
+		}
+	}
+	return true
+}
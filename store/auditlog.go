@@ -0,0 +1,381 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/signature"
+	"github.com/google/tink/go/tink"
+)
+
+// The audit log records every change to the entries of a store, one
+// JSON-encoded LogEntry per line. Each entry holds the SHA-256 of the line
+// before it and is signed with an Ed25519 key kept in log.key, wrapped
+// with the master key, so that entries cannot be changed, dropped or
+// reordered without DB.VerifyLog noticing. Cutting entries off the end
+// leaves a valid log, so VerifyLog also checks that the log still holds a
+// head seen before. Shared vaults, which have no master key, keep no log.
+const (
+	logFile    = "audit.log"
+	logKeyFile = "log.key"
+)
+
+// logKeyAD is authenticated along with the log key when it is wrapped with
+// the master key.
+var logKeyAD = []byte("durin audit log key")
+
+// Operations recorded in the audit log.
+const (
+	LogPut    = "put"
+	LogDelete = "delete"
+	LogRename = "rename"
+)
+
+// LogEntry is a change recorded in the audit log.
+type LogEntry struct {
+	Seq  int64     `json:"seq" yaml:"seq"`
+	Time time.Time `json:"time" yaml:"time"`
+	Op   string    `json:"op" yaml:"op"`
+	Name string    `json:"name,omitempty" yaml:"name,omitempty"`
+	// To is the new name of an entry renamed.
+	To string `json:"to,omitempty" yaml:"to,omitempty"`
+	// Prev is the hex SHA-256 of the line before, empty for the first.
+	Prev string `json:"prev" yaml:"prev"`
+	// Sig signs the entry encoded without it.
+	Sig []byte `json:"sig,omitempty" yaml:"-"`
+}
+
+// LogHead identifies the last entry of an audit log.
+type LogHead struct {
+	Seq int64 `json:"seq"`
+	// Hash is the hex SHA-256 of the entry's line.
+	Hash string `json:"hash"`
+}
+
+// logTail is where a DB last appended to the audit log.
+type logTail struct {
+	head LogHead
+	size int64
+}
+
+// logLines returns the complete lines of the audit log in dir, without
+// their newlines, and the length of the file up to the end of the last.
+func logLines(dir string) (lines [][]byte, valid int64, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, logFile))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(bytes.NewReader(b))
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline was torn by a crash while it was
+			// appended, so the change it records was never reported done.
+			return lines, valid, nil
+		}
+		valid += int64(len(line))
+		lines = append(lines, line[:len(line)-1])
+	}
+}
+
+// ReadLog returns the entries of the audit log in dir, without checking
+// them; see DB.VerifyLog.
+func ReadLog(dir string) ([]LogEntry, error) {
+	lines, _, err := logLines(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LogEntry, 0, len(lines))
+	for i, line := range lines {
+		var e LogEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("%w: %s line %d: %v", ErrCorrupt, logFile, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// signedPart returns what the signature of e covers.
+func (e LogEntry) signedPart() ([]byte, error) {
+	e.Sig = nil
+	return json.Marshal(e)
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// logKey returns the keyset signing the audit log, creating it if the
+// store has none. mu must be held for writing.
+func (db *DB) logKey() (*keyset.Handle, error) {
+	if db.logKeyset != nil {
+		return db.logKeyset, nil
+	}
+	path := filepath.Join(db.dir, logKeyFile)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(db.dir, logFile)); err == nil {
+			// Signing the log anew would paper over whatever removed
+			// the key.
+			return nil, fmt.Errorf("%w: %s is missing", ErrTampered, logKeyFile)
+		}
+		h, err := keyset.NewHandle(signature.ED25519KeyWithoutPrefixTemplate())
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := h.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), db.master, logKeyAD); err != nil {
+			return nil, fmt.Errorf("failed to wrap the audit log key: %v", err)
+		}
+		if err := atomicfile.WriteFile(path, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		db.logKeyset = h
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(b)), db.master, logKeyAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, logKeyFile, err)
+	}
+	db.logKeyset = h
+	return h, nil
+}
+
+// appendLog records op on the entry called name, renamed to to if op is
+// LogRename, in the audit log. mu must be held for writing.
+func (db *DB) appendLog(op, name, to string) (_err error) {
+	if db.shared {
+		return nil
+	}
+	if db.master == nil {
+		return ErrLocked
+	}
+	h, err := db.logKey()
+	if err != nil {
+		return err
+	}
+	signer, err := signature.NewSigner(h)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(db.dir, logFile)
+	tail := db.logTail
+	if info, err := os.Stat(path); err != nil || tail == nil || info.Size() != tail.size {
+		// Read the log again unless it is the one this DB last appended to.
+		lines, valid, err := logLines(db.dir)
+		if err != nil {
+			return err
+		}
+		tail = &logTail{size: valid}
+		if n := len(lines); n > 0 {
+			var last LogEntry
+			if err := json.Unmarshal(lines[n-1], &last); err != nil {
+				return fmt.Errorf("%w: %s line %d: %v", ErrCorrupt, logFile, n, err)
+			}
+			tail.head = LogHead{Seq: last.Seq, Hash: hashLine(lines[n-1])}
+		}
+	}
+	e := LogEntry{Seq: tail.head.Seq + 1, Time: time.Now().UTC(), Op: op, Name: name, To: to, Prev: tail.head.Hash}
+	signed, err := e.signedPart()
+	if err != nil {
+		return err
+	}
+	if e.Sig, err = signer.Sign(signed); err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); _err == nil {
+			_err = err
+		}
+	}()
+	if err := f.Truncate(tail.size); err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	db.logTail = &logTail{head: LogHead{Seq: e.Seq, Hash: hashLine(line[:len(line)-1])}, size: tail.size + int64(len(line))}
+	return nil
+}
+
+// VerifyLog checks the signatures and hash chain of the audit log and
+// returns its head. If since is set, the log must still hold that entry,
+// so that cutting entries off its end or restoring an older copy of the
+// store is noticed.
+func (db *DB) VerifyLog(since *LogHead) (LogHead, error) {
+	if db.shared {
+		return LogHead{}, errors.New("shared vaults keep no audit log")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.master == nil {
+		return LogHead{}, ErrLocked
+	}
+	lines, _, err := logLines(db.dir)
+	if err != nil {
+		return LogHead{}, err
+	}
+	if len(lines) == 0 {
+		if since != nil && since.Seq > 0 {
+			return LogHead{}, fmt.Errorf("%w: the log is empty, but held entry %d before", ErrTampered, since.Seq)
+		}
+		return LogHead{}, nil
+	}
+	h, err := db.logKey()
+	if err != nil {
+		return LogHead{}, err
+	}
+	pub, err := h.Public()
+	if err != nil {
+		return LogHead{}, err
+	}
+	verifier, err := signature.NewVerifier(pub)
+	if err != nil {
+		return LogHead{}, err
+	}
+	var (
+		head    LogHead
+		sinceOK = since == nil || since.Seq == 0
+	)
+	for i, line := range lines {
+		if err := verifyLogLine(verifier, line, head); err != nil {
+			return LogHead{}, fmt.Errorf("%w: line %d: %v", ErrTampered, i+1, err)
+		}
+		head = LogHead{Seq: head.Seq + 1, Hash: hashLine(line)}
+		if since != nil && head.Seq == since.Seq {
+			if head.Hash != since.Hash {
+				return LogHead{}, fmt.Errorf("%w: entry %d differs from the one seen before", ErrTampered, head.Seq)
+			}
+			sinceOK = true
+		}
+	}
+	if !sinceOK {
+		return LogHead{}, fmt.Errorf("%w: the log ends at entry %d, but held entry %d before; it or the store was rolled back", ErrTampered, head.Seq, since.Seq)
+	}
+	return head, nil
+}
+
+// verifyLogLine checks line, which must follow prev.
+func verifyLogLine(v tink.Verifier, line []byte, prev LogHead) error {
+	var e LogEntry
+	if err := json.Unmarshal(line, &e); err != nil {
+		return err
+	}
+	if e.Seq != prev.Seq+1 {
+		return fmt.Errorf("entry %d follows entry %d", e.Seq, prev.Seq)
+	}
+	if e.Prev != prev.Hash {
+		return fmt.Errorf("entry %d does not chain to the entry before", e.Seq)
+	}
+	signed, err := e.signedPart()
+	if err != nil {
+		return err
+	}
+	if err := v.Verify(e.Sig, signed); err != nil {
+		return fmt.Errorf("entry %d has a bad signature", e.Seq)
+	}
+	return nil
+}
+
+// SignStatement signs statement with the audit log key, for documents that
+// vouch for the store, such as inventories handed to auditors. kind names
+// the document and is signed along with it, so that a signature passes
+// neither for another kind of document nor for a log entry. It returns the
+// signature and the public key checking it, encoded like the public keys
+// of identities.
+func (db *DB) SignStatement(kind string, statement []byte) (sig []byte, pub string, err error) {
+	if db.shared {
+		return nil, "", errors.New("shared vaults keep no audit log key to sign with")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.master == nil {
+		return nil, "", ErrLocked
+	}
+	h, err := db.logKey()
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := signature.NewSigner(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if sig, err = signer.Sign(statementMessage(kind, statement)); err != nil {
+		return nil, "", err
+	}
+	ph, err := h.Public()
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := ph.WriteWithNoSecrets(keyset.NewBinaryWriter(&buf)); err != nil {
+		return nil, "", err
+	}
+	return sig, base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// VerifyStatement checks that sig, made by SignStatement with the key pub,
+// signs statement as a document of kind. It fails with ErrBadSignature if
+// not.
+func VerifyStatement(kind string, statement, sig []byte, pub string) error {
+	b, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil {
+		return fmt.Errorf("invalid signing key: %v", err)
+	}
+	h, err := keyset.ReadWithNoSecrets(keyset.NewBinaryReader(bytes.NewReader(b)))
+	if err != nil {
+		return fmt.Errorf("invalid signing key: %v", err)
+	}
+	v, err := signature.NewVerifier(h)
+	if err != nil {
+		return fmt.Errorf("invalid signing key: %v", err)
+	}
+	if err := v.Verify(sig, statementMessage(kind, statement)); err != nil {
+		return fmt.Errorf("%w: the %s was changed after it was signed, or not signed with this key", ErrBadSignature, kind)
+	}
+	return nil
+}
+
+// PublicKeyID returns the fingerprint of pub, a public key SignStatement
+// returned, as Identity.ID does for identities.
+func PublicKeyID(pub string) string {
+	return keyID(pub)
+}
+
+func statementMessage(kind string, statement []byte) []byte {
+	return append([]byte("durin statement\x00"+kind+"\x00"), statement...)
+}
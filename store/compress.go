@@ -0,0 +1,73 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/klauspost/compress/zstd"
+)
+
+// An entry's payload, the plaintext that is encrypted, is either a JSON
+// record, which starts with '{', or a zstd frame holding one, which starts
+// with zstd's magic number. The payload is authenticated along with the
+// codec it tells, and entries written without compression read as before.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+const (
+	// compressMin is the smallest payload worth compressing; short records
+	// barely shrink.
+	compressMin = 1 << 10
+
+	// maxPayload bounds the decompressed size of a payload, so that a
+	// damaged entry cannot exhaust memory.
+	maxPayload = 64 << 20
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// zstdCodec returns an encoder and decoder that are safe for concurrent
+// use with EncodeAll and DecodeAll.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// Neither fails without options that could be invalid.
+		zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxPayload))
+	})
+	return zstdEnc, zstdDec
+}
+
+// compressPayload returns b compressed, or b itself if that would not save
+// space.
+func compressPayload(b []byte) []byte {
+	if len(b) < compressMin {
+		return b
+	}
+	enc, _ := zstdCodec()
+	c := enc.EncodeAll(b, make([]byte, 0, len(b)))
+	if len(c) >= len(b) {
+		secmem.Wipe(c)
+		return b
+	}
+	return c
+}
+
+// decompressPayload returns the JSON record in payload b, decompressing it
+// if needed. A decompressed payload replaces b, which is wiped.
+func decompressPayload(name string, b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, zstdMagic) {
+		return b, nil
+	}
+	_, dec := zstdCodec()
+	d, err := dec.DecodeAll(b, nil)
+	secmem.Wipe(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: entry %q: %v", ErrCorrupt, name, err)
+	}
+	return d, nil
+}
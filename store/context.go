@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/tink"
+)
+
+// ContextAEAD is a master key whose operations can be cancelled, such as
+// one forwarding to an agent in another process. Get and Put use the
+// context methods of keys from Options.CachedKey that implement it.
+type ContextAEAD interface {
+	tink.AEAD
+	EncryptContext(ctx context.Context, plaintext, associatedData []byte) ([]byte, error)
+	DecryptContext(ctx context.Context, ciphertext, associatedData []byte) ([]byte, error)
+}
+
+func encrypt(ctx context.Context, key tink.AEAD, plaintext, ad []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ContextAEAD); ok {
+		return k.EncryptContext(ctx, plaintext, ad)
+	}
+	return key.Encrypt(plaintext, ad)
+}
+
+func decrypt(ctx context.Context, key tink.AEAD, ciphertext, ad []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if k, ok := key.(ContextAEAD); ok {
+		return k.DecryptContext(ctx, ciphertext, ad)
+	}
+	return key.Decrypt(ciphertext, ad)
+}
+
+// deriveKey is DeriveKey, but returns early with ctx's error if ctx is done
+// first. Argon2 cannot be interrupted, so the derivation runs on and its
+// result is wiped when it finishes.
+func deriveKey(ctx context.Context, pw, salt []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return DeriveKey(pw, salt), nil
+	}
+	// pw belongs to the caller, who may wipe it once we return.
+	pw = append([]byte(nil), pw...)
+	done := make(chan []byte, 1)
+	go func() {
+		done <- DeriveKey(pw, salt)
+		secmem.Wipe(pw)
+	}()
+	select {
+	case key := <-done:
+		return key, nil
+	case <-ctx.Done():
+		go func() { secmem.Wipe(<-done) }()
+		return nil, ctx.Err()
+	}
+}
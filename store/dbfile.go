@@ -0,0 +1,227 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+)
+
+// pw.db is written in an indexed format, so that opening a store reads the
+// names and metadata of its entries but not their ciphertexts, which are
+// read when an entry is decrypted:
+//
+//	durin-db 2
+//	{"records":[{"name":...,"meta":...,"offset":...,"length":...},...],"data_sha256":...}
+//	the ciphertexts, back to back
+//
+// Offsets count from the first ciphertext. A pw.db written before the
+// format was introduced is a single JSON RecordSet with the ciphertexts
+// inline; it is read in full, and rewritten in the indexed format by the
+// next snapshot.
+const dbHeader = "durin-db 2\n"
+
+// Reading a store decodes what another copy of it, such as a sync remote,
+// may have handed over, so it accepts only what durin writes, and no more
+// of it than memory allows.
+var (
+	// indexLimits bound the index line of an indexed pw.db.
+	indexLimits = strictjson.Limits{MaxSize: 64 << 20, MaxDepth: 8}
+	// legacyLimits bound a pw.db from before the indexed format, which
+	// holds the ciphertexts too.
+	legacyLimits = strictjson.Limits{MaxSize: 1 << 30, MaxDepth: 8}
+	// journalLimits bound a record in the journal, which holds one
+	// ciphertext.
+	journalLimits = strictjson.Limits{MaxSize: 2 * maxPayload, MaxDepth: 8}
+)
+
+// dbIndex is the second line of an indexed pw.db.
+type dbIndex struct {
+	Records []indexEntry `json:"records"`
+	// DataDigest is the SHA-256 of the ciphertexts, so that a digest of the
+	// first two lines identifies the whole file.
+	DataDigest []byte `json:"data_sha256"`
+}
+
+type indexEntry struct {
+	Name   string            `json:"name"`
+	Format int               `json:"format,omitempty"`
+	Meta   *EntryMeta        `json:"meta,omitempty"`
+	Keys   map[string][]byte `json:"keys,omitempty"`
+	Offset int64             `json:"offset"`
+	Length int64             `json:"length"`
+}
+
+// dataRef locates the ciphertext of an envelope in an open pw.db.
+type dataRef struct {
+	f      *os.File
+	off, n int64
+}
+
+// data returns the ciphertext of env, reading it from pw.db if it was not
+// read yet. A DB must hold mu for reading meanwhile, so that the file is
+// not closed under it.
+func (env *Envelope) data() ([]byte, error) {
+	if env.ref == nil {
+		return env.Data, nil
+	}
+	b := make([]byte, env.ref.n)
+	if _, err := env.ref.f.ReadAt(b, env.ref.off); err != nil {
+		return nil, fmt.Errorf("%w: entry %q: %v", ErrCorrupt, env.Name, err)
+	}
+	return b, nil
+}
+
+// readDB reads the envelopes in pwPath and identifies the version read.
+// For an indexed pw.db, the envelopes read their ciphertexts from v.file,
+// which stays open until v is closed.
+func readDB(pwPath string) (envs []Envelope, v dbVersion, err error) {
+	f, err := os.Open(pwPath)
+	if err != nil {
+		return nil, dbVersion{}, err
+	}
+	defer func() {
+		if v.file == nil {
+			f.Close()
+		}
+	}()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, dbVersion{}, err
+	}
+	br := bufio.NewReader(f)
+	if head, err := br.Peek(len(dbHeader)); err != nil || string(head) != dbHeader {
+		b, err := strictjson.ReadAll(br, legacyLimits.MaxSize)
+		if err != nil {
+			return nil, dbVersion{}, fmt.Errorf("%w: %s: %v", ErrCorrupt, dbFile, err)
+		}
+		var rs RecordSet
+		if err := strictjson.Unmarshal(b, &rs, legacyLimits); err != nil {
+			return nil, dbVersion{}, fmt.Errorf("%w: %s: %v", ErrCorrupt, dbFile, err)
+		}
+		return rs.Records, dbVersion{info: info, digest: sha256.Sum256(b)}, nil
+	}
+	br.Discard(len(dbHeader))
+	line, err := readIndexLine(br)
+	if err != nil {
+		return nil, dbVersion{}, fmt.Errorf("%w: %s: %v", ErrCorrupt, dbFile, err)
+	}
+	var idx dbIndex
+	if err := strictjson.Unmarshal(line, &idx, indexLimits); err != nil {
+		return nil, dbVersion{}, fmt.Errorf("%w: %s: %v", ErrCorrupt, dbFile, err)
+	}
+	base := int64(len(dbHeader) + len(line))
+	envs = make([]Envelope, 0, len(idx.Records))
+	for _, e := range idx.Records {
+		if e.Offset < 0 || e.Length < 0 || base+e.Offset+e.Length > info.Size() {
+			return nil, dbVersion{}, fmt.Errorf("%w: %s: entry %q lies outside the file", ErrCorrupt, dbFile, e.Name)
+		}
+		envs = append(envs, Envelope{Name: e.Name, Format: e.Format, Meta: e.Meta, Keys: e.Keys, ref: &dataRef{f: f, off: base + e.Offset, n: e.Length}})
+	}
+	h := sha256.New()
+	h.Write([]byte(dbHeader))
+	h.Write(line)
+	v = dbVersion{info: info, file: f}
+	h.Sum(v.digest[:0])
+	return envs, v, nil
+}
+
+// dbDigest returns the digest readDB identifies the indexed pw.db b by:
+// that of its header and index line, which holds the digest of the rest.
+func dbDigest(b []byte) [sha256.Size]byte {
+	n := len(dbHeader)
+	if i := bytes.IndexByte(b[n:], '\n'); i >= 0 {
+		n += i + 1
+	}
+	return sha256.Sum256(b[:n])
+}
+
+// readIndexLine reads the index line of an indexed pw.db from br, newline
+// included, refusing lines over indexLimits.
+func readIndexLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := br.ReadSlice('\n')
+		line = append(line, b...)
+		if int64(len(line)) > indexLimits.MaxSize {
+			return nil, fmt.Errorf("%w: index over the %d bytes accepted", strictjson.ErrTooLarge, indexLimits.MaxSize)
+		}
+		switch err {
+		case nil:
+			return line, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return nil, errors.New("truncated index")
+		default:
+			return nil, err
+		}
+	}
+}
+
+// encodeDB returns records as an indexed pw.db.
+func encodeDB(records map[string]Envelope) ([]byte, error) {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var (
+		idx  = dbIndex{Records: make([]indexEntry, 0, len(names))}
+		data bytes.Buffer
+	)
+	for _, name := range names {
+		env := records[name]
+		b, err := env.data()
+		if err != nil {
+			return nil, err
+		}
+		idx.Records = append(idx.Records, indexEntry{Name: name, Format: env.Format, Meta: env.Meta, Keys: env.Keys, Offset: int64(data.Len()), Length: int64(len(b))})
+		data.Write(b)
+	}
+	sum := sha256.Sum256(data.Bytes())
+	idx.DataDigest = sum[:]
+	line, err := json.Marshal(&idx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(dbHeader)+len(line)+1+data.Len())
+	out = append(out, dbHeader...)
+	out = append(out, line...)
+	out = append(out, '\n')
+	return append(out, data.Bytes()...), nil
+}
+
+// close closes the pw.db that the envelopes read with v refer to.
+func (v *dbVersion) close() {
+	if v.file != nil {
+		v.file.Close()
+		v.file = nil
+	}
+}
+
+// ReadEnvelope reads the envelope of the entry called name in the store in
+// dir, without reading the others' ciphertexts.
+func ReadEnvelope(dir, name string) (*Envelope, error) {
+	records, v, err := readRecords(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer v.close()
+	env, ok := records[name]
+	if !ok {
+		return nil, notFound(name)
+	}
+	if env.Data, err = env.data(); err != nil {
+		return nil, err
+	}
+	env.ref = nil
+	return &env, nil
+}
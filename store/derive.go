@@ -0,0 +1,159 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/prf"
+)
+
+// The passwords of derived records are never stored: they are computed
+// whenever the record is read, from its site and counter with an
+// HMAC-SHA256 key kept in derive.key, wrapped with the master key. The
+// key is made with the first derived record and must travel with the
+// store, as every copy of the store must compute the same passwords.
+const deriveKeyFile = "derive.key"
+
+// deriveKeyAD is authenticated along with the derivation key when it is
+// wrapped with the master key.
+var deriveKeyAD = []byte("durin derivation key")
+
+// Derivation says how the password of a derived record is computed.
+type Derivation struct {
+	// Site is what the password is for, usually the site's domain.
+	Site string `json:"site" yaml:"site"`
+	// Counter is bumped to rotate the password.
+	Counter int `json:"counter" yaml:"counter"`
+}
+
+// deriveKey returns the derivation key, creating it if create is set and
+// the store has none. mu must be held for writing.
+func (db *DB) deriveKey(create bool) (*prf.Set, error) {
+	path := filepath.Join(db.dir, deriveKeyFile)
+	b, err := ioutil.ReadFile(path)
+	var h *keyset.Handle
+	switch {
+	case os.IsNotExist(err) && create:
+		if h, err = keyset.NewHandle(prf.HMACSHA256PRFKeyTemplate()); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := h.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), db.master, deriveKeyAD); err != nil {
+			return nil, fmt.Errorf("failed to wrap the derivation key: %v", err)
+		}
+		if err := atomicfile.WriteFile(path, buf.Bytes()); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		// Making a new key would silently change every derived password.
+		return nil, fmt.Errorf("%w: %s is missing", ErrCorrupt, deriveKeyFile)
+	case err != nil:
+		return nil, err
+	default:
+		if h, err = keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(b)), db.master, deriveKeyAD); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, deriveKeyFile, err)
+		}
+	}
+	return prf.NewPRFSet(h)
+}
+
+// hasDerived reports whether an entry other than name is derived. mu must
+// be held.
+func (db *DB) hasDerived(name string) bool {
+	for n, env := range db.records {
+		if n != name && env.Meta != nil && env.Meta.Kind == KindDerived {
+			return true
+		}
+	}
+	return false
+}
+
+// Derive sets the password of r, if it is a derived record, to the one
+// computed from r.Derived with Options.DerivePassword. Get and Peek do so
+// by themselves.
+func (db *DB) Derive(r *Record) error {
+	return db.derive("", r, false)
+}
+
+// derive is Derive, making the derivation key if create is set and no
+// entry but name needs the key there is.
+func (db *DB) derive(name string, r *Record, create bool) error {
+	if r.Derived == nil {
+		return nil
+	}
+	if db.shared {
+		return errors.New("shared vaults cannot hold derived entries")
+	}
+	if db.opts.DerivePassword == nil {
+		return errors.New("derived passwords are not supported")
+	}
+	db.mu.Lock()
+	if db.master == nil {
+		db.mu.Unlock()
+		return ErrLocked
+	}
+	ps, err := db.deriveKey(create && !db.hasDerived(name))
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The input names the site and counter unambiguously; the output is
+	// drawn from as many blocks of it as the password takes.
+	input := []byte("durin derived password\x00" + r.Derived.Site + "\x00" + strconv.Itoa(r.Derived.Counter) + "\x00")
+	var (
+		buf   []byte
+		block uint32
+	)
+	pick := func(n int) (int, error) {
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid range %d", n)
+		}
+		// Values at or above limit are rejected so that every result is
+		// equally likely.
+		limit := (uint64(1) << 32) / uint64(n) * uint64(n)
+		for {
+			if len(buf) < 4 {
+				out, err := ps.ComputePrimaryPRF(binary.BigEndian.AppendUint32(input[:len(input):len(input)], block), 32)
+				if err != nil {
+					return 0, err
+				}
+				block++
+				buf = append(buf, out...)
+			}
+			v := uint64(binary.BigEndian.Uint32(buf))
+			buf = buf[4:]
+			if v < limit {
+				return int(v % uint64(n)), nil
+			}
+		}
+	}
+	pw, err := db.opts.DerivePassword(r, pick)
+	if err != nil {
+		return err
+	}
+	r.Password = pw
+	return nil
+}
+
+// storedDerived returns what Put stores of the derived record r: r without
+// its password, which must be the derived one if set.
+func (db *DB) storedDerived(ctx context.Context, name string, r *Record) (*Record, error) {
+	d := *r
+	if err := db.derive(name, &d, true); err != nil {
+		return nil, err
+	}
+	if r.Password != "" && r.Password != d.Password {
+		return nil, ErrDerivedPassword
+	}
+	d.Password = ""
+	return &d, nil
+}
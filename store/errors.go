@@ -0,0 +1,55 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned, possibly wrapped, by the store. Use errors.Is to check
+// for them.
+var (
+	// ErrNotFound means there is no entry of the requested name.
+	ErrNotFound = errors.New("not found")
+	// ErrLocked means the master key was dropped with DB.Lock, or the
+	// agent holding it is locked.
+	ErrLocked = errors.New("store is locked")
+	// ErrBadPassphrase means a passphrase does not unlock the master
+	// keyset.
+	ErrBadPassphrase = errors.New("wrong passphrase")
+	// ErrCorrupt means a store file or entry cannot be parsed, or an entry
+	// fails to decrypt with the master keyset.
+	ErrCorrupt = errors.New("store is corrupt")
+	// ErrNoStore means the directory holds no store; see NoStoreError.
+	ErrNoStore = errors.New("no store")
+	// ErrInUse means another process holds the store lock; see
+	// LockedError.
+	ErrInUse = errors.New("store is in use")
+	// ErrTampered means the audit log fails to verify; see DB.VerifyLog.
+	ErrTampered = errors.New("audit log was tampered with")
+	// ErrBadSignature means a statement fails to verify; see
+	// VerifyStatement.
+	ErrBadSignature = errors.New("bad signature")
+	// ErrDerivedPassword means a password was given for a derived record,
+	// whose password is computed instead; see Record.Derived.
+	ErrDerivedPassword = errors.New("the password of a derived entry cannot be set")
+	// ErrNotRecipient means the identity opening a shared vault is not
+	// one of its recipients, or an entry is not shared with it.
+	ErrNotRecipient = errors.New("not a recipient")
+	// ErrNoIdentity means the store holds no identity for shared vaults;
+	// see DB.Identity.
+	ErrNoIdentity = errors.New("no identity")
+	// ErrNoKeyFile means the store needs a keyfile besides its passphrase
+	// and none was given; see Options.KeyFile.
+	ErrNoKeyFile = errors.New("needs its keyfile")
+	// ErrReadOnly means the store is read-only and cannot be written; see
+	// ReadOnly.
+	ErrReadOnly = errors.New("is read-only")
+	// ErrNoKeyset means the store holds entries but its master keyset is
+	// missing, so that they cannot be decrypted; see LostKeysetError.
+	ErrNoKeyset = errors.New("has lost its master keyset")
+)
+
+// notFound returns the error for a missing entry called name.
+func notFound(name string) error {
+	return fmt.Errorf("password %q %w", name, ErrNotFound)
+}
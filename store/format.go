@@ -0,0 +1,286 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+	"github.com/citizencloud/passwordstore/internal/workpool"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// formatFile identifies the store and the version of its format. From
+// version 1 on, the store's ID and the version are authenticated along
+// with every entry and with the wrapped master keyset, so that envelopes
+// cannot be moved between stores sharing a master keyset, such as copies
+// restored from one backup, nor replaced with ones in an older format.
+// Stores without the file are in version 0, which authenticates the entry
+// name only; DB.Upgrade brings them to the current version. Envelopes in
+// version 0 are refused once a store has an ID, whatever the unauthenticated
+// version in the file says, so that old copies cannot be slipped back in
+// by editing it. Shared vaults, whose entries have data keys of their own,
+// stay in version 0.
+const formatFile = "format"
+
+// pendingFormatFile holds the format with the store's new ID while Upgrade
+// wraps master with it, so that a store never has an ID its master keyset
+// is not bound to.
+const pendingFormatFile = "format.new"
+
+// CurrentFormat is the version new stores and envelopes are written in.
+const CurrentFormat = 1
+
+// formatLimits bound formatFile.
+var formatLimits = strictjson.Limits{MaxSize: 1 << 16, MaxDepth: 4, AllowUnknownFields: true}
+
+// storeFormat is the contents of formatFile.
+type storeFormat struct {
+	// ID tells the store apart from others. All its copies share it.
+	ID string `json:"id"`
+	// Version is the oldest format the store's envelopes may be in. An
+	// interrupted Upgrade leaves a store with an ID but in version 0, whose
+	// master keyset may not be wrapped with the ID yet.
+	Version int `json:"version"`
+}
+
+// newStoreFormat returns the format of a new store.
+func newStoreFormat() storeFormat {
+	b := random.GetRandomBytes(16)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return storeFormat{ID: formatID(b), Version: CurrentFormat}
+}
+
+// formatID formats the 16 bytes of a store ID like a UUID.
+func formatID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// readFormat returns the format of the store in dir.
+func readFormat(dir string) (storeFormat, error) {
+	return readFormatFile(dir, formatFile)
+}
+
+// readFormatFile returns the format in the file called name in dir.
+func readFormatFile(dir, name string) (storeFormat, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return storeFormat{}, nil
+	}
+	if err != nil {
+		return storeFormat{}, err
+	}
+	var f storeFormat
+	// Fields a newer durin added are left for the version to refuse.
+	if err := strictjson.Unmarshal(b, &f, formatLimits); err != nil {
+		return storeFormat{}, fmt.Errorf("%w: %s: %v", ErrCorrupt, name, err)
+	}
+	switch {
+	case f.Version > CurrentFormat:
+		return storeFormat{}, fmt.Errorf("the store in %s is in format %d, which only a newer durin reads", dir, f.Version)
+	case f.ID == "":
+		return storeFormat{}, fmt.Errorf("%w: %s names no store ID", ErrCorrupt, name)
+	}
+	return f, nil
+}
+
+func writeFormat(dir string, f storeFormat) error {
+	return writeFormatFile(dir, formatFile, f)
+}
+
+func writeFormatFile(dir, name string, f storeFormat) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, name), append(b, '\n'))
+}
+
+// writeVersion is the format in which envelopes are written.
+func (f storeFormat) writeVersion() int {
+	if f.ID == "" {
+		return 0
+	}
+	return CurrentFormat
+}
+
+// recordAD returns the associated data of the entry called name in an
+// envelope in format version, checking that the store accepts it.
+func (f storeFormat) recordAD(version int, name string) ([]byte, error) {
+	switch {
+	case version < f.Version, version == 0 && f.ID != "":
+		return nil, fmt.Errorf("%w: entry %q is in format %d, older than the store's; it may have been replaced with an old copy, or durin key upgrade was interrupted and finishes it", ErrCorrupt, name, version)
+	case version > f.writeVersion():
+		return nil, fmt.Errorf("%w: entry %q is in format %d, newer than the store's", ErrCorrupt, name, version)
+	case version == 0:
+		return []byte(name), nil
+	}
+	return []byte(fmt.Sprintf("durin entry %d\x00%s\x00%s", version, f.ID, name)), nil
+}
+
+// masterAD returns the associated data of the master keyset in format
+// version, or nil for version 0, which has none.
+func (f storeFormat) masterAD(version int) []byte {
+	if version == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf("durin master %d\x00%s", version, f.ID))
+}
+
+// Format returns the version of the store's format and its ID, which is
+// empty for stores in version 0. A store whose Upgrade was interrupted is
+// in version 0 with an ID.
+func (db *DB) Format() (version int, id string) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.format.Version, db.format.ID
+}
+
+// Upgrade brings the store to the current format: it gives it an ID and
+// encrypts the master keyset and every entry anew with the ID and version
+// authenticated along with them. pw must be the store's passphrase. Each
+// step leaves a store that opens, so an interrupted Upgrade is finished by
+// running it again; until then, entries still in the old format cannot be
+// read.
+func (db *DB) Upgrade(ctx context.Context, pw []byte) error {
+	if db.shared {
+		return errors.New("shared vaults stay in format 0")
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	if db.format.Version == CurrentFormat {
+		return nil
+	}
+	ks, rawKey, err := unlockPassphrase(ctx, db.dir, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(rawKey)
+	master, err := aead.New(ks)
+	if err != nil {
+		return err
+	}
+	f := db.format
+	if f.ID == "" {
+		f = newStoreFormat()
+		f.Version = 0
+		if err := writeFormatFile(db.dir, pendingFormatFile, f); err != nil {
+			return err
+		}
+	}
+	if err := writeMasterKeyset(db.dir, ks, rawKey, f, CurrentFormat); err != nil {
+		return err
+	}
+	if err := db.noteMaster(); err != nil {
+		return err
+	}
+	if db.format.ID == "" {
+		if err := os.Rename(filepath.Join(db.dir, pendingFormatFile), filepath.Join(db.dir, formatFile)); err != nil {
+			return err
+		}
+		db.format = f
+	}
+
+	records := make(map[string]Envelope, len(db.records))
+	var old []Envelope
+	for name, env := range db.records {
+		if env.Format == CurrentFormat {
+			records[name] = env
+		} else {
+			old = append(old, env)
+		}
+	}
+	upgraded := make([]Envelope, len(old))
+	err = workpool.Run(ctx, len(old), func(ctx context.Context, i int) error {
+		env := old[i]
+		name := env.Name
+		data, err := env.data()
+		if err != nil {
+			return err
+		}
+		// Only Upgrade reads envelopes in version 0 of a store with an
+		// ID, to bring them to the current one.
+		from := f
+		if env.Format == 0 {
+			from = storeFormat{}
+		}
+		ad, err := from.recordAD(env.Format, name)
+		if err != nil {
+			return err
+		}
+		b, err := decrypt(ctx, master, data, ad)
+		if err != nil {
+			return fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, name, err)
+		}
+		if ad, err = f.recordAD(CurrentFormat, name); err != nil {
+			secmem.Wipe(b)
+			return err
+		}
+		c, err := encrypt(ctx, master, b, ad)
+		secmem.Wipe(b)
+		if err != nil {
+			return err
+		}
+		upgraded[i] = Envelope{Name: name, Format: CurrentFormat, Data: c, Meta: env.Meta}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, env := range upgraded {
+		records[env.Name] = env
+	}
+	if err := db.rewrite(records); err != nil {
+		return err
+	}
+	f.Version = CurrentFormat
+	if err := writeFormat(db.dir, f); err != nil {
+		return err
+	}
+	db.format = f
+	return nil
+}
+
+// writeMasterKeyset writes ks as the master keyset of the store in dir,
+// wrapped with rawKey, the key derived from its passphrase, in format
+// version of f.
+func writeMasterKeyset(dir string, ks *keyset.Handle, rawKey []byte, f storeFormat, version int) error {
+	pwKey, err := subtle.NewChaCha20Poly1305(rawKey)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if version == 0 {
+		err = ks.Write(keyset.NewBinaryWriter(&buf), pwKey)
+	} else {
+		err = ks.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), pwKey, f.masterAD(version))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to wrap the master keyset: %v", err)
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, masterFile), buf.Bytes())
+}
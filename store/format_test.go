@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// createV0Store creates a store in format 0, as durin wrote before stores
+// had a format file, holding the entries of records.
+func createV0Store(t *testing.T, records map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	salt := random.GetRandomBytes(16)
+	if err := ioutil.WriteFile(filepath.Join(dir, saltFile), salt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMasterKeyset(dir, ks, DeriveKey([]byte(testPassphrase), salt), storeFormat{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	db := openStore(t, dir)
+	for name, pw := range records {
+		put(t, db, name, pw)
+	}
+	db.Close()
+	return dir
+}
+
+// interruptUpgrade leaves the store in dir as an Upgrade interrupted
+// once master is bound to the new ID, but before format holds it.
+func interruptUpgrade(t *testing.T, dir string) storeFormat {
+	t.Helper()
+	salt, err := ioutil.ReadFile(filepath.Join(dir, saltFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := UnlockKeyset(context.Background(), dir, []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newStoreFormat()
+	f.Version = 0
+	if err := writeFormatFile(dir, pendingFormatFile, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMasterKeyset(dir, ks, DeriveKey([]byte(testPassphrase), salt), f, CurrentFormat); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestUpgrade(t *testing.T) {
+	records := map[string]string{"a": "1", "b/c": "2"}
+	ctx := context.Background()
+	for _, interrupted := range []bool{false, true} {
+		name := "upgrade"
+		if interrupted {
+			name = "interrupted upgrade"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := createV0Store(t, records)
+			var pending storeFormat
+			if interrupted {
+				pending = interruptUpgrade(t, dir)
+			}
+			db := openStore(t, dir)
+			version, id := db.Format()
+			if version != 0 || id != pending.ID {
+				t.Fatalf("Format() = %d, %q before upgrading, want 0, %q", version, id, pending.ID)
+			}
+			if interrupted {
+				// The entries of a store with an ID must be in its format.
+				if _, err := db.Peek(ctx, "a"); !errors.Is(err, ErrCorrupt) {
+					t.Errorf("Peek of a format 0 entry mid-upgrade: %v, want ErrCorrupt", err)
+				}
+			} else {
+				for name, pw := range records {
+					wantPassword(t, db, name, pw)
+				}
+			}
+
+			if err := db.Upgrade(ctx, []byte(testPassphrase)); err != nil {
+				t.Fatal(err)
+			}
+			version, id = db.Format()
+			if version != CurrentFormat || id == "" || interrupted && id != pending.ID {
+				t.Errorf("Format() = %d, %q after upgrading, want %d and an ID", version, id, CurrentFormat)
+			}
+			db = reopen(t, db)
+			if v, id2 := db.Format(); v != version || id2 != id {
+				t.Errorf("Format() = %d, %q after reopening, want %d, %q", v, id2, version, id)
+			}
+			for name, pw := range records {
+				wantPassword(t, db, name, pw)
+				if env := db.records[name]; env.Format != CurrentFormat {
+					t.Errorf("%s is in format %d after upgrading", name, env.Format)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordAD(t *testing.T) {
+	id := newStoreFormat().ID
+	tests := []struct {
+		name    string
+		format  storeFormat
+		version int
+		wantErr bool
+	}{
+		{"format 0 store, format 0 entry", storeFormat{}, 0, false},
+		{"format 0 store, newer entry", storeFormat{}, 1, true},
+		{"current store, current entry", storeFormat{ID: id, Version: 1}, 1, false},
+		{"current store, format 0 entry", storeFormat{ID: id, Version: 1}, 0, true},
+		// The version in format is not authenticated: an ID is enough
+		// to refuse entries in format 0.
+		{"store with ID claiming format 0", storeFormat{ID: id}, 0, true},
+		{"current store, newer entry", storeFormat{ID: id, Version: 1}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.format.recordAD(tt.version, "a")
+			if tt.wantErr != (err != nil) {
+				t.Errorf("recordAD(%d) = %v, want error %v", tt.version, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrCorrupt) {
+				t.Errorf("recordAD(%d) = %v, want ErrCorrupt", tt.version, err)
+			}
+		})
+	}
+}
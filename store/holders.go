@@ -0,0 +1,130 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+)
+
+// A store under dual control, such as a break-glass vault of root
+// credentials, has no passphrase of its own: each of its holders has one,
+// and it takes all of them to open it. The store's holdersFile names the
+// holders in order, and their passphrases are combined into the one the
+// key is derived from, so that, as with a keyfile, everything downstream
+// sees a passphrase like any other.
+const holdersFile = "holders"
+
+var holdersKey = []byte("durin dual control")
+
+type holderList struct {
+	Holders []string `json:"holders"`
+}
+
+// Holders returns the names of the holders of the store in dir, in the
+// order their passphrases are combined, or nil if it is not under dual
+// control.
+func Holders(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, holdersFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list holderList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, holdersFile, err)
+	}
+	if len(list.Holders) < 2 {
+		return nil, fmt.Errorf("%w: %s names fewer than two holders", ErrCorrupt, holdersFile)
+	}
+	return list.Holders, nil
+}
+
+// CombinePassphrases returns the passphrase of a store under dual control
+// from those of its holders, in the order Holders returns them. The caller
+// wipes it.
+func CombinePassphrases(pws [][]byte) []byte {
+	mac := hmac.New(sha256.New, holdersKey)
+	for _, pw := range pws {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(pw)))
+		mac.Write(n[:])
+		mac.Write(pw)
+	}
+	return mac.Sum(nil)
+}
+
+// CreateDualControl is CreateWithKeyFile for a store under the dual
+// control of holders, at least two, which pws are the passphrases of. The
+// passphrases must differ, so that no holder can open the store alone.
+func CreateDualControl(dir string, holders []string, pws [][]byte, keyFile string) error {
+	if len(holders) < 2 {
+		return errors.New("dual control needs at least two holders")
+	}
+	if err := CheckKeyset(dir); err != nil {
+		return err
+	}
+	if len(pws) != len(holders) {
+		return fmt.Errorf("%d passphrases given for %d holders", len(pws), len(holders))
+	}
+	for i, h := range holders {
+		if strings.TrimSpace(h) == "" {
+			return errors.New("holder names must not be empty")
+		}
+		if len(pws[i]) == 0 {
+			return fmt.Errorf("the passphrase of %s must not be empty", h)
+		}
+		for j := 0; j < i; j++ {
+			if holders[j] == h {
+				return fmt.Errorf("%s is named twice as a holder", h)
+			}
+			if hmac.Equal(pws[j], pws[i]) {
+				return fmt.Errorf("%s and %s chose the same passphrase", holders[j], h)
+			}
+		}
+	}
+	b, err := json.Marshal(holderList{Holders: holders})
+	if err != nil {
+		return err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, holdersFile), append(b, '\n')); err != nil {
+		return err
+	}
+	pw := CombinePassphrases(pws)
+	defer secmem.Wipe(pw)
+	return CreateWithKeyFile(dir, pw, keyFile)
+}
+
+// holderPassphrase asks opts for the passphrase of each holder of the store
+// in dir and combines them.
+func holderPassphrase(opts *Options, holders []string) ([]byte, error) {
+	read := opts.holderPassphrase()
+	if read == nil {
+		return nil, fmt.Errorf("the store is under the dual control of %s, and no source for their passphrases is configured", strings.Join(holders, " and "))
+	}
+	pws := make([][]byte, 0, len(holders))
+	defer func() {
+		for _, pw := range pws {
+			secmem.Wipe(pw)
+		}
+	}()
+	for _, h := range holders {
+		pw, err := read(h)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the passphrase of %s: %w", h, err)
+		}
+		pws = append(pws, pw)
+	}
+	return CombinePassphrases(pws), nil
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// nameIndex answers prefix and substring queries on entry names without
+// looking at every name, so that they stay fast on stores with a hundred
+// thousand entries, as imports from enterprise password managers produce.
+// Names are kept sorted for prefix queries, and their trigrams are indexed
+// for case-insensitive substring queries.
+//
+// Only names are indexed: indexing notes would mean decrypting every entry
+// when the store is opened.
+type nameIndex struct {
+	sorted []string
+
+	// ids numbers the names for the trigram postings; byID and lower hold
+	// each name as it is and in lower case under its number. Numbers are
+	// not reused, and both hold "" under the number of a removed name.
+	ids     map[string]int32
+	byID    []string
+	lower   []string
+	grams   map[uint32][]int32
+	removed int
+}
+
+func newNameIndex(records map[string]Envelope) *nameIndex {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return buildNameIndex(names)
+}
+
+// buildNameIndex indexes sorted, which it keeps.
+func buildNameIndex(sorted []string) *nameIndex {
+	x := &nameIndex{
+		sorted: sorted,
+		ids:    make(map[string]int32, len(sorted)),
+		byID:   make([]string, 0, len(sorted)),
+		lower:  make([]string, 0, len(sorted)),
+		grams:  make(map[uint32][]int32),
+	}
+	for _, name := range sorted {
+		x.number(name)
+	}
+	return x
+}
+
+// trigram packs the three bytes of s starting at i.
+func trigram(s string, i int) uint32 {
+	return uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+}
+
+// number gives name the next number and adds it to the postings.
+func (x *nameIndex) number(name string) {
+	id := int32(len(x.lower))
+	lower := strings.ToLower(name)
+	x.ids[name] = id
+	x.byID = append(x.byID, name)
+	x.lower = append(x.lower, lower)
+	for i := 0; i+3 <= len(lower); i++ {
+		g := trigram(lower, i)
+		// Numbers only grow, so a name with a repeated trigram is the last
+		// posting already.
+		if p := x.grams[g]; len(p) == 0 || p[len(p)-1] != id {
+			x.grams[g] = append(p, id)
+		}
+	}
+}
+
+func (x *nameIndex) add(name string) {
+	if _, ok := x.ids[name]; ok {
+		return
+	}
+	i := sort.SearchStrings(x.sorted, name)
+	x.sorted = append(x.sorted, "")
+	copy(x.sorted[i+1:], x.sorted[i:])
+	x.sorted[i] = name
+	x.number(name)
+}
+
+func (x *nameIndex) remove(name string) {
+	id, ok := x.ids[name]
+	if !ok {
+		return
+	}
+	i := sort.SearchStrings(x.sorted, name)
+	x.sorted = append(x.sorted[:i], x.sorted[i+1:]...)
+	delete(x.ids, name)
+	x.byID[id], x.lower[id] = "", ""
+	x.removed++
+	// Rebuild once removed names make up most of the postings.
+	if x.removed > len(x.ids) {
+		*x = *buildNameIndex(x.sorted)
+	}
+}
+
+// withPrefix returns the names starting with prefix, sorted.
+func (x *nameIndex) withPrefix(prefix string) []string {
+	i := sort.SearchStrings(x.sorted, prefix)
+	j := i
+	for j < len(x.sorted) && strings.HasPrefix(x.sorted[j], prefix) {
+		j++
+	}
+	return append([]string{}, x.sorted[i:j]...)
+}
+
+// containing returns the names containing query, ignoring case, sorted.
+func (x *nameIndex) containing(query string) []string {
+	query = strings.ToLower(query)
+	names := []string{}
+	if len(query) < 3 {
+		// Too short for a trigram: look at every name.
+		for id, lower := range x.lower {
+			if lower != "" && strings.Contains(lower, query) {
+				names = append(names, x.byID[id])
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	// Every match is in the postings of each trigram of query; go through
+	// the shortest.
+	var candidates []int32
+	for i := 0; i+3 <= len(query); i++ {
+		p, ok := x.grams[trigram(query, i)]
+		if !ok {
+			return names
+		}
+		if candidates == nil || len(p) < len(candidates) {
+			candidates = p
+		}
+	}
+	for _, id := range candidates {
+		if lower := x.lower[id]; lower != "" && strings.Contains(lower, query) {
+			names = append(names, x.byID[id])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+)
+
+// journalFile holds the changes made since pw.db was last written, one
+// JSON-encoded journalRecord per line. Appending a line is much cheaper
+// than rewriting pw.db on every Put and Delete, and a crash can at worst
+// tear the line being appended, which readers then ignore.
+const journalFile = "pw.journal"
+
+// snapshotEvery is how many records the journal may hold before a commit
+// rewrites pw.db instead and starts a new journal.
+const snapshotEvery = 128
+
+// snapshotMinJournal is the size past which a journal larger than pw.db
+// is folded into it too, as happens with few but large entries.
+const snapshotMinJournal = 64 << 10
+
+// journalRecord is one change: the envelope a Put wrote, or the name of
+// an entry that was deleted.
+type journalRecord struct {
+	Put    *Envelope `json:"put,omitempty"`
+	Delete string    `json:"delete,omitempty"`
+	// Base, set in the first line of a journal only and in no change,
+	// names the pw.db the journal continues by its digest. A journal left
+	// behind by a snapshot that folded it in, such as when the process
+	// died before removing it, names the pw.db before and so is ignored.
+	// Journals from before Base was recorded have no such line.
+	Base string `json:"base,omitempty"`
+}
+
+func (r *journalRecord) name() string {
+	if r.Put != nil {
+		return r.Put.Name
+	}
+	return r.Delete
+}
+
+func (r *journalRecord) apply(records map[string]Envelope) {
+	if r.Put != nil {
+		records[r.Put.Name] = *r.Put
+	} else {
+		delete(records, r.Delete)
+	}
+}
+
+// journalState identifies the journal a DB read.
+type journalState struct {
+	// info is nil if there was no journal.
+	info os.FileInfo
+	// valid is the length of the journal up to the end of its last
+	// complete record. Anything after it is a torn append, which is cut
+	// off before the next one.
+	valid int64
+	// n is the number of records.
+	n int
+}
+
+// readJournal reads the journal of the store in dir, if it has one and it
+// continues the pw.db whose digest is base. A journal continuing another
+// pw.db is read as holding no records, so that the next append replaces
+// it.
+func readJournal(dir string, base [sha256.Size]byte) ([]journalRecord, journalState, error) {
+	f, err := os.Open(filepath.Join(dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil, journalState{}, nil
+	}
+	if err != nil {
+		return nil, journalState{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, journalState{}, err
+	}
+	if info.Size() > legacyLimits.MaxSize {
+		return nil, journalState{}, fmt.Errorf("%w: %s: over the %d bytes accepted", ErrCorrupt, journalFile, legacyLimits.MaxSize)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, journalState{}, err
+	}
+	var (
+		recs  []journalRecord
+		valid int
+	)
+	for {
+		i := bytes.IndexByte(b[valid:], '\n')
+		if i < 0 {
+			break
+		}
+		var r journalRecord
+		if err := strictjson.Unmarshal(b[valid:valid+i], &r, journalLimits); err != nil {
+			return nil, journalState{}, fmt.Errorf("%w: %s: bad record at offset %d: %v", ErrCorrupt, journalFile, valid, err)
+		}
+		switch {
+		case r.Base != "" && (valid > 0 || r.Put != nil || r.Delete != ""):
+			return nil, journalState{}, fmt.Errorf("%w: %s: bad record at offset %d", ErrCorrupt, journalFile, valid)
+		case r.Base != "" && r.Base != hex.EncodeToString(base[:]):
+			return nil, journalState{info: info}, nil
+		case r.Base == "" && r.Put == nil && r.Delete == "":
+			return nil, journalState{}, fmt.Errorf("%w: %s: bad record at offset %d", ErrCorrupt, journalFile, valid)
+		case r.Base == "":
+			recs = append(recs, r)
+		}
+		valid += i + 1
+	}
+	return recs, journalState{info: info, valid: int64(valid), n: len(recs)}, nil
+}
+
+// readRecords reads pw.db of the store in dir and applies its journal.
+// Without the store lock, pw.db may be rewritten in between, so the two
+// are read again, a few times at most, until pw.db stayed the same. The
+// caller must close v once done with the records.
+func readRecords(dir string) (map[string]Envelope, dbVersion, error) {
+	pwPath := filepath.Join(dir, dbFile)
+	for attempt := 1; ; attempt++ {
+		envs, v, err := readDB(pwPath)
+		if err != nil {
+			return nil, dbVersion{}, err
+		}
+		recs, j, err := readJournal(dir, v.digest)
+		if err != nil {
+			v.close()
+			return nil, dbVersion{}, err
+		}
+		if info, err := os.Stat(pwPath); (err != nil || !sameVersion(v.info, info)) && attempt < 3 {
+			v.close()
+			continue
+		}
+		records := make(map[string]Envelope, len(envs))
+		for _, env := range envs {
+			records[env.Name] = env
+		}
+		for i := range recs {
+			recs[i].apply(records)
+		}
+		v.journal = j
+		return records, v, nil
+	}
+}
+
+// sameVersion reports whether a and b, either of which may be nil for a
+// missing file, look like the same version of a file.
+func sameVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// journalStale reports whether the journal differs from the one db read.
+// mu must be held.
+func (db *DB) journalStale() (bool, error) {
+	info, err := os.Stat(filepath.Join(db.dir, journalFile))
+	if os.IsNotExist(err) {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !sameVersion(db.loaded.journal.info, info), nil
+}
+
+// journalFull reports whether the next commit should write a snapshot
+// rather than add to the journal. mu must be held.
+func (db *DB) journalFull() bool {
+	j := db.loaded.journal
+	if j.n+1 >= snapshotEvery {
+		return true
+	}
+	return j.valid > snapshotMinJournal && db.loaded.info != nil && j.valid > db.loaded.info.Size()
+}
+
+// appendJournal appends r to the journal. mu must be held for writing.
+func (db *DB) appendJournal(r *journalRecord) (_err error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	j := db.loaded.journal
+	if j.valid == 0 {
+		// A new journal, or one replacing a journal of another pw.db,
+		// first names the pw.db it continues.
+		head, err := json.Marshal(&journalRecord{Base: hex.EncodeToString(db.loaded.digest[:])})
+		if err != nil {
+			return err
+		}
+		line = append(append(head, '\n'), line...)
+	}
+	f, err := os.OpenFile(filepath.Join(db.dir, journalFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); _err == nil {
+			_err = err
+		}
+	}()
+	if j.info != nil && j.info.Size() > j.valid {
+		if err := f.Truncate(j.valid); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Write(line); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if j.info == nil {
+		if err := syncDir(db.dir); err != nil {
+			return err
+		}
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	db.loaded.journal = journalState{info: info, valid: info.Size(), n: j.n + 1}
+	return nil
+}
+
+// syncDir makes a new file in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeSnapshot writes records as the new pw.db of the store in dir and
+// removes the journal they include. It returns the records as read back
+// from the new pw.db; the caller must close v once done with them.
+func writeSnapshot(dir string, records map[string]Envelope) (map[string]Envelope, dbVersion, error) {
+	b, err := encodeDB(records)
+	if err != nil {
+		return nil, dbVersion{}, err
+	}
+	pwPath := filepath.Join(dir, dbFile)
+	// Once the new pw.db is in place, the journal names the one before, so
+	// it is ignored even should removing it fail. A pw.db the same as the
+	// one before would not tell them apart, but then the journal changes
+	// nothing in the end, so it is removed first.
+	same := false
+	if _, v, err := readDB(pwPath); err == nil {
+		same = v.digest == dbDigest(b)
+		v.close()
+	}
+	if !same {
+		if err := atomicfile.WriteFile(pwPath, b); err != nil {
+			return nil, dbVersion{}, err
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, journalFile)); err == nil {
+		syncDir(dir)
+	} else if !os.IsNotExist(err) && same {
+		return nil, dbVersion{}, err
+	}
+	return readRecords(dir)
+}
+
+// Compact folds the journal of the store in dir into a new pw.db, e.g.
+// before pw.db is committed to version control, dropping the records that
+// later ones superseded. It returns the size of pw.db and the journal
+// before and after; if there is no journal, nothing is written. Like
+// Create, it does not take the store lock; the caller must hold it.
+func Compact(dir string) (before, after int64, err error) {
+	records, v, err := readRecords(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return 0, 0, err
+	}
+	defer v.close()
+	before = v.info.Size()
+	if v.journal.info == nil {
+		return before, before, nil
+	}
+	before += v.journal.info.Size()
+	_, nv, err := writeSnapshot(dir, records)
+	if err != nil {
+		return 0, 0, err
+	}
+	nv.close()
+	return before, nv.info.Size(), nil
+}
+
+// DataStat returns the combined size of the files holding the entries of
+// the store in dir and when they were last written.
+func DataStat(dir string) (size int64, modified time.Time, err error) {
+	for _, name := range []string{dbFile, journalFile} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		size += info.Size()
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return size, modified, nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalReplay(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// change changes the store in dir, left closed, behind the back
+		// of the DB opened afterwards.
+		change func(t *testing.T, dir string)
+		want   map[string]string
+	}{{
+		name: "journal over a compacted pw.db",
+		change: func(t *testing.T, dir string) {
+			db := openStore(t, dir)
+			put(t, db, "a", "1")
+			put(t, db, "b", "1")
+			db.Close()
+			if _, _, err := Compact(dir); err != nil {
+				t.Fatal(err)
+			}
+			db = openStore(t, dir)
+			put(t, db, "c", "1")
+			put(t, db, "b", "2")
+			if err := db.Delete(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+			if _, err := os.Stat(filepath.Join(dir, journalFile)); err != nil {
+				t.Fatalf("no journal after the changes: %v", err)
+			}
+		},
+		want: map[string]string{"b": "2", "c": "1"},
+	}, {
+		name: "torn append",
+		change: func(t *testing.T, dir string) {
+			db := openStore(t, dir)
+			put(t, db, "a", "1")
+			db.Close()
+			f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(`{"put":{"name":"b","da`)
+			f.Close()
+		},
+		want: map[string]string{"a": "1"},
+	}, {
+		// A snapshot written without removing the journal it folded in,
+		// as when interrupted, must not have the journal replayed over it.
+		name: "journal of an older pw.db",
+		change: func(t *testing.T, dir string) {
+			db := openStore(t, dir)
+			put(t, db, "a", "1")
+			db.Close()
+			old, err := ioutil.ReadFile(filepath.Join(dir, journalFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db = openStore(t, dir)
+			put(t, db, "a", "2")
+			db.Close()
+			if _, _, err := Compact(dir); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, journalFile), old, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		want: map[string]string{"a": "2"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := createStore(t)
+			tt.change(t, dir)
+			db := openStore(t, dir)
+			names := make([]string, 0, len(tt.want))
+			for name, pw := range tt.want {
+				names = append(names, name)
+				wantPassword(t, db, name, pw)
+			}
+			wantNames(t, db, names...)
+			// The store takes further changes, and reads them back.
+			put(t, db, "z", "1")
+			db = reopen(t, db)
+			wantPassword(t, db, "z", "1")
+			for name, pw := range tt.want {
+				wantPassword(t, db, name, pw)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/subtle/random"
+)
+
+// A store may need a keyfile besides its passphrase, such as one kept on a
+// USB stick, so that the passphrase alone does not open it. The store's
+// keyFileName file records the ID of its keyfile, and the passphrase is
+// mixed with the keyfile's contents before a key is derived from it, so
+// that everything downstream, such as the agent, sees a passphrase like
+// any other.
+const keyFileName = "keyfile"
+
+// keyFileMin is the smallest keyfile accepted, in bytes.
+const keyFileMin = 32
+
+var keyFileIDAD = []byte("durin keyfile id")
+
+// NewKeyFile writes a new random keyfile to path, which must not exist
+// yet.
+func NewKeyFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	b := random.GetRandomBytes(64)
+	defer secmem.Wipe(b)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// readKeyFile returns the secret the keyfile at path holds and its ID.
+func readKeyFile(path string) ([]byte, string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read keyfile: %v", err)
+	}
+	defer secmem.Wipe(b)
+	if len(b) < keyFileMin {
+		return nil, "", fmt.Errorf("keyfile %s is too short; it needs at least %d random bytes", path, keyFileMin)
+	}
+	sum := sha256.Sum256(b)
+	mac := hmac.New(sha256.New, sum[:])
+	mac.Write(keyFileIDAD)
+	id := hex.EncodeToString(mac.Sum(nil)[:8])
+	return sum[:], id, nil
+}
+
+// UsesKeyFile reports whether the store in dir needs a keyfile.
+func UsesKeyFile(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, keyFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mixKeyFile returns the passphrase to derive the key of the store in dir
+// from: a copy of pw, mixed with the keyfile at path if the store needs
+// one. The caller wipes it.
+func mixKeyFile(dir, path string, pw []byte) ([]byte, error) {
+	want, err := ioutil.ReadFile(filepath.Join(dir, keyFileName))
+	if os.IsNotExist(err) {
+		if path != "" {
+			return nil, fmt.Errorf("the store in %s does not use a keyfile", dir)
+		}
+		return append([]byte(nil), pw...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("the store in %s %w", dir, ErrNoKeyFile)
+	}
+	secret, id, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(secret)
+	if id != strings.TrimSpace(string(want)) {
+		return nil, fmt.Errorf("%s is not the keyfile of the store in %s", path, dir)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(pw)
+	return mac.Sum(nil), nil
+}
+
+// useKeyFile records that the store in dir needs the keyfile at path.
+func useKeyFile(dir, path string) error {
+	secret, id, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	secmem.Wipe(secret)
+	return atomicfile.WriteFile(filepath.Join(dir, keyFileName), []byte(id+"\n"))
+}
@@ -0,0 +1,390 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Files of a store.
+const (
+	saltFile   = "salt"
+	masterFile = "master"
+	dbFile     = "pw.db"
+	// resaltFile holds the new salt while Resalt replaces master.
+	resaltFile = "salt.new"
+)
+
+// NoStoreError is returned by Open when dir holds no store.
+type NoStoreError struct {
+	Dir string
+}
+
+func (e *NoStoreError) Error() string {
+	return fmt.Sprintf("no store in %s", e.Dir)
+}
+
+func (e *NoStoreError) Unwrap() error {
+	return ErrNoStore
+}
+
+// Exists reports whether dir holds an initialized store.
+func Exists(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, masterFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// masterVersion identifies one version of the master file, so that a DB
+// notices when another process, such as durin key rekey, replaces the
+// keyset it unlocked.
+type masterVersion struct {
+	info   os.FileInfo
+	digest [sha256.Size]byte
+}
+
+func readMasterVersion(dir string) (masterVersion, error) {
+	f, err := os.Open(filepath.Join(dir, masterFile))
+	if err != nil {
+		return masterVersion{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return masterVersion{}, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return masterVersion{}, err
+	}
+	return masterVersion{info: info, digest: sha256.Sum256(b)}, nil
+}
+
+// MasterDigest returns the SHA-256 of the wrapped master keyset of the
+// store in dir. It changes whenever the keyset or its wrapping does, so a
+// process holding the unlocked keyset, such as durin agent, can tell that
+// it is out of date.
+func MasterDigest(dir string) ([sha256.Size]byte, error) {
+	v, err := readMasterVersion(dir)
+	return v.digest, err
+}
+
+// Create initializes a store in dir: it writes a new salt, the store's
+// format and a new master keyset wrapped with a key derived from pw. The
+// keyset is written last, so a store without one is not initialized. It
+// refuses to make one for a store that lost its own; see CheckKeyset.
+// Create does not take the store lock; see LockDir.
+func Create(dir string, pw []byte) error {
+	return CreateWithKeyFile(dir, pw, "")
+}
+
+// CreateWithKeyFile is Create for a store that needs the keyfile at
+// keyFile besides pw to be opened, or none if keyFile is empty; see
+// NewKeyFile.
+func CreateWithKeyFile(dir string, pw []byte, keyFile string) error {
+	if err := CheckKeyset(dir); err != nil {
+		return err
+	}
+	if keyFile != "" {
+		if err := useKeyFile(dir, keyFile); err != nil {
+			return err
+		}
+	}
+	pw, err := mixKeyFile(dir, keyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	saltPath := filepath.Join(dir, saltFile)
+	salt := random.GetRandomBytes(16)
+	if err := atomicfile.WriteFile(saltPath, salt); err != nil {
+		return fmt.Errorf("failed to write initial salt to %q: %v", saltPath, err)
+	}
+	f := newStoreFormat()
+	if err := writeFormat(dir, f); err != nil {
+		return fmt.Errorf("failed to write the store format: %v", err)
+	}
+	rawKey := secmem.NewBuffer(DeriveKey(pw, salt))
+	defer rawKey.Wipe()
+	h, err := keyset.NewHandle(aead.XChaCha20Poly1305KeyTemplate())
+	if err != nil {
+		return err
+	}
+	if err := writeMasterKeyset(dir, h, rawKey.Bytes(), f, f.Version); err != nil {
+		return fmt.Errorf("failed to write initial master keyset: %v", err)
+	}
+	return nil
+}
+
+// DeriveKey derives the key wrapping the master keyset from pw.
+func DeriveKey(pw, salt []byte) []byte {
+	if len(salt) < 16 {
+		panic(fmt.Sprintf("salt is too small: %d", len(salt)))
+	}
+
+	const (
+		time    = 1
+		mem     = 64 * 1024
+		threads = 4
+	)
+
+	return argon2.IDKey(pw, salt, time, mem, threads, chacha20poly1305.KeySize)
+}
+
+// UnlockKeyset decrypts the master keyset of the store in dir with pw.
+func UnlockKeyset(ctx context.Context, dir string, pw []byte) (*keyset.Handle, error) {
+	ks, rawKey, err := unlockPassphrase(ctx, dir, pw)
+	if err != nil {
+		return nil, err
+	}
+	secmem.Wipe(rawKey)
+	return ks, nil
+}
+
+// unlockPassphrase decrypts the master keyset of the store in dir with
+// pw, returning it and the key derived from pw that unwrapped it. It fails
+// with ErrBadPassphrase if pw is wrong. If a Resalt was interrupted, it
+// tries the new salt as well, and finishes or undoes what Resalt began.
+func unlockPassphrase(ctx context.Context, dir string, pw []byte) (*keyset.Handle, []byte, error) {
+	saltPath := filepath.Join(dir, saltFile)
+	salt, err := ioutil.ReadFile(saltPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read salt from %q: %v", saltPath, err)
+	}
+	pending, perr := ioutil.ReadFile(filepath.Join(dir, resaltFile))
+	b, err := deriveKey(ctx, pw, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	ks, err := UnlockKeysetWithKey(dir, b)
+	if err == nil {
+		if perr == nil {
+			// Resalt stopped before it replaced master.
+			os.Remove(filepath.Join(dir, resaltFile))
+		}
+		return ks, b, nil
+	}
+	secmem.Wipe(b)
+	if errors.Is(err, ErrCorrupt) {
+		return nil, nil, err
+	}
+	if perr != nil || len(pending) < 16 {
+		return nil, nil, ErrBadPassphrase
+	}
+	if b, err = deriveKey(ctx, pw, pending); err != nil {
+		return nil, nil, err
+	}
+	if ks, err = UnlockKeysetWithKey(dir, b); err != nil {
+		secmem.Wipe(b)
+		return nil, nil, ErrBadPassphrase
+	}
+	// Resalt replaced master but not salt.
+	if err := finishResalt(dir, pending); err != nil {
+		secmem.Wipe(b)
+		return nil, nil, err
+	}
+	return ks, b, nil
+}
+
+// finishResalt replaces the salt with the pending one and removes
+// resaltFile.
+func finishResalt(dir string, salt []byte) error {
+	if err := atomicfile.WriteFile(filepath.Join(dir, saltFile), salt); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, resaltFile))
+}
+
+// Resalt wraps the master keyset with a key derived from pw and a new
+// salt, e.g. after the salt may have been exposed or DeriveKey changed.
+// The entries, encrypted with the master keyset itself, stay as they are.
+// pw must be the store's passphrase.
+func (db *DB) Resalt(ctx context.Context, pw []byte) error {
+	if db.shared {
+		return errors.New("a shared vault has no passphrase or salt")
+	}
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ks, old, err := unlockPassphrase(ctx, db.dir, pw)
+	if err != nil {
+		return err
+	}
+	secmem.Wipe(old)
+	salt := random.GetRandomBytes(16)
+	b, err := deriveKey(ctx, pw, salt)
+	if err != nil {
+		return err
+	}
+	rawKey := secmem.NewBuffer(b)
+	defer rawKey.Wipe()
+	// The new salt is written aside first, so that unlockPassphrase can
+	// finish the change should it be interrupted once master is replaced.
+	if err := atomicfile.WriteFile(filepath.Join(db.dir, resaltFile), salt); err != nil {
+		return err
+	}
+	if err := writeMasterKeyset(db.dir, ks, rawKey.Bytes(), db.format, db.format.writeVersion()); err != nil {
+		return err
+	}
+	if err := finishResalt(db.dir, salt); err != nil {
+		return err
+	}
+	if err := db.noteMaster(); err != nil {
+		return err
+	}
+	if db.keyset == nil {
+		db.keyset = ks
+	}
+	if db.opts.Unlocked != nil {
+		db.opts.Unlocked(db.dir, pw, rawKey.Bytes())
+	}
+	return nil
+}
+
+// UnlockKeysetWithKey decrypts the master keyset of the store in dir with
+// a key DeriveKey returned before, e.g. one cached in the OS keyring.
+func UnlockKeysetWithKey(dir string, rawKey []byte) (*keyset.Handle, error) {
+	f, err := readFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+	masterb, err := ioutil.ReadFile(filepath.Join(dir, masterFile))
+	if err != nil {
+		return nil, err
+	}
+	pwKey, err := subtle.NewChaCha20Poly1305(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	if f.ID != "" {
+		// Once a store has an ID, its master keyset is bound to it, so
+		// that an older one cannot be put back in its place.
+		ks, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(masterb)), pwKey, f.masterAD(CurrentFormat))
+		if err != nil {
+			if _, uerr := keyset.Read(keyset.NewBinaryReader(bytes.NewReader(masterb)), pwKey); uerr == nil {
+				return nil, fmt.Errorf("%w: %s is not bound to the store's ID; if durin key upgrade of an older durin was interrupted, remove %s and run it again", ErrCorrupt, masterFile, formatFile)
+			}
+		}
+		return ks, err
+	}
+	if p, err := readFormatFile(dir, pendingFormatFile); err == nil && p.ID != "" {
+		if ks, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(masterb)), pwKey, p.masterAD(CurrentFormat)); err == nil {
+			// Upgrade stopped between binding master to the new ID and
+			// giving the store the ID.
+			if err := os.Rename(filepath.Join(dir, pendingFormatFile), filepath.Join(dir, formatFile)); err != nil {
+				return nil, err
+			}
+			return ks, nil
+		}
+	}
+	return keyset.Read(keyset.NewBinaryReader(bytes.NewReader(masterb)), pwKey)
+}
+
+// loadMasterKey unlocks the master keyset. With useCache, opts.CachedKey
+// is asked for a key before the passphrase. A passphrase read here is
+// passed to opts.Unlocked. A missing store is created only with
+// opts.AutoCreate, and never over the entries of one that lost its master
+// keyset: a new keyset would leave them all undecryptable.
+func loadMasterKey(ctx context.Context, dir string, opts *Options, useCache bool) (*keyset.Handle, tink.AEAD, error) {
+	exists, err := Exists(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		if err := CheckKeyset(dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !exists && !opts.AutoCreate {
+		return nil, nil, &NoStoreError{dir}
+	}
+	if useCache && exists && opts.CachedKey != nil {
+		if ks, key := opts.CachedKey(ctx, dir); key != nil {
+			return ks, key, nil
+		}
+	}
+
+	if exists && opts.KeyFile == "" {
+		// Fail before asking for a passphrase that cannot help.
+		if uses, err := UsesKeyFile(dir); err != nil {
+			return nil, nil, err
+		} else if uses {
+			return nil, nil, fmt.Errorf("the store in %s %w", dir, ErrNoKeyFile)
+		}
+	}
+	var holders []string
+	if exists {
+		if holders, err = Holders(dir); err != nil {
+			return nil, nil, err
+		}
+	}
+	var pwb []byte
+	if holders != nil {
+		if pwb, err = holderPassphrase(opts, holders); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		read := opts.passphrase()
+		if newRead := opts.newPassphrase(); !exists && newRead != nil {
+			read = newRead
+		}
+		if read == nil {
+			return nil, nil, errors.New("no passphrase source configured")
+		}
+		if pwb, err = read(); err != nil {
+			return nil, nil, fmt.Errorf("failed to read password: %w", err)
+		}
+	}
+	typed := secmem.NewBuffer(pwb)
+	defer typed.Wipe()
+	if !exists {
+		if err := CreateWithKeyFile(dir, typed.Bytes(), opts.KeyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	mixed, err := mixKeyFile(dir, opts.KeyFile, typed.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	pw := secmem.NewBuffer(mixed)
+	defer pw.Wipe()
+
+	ks, b, err := unlockPassphrase(ctx, dir, pw.Bytes())
+	if errors.Is(err, ErrBadPassphrase) {
+		return nil, nil, fmt.Errorf("failed to decrypt master keyset: %w", err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rawKey := secmem.NewBuffer(b)
+	defer rawKey.Wipe()
+	key, err := aead.New(ks)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Unlocked != nil {
+		opts.Unlocked(dir, pw.Bytes(), rawKey.Bytes())
+	}
+	return ks, key, nil
+}
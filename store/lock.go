@@ -0,0 +1,144 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LockedError is returned when another process holds the lock of a store.
+type LockedError struct {
+	Dir string
+	// PID is the process that took the lock, or 0 if it is not known.
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("the store in %s is in use by another process", e.Dir)
+	}
+	return fmt.Sprintf("the store in %s is in use by pid %d", e.Dir, e.PID)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrInUse
+}
+
+// held maps the stores this process locked to the descriptors of their
+// lock files.
+var (
+	heldMu sync.Mutex
+	held   = make(map[string]int)
+)
+
+func lockPath(dir string) string {
+	return filepath.Join(dir, "lock")
+}
+
+// LockDir takes an exclusive lock on the store in dir, waiting up to wait
+// for another process to release it. The lock is held until the process
+// exits, or the DB opened on it is closed. The holder's PID is written
+// into the lock file so that others can say who has it; see LockState.
+// Waiting ends early if ctx is done.
+func LockDir(ctx context.Context, dir string, wait time.Duration) error {
+	fd, err := unix.Open(lockPath(dir), unix.O_CREAT|unix.O_RDWR|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err = unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB)
+		if err != unix.EWOULDBLOCK || !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			unix.Close(fd)
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if err == unix.EWOULDBLOCK {
+		unix.Close(fd)
+		return &LockedError{Dir: dir, PID: lockHolder(dir)}
+	}
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to acquire DB lock: %v", err)
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := unix.Ftruncate(fd, 0); err == nil {
+		unix.Pwrite(fd, pid, 0)
+	}
+	heldMu.Lock()
+	held[dir] = fd
+	heldMu.Unlock()
+	return nil
+}
+
+// unlockDir releases the lock LockDir took on the store in dir, if this
+// process holds it.
+func unlockDir(dir string) error {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	fd, ok := held[dir]
+	if !ok {
+		return nil
+	}
+	delete(held, dir)
+	unix.Ftruncate(fd, 0)
+	return unix.Close(fd)
+}
+
+// lockHolder returns the PID recorded in the lock file of the store in
+// dir, or 0 if there is none.
+func lockHolder(dir string) int {
+	b, err := ioutil.ReadFile(lockPath(dir))
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// LockState describes who holds the lock of the store in dir, without
+// taking it. held is false if the lock is free; pid is the recorded
+// holder, if any.
+func LockState(dir string) (held bool, pid int, err error) {
+	fd, err := unix.Open(lockPath(dir), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	defer unix.Close(fd)
+	switch err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err {
+	case nil:
+		unix.Flock(fd, unix.LOCK_UN)
+		return false, lockHolder(dir), nil
+	case unix.EWOULDBLOCK:
+		return true, lockHolder(dir), nil
+	default:
+		return false, 0, err
+	}
+}
+
+// RemoveLock deletes the lock file of the store in dir, so that the next
+// LockDir locks a new one. It is only safe once the holder is known to be
+// gone, e.g. when a child that inherited the lock keeps it after the
+// process that took it died.
+func RemoveLock(dir string) error {
+	return os.Remove(lockPath(dir))
+}
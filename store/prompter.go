@@ -0,0 +1,42 @@
+package store
+
+// Prompter asks the user of a store for its passphrases. Frontends that are
+// not terminals, such as GUIs, and tests set Options.Prompter rather than
+// Options.Passphrase, NewPassphrase and HolderPassphrase one by one; those
+// that are set take precedence over it. The store asks for nothing else.
+type Prompter interface {
+	// Passphrase asks for the master passphrase of an existing store.
+	Passphrase() ([]byte, error)
+	// NewPassphrase asks for the passphrase of a store being created,
+	// making sure it was not mistyped, e.g. by asking twice.
+	NewPassphrase() ([]byte, error)
+	// HolderPassphrase asks holder for their passphrase of a store under
+	// dual control.
+	HolderPassphrase(holder string) ([]byte, error)
+}
+
+// passphrase returns where the master passphrase comes from, or nil.
+func (o *Options) passphrase() func() ([]byte, error) {
+	if o.Passphrase == nil && o.Prompter != nil {
+		return o.Prompter.Passphrase
+	}
+	return o.Passphrase
+}
+
+// newPassphrase returns where the passphrase of a new store comes from, or
+// nil.
+func (o *Options) newPassphrase() func() ([]byte, error) {
+	if o.NewPassphrase == nil && o.Prompter != nil {
+		return o.Prompter.NewPassphrase
+	}
+	return o.NewPassphrase
+}
+
+// holderPassphrase returns where the passphrases of holders come from, or
+// nil.
+func (o *Options) holderPassphrase() func(holder string) ([]byte, error) {
+	if o.HolderPassphrase == nil && o.Prompter != nil {
+		return o.Prompter.HolderPassphrase
+	}
+	return o.HolderPassphrase
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+)
+
+// readOnlyFile marks a store read-only, such as an archived copy kept as
+// it was at the end of a year. It is synced with pw.db, so that every copy
+// of the archive is read-only too.
+const readOnlyFile = "readonly"
+
+// readOnlyLimits bound readOnlyFile.
+var readOnlyLimits = strictjson.Limits{MaxSize: 1 << 16, MaxDepth: 2}
+
+// ReadOnlyInfo tells since when and why a store is read-only.
+type ReadOnlyInfo struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ReadOnly returns why the store in dir is read-only, or nil if it is not.
+// Entries of a read-only store can be read but not written: DB.Put,
+// DB.Delete and everything else changing pw.db fail with ErrReadOnly.
+func ReadOnly(dir string) (*ReadOnlyInfo, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, readOnlyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info ReadOnlyInfo
+	if err := strictjson.Unmarshal(b, &info, readOnlyLimits); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, readOnlyFile, err)
+	}
+	return &info, nil
+}
+
+// SetReadOnly makes the store in dir read-only for the reason info gives,
+// or writable again if info is nil. Like Create, it does not take the
+// store lock; see LockDir.
+func SetReadOnly(dir string, info *ReadOnlyInfo) error {
+	path := filepath.Join(dir, readOnlyFile)
+	if info == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(b, '\n'))
+}
+
+// writable returns ErrReadOnly if the store is read-only. It reads
+// readOnlyFile every time, so that a store archived by another process, or
+// by sync, is not written either.
+func (db *DB) writable() error {
+	info, err := ReadOnly(db.dir)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return nil
+	}
+	err = fmt.Errorf("the store in %s %w, archived on %s", db.dir, ErrReadOnly, info.Since.Local().Format("2006-01-02"))
+	if info.Reason != "" {
+		err = fmt.Errorf("%w (%s)", err, info.Reason)
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyRefusals(t *testing.T) {
+	ctx := context.Background()
+	pw := func() []byte { return []byte(testPassphrase) }
+	tests := []struct {
+		name   string
+		shared bool
+		change func(db *DB) error
+	}{
+		{"put", false, func(db *DB) error { return db.Put(ctx, "b", &Record{Password: "1"}) }},
+		{"delete", false, func(db *DB) error { return db.Delete(ctx, "a") }},
+		{"rename", false, func(db *DB) error { return db.Rename(ctx, map[string]string{"a": "b"}) }},
+		{"undo", false, func(db *DB) error { _, err := db.Undo(time.Hour); return err }},
+		{"rekey", false, func(db *DB) error { return db.Rekey(ctx, pw(), RekeyOptions{}) }},
+		{"upgrade", false, func(db *DB) error { return db.Upgrade(ctx, pw()) }},
+		{"shared put", true, func(db *DB) error { return db.Put(ctx, "b", &Record{Password: "1"}) }},
+		{"shared rename", true, func(db *DB) error { return db.Rename(ctx, map[string]string{"a": "b"}) }},
+		{"set ACL", true, func(db *DB) error { _, err := db.SetACL(ctx, "a", []string{"alice"}); return err }},
+	}
+	// files are those a refused change must leave alone.
+	files := []string{dbFile, journalFile, masterFile, formatFile, recipientsFile, undoFile}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var db *DB
+			if tt.shared {
+				db = openSharedVault(t)
+				if _, err := db.SetACL(ctx, "a", []string{"alice", "bob"}); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				db = openStore(t, createStore(t))
+			}
+			put(t, db, "a", "1")
+			if err := SetReadOnly(db.Dir(), &ReadOnlyInfo{Since: time.Now(), Reason: "archive"}); err != nil {
+				t.Fatal(err)
+			}
+			before := make(map[string][]byte)
+			for _, name := range files {
+				before[name], _ = ioutil.ReadFile(filepath.Join(db.Dir(), name))
+			}
+			if err := tt.change(db); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("%s in a read-only store = %v, want ErrReadOnly", tt.name, err)
+			}
+			for _, name := range files {
+				if after, _ := ioutil.ReadFile(filepath.Join(db.Dir(), name)); !bytes.Equal(after, before[name]) {
+					t.Errorf("refused %s changed %s", tt.name, name)
+				}
+			}
+			wantPassword(t, db, "a", "1")
+
+			if err := SetReadOnly(db.Dir(), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.change(db); err != nil {
+				t.Errorf("%s once writable again: %v", tt.name, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/tink"
+)
+
+// RecordSet is the set of all records in the db
+type RecordSet struct {
+	Records []Envelope `json:"records"`
+}
+
+// Envelope represents a single entry in the db
+type Envelope struct {
+	Name string `json:"name"`
+	// Format is the version of the store's format Data was encrypted in,
+	// which decides what is authenticated along with it.
+	Format int    `json:"format,omitempty"`
+	Data   []byte `json:"data"`
+	// Meta describes the entry so that it can be listed without
+	// decrypting Data. It is stored in the clear and not authenticated, so
+	// it is only fit for display; Data is what counts. Entries written
+	// before metadata was recorded have none until they are next written.
+	Meta *EntryMeta `json:"meta,omitempty"`
+	// Keys holds the entry's data key in a shared vault, wrapped to each
+	// recipient and keyed by the ID of their public key.
+	Keys map[string][]byte `json:"keys,omitempty"`
+
+	// ref locates Data in pw.db until it is read.
+	ref *dataRef
+}
+
+// EntryMeta is what an envelope tells about its entry.
+type EntryMeta struct {
+	Kind string   `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	// Created is when the entry was first written, if known, and Modified
+	// when it was last written.
+	Created  *time.Time `json:"created,omitempty" yaml:"created,omitempty"`
+	Modified *time.Time `json:"modified,omitempty" yaml:"modified,omitempty"`
+	HasTOTP  bool       `json:"has_totp,omitempty" yaml:"has_totp,omitempty"`
+}
+
+// EntryInfo describes an entry, as returned by DB.ListEntries.
+type EntryInfo struct {
+	Name      string `json:"name" yaml:"name"`
+	EntryMeta `yaml:",inline"`
+}
+
+// Record is the decrypted contents of a single entry
+type Record struct {
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	Notes    string `json:"notes,omitempty" yaml:"notes,omitempty"`
+	// URL is the address of the site or service the entry logs in to.
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+
+	// Fields holds additional named values, such as security questions or
+	// API keys.
+	Fields map[string]string `json:"fields,omitempty" yaml:"fields,omitempty"`
+
+	// Attributes are the lookup attributes a Secret Service client stored
+	// the entry with.
+	Attributes map[string]string `json:"attributes,omitempty" yaml:"attributes,omitempty"`
+
+	// Changed is when the password was last set, if known.
+	Changed *time.Time `json:"changed,omitempty" yaml:"changed,omitempty"`
+	// Expires is when the password should be replaced, if ever.
+	Expires *time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+
+	// Created is when the entry was first written and Modified when it was
+	// last written, as DB.Put records them. Unlike the times in EntryMeta,
+	// they are encrypted with the entry, so sync cannot change them.
+	// Entries written before they were recorded have none until they are
+	// next written.
+	Created  *time.Time `json:"created,omitempty" yaml:"created,omitempty"`
+	Modified *time.Time `json:"modified,omitempty" yaml:"modified,omitempty"`
+
+	// Policy, if set, governs passwords generated for this record.
+	Policy *PasswordPolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+
+	// Kind classifies the record, e.g. "login" or "note". See
+	// Record.KindOrDefault.
+	Kind string `json:"kind,omitempty" yaml:"kind,omitempty"`
+
+	// Tags are free-form labels for grouping entries. They are copied
+	// into the envelope in the clear; see EntryMeta.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+
+	// History holds previous passwords, oldest first.
+	History []HistoryEntry `json:"history,omitempty" yaml:"history,omitempty"`
+
+	// Attachments are files kept with the entry, such as recovery codes or
+	// key files imported from another password manager.
+	Attachments []Attachment `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+
+	// Passkey is the WebAuthn credential of a passkey record.
+	Passkey *Passkey `json:"passkey,omitempty" yaml:"passkey,omitempty"`
+
+	// Derived makes the record a derived one, whose password is computed
+	// from it under Policy when read and never stored; see DB.Derive.
+	Derived *Derivation `json:"derived,omitempty" yaml:"derived,omitempty"`
+}
+
+// Passkey is a WebAuthn credential, a passkey, that durin acts as the
+// authenticator of.
+type Passkey struct {
+	// CredentialID identifies the credential to the relying party.
+	CredentialID []byte `json:"credential_id" yaml:"credential_id"`
+	// RPID is the relying party ID, a domain such as example.com.
+	RPID string `json:"rp_id" yaml:"rp_id"`
+	// UserHandle is the relying party's ID of the account, and UserName
+	// its name for it, as shown when picking a passkey.
+	UserHandle []byte `json:"user_handle" yaml:"user_handle"`
+	UserName   string `json:"user_name,omitempty" yaml:"user_name,omitempty"`
+	// PrivateKey is the credential's private key as a COSE_Key. It is left
+	// out of YAML, like attachment data.
+	PrivateKey []byte `json:"private_key,omitempty" yaml:"-"`
+	// SignCount is the number of assertions made with the credential.
+	SignCount uint32 `json:"sign_count" yaml:"sign_count"`
+}
+
+// Attachment is a file attached to a record.
+type Attachment struct {
+	Name string `json:"name" yaml:"name"`
+	// Data is left out of YAML, which would print it byte by byte.
+	Data []byte `json:"data" yaml:"-"`
+}
+
+// Record kinds.
+const (
+	KindLogin    = "login"
+	KindNote     = "note"
+	KindCard     = "card"
+	KindIdentity = "identity"
+	// KindSSHKey records hold an SSH private key in their password, for
+	// durin ssh-agent.
+	KindSSHKey = "ssh-key"
+	// KindPasskey records hold a WebAuthn credential in Passkey, for the
+	// browser extension through durin host.
+	KindPasskey = "passkey"
+	// KindDerived records have a password computed from Derived instead
+	// of a stored one.
+	KindDerived = "derived"
+)
+
+// KindOrDefault returns the kind of r. Records without an explicit kind
+// are notes if they only hold notes, and logins otherwise.
+func (r *Record) KindOrDefault() string {
+	switch {
+	case r.Kind != "":
+		return r.Kind
+	case r.Password == "" && r.Username == "" && r.Notes != "":
+		return KindNote
+	default:
+		return KindLogin
+	}
+}
+
+// LoginURL returns the URL of r. Entries imported before records had a URL
+// keep it in their url field.
+func (r *Record) LoginURL() string {
+	if r.URL != "" {
+		return r.URL
+	}
+	return r.Fields["url"]
+}
+
+// HasTOTP reports whether r holds a TOTP secret, as an otpauth://totp/ URI,
+// or a steam:// one for Steam Guard codes, in its password or one of its
+// fields.
+func (r *Record) HasTOTP() bool {
+	return r.TOTPURI() != ""
+}
+
+// TOTPURI returns the TOTP URI r holds: that in its otpauth field, else
+// its password, else that in the first field in name order holding one.
+// It is empty if there is none.
+func (r *Record) TOTPURI() string {
+	if v := r.Fields["otpauth"]; isTOTPURI(v) {
+		return v
+	}
+	if isTOTPURI(r.Password) {
+		return r.Password
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for k, v := range r.Fields {
+		if isTOTPURI(v) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	return r.Fields[keys[0]]
+}
+
+func isTOTPURI(s string) bool {
+	for _, prefix := range []string{"otpauth://totp/", "steam://"} {
+		if len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryEntry is a password a record used to have.
+type HistoryEntry struct {
+	Password string    `json:"password" yaml:"password"`
+	Retired  time.Time `json:"retired" yaml:"retired"`
+}
+
+// PasswordPolicy describes which passwords may be generated for a record.
+// Records can carry one, in which case passwords generated for them follow
+// it and audits report passwords that do not.
+type PasswordPolicy struct {
+	// Length is the length of generated passwords, and the minimum length
+	// of passwords checked against the policy.
+	Length      int  `json:"length" yaml:"length"`
+	NoLower     bool `json:"no_lower,omitempty" yaml:"no_lower,omitempty"`
+	NoUpper     bool `json:"no_upper,omitempty" yaml:"no_upper,omitempty"`
+	NoDigits    bool `json:"no_digits,omitempty" yaml:"no_digits,omitempty"`
+	Symbols     bool `json:"symbols,omitempty" yaml:"symbols,omitempty"`
+	NoAmbiguous bool `json:"no_ambiguous,omitempty" yaml:"no_ambiguous,omitempty"`
+	// Exclude lists characters that must never appear.
+	Exclude string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// Words selects a diceware passphrase of this many words, joined by
+	// Separator, instead of a character password.
+	Words     int    `json:"words,omitempty" yaml:"words,omitempty"`
+	Separator string `json:"separator,omitempty" yaml:"separator,omitempty"`
+
+	// Pronounceable selects a password of alternating consonants and
+	// vowels instead of random characters.
+	Pronounceable bool `json:"pronounceable,omitempty" yaml:"pronounceable,omitempty"`
+
+	// MaxAgeDays is how long a password may be kept before it must be
+	// rotated. Zero means forever.
+	MaxAgeDays int `json:"max_age_days,omitempty" yaml:"max_age_days,omitempty"`
+}
+
+// lockMemory locks the memory holding the secrets of r; see secmem.Lock.
+func (r *Record) lockMemory() {
+	secmem.LockString(r.Password)
+	secmem.LockString(r.Notes)
+	for _, v := range r.Fields {
+		secmem.LockString(v)
+	}
+	for _, h := range r.History {
+		secmem.LockString(h.Password)
+	}
+}
+
+// Wipe zeroes the password, notes, custom fields and history of a record
+// returned by DB.Get. Callers that only read a record defer it, so that
+// the secrets do not linger in memory until the process exits. r must not
+// be used afterwards, and neither may strings sliced from its fields.
+func (r *Record) Wipe() {
+	secmem.WipeString(r.Password)
+	secmem.WipeString(r.Notes)
+	for _, v := range r.Fields {
+		secmem.WipeString(v)
+	}
+	for _, h := range r.History {
+		secmem.WipeString(h.Password)
+	}
+	for _, a := range r.Attachments {
+		secmem.Wipe(a.Data)
+	}
+	if r.Passkey != nil {
+		secmem.Wipe(r.Passkey.PrivateKey)
+	}
+}
+
+// SetPassword replaces the password of r, moving the old one into its
+// history.
+func (r *Record) SetPassword(pw string, now time.Time) {
+	if r.Password != "" && r.Password != pw {
+		r.History = append(r.History, HistoryEntry{Password: r.Password, Retired: now})
+	}
+	r.Password = pw
+	r.Changed = &now
+}
+
+// DecryptRecord decrypts the data of the envelope of the entry called name,
+// in format version 0, with the master key. The entry name is
+// authenticated along with the data, so envelopes cannot be swapped.
+func DecryptRecord(ctx context.Context, master tink.AEAD, name string, data []byte) (*Record, error) {
+	return decryptRecord(ctx, master, name, data, []byte(name))
+}
+
+// DecryptEnvelope decrypts env, an envelope of the store in dir, with the
+// master key, in whichever format it is.
+func DecryptEnvelope(ctx context.Context, master tink.AEAD, dir string, env *Envelope) (*Record, error) {
+	f, err := readFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := f.recordAD(env.Format, env.Name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := env.data()
+	if err != nil {
+		return nil, err
+	}
+	return decryptRecord(ctx, master, env.Name, data, ad)
+}
+
+// decryptRecord decrypts data, the ciphertext of the entry called name,
+// with ad as its associated data.
+func decryptRecord(ctx context.Context, master tink.AEAD, name string, data, ad []byte) (*Record, error) {
+	b, err := decrypt(ctx, master, data, ad)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = decompressPayload(name, b); err != nil {
+		return nil, err
+	}
+	plain := secmem.NewBuffer(b)
+	defer plain.Wipe()
+	var out Record
+	if err := json.Unmarshal(plain.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("%w: entry %q: %v", ErrCorrupt, name, err)
+	}
+	out.lockMemory()
+	return &out, nil
+}
+
+// ReadRecordSet reads the envelopes of the store in dir, sorted by name.
+// The envelopes are not decrypted, so no key is needed. It reads every
+// ciphertext; see ReadEnvelope to read a single entry.
+func ReadRecordSet(dir string) (*RecordSet, error) {
+	records, v, err := readRecords(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer v.close()
+	rs := &RecordSet{Records: make([]Envelope, 0, len(records))}
+	for _, env := range records {
+		if env.Data, err = env.data(); err != nil {
+			return nil, err
+		}
+		env.ref = nil
+		rs.Records = append(rs.Records, env)
+	}
+	sort.Slice(rs.Records, func(i, j int) bool { return rs.Records[i].Name < rs.Records[j].Name })
+	return rs, nil
+}
+
+// ListNames returns the sorted names in the store in dir without taking
+// the lock or unlocking the store. Since names are stored unencrypted this
+// is cheap enough for shell completion.
+func ListNames(dir string) ([]string, error) {
+	records, v, err := readRecords(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	v.close()
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,436 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/strictjson"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	tinkpb "github.com/google/tink/go/proto/tink_go_proto"
+	xchachapb "github.com/google/tink/go/proto/xchacha20_poly1305_go_proto"
+	"github.com/google/tink/go/subtle/random"
+	"google.golang.org/protobuf/proto"
+)
+
+// A store whose master file was lost, such as deleted by mistake or left
+// out of a backup, still holds its entries, but nothing can decrypt them
+// without the keyset. Making a new one would orphan them, so the store
+// refuses to, and offers recovery instead: from a copy of master, from a
+// keyset backup written by BackupKeyset, or from the recovery key of
+// DB.RecoveryKey.
+
+// LostKeysetError is returned by Open and Create when dir holds entries
+// but no master keyset.
+type LostKeysetError struct {
+	Dir string
+	// Entries is the number of entries in pw.db.
+	Entries int
+}
+
+func (e *LostKeysetError) Error() string {
+	return fmt.Sprintf("the store in %s %v: its %d entries cannot be decrypted without %s", e.Dir, ErrNoKeyset, e.Entries, masterFile)
+}
+
+func (e *LostKeysetError) Unwrap() error {
+	return ErrNoKeyset
+}
+
+// CheckKeyset returns a *LostKeysetError if dir holds entries but no
+// master keyset, and nil otherwise, also if dir holds no store at all.
+func CheckKeyset(dir string) error {
+	if exists, err := Exists(dir); err != nil || exists {
+		return err
+	}
+	if shared, err := IsShared(dir); err != nil || shared {
+		return err
+	}
+	records, v, err := readRecords(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	v.close()
+	if len(records) == 0 {
+		return nil
+	}
+	return &LostKeysetError{Dir: dir, Entries: len(records)}
+}
+
+// keysetBackupFiles are the files a keyset backup holds. Salt and master
+// are needed; the others only if the store has them.
+var keysetBackupFiles = []string{saltFile, masterFile, formatFile, holdersFile, keyFileName}
+
+// keysetBackupLimits bound a keyset backup.
+var keysetBackupLimits = strictjson.Limits{MaxSize: 1 << 20, MaxDepth: 3}
+
+// keysetBackup is what BackupKeyset writes.
+type keysetBackup struct {
+	// Version is the version of the backup, 1.
+	Version int `json:"durin_keyset_backup"`
+	// Store is the store's ID, if it has one.
+	Store string `json:"store,omitempty"`
+	// Files holds the contents of keysetBackupFiles, by name.
+	Files map[string][]byte `json:"files"`
+}
+
+// BackupKeyset returns a backup of the master keyset of the store in dir
+// and the files needed to unwrap it. The keyset stays wrapped with the
+// key derived from the passphrase, so the backup is no use without the
+// passphrase, and the keyfile if the store needs one. RestoreKeyset
+// restores it.
+func BackupKeyset(dir string) ([]byte, error) {
+	if shared, err := IsShared(dir); err != nil {
+		return nil, err
+	} else if shared {
+		return nil, errors.New("a shared vault has no master keyset")
+	}
+	f, err := readFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+	backup := keysetBackup{Version: 1, Store: f.ID, Files: make(map[string][]byte)}
+	for _, name := range keysetBackupFiles {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if os.IsNotExist(err) && name != saltFile && name != masterFile {
+			continue
+		}
+		if os.IsNotExist(err) && name == masterFile {
+			if err := CheckKeyset(dir); err != nil {
+				return nil, err
+			}
+			return nil, &NoStoreError{dir}
+		}
+		if err != nil {
+			return nil, err
+		}
+		backup.Files[name] = b
+	}
+	b, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// RestoreKeyset restores the master keyset of the store in dir from a
+// backup BackupKeyset returned, if the store lost it. It refuses a backup
+// of another store, or one lacking keys that entries are encrypted with,
+// such as one from before a DB.Rekey. Like Create, it does not take the
+// store lock; see LockDir.
+func RestoreKeyset(dir string, b []byte) error {
+	var backup keysetBackup
+	if err := strictjson.Unmarshal(b, &backup, keysetBackupLimits); err != nil {
+		return fmt.Errorf("not a keyset backup: %v", err)
+	}
+	if backup.Version != 1 {
+		return fmt.Errorf("the keyset backup is in version %d, which only a newer durin reads", backup.Version)
+	}
+	for name := range backup.Files {
+		if !contains(keysetBackupFiles, name) {
+			return fmt.Errorf("the keyset backup holds an unknown file %q", name)
+		}
+	}
+	master, salt := backup.Files[masterFile], backup.Files[saltFile]
+	if len(master) == 0 || len(salt) < 16 {
+		return fmt.Errorf("the keyset backup lacks %s or %s", masterFile, saltFile)
+	}
+	ids, err := encryptedKeyIDs(master)
+	if err != nil {
+		return err
+	}
+	if err := checkRecovery(dir, backup.Store, ids); err != nil {
+		return err
+	}
+	// master is written last, so that a restore stopped midway leaves the
+	// store as lost as it was.
+	for _, name := range keysetBackupFiles {
+		data, ok := backup.Files[name]
+		if !ok || name == masterFile {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if name != saltFile {
+			if _, err := os.Stat(path); err == nil {
+				// checkRecovery made sure the store's matches.
+				continue
+			}
+		}
+		if err := atomicfile.WriteFile(path, data); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(dir, resaltFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, masterFile), master)
+}
+
+// encryptedKeyIDs returns the IDs of the keys in the wrapped keyset b,
+// which Tink writes in the clear along with it, or nil if it does not.
+func encryptedKeyIDs(b []byte) ([]uint32, error) {
+	var eks tinkpb.EncryptedKeyset
+	if err := proto.Unmarshal(b, &eks); err != nil || len(eks.GetEncryptedKeyset()) == 0 {
+		return nil, fmt.Errorf("%w: the backup's %s is not a wrapped keyset", ErrCorrupt, masterFile)
+	}
+	var ids []uint32
+	for _, k := range eks.GetKeysetInfo().GetKeyInfo() {
+		ids = append(ids, k.GetKeyId())
+	}
+	return ids, nil
+}
+
+// checkRecovery checks that the store in dir lost its master keyset and
+// that a keyset of the store with ID id and the keys ids can take its
+// place: that the store's format, if it has one left, has the same ID,
+// and that ids, unless nil, hold every key its entries are encrypted with.
+func checkRecovery(dir, id string, ids []uint32) error {
+	err := CheckKeyset(dir)
+	var lost *LostKeysetError
+	if err == nil {
+		if exists, err := Exists(dir); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("the store in %s has its master keyset; only a lost one is restored", dir)
+		}
+		return &NoStoreError{dir}
+	}
+	if !errors.As(err, &lost) {
+		return err
+	}
+	f, err := readFormat(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case f.ID != "" && id == "":
+		return fmt.Errorf("the keyset is from before the store in %s was upgraded to format %d; use a newer one", dir, f.Version)
+	case f.ID != "" && f.ID != id:
+		return fmt.Errorf("the keyset is of store %s, not of the store in %s, which is %s", id, dir, f.ID)
+	}
+	if ids == nil {
+		return nil
+	}
+	records, v, err := readRecords(dir)
+	if err != nil {
+		return err
+	}
+	defer v.close()
+	missing := 0
+	for _, env := range records {
+		data, err := env.data()
+		if err != nil {
+			return err
+		}
+		if kid, ok := ciphertextKeyID(data); !ok || !containsID(ids, kid) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of the %d entries are encrypted with keys the keyset lacks, such as after durin key rekey; use a newer one", missing, len(records))
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The recovery key of a store is its master keyset in the clear, in a
+// compact form meant to be written down: a version byte of 1, the store's
+// ID as 16 bytes, all zero if it has none, the format version, the ID of
+// the primary key and then, for each key, its ID, status and output
+// prefix type and its 32 bytes of key material. Only XChaCha20-Poly1305
+// keys, which durin makes, can be in it.
+const (
+	recoveryKeyVersion = 1
+	recoveryKeyHeader  = 1 + 16 + 1 + 4
+	recoveryKeyEntry   = 4 + 1 + 1 + 32
+)
+
+// xchachaKeyURL is the type of the keys of master keysets.
+const xchachaKeyURL = "type.googleapis.com/google.crypto.tink.XChaCha20Poly1305Key"
+
+// RecoveryKey returns the recovery key of the store: its master keyset in
+// the clear, which RecoverKeyset makes a new master from should master be
+// lost. Whoever has it can decrypt every entry, without the passphrase,
+// so it is for paper kept somewhere safe. pw must be the store's
+// passphrase. The caller wipes the key.
+func (db *DB) RecoveryKey(ctx context.Context, pw []byte) ([]byte, error) {
+	if db.shared {
+		return nil, errors.New("a shared vault has no master keyset")
+	}
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(pw)
+	ks, rawKey, err := unlockPassphrase(ctx, db.dir, pw)
+	if err != nil {
+		return nil, err
+	}
+	secmem.Wipe(rawKey)
+	db.mu.RLock()
+	f := db.format
+	db.mu.RUnlock()
+
+	var buf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(ks, keyset.NewBinaryWriter(&buf)); err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(buf.Bytes())
+	var k tinkpb.Keyset
+	if err := proto.Unmarshal(buf.Bytes(), &k); err != nil {
+		return nil, err
+	}
+	out := make([]byte, recoveryKeyHeader, recoveryKeyHeader+len(k.Key)*recoveryKeyEntry)
+	out[0] = recoveryKeyVersion
+	if f.ID != "" {
+		id, err := hex.DecodeString(strings.Replace(f.ID, "-", "", -1))
+		if err != nil || len(id) != 16 {
+			return nil, fmt.Errorf("%w: %s: bad store ID %q", ErrCorrupt, formatFile, f.ID)
+		}
+		copy(out[1:17], id)
+	}
+	out[17] = byte(f.Version)
+	binary.BigEndian.PutUint32(out[18:22], k.PrimaryKeyId)
+	for _, key := range k.Key {
+		if key.GetKeyData().GetTypeUrl() != xchachaKeyURL {
+			secmem.Wipe(out)
+			return nil, fmt.Errorf("the master keyset holds a key of type %s, which a recovery key cannot hold", key.GetKeyData().GetTypeUrl())
+		}
+		var x xchachapb.XChaCha20Poly1305Key
+		if err := proto.Unmarshal(key.GetKeyData().GetValue(), &x); err != nil || len(x.KeyValue) != 32 {
+			secmem.Wipe(out)
+			return nil, fmt.Errorf("%w: bad key %d in the master keyset", ErrCorrupt, key.KeyId)
+		}
+		var e [recoveryKeyEntry]byte
+		binary.BigEndian.PutUint32(e[:4], key.KeyId)
+		e[4], e[5] = byte(key.Status), byte(key.OutputPrefixType)
+		copy(e[6:], x.KeyValue)
+		out = append(out, e[:]...)
+		secmem.Wipe(e[:])
+		secmem.Wipe(x.KeyValue)
+		secmem.Wipe(key.GetKeyData().GetValue())
+	}
+	return out, nil
+}
+
+// parseRecoveryKey returns the store ID and format version a recovery key
+// holds, and the master keyset.
+func parseRecoveryKey(b []byte) (storeFormat, *keyset.Handle, error) {
+	if len(b) < recoveryKeyHeader+recoveryKeyEntry || (len(b)-recoveryKeyHeader)%recoveryKeyEntry != 0 {
+		return storeFormat{}, nil, errors.New("the recovery key is incomplete")
+	}
+	if b[0] != recoveryKeyVersion {
+		return storeFormat{}, nil, fmt.Errorf("the recovery key is in version %d, which only a newer durin reads", b[0])
+	}
+	var f storeFormat
+	if id := b[1:17]; !bytes.Equal(id, make([]byte, 16)) {
+		f.ID = formatID(id)
+	}
+	f.Version = int(b[17])
+	if f.Version > CurrentFormat {
+		return storeFormat{}, nil, fmt.Errorf("the recovery key is of a store in format %d, which only a newer durin reads", f.Version)
+	}
+	k := &tinkpb.Keyset{PrimaryKeyId: binary.BigEndian.Uint32(b[18:22])}
+	for e := b[recoveryKeyHeader:]; len(e) > 0; e = e[recoveryKeyEntry:] {
+		value, err := proto.Marshal(&xchachapb.XChaCha20Poly1305Key{KeyValue: append([]byte(nil), e[6:recoveryKeyEntry]...)})
+		if err != nil {
+			return storeFormat{}, nil, err
+		}
+		k.Key = append(k.Key, &tinkpb.Keyset_Key{
+			KeyData: &tinkpb.KeyData{
+				TypeUrl:         xchachaKeyURL,
+				Value:           value,
+				KeyMaterialType: tinkpb.KeyData_SYMMETRIC,
+			},
+			Status:           tinkpb.KeyStatusType(e[4]),
+			KeyId:            binary.BigEndian.Uint32(e[:4]),
+			OutputPrefixType: tinkpb.OutputPrefixType(e[5]),
+		})
+	}
+	ks, err := insecurecleartextkeyset.Read(&keyset.MemReaderWriter{Keyset: k})
+	if err != nil {
+		return storeFormat{}, nil, fmt.Errorf("the recovery key holds no valid keyset: %v", err)
+	}
+	return f, ks, nil
+}
+
+// RecoverKeyset makes a new master for the store in dir, if it lost its
+// own, from the recovery key of DB.RecoveryKey: it wraps the keyset anew
+// with a key derived from pw, the new passphrase, and a new salt, mixed
+// with the keyfile at keyFile if it is not empty. It refuses a key of
+// another store, or one lacking keys that entries are encrypted with.
+// Like Create, it does not take the store lock; see LockDir.
+func RecoverKeyset(dir string, key, pw []byte, keyFile string) error {
+	f, ks, err := parseRecoveryKey(key)
+	if err != nil {
+		return err
+	}
+	var ids []uint32
+	for _, k := range ks.KeysetInfo().GetKeyInfo() {
+		ids = append(ids, k.GetKeyId())
+	}
+	if err := checkRecovery(dir, f.ID, ids); err != nil {
+		return err
+	}
+	if f.ID != "" {
+		if _, err := os.Stat(filepath.Join(dir, formatFile)); os.IsNotExist(err) {
+			if err := writeFormat(dir, f); err != nil {
+				return err
+			}
+		}
+	}
+	if keyFile != "" {
+		if uses, err := UsesKeyFile(dir); err != nil {
+			return err
+		} else if !uses {
+			if err := useKeyFile(dir, keyFile); err != nil {
+				return err
+			}
+		}
+	}
+	pw, err = mixKeyFile(dir, keyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	salt := random.GetRandomBytes(16)
+	rawKey := secmem.NewBuffer(DeriveKey(pw, salt))
+	defer rawKey.Wipe()
+	if err := atomicfile.WriteFile(filepath.Join(dir, saltFile), salt); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, resaltFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeMasterKeyset(dir, ks, rawKey.Bytes(), f, f.writeVersion())
+}
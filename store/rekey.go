@@ -0,0 +1,418 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/workpool"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/keyset"
+)
+
+// A rekey adds a new key to the master keyset, makes it the one entries
+// are encrypted with, encrypts every entry again with it in batches and
+// finally drops the keys it replaces. Which key an entry was encrypted with
+// is told by the ID Tink puts in front of every ciphertext, so the batches
+// need no bookkeeping of their own: while rekeyFile exists, a rekey is
+// under way, and entries not yet under its key are what is left to do. A
+// rekey interrupted at any point is finished by resuming it.
+const rekeyFile = "rekey"
+
+// LogRekey is the operation recorded in the audit log when a rekey
+// finishes.
+const LogRekey = "rekey"
+
+// RekeyState describes a rekey under way, as recorded in rekeyFile.
+type RekeyState struct {
+	Started time.Time `json:"started" yaml:"started"`
+	// From are the IDs of the keys being replaced, and To that of the key
+	// replacing them.
+	From []uint32 `json:"from" yaml:"from"`
+	To   uint32   `json:"to" yaml:"to"`
+}
+
+// KeyUsage tells which keys of the master keyset the entries are
+// encrypted with.
+type KeyUsage struct {
+	// Primary is the ID of the key new entries are encrypted with.
+	Primary uint32 `json:"primary" yaml:"primary"`
+	// Entries counts the entries encrypted with each key, by ID.
+	Entries map[uint32]int `json:"entries" yaml:"entries"`
+	// Rekey is the rekey under way, if any.
+	Rekey *RekeyState `json:"rekey,omitempty" yaml:"rekey,omitempty"`
+}
+
+// RekeyOptions configure DB.Rekey.
+type RekeyOptions struct {
+	// Resume continues the rekey under way instead of beginning one.
+	Resume bool
+	// BatchSize is how many entries are encrypted again before pw.db is
+	// written, 1000 if zero.
+	BatchSize int
+	// Progress, if set, is called after each batch with the number of
+	// entries done and of those there are to do.
+	Progress func(done, total int)
+}
+
+// ciphertextKeyID returns the ID of the key c was encrypted with, from its
+// Tink prefix, or false if it has none.
+func ciphertextKeyID(c []byte) (uint32, bool) {
+	// Tink prefixes are a version byte of 1 followed by the key ID.
+	if len(c) < 5 || c[0] != 1 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(c[1:5]), true
+}
+
+func readRekeyState(dir string) (*RekeyState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, rekeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s RekeyState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, rekeyFile, err)
+	}
+	return &s, nil
+}
+
+// KeyUsage returns which keys the entries are encrypted with, and the
+// rekey under way, if any. It needs the master keyset, which a store
+// unlocked by an agent does not hold.
+func (db *DB) KeyUsage() (*KeyUsage, error) {
+	if db.shared {
+		return nil, errors.New("the entries of a shared vault have keys of their own")
+	}
+	state, err := readRekeyState(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	u := &KeyUsage{Entries: make(map[uint32]int), Rekey: state}
+	var dataErr error
+	err = db.view(func() {
+		if db.keyset != nil {
+			u.Primary = db.keyset.KeysetInfo().GetPrimaryKeyId()
+		}
+		for name, env := range db.records {
+			data, err := env.data()
+			if err != nil {
+				dataErr = err
+				return
+			}
+			id, ok := ciphertextKeyID(data)
+			if !ok {
+				dataErr = fmt.Errorf("%w: entry %q has no key ID", ErrCorrupt, name)
+				return
+			}
+			u.Entries[id]++
+		}
+	})
+	if err == nil {
+		err = dataErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Primary == 0 {
+		return nil, errors.New("the store was unlocked without its master keyset; open it with the passphrase")
+	}
+	return u, nil
+}
+
+// Rekey replaces the keys of the master keyset with a new one and
+// encrypts every entry again with it, as described at rekeyFile. pw must
+// be the store's passphrase. It stops between batches when ctx is done,
+// leaving a rekey to resume.
+func (db *DB) Rekey(ctx context.Context, pw []byte, opts RekeyOptions) error {
+	if db.shared {
+		return errors.New("the entries of a shared vault have keys of their own")
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	state, err := db.beginRekey(ctx, pw, opts.Resume)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, total, err := db.rekeyBatch(ctx, state.To, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(done, total)
+		}
+		if done == total {
+			break
+		}
+	}
+	return db.finishRekey(ctx, pw, state)
+}
+
+// beginRekey adds the new key to the master keyset and makes it primary,
+// or with resume returns the rekey under way.
+func (db *DB) beginRekey(ctx context.Context, pw []byte, resume bool) (*RekeyState, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	ks, rawKey, err := unlockPassphrase(ctx, db.dir, pw)
+	if err != nil {
+		return nil, err
+	}
+	defer secmem.Wipe(rawKey)
+	state, err := readRekeyState(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case state != nil && !resume:
+		return nil, fmt.Errorf("a rekey begun %s is under way; resume it", state.Started.Local().Format("2006-01-02 15:04"))
+	case state == nil && resume:
+		return nil, errors.New("no rekey to resume")
+	}
+	if state != nil {
+		if ks.KeysetInfo().GetPrimaryKeyId() == state.To {
+			return state, db.useKeyset(ks)
+		}
+		// Interrupted before the new key was stored: begin again.
+	}
+	state = &RekeyState{Started: time.Now().UTC()}
+	for _, k := range ks.KeysetInfo().GetKeyInfo() {
+		state.From = append(state.From, k.GetKeyId())
+	}
+	m := keyset.NewManagerFromHandle(ks)
+	if state.To, err = m.Add(aead.XChaCha20Poly1305KeyTemplate()); err != nil {
+		return nil, err
+	}
+	if err := m.SetPrimary(state.To); err != nil {
+		return nil, err
+	}
+	if ks, err = m.Handle(); err != nil {
+		return nil, err
+	}
+	// The state is written first, so that a rekey interrupted before
+	// master holds its key begins anew when resumed.
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(db.dir, rekeyFile), b); err != nil {
+		return nil, err
+	}
+	if err := writeMasterKeyset(db.dir, ks, rawKey, db.format, db.format.writeVersion()); err != nil {
+		return nil, err
+	}
+	return state, db.useKeyset(ks)
+}
+
+// useKeyset makes ks, just read from or written to master, the master
+// keyset. mu must be held for writing.
+func (db *DB) useKeyset(ks *keyset.Handle) error {
+	master, err := aead.New(ks)
+	if err != nil {
+		return err
+	}
+	db.keyset, db.master = ks, master
+	return db.noteMaster()
+}
+
+// rekeyBatch encrypts up to n of the entries not yet encrypted with the key
+// to again with it, and returns how many entries are done and how many
+// there are.
+func (db *DB) rekeyBatch(ctx context.Context, to uint32, n int) (done, total int, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.refresh(); err != nil {
+		return 0, 0, err
+	}
+	var todo []string
+	for name, env := range db.records {
+		data, err := env.data()
+		if err != nil {
+			return 0, 0, err
+		}
+		if id, _ := ciphertextKeyID(data); id != to {
+			todo = append(todo, name)
+		}
+	}
+	total = len(db.records)
+	if len(todo) == 0 {
+		return total, total, nil
+	}
+	sort.Strings(todo)
+	if len(todo) > n {
+		todo = todo[:n]
+	}
+	records := make(map[string]Envelope, len(db.records))
+	for name, env := range db.records {
+		records[name] = env
+	}
+	rekeyed := make([]Envelope, len(todo))
+	err = workpool.Run(ctx, len(todo), func(ctx context.Context, i int) error {
+		name := todo[i]
+		env := db.records[name]
+		data, err := env.data()
+		if err != nil {
+			return err
+		}
+		ad, err := db.format.recordAD(env.Format, name)
+		if err != nil {
+			return err
+		}
+		b, err := decrypt(ctx, db.master, data, ad)
+		if err != nil {
+			return fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, name, err)
+		}
+		c, err := encrypt(ctx, db.master, b, ad)
+		secmem.Wipe(b)
+		if err != nil {
+			return err
+		}
+		rekeyed[i] = Envelope{Name: name, Format: env.Format, Data: c, Meta: env.Meta}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, env := range rekeyed {
+		records[env.Name] = env
+	}
+	if err := db.rewrite(records); err != nil {
+		return 0, 0, err
+	}
+	left := 0
+	for _, env := range db.records {
+		data, err := env.data()
+		if err != nil {
+			return 0, 0, err
+		}
+		if id, _ := ciphertextKeyID(data); id != to {
+			left++
+		}
+	}
+	return total - left, total, nil
+}
+
+// finishRekey drops the keys the rekey replaced from the master keyset,
+// once no entry is encrypted with them.
+func (db *DB) finishRekey(ctx context.Context, pw []byte, state *RekeyState) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	ks, rawKey, err := unlockPassphrase(ctx, db.dir, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(rawKey)
+	if err := db.useKeyset(ks); err != nil {
+		return err
+	}
+	if err := db.rewrapFiles(ctx); err != nil {
+		return err
+	}
+	have := make(map[uint32]bool)
+	for _, k := range ks.KeysetInfo().GetKeyInfo() {
+		have[k.GetKeyId()] = true
+	}
+	m := keyset.NewManagerFromHandle(ks)
+	for _, id := range state.From {
+		// Keys already dropped by a rekey interrupted since are skipped.
+		if !have[id] || id == state.To {
+			continue
+		}
+		if err := m.Delete(id); err != nil {
+			return err
+		}
+	}
+	if ks, err = m.Handle(); err != nil {
+		return err
+	}
+	if err := writeMasterKeyset(db.dir, ks, rawKey, db.format, db.format.writeVersion()); err != nil {
+		return err
+	}
+	if err := db.useKeyset(ks); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(db.dir, rekeyFile)); err != nil {
+		return err
+	}
+	if err := db.appendLog(LogRekey, "", ""); err != nil {
+		return fmt.Errorf("the rekey finished, but was not logged: %w", err)
+	}
+	return nil
+}
+
+// rewrapFiles encrypts the files wrapped with the master key again with its
+// primary key, so that they still open once the old keys are dropped. mu
+// must be held for writing.
+func (db *DB) rewrapFiles(ctx context.Context) error {
+	for _, f := range []struct {
+		name string
+		ad   []byte
+	}{{logKeyFile, logKeyAD}, {identityFile, identityAD}, {deriveKeyFile, deriveKeyAD}} {
+		path := filepath.Join(db.dir, f.name)
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		h, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(b)), db.master, f.ad)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorrupt, f.name, err)
+		}
+		var buf bytes.Buffer
+		if err := h.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), db.master, f.ad); err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(path, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	db.accessMu.Lock()
+	defer db.accessMu.Unlock()
+	path := filepath.Join(db.dir, accessFile)
+	c, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	b, err := decrypt(ctx, db.master, c, accessAD)
+	if err != nil {
+		// The read times are a convenience; start them over instead.
+		db.accessed = nil
+		return os.Remove(path)
+	}
+	defer secmem.Wipe(b)
+	if c, err = encrypt(ctx, db.master, b, accessAD); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, c)
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRekeyResume(t *testing.T) {
+	const n = 5
+	tests := []struct {
+		name string
+		// stopAfter is how many entries are rekeyed before the rekey is
+		// stopped, or 0 to let it run.
+		stopAfter int
+		// reopen opens the store anew before resuming, as a later
+		// durin key rekey --resume would.
+		reopen bool
+	}{
+		{"uninterrupted", 0, false},
+		{"resumed", 2, false},
+		{"resumed by another process", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openStore(t, createStore(t))
+			for i := 0; i < n; i++ {
+				put(t, db, fmt.Sprint(i), fmt.Sprint("pw", i))
+			}
+			before, err := db.KeyUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = db.Rekey(ctx, []byte(testPassphrase), RekeyOptions{
+				BatchSize: 2,
+				Progress: func(done, total int) {
+					if tt.stopAfter > 0 && done >= tt.stopAfter {
+						cancel()
+					}
+				},
+			})
+			if tt.stopAfter > 0 {
+				if !errors.Is(err, context.Canceled) {
+					t.Fatalf("stopped Rekey = %v, want context.Canceled", err)
+				}
+				u, uerr := db.KeyUsage()
+				if uerr != nil {
+					t.Fatal(uerr)
+				}
+				if u.Rekey == nil || u.Rekey.To != u.Primary || u.Entries[u.Primary] != tt.stopAfter || u.Entries[before.Primary] != n-tt.stopAfter {
+					t.Fatalf("KeyUsage() mid-rekey = %+v, want %d entries under the new key", u, tt.stopAfter)
+				}
+				// Entries under either key open until the rekey is done.
+				for i := 0; i < n; i++ {
+					wantPassword(t, db, fmt.Sprint(i), fmt.Sprint("pw", i))
+				}
+				if err := db.Rekey(context.Background(), []byte(testPassphrase), RekeyOptions{}); err == nil {
+					t.Error("Rekey began a second rekey while one is under way")
+				}
+				if tt.reopen {
+					db = reopen(t, db)
+				}
+				err = db.Rekey(context.Background(), []byte(testPassphrase), RekeyOptions{Resume: true})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			u, err := db.KeyUsage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Rekey != nil || u.Primary == before.Primary || len(u.Entries) != 1 || u.Entries[u.Primary] != n {
+				t.Errorf("KeyUsage() after the rekey = %+v, want all %d entries under a new key", u, n)
+			}
+			if k := db.NumKeys(); k != 1 {
+				t.Errorf("NumKeys() = %d after the rekey, want the old keys dropped", k)
+			}
+			if err := db.Rekey(context.Background(), []byte(testPassphrase), RekeyOptions{Resume: true}); err == nil {
+				t.Error("Rekey resumed a finished rekey")
+			}
+			db = reopen(t, db)
+			for i := 0; i < n; i++ {
+				wantPassword(t, db, fmt.Sprint(i), fmt.Sprint("pw", i))
+			}
+		})
+	}
+}
+
+// A DB holding a keyset that another process replaced, e.g. by rekeying,
+// must not go on writing entries with it.
+func TestKeysetReplacedLocks(t *testing.T) {
+	ctx := context.Background()
+	db := openStore(t, createStore(t))
+	put(t, db, "a", "1")
+	// Wrap the keyset anew, as another process changing it would.
+	ks, rawKey, err := unlockPassphrase(ctx, db.Dir(), []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMasterKeyset(db.Dir(), ks, rawKey, db.format, CurrentFormat); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(ctx, "b", &Record{Password: "1"}); !errors.Is(err, ErrLocked) {
+		t.Errorf("Put after the keyset changed = %v, want ErrLocked", err)
+	}
+	if !db.Locked() {
+		t.Error("DB still unlocked after the keyset changed")
+	}
+	if err := db.UnlockWith(ctx, []byte(testPassphrase)); err != nil {
+		t.Fatal(err)
+	}
+	put(t, db, "b", "1")
+	wantPassword(t, db, "a", "1")
+}
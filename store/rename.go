@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/aead/subtle"
+)
+
+// Rename renames the entries named by the keys of renames to the names
+// they map to, all at once: either every entry is renamed or none is.
+// Since an entry's name is authenticated along with its data, each is
+// decrypted and encrypted again under its new name. In a shared vault, an
+// entry's own ACL moves with it, and it gets a new data key wrapped to the
+// recipients the ACLs allow under its new name. A new name may be taken
+// only by an entry being renamed itself.
+func (db *DB) Rename(ctx context.Context, renames map[string]string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.master == nil && db.identity == nil {
+		return ErrLocked
+	}
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	olds := make([]string, 0, len(renames))
+	taken := make(map[string]string, len(renames))
+	for old, name := range renames {
+		if _, ok := db.records[old]; !ok {
+			return notFound(old)
+		}
+		if name == "" {
+			return fmt.Errorf("cannot rename %q to an empty name", old)
+		}
+		if other, ok := taken[name]; ok {
+			if other > old {
+				other, old = old, other
+			}
+			return fmt.Errorf("%q and %q would both be renamed to %q", other, old, name)
+		}
+		taken[name] = old
+		if _, ok := db.records[name]; ok {
+			if _, moving := renames[name]; !moving {
+				return fmt.Errorf("entry %q already exists", name)
+			}
+		}
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+	var (
+		list    *recipientList
+		oldACLs map[string][]string
+		moved   bool
+	)
+	if db.identity != nil {
+		var err error
+		if list, err = readRecipientList(db.dir); err != nil {
+			return err
+		}
+		oldACLs = list.ACLs
+		acls := make(map[string][]string, len(list.ACLs))
+		for path, members := range list.ACLs {
+			if _, ok := renames[path]; !ok {
+				acls[path] = members
+			}
+		}
+		for path, members := range list.ACLs {
+			if name, ok := renames[path]; ok {
+				acls[name], moved = members, true
+			}
+		}
+		// The entries are wrapped to the recipients the moved ACLs allow,
+		// but the rules are only written once every entry is.
+		list.ACLs = acls
+	}
+
+	records := make(map[string]Envelope, len(db.records))
+	for name, env := range db.records {
+		if _, moving := renames[name]; !moving {
+			records[name] = env
+		}
+	}
+	for _, old := range olds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		env, err := db.renamed(ctx, old, renames[old], db.records[old], list)
+		if err != nil {
+			return err
+		}
+		records[env.Name] = env
+	}
+	news := make([]string, 0, len(olds))
+	for _, old := range olds {
+		news = append(news, renames[old])
+	}
+	before, err := db.undoBefore(append(append([]string(nil), olds...), news...)...)
+	if err != nil {
+		return err
+	}
+	if moved {
+		// As with SetACL, the rules are written before the entries, so
+		// that the entries renamed are never wrapped to anyone they
+		// exclude.
+		if err := writeRecipients(db.dir, list); err != nil {
+			return err
+		}
+	}
+	if err := db.rewrite(records); err != nil {
+		if moved {
+			// The old entries keep their own rules.
+			list.ACLs = oldACLs
+			if rerr := writeRecipients(db.dir, list); rerr != nil {
+				return fmt.Errorf("%w; restoring %s failed too: %v", err, recipientsFile, rerr)
+			}
+		}
+		return err
+	}
+	db.index = newNameIndex(db.records)
+	// As in commit, a rename that cannot be undone is still made.
+	db.saveUndo(LogRename, before, olds)
+	for _, old := range olds {
+		if err := db.appendLog(LogRename, old, renames[old]); err != nil {
+			return fmt.Errorf("%s was renamed, but the change was not logged: %w", old, err)
+		}
+	}
+	return nil
+}
+
+// renamed returns env, the envelope of the entry called old, encrypted
+// anew as the entry called name. list is the recipients of a shared
+// vault. mu must be held for writing.
+func (db *DB) renamed(ctx context.Context, old, name string, env Envelope, list *recipientList) (Envelope, error) {
+	data, err := env.data()
+	if err != nil {
+		return Envelope{}, err
+	}
+	if list == nil {
+		ad, err := db.format.recordAD(env.Format, old)
+		if err != nil {
+			return Envelope{}, err
+		}
+		b, err := decrypt(ctx, db.master, data, ad)
+		if err != nil {
+			return Envelope{}, fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, old, err)
+		}
+		defer secmem.Wipe(b)
+		version := db.format.writeVersion()
+		if ad, err = db.format.recordAD(version, name); err != nil {
+			return Envelope{}, err
+		}
+		c, err := encrypt(ctx, db.master, b, ad)
+		if err != nil {
+			return Envelope{}, err
+		}
+		return Envelope{Name: name, Format: version, Data: c, Meta: env.Meta}, nil
+	}
+	raw, err := db.identity.unwrap(old, env.Keys)
+	if err != nil {
+		return Envelope{}, err
+	}
+	key, err := subtle.NewXChaCha20Poly1305(raw)
+	if err != nil {
+		secmem.Wipe(raw)
+		return Envelope{}, err
+	}
+	b, err := key.Decrypt(data, []byte(old))
+	secmem.Wipe(raw)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, old, err)
+	}
+	defer secmem.Wipe(b)
+	c, keys, err := sealShared(name, b, list.recipientsFor(name))
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Name: name, Data: c, Meta: env.Meta, Keys: keys}, nil
+}
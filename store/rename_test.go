@@ -0,0 +1,141 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
+)
+
+// newTestIdentity returns a new identity, as DB.Identity makes.
+func newTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	h, err := keyset.NewHandle(hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_CHACHA20_POLY1305_Key_Template())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := newIdentity(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// openSharedVault creates a shared vault of alice and bob and opens it
+// as alice.
+func openSharedVault(t *testing.T) *DB {
+	t.Helper()
+	ctx := context.Background()
+	alice, bob := newTestIdentity(t), newTestIdentity(t)
+	dir := t.TempDir()
+	if err := CreateShared(dir, Recipient{Name: "alice", Key: alice.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(ctx, dir, Options{Identity: func(context.Context) (*Identity, error) { return alice, nil }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.AddRecipient(ctx, Recipient{Name: "bob", Key: bob.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRenameACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		renames map[string]string
+		// cancel cancels the rename before it begins.
+		cancel bool
+		// want maps entries to the rule governing them afterwards and
+		// their readers, and contents to what they hold.
+		want     map[string]ACL
+		contents map[string]string
+	}{{
+		name:    "own rule moves",
+		renames: map[string]string{"team/a": "x"},
+		want: map[string]ACL{
+			"x":      {Path: "x", Members: []string{"alice"}, Readers: []string{"alice"}},
+			"team/b": {Readers: []string{"alice", "bob"}},
+		},
+		contents: map[string]string{"x": "a", "team/b": "b"},
+	}, {
+		name:    "into a folder with a rule",
+		renames: map[string]string{"team/b": "private/b"},
+		want: map[string]ACL{
+			"team/a":    {Path: "team/a", Members: []string{"alice"}, Readers: []string{"alice"}},
+			"private/b": {Path: "private/", Members: []string{"alice"}, Readers: []string{"alice"}},
+		},
+		contents: map[string]string{"team/a": "a", "private/b": "b"},
+	}, {
+		name:    "swap",
+		renames: map[string]string{"team/a": "team/b", "team/b": "team/a"},
+		want: map[string]ACL{
+			"team/a": {Readers: []string{"alice", "bob"}},
+			"team/b": {Path: "team/b", Members: []string{"alice"}, Readers: []string{"alice"}},
+		},
+		contents: map[string]string{"team/a": "b", "team/b": "a"},
+	}, {
+		// A rename that fails leaves the rules as they were.
+		name:    "cancelled",
+		renames: map[string]string{"team/a": "x"},
+		cancel:  true,
+		want: map[string]ACL{
+			"team/a": {Path: "team/a", Members: []string{"alice"}, Readers: []string{"alice"}},
+			"team/b": {Readers: []string{"alice", "bob"}},
+		},
+		contents: map[string]string{"team/a": "a", "team/b": "b"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := openSharedVault(t)
+			put(t, db, "team/a", "a")
+			put(t, db, "team/b", "b")
+			for path, members := range map[string][]string{"team/a": {"alice"}, "private/": {"alice"}} {
+				if _, err := db.SetACL(ctx, path, members); err != nil {
+					t.Fatal(err)
+				}
+			}
+			recipients := filepath.Join(db.Dir(), recipientsFile)
+			before, err := ioutil.ReadFile(recipients)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rctx, cancel := context.WithCancel(ctx)
+			if tt.cancel {
+				cancel()
+			}
+			err = db.Rename(rctx, tt.renames)
+			cancel()
+			if tt.cancel {
+				if err == nil {
+					t.Fatal("cancelled Rename succeeded")
+				}
+				if after, _ := ioutil.ReadFile(recipients); !bytes.Equal(after, before) {
+					t.Errorf("failed Rename changed %s:\n%s\nwas:\n%s", recipientsFile, after, before)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				got, err := db.ACL(name)
+				if err != nil {
+					t.Fatalf("ACL(%q): %v", name, err)
+				}
+				if !reflect.DeepEqual(*got, want) {
+					t.Errorf("ACL(%q) = %+v, want %+v", name, *got, want)
+				}
+			}
+			for name, pw := range tt.contents {
+				wantPassword(t, db, name, pw)
+			}
+		})
+	}
+}
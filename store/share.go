@@ -0,0 +1,538 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/subtle/random"
+	"github.com/google/tink/go/tink"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// A shared vault is a store that several people open with keys of their
+// own instead of a common passphrase. In place of salt and master it holds
+// recipients, the public keys of its members. Every entry is encrypted
+// with a data key of its own, which its envelope keeps wrapped to each
+// recipient, or to those its ACL allows, with Tink's hybrid encryption
+// (HPKE with X25519, HKDF-SHA256 and ChaCha20-Poly1305). Members open it
+// with their identity, the private key kept in the file identity of their
+// own store.
+const (
+	recipientsFile = "recipients"
+	identityFile   = "identity"
+)
+
+// identityAD is authenticated along with the identity when it is wrapped
+// with the master key.
+var identityAD = []byte("durin identity")
+
+// Identity is the key pair its owner is known by in shared vaults.
+type Identity struct {
+	dec tink.HybridDecrypt
+	pub string
+}
+
+// PublicKey returns the public key to give the members of a shared vault,
+// who add it with DB.AddRecipient.
+func (id *Identity) PublicKey() string {
+	return id.pub
+}
+
+// ID returns the fingerprint of the identity's public key.
+func (id *Identity) ID() string {
+	return keyID(id.pub)
+}
+
+// unwrap returns the data key of the entry called name from its wrapped
+// keys. It fails with ErrNotRecipient if none was wrapped to id.
+func (id *Identity) unwrap(name string, keys map[string][]byte) ([]byte, error) {
+	w, ok := keys[id.ID()]
+	if !ok {
+		return nil, fmt.Errorf("entry %q is not shared with you: %w", name, ErrNotRecipient)
+	}
+	raw, err := id.dec.Decrypt(w, []byte(name))
+	if err != nil || len(raw) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("%w: the data key of entry %q cannot be decrypted", ErrCorrupt, name)
+	}
+	return raw, nil
+}
+
+// Decrypt decrypts c, which Recipient.Encrypt encrypted to id with the
+// same ad.
+func (id *Identity) Decrypt(c, ad []byte) ([]byte, error) {
+	return id.dec.Decrypt(c, ad)
+}
+
+// keyID returns the fingerprint of a public key: the start of its SHA-256
+// in hex.
+func keyID(pub string) string {
+	sum := sha256.Sum256([]byte(pub))
+	return hex.EncodeToString(sum[:8])
+}
+
+// newIdentity returns the identity of the private keyset h.
+func newIdentity(h *keyset.Handle) (*Identity, error) {
+	dec, err := hybrid.NewHybridDecrypt(h)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := h.Public()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := pub.WriteWithNoSecrets(keyset.NewBinaryWriter(&buf)); err != nil {
+		return nil, err
+	}
+	return &Identity{dec: dec, pub: base64.StdEncoding.EncodeToString(buf.Bytes())}, nil
+}
+
+// Identity returns the identity kept in the store, wrapped with its master
+// key. If the store has none, Identity creates one if create is set, and
+// fails with ErrNoIdentity otherwise.
+func (db *DB) Identity(create bool) (*Identity, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.shared {
+		return nil, errors.New("a shared vault holds no identity; your own store does")
+	}
+	if db.master == nil {
+		return nil, ErrLocked
+	}
+	path := filepath.Join(db.dir, identityFile)
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err) && create:
+		h, err := keyset.NewHandle(hybrid.DHKEM_X25519_HKDF_SHA256_HKDF_SHA256_CHACHA20_POLY1305_Key_Template())
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := h.WriteWithAssociatedData(keyset.NewBinaryWriter(&buf), db.master, identityAD); err != nil {
+			return nil, fmt.Errorf("failed to wrap the new identity: %v", err)
+		}
+		if err := atomicfile.WriteFile(path, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		return newIdentity(h)
+	case os.IsNotExist(err):
+		return nil, ErrNoIdentity
+	case err != nil:
+		return nil, err
+	}
+	h, err := keyset.ReadWithAssociatedData(keyset.NewBinaryReader(bytes.NewReader(b)), db.master, identityAD)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, identityFile, err)
+	}
+	return newIdentity(h)
+}
+
+// Recipient is a member of a shared vault.
+type Recipient struct {
+	Name string `json:"name" yaml:"name"`
+	// Key is the public key of the member's identity, as returned by
+	// Identity.PublicKey.
+	Key string `json:"key" yaml:"key"`
+}
+
+// ID returns the fingerprint of the recipient's public key, which names
+// the data keys wrapped to them.
+func (r Recipient) ID() string {
+	return keyID(r.Key)
+}
+
+// encrypter returns the primitive wrapping data keys to r.
+func (r Recipient) encrypter() (tink.HybridEncrypt, error) {
+	b, err := base64.StdEncoding.DecodeString(r.Key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %s: %v", r.Name, err)
+	}
+	h, err := keyset.ReadWithNoSecrets(keyset.NewBinaryReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %s: %v", r.Name, err)
+	}
+	enc, err := hybrid.NewHybridEncrypt(h)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of %s: %v", r.Name, err)
+	}
+	return enc, nil
+}
+
+// Encrypt encrypts b to r, authenticating ad along with it, for secrets
+// given to r outside a shared vault.
+func (r Recipient) Encrypt(b, ad []byte) ([]byte, error) {
+	enc, err := r.encrypter()
+	if err != nil {
+		return nil, err
+	}
+	return enc.Encrypt(b, ad)
+}
+
+// ParseRecipient returns the recipient called name with the public key
+// key, checking that the key can be encrypted to.
+func ParseRecipient(name, key string) (Recipient, error) {
+	r := Recipient{Name: name, Key: strings.TrimSpace(key)}
+	if r.Name == "" {
+		return Recipient{}, errors.New("a recipient needs a name")
+	}
+	if _, err := r.encrypter(); err != nil {
+		return Recipient{}, err
+	}
+	return r, nil
+}
+
+// recipientList is the recipients file of a shared vault.
+type recipientList struct {
+	Recipients []Recipient `json:"recipients"`
+	// ACLs restricts entries, or folders if the key ends in a slash, to
+	// the recipients named; see DB.SetACL.
+	ACLs map[string][]string `json:"acls,omitempty"`
+}
+
+// IsShared reports whether dir holds a shared vault.
+func IsShared(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, recipientsFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReadRecipients returns the members of the shared vault in dir.
+func ReadRecipients(dir string) ([]Recipient, error) {
+	list, err := readRecipientList(dir)
+	if err != nil {
+		return nil, err
+	}
+	return list.Recipients, nil
+}
+
+func readRecipientList(dir string) (*recipientList, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, recipientsFile))
+	if err != nil {
+		return nil, err
+	}
+	var list recipientList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, recipientsFile, err)
+	}
+	return &list, nil
+}
+
+func writeRecipients(dir string, list *recipientList) error {
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, recipientsFile), append(b, '\n'))
+}
+
+// CreateShared initializes a shared vault in dir whose only member is
+// owner. Like Create, it does not take the store lock.
+func CreateShared(dir string, owner Recipient) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, name := range []string{masterFile, recipientsFile, dbFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return fmt.Errorf("%s already holds a store", dir)
+		}
+	}
+	return writeRecipients(dir, &recipientList{Recipients: []Recipient{owner}})
+}
+
+// sharedIdentity returns the identity from opts that opens the shared
+// vault in dir, checking that it is one of the vault's recipients.
+func sharedIdentity(ctx context.Context, dir string, opts *Options) (*Identity, error) {
+	if opts.Identity == nil {
+		return nil, errors.New("no identity configured to open the shared vault with")
+	}
+	id, err := opts.Identity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ReadRecipients(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rs {
+		if r.ID() == id.ID() {
+			return id, nil
+		}
+	}
+	return nil, fmt.Errorf("you are %w in %s; ask a member to add your key with durin share add-recipient", ErrNotRecipient, dir)
+}
+
+// wrapDataKey wraps the data key raw of the entry called name to each of
+// rs, adding the results to keys.
+func wrapDataKey(raw []byte, name string, rs []Recipient, keys map[string][]byte) error {
+	for _, r := range rs {
+		enc, err := r.encrypter()
+		if err != nil {
+			return err
+		}
+		w, err := enc.Encrypt(raw, []byte(name))
+		if err != nil {
+			return fmt.Errorf("failed to wrap the data key of %q to %s: %v", name, r.Name, err)
+		}
+		keys[r.ID()] = w
+	}
+	return nil
+}
+
+// sealShared encrypts the payload b of the entry called name with a new
+// data key wrapped to rs.
+func sealShared(name string, b []byte, rs []Recipient) ([]byte, map[string][]byte, error) {
+	if len(rs) == 0 {
+		return nil, nil, fmt.Errorf("the ACL of %q allows no recipient", name)
+	}
+	raw := random.GetRandomBytes(chacha20poly1305.KeySize)
+	defer secmem.Wipe(raw)
+	key, err := subtle.NewXChaCha20Poly1305(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := key.Encrypt(b, []byte(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make(map[string][]byte, len(rs))
+	if err := wrapDataKey(raw, name, rs, keys); err != nil {
+		return nil, nil, err
+	}
+	return c, keys, nil
+}
+
+// Shared reports whether db is a shared vault.
+func (db *DB) Shared() bool {
+	return db.shared
+}
+
+// Recipients returns the members of the shared vault, sorted by name.
+func (db *DB) Recipients() ([]Recipient, error) {
+	if !db.shared {
+		return nil, errNotShared
+	}
+	rs, err := ReadRecipients(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Name < rs[j].Name })
+	return rs, nil
+}
+
+var errNotShared = errors.New("not a shared vault")
+
+// AddRecipient adds r to the members of the shared vault and wraps the data
+// key of every entry without an ACL to them. It returns the names of the
+// entries it could not rewrap because they are not shared with db's
+// identity.
+func (db *DB) AddRecipient(ctx context.Context, r Recipient) (skipped []string, err error) {
+	if !db.shared {
+		return nil, errNotShared
+	}
+	if err := db.writable(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.identity == nil {
+		return nil, ErrLocked
+	}
+	list, err := readRecipientList(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range list.Recipients {
+		switch {
+		case old.Name == r.Name:
+			return nil, fmt.Errorf("there already is a recipient called %s", r.Name)
+		case old.ID() == r.ID():
+			return nil, fmt.Errorf("%s already has this key", old.Name)
+		}
+	}
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	records := make(map[string]Envelope, len(db.records))
+	for name, env := range db.records {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if path, _ := list.aclFor(name); path != "" {
+			records[name] = env
+			continue
+		}
+		raw, err := db.identity.unwrap(name, env.Keys)
+		if errors.Is(err, ErrNotRecipient) {
+			skipped = append(skipped, name)
+			records[name] = env
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		keys := make(map[string][]byte, len(env.Keys)+1)
+		for id, w := range env.Keys {
+			keys[id] = w
+		}
+		err = wrapDataKey(raw, name, []Recipient{r}, keys)
+		secmem.Wipe(raw)
+		if err != nil {
+			return nil, err
+		}
+		env.Keys = keys
+		records[name] = env
+	}
+	// The entries are rewrapped before r is listed, so that a failure in
+	// between leaves keys wrapped to someone who is not a member yet
+	// rather than a member without keys.
+	if err := db.rewrite(records); err != nil {
+		return nil, err
+	}
+	sort.Strings(skipped)
+	list.Recipients = append(list.Recipients, r)
+	return skipped, writeRecipients(db.dir, list)
+}
+
+// RemoveRecipient removes the recipient called name from the shared vault
+// and its ACLs. Since they may have kept the data keys, every entry is
+// encrypted anew with a fresh data key wrapped to the remaining members it
+// is shared with; still, whatever
+// they could read before they may have copied, so the secrets themselves
+// should be changed. It returns the names of the entries it could not
+// re-encrypt because they are not shared with db's identity; those only
+// lose the key wrapped to the recipient.
+func (db *DB) RemoveRecipient(ctx context.Context, name string) (skipped []string, err error) {
+	if !db.shared {
+		return nil, errNotShared
+	}
+	if err := db.writable(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.identity == nil {
+		return nil, ErrLocked
+	}
+	list, err := readRecipientList(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		removed Recipient
+		kept    []Recipient
+	)
+	for _, r := range list.Recipients {
+		if r.Name == name {
+			removed = r
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	switch {
+	case removed.Name == "":
+		return nil, fmt.Errorf("there is no recipient called %s", name)
+	case removed.ID() == db.identity.ID():
+		return nil, errors.New("you cannot remove yourself; ask another member to remove you")
+	}
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	// Listing the remaining members first means that no entry written from
+	// now on is wrapped to the removed one, even if rewriting fails.
+	list.Recipients = kept
+	for path, members := range list.ACLs {
+		list.ACLs[path] = without(members, name)
+	}
+	if err := writeRecipients(db.dir, list); err != nil {
+		return nil, err
+	}
+	records := make(map[string]Envelope, len(db.records))
+	for entry, env := range db.records {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		raw, err := db.identity.unwrap(entry, env.Keys)
+		if errors.Is(err, ErrNotRecipient) {
+			keys := make(map[string][]byte, len(env.Keys))
+			for id, w := range env.Keys {
+				if id != removed.ID() {
+					keys[id] = w
+				}
+			}
+			env.Keys = keys
+			skipped = append(skipped, entry)
+			records[entry] = env
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		env, err = reseal(entry, env, raw, list.recipientsFor(entry))
+		secmem.Wipe(raw)
+		if err != nil {
+			return nil, err
+		}
+		records[entry] = env
+	}
+	sort.Strings(skipped)
+	return skipped, db.rewrite(records)
+}
+
+// reseal decrypts env with its data key raw and encrypts it again with a
+// new data key wrapped to rs.
+func reseal(name string, env Envelope, raw []byte, rs []Recipient) (Envelope, error) {
+	data, err := env.data()
+	if err != nil {
+		return Envelope{}, err
+	}
+	key, err := subtle.NewXChaCha20Poly1305(raw)
+	if err != nil {
+		return Envelope{}, err
+	}
+	b, err := key.Decrypt(data, []byte(name))
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, name, err)
+	}
+	defer secmem.Wipe(b)
+	c, keys, err := sealShared(name, b, rs)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Name: name, Data: c, Meta: env.Meta, Keys: keys}, nil
+}
+
+// rewrite replaces the records with records, writing them as a new pw.db.
+// The change cannot be undone. mu must be held for writing.
+func (db *DB) rewrite(records map[string]Envelope) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if changed, err := db.changed(); err != nil {
+		return err
+	} else if changed {
+		return errors.New("pw.db was changed by another process; not overwriting it, try again")
+	}
+	records, v, err := writeSnapshot(db.dir, records)
+	if err != nil {
+		return err
+	}
+	db.loaded.close()
+	db.records, db.loaded = records, v
+	return db.dropUndo()
+}
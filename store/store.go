@@ -0,0 +1,802 @@
+// Package store implements durin's encrypted password store, so that other
+// Go programs can use a store without running the durin binary.
+//
+// A store is a directory holding these files: salt, the salt for deriving
+// a key from the passphrase; master, a Tink keyset wrapped with that key;
+// pw.db, the entries, each encrypted with the master keyset; and
+// pw.journal, the changes made since pw.db was last written. format holds
+// the store's ID and the version of its format, both authenticated along
+// with the entries and master; see DB.Upgrade. Entry names are not
+// encrypted, so they can be listed without the passphrase.
+//
+// A store may also hold other files. keyfile names the keyfile it needs
+// besides the passphrase. holders names the holders whose passphrases it
+// takes to open a store under dual control. identity is the user's key
+// pair for shared vaults, which are stores that keep recipients in place
+// of salt and master; see CreateShared. pw.access records when the entries
+// were last read. audit.log records the changes to the entries, signed
+// with the key in log.key, and pw.undo holds what it takes to reverse the
+// last change.
+//
+// Open takes an exclusive lock on the store, held until the process exits
+// or DB.Close is called, and unlocks it:
+//
+//	db, err := store.Open(ctx, dir, store.Options{Passphrase: ask})
+//	if err != nil {
+//		return err
+//	}
+//	r, err := db.Get(ctx, "github.com")
+//
+// The context passed to Open, Get, Put and the like bounds the work that can
+// be slow: waiting for the lock, deriving the key from the passphrase and
+// talking to an agent holding the key.
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/internal/workpool"
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+)
+
+// DB is an open store. A DB is safe for concurrent use: reads share it,
+// while Put and Delete, which write to pw.db or its journal, run one at a
+// time.
+type DB struct {
+	dir    string
+	opts   Options
+	shared bool
+
+	// mu guards the fields below. It is held for writing while pw.db is
+	// reloaded or committed.
+	mu      sync.RWMutex
+	keyset  *keyset.Handle
+	master  tink.AEAD
+	records map[string]Envelope
+	// identity opens the entries of a shared vault instead of master.
+	identity *Identity
+	// logKeyset signs the audit log once it has been loaded.
+	logKeyset *keyset.Handle
+	logTail   *logTail
+	index     *nameIndex
+	// format is what formatFile held when the records were loaded.
+	format storeFormat
+	// keyFrom is the master file that keyset and master were unlocked
+	// from.
+	keyFrom masterVersion
+
+	// loaded identifies the pw.db and journal that records was read from
+	// or last written to, so that changes by other processes are noticed.
+	loaded dbVersion
+
+	// accessMu guards accessed, when the entries were last read, once it
+	// has been loaded from pw.access.
+	accessMu sync.Mutex
+	accessed map[string]time.Time
+}
+
+// dbVersion identifies one version of pw.db and its journal.
+type dbVersion struct {
+	info    os.FileInfo
+	digest  [sha256.Size]byte
+	journal journalState
+	// file is the open pw.db that envelopes read their ciphertexts from,
+	// or nil if they hold them.
+	file *os.File
+}
+
+// Options configure how Open unlocks a store.
+type Options struct {
+	// Passphrase supplies the master passphrase.
+	Passphrase func() ([]byte, error)
+
+	// Prompter, if set, supplies the passphrases that Passphrase,
+	// NewPassphrase and HolderPassphrase do not.
+	Prompter Prompter
+
+	// AutoCreate lets Open create a missing store instead of failing with
+	// a NoStoreError. NewPassphrase, if set, then supplies the passphrase
+	// of the new store instead of Passphrase, e.g. to ask twice.
+	AutoCreate    bool
+	NewPassphrase func() ([]byte, error)
+
+	// Compress lets Put compress large entries, such as those with long
+	// notes, before encrypting them. Compressed entries are read either
+	// way.
+	Compress bool
+
+	// LockWait is how long Open waits for another process to release the
+	// store.
+	LockWait time.Duration
+
+	// CachedKey, if set, is asked for the unlocked master key before the
+	// passphrase is, e.g. to take it from an agent. It returns a nil AEAD
+	// if it has none; the keyset handle may be nil even if it has one. A key
+	// that does I/O should implement ContextAEAD.
+	CachedKey func(ctx context.Context, dir string) (*keyset.Handle, tink.AEAD)
+
+	// Unlocked, if set, is called after the passphrase unlocked the store,
+	// with the passphrase and the key DeriveKey derived from it, so that
+	// they can be cached. Both are wiped once it returns.
+	Unlocked func(dir string, passphrase, key []byte)
+
+	// Identity supplies the identity that opens a shared vault, which has
+	// no passphrase. It must be one of the vault's recipients.
+	Identity func(ctx context.Context) (*Identity, error)
+
+	// HolderPassphrase supplies the passphrase of a holder of a store
+	// under dual control, in place of Passphrase; see Holders.
+	HolderPassphrase func(holder string) ([]byte, error)
+
+	// DerivePassword, if set, computes the password of a derived record
+	// under its policy, drawing characters with pick, which returns an
+	// integer in [0, n) the record's site and counter decide. Without it,
+	// derived records cannot be read.
+	DerivePassword func(r *Record, pick func(n int) (int, error)) (string, error)
+
+	// KeyFile is the path of the keyfile of a store that needs one besides
+	// its passphrase, or of the keyfile a store created with AutoCreate is
+	// to need. Passphrases passed to Unlocked are mixed with it.
+	KeyFile string
+}
+
+// DefaultDir returns the directory of the user's store, ~/.durin, creating
+// it if necessary.
+func DefaultDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to find home directory: %v", err)
+	}
+	pwDir := filepath.Join(homeDir, ".durin")
+	if err := os.MkdirAll(pwDir, 0700); err != nil {
+		return "", err
+	}
+	return pwDir, nil
+}
+
+// Open locks and unlocks the store in dir. The lock is held until the
+// process exits or Close is called. A shared vault is unlocked with
+// Options.Identity rather than a passphrase.
+func Open(ctx context.Context, dir string, opts Options) (*DB, error) {
+	if err := LockDir(ctx, dir, opts.LockWait); err != nil {
+		return nil, err
+	}
+	shared, err := IsShared(dir)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{dir: dir, opts: opts, shared: shared, records: make(map[string]Envelope)}
+	if shared {
+		if db.identity, err = sharedIdentity(ctx, dir, &opts); err != nil {
+			return nil, err
+		}
+	} else {
+		// The master file is read before it is unlocked, so that one
+		// replaced in between counts as changed.
+		if db.keyFrom, err = readMasterVersion(dir); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if db.keyset, db.master, err = loadMasterKey(ctx, dir, &opts, true); err != nil {
+			return nil, err
+		}
+		if db.keyFrom.info == nil {
+			// Created just now.
+			if err := db.noteMaster(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Dir returns the directory of the store.
+func (db *DB) Dir() string {
+	return db.dir
+}
+
+// NumKeys returns the number of keys in the master keyset, or 0 if it is
+// not known because the key came from Options.CachedKey without a handle.
+func (db *DB) NumKeys() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.keyset == nil {
+		return 0
+	}
+	return len(db.keyset.KeysetInfo().GetKeyInfo())
+}
+
+// List returns the sorted names of the entries. See ListEntries for more
+// about each.
+func (db *DB) List() []string {
+	return db.ListPrefix("")
+}
+
+// ListPrefix returns the sorted names of the entries starting with prefix.
+func (db *DB) ListPrefix(prefix string) []string {
+	var names []string
+	// Listing cannot fail; if pw.db cannot be reread, the names loaded
+	// before are the best answer, and the next Put or Delete reports the
+	// error.
+	db.view(func() {
+		names = db.index.withPrefix(prefix)
+	})
+	return names
+}
+
+// Search returns the sorted names of the entries containing query,
+// ignoring case. Like List, it only looks at names.
+func (db *DB) Search(query string) []string {
+	var names []string
+	db.view(func() {
+		names = db.index.containing(query)
+	})
+	return names
+}
+
+// ListEntries describes the entries in name order. It works from the
+// envelopes, so it needs neither the master key nor any decryption.
+func (db *DB) ListEntries() []EntryInfo {
+	entries := []EntryInfo{}
+	// Like List, ListEntries answers from the entries loaded before if
+	// pw.db cannot be reread.
+	db.view(func() {
+		for name, env := range db.records {
+			info := EntryInfo{Name: name}
+			if env.Meta != nil {
+				info.EntryMeta = *env.Meta
+			}
+			entries = append(entries, info)
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Close drops the unlocked master key and releases the store lock, so that
+// other processes can open the store while this one goes on without it,
+// e.g. serving keys it read. db must not be used afterwards.
+func (db *DB) Close() error {
+	db.Lock()
+	db.mu.Lock()
+	db.loaded.close()
+	db.records = nil
+	db.mu.Unlock()
+	return unlockDir(db.dir)
+}
+
+// Lock drops the unlocked master key. Entries cannot be read or written
+// until Unlock is called.
+func (db *DB) Lock() {
+	db.mu.Lock()
+	db.keyset, db.master, db.identity, db.logKeyset = nil, nil, nil, nil
+	db.keyFrom = masterVersion{}
+	db.mu.Unlock()
+	db.accessMu.Lock()
+	db.accessed = nil
+	db.accessMu.Unlock()
+}
+
+// Locked reports whether the master key has been dropped with Lock.
+func (db *DB) Locked() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.master == nil && db.identity == nil
+}
+
+// Unlock asks for the passphrase again and reloads the master key. It
+// never uses Options.CachedKey, since whoever locked the DB wants the
+// passphrase to be asked for.
+func (db *DB) Unlock(ctx context.Context) error {
+	if db.shared {
+		id, err := sharedIdentity(ctx, db.dir, &db.opts)
+		if err != nil {
+			return err
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.identity = id
+		return nil
+	}
+	v, err := readMasterVersion(db.dir)
+	if err != nil {
+		return err
+	}
+	ks, key, err := loadMasterKey(ctx, db.dir, &db.opts, false)
+	if err != nil {
+		return err
+	}
+	db.setKey(ks, key, v)
+	return nil
+}
+
+// UnlockWith reloads the master key using pw rather than prompting. For a
+// store under dual control, pw is its holders' passphrases combined with
+// CombinePassphrases.
+func (db *DB) UnlockWith(ctx context.Context, pw []byte) error {
+	if db.shared {
+		return errors.New("a shared vault has no passphrase; use Unlock")
+	}
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	v, err := readMasterVersion(db.dir)
+	if err != nil {
+		return err
+	}
+	ks, err := UnlockKeyset(ctx, db.dir, pw)
+	if err != nil {
+		return err
+	}
+	key, err := aead.New(ks)
+	if err != nil {
+		return err
+	}
+	db.setKey(ks, key, v)
+	return nil
+}
+
+// setKey makes key, unlocked from the master file v, the master key.
+func (db *DB) setKey(ks *keyset.Handle, key tink.AEAD, v masterVersion) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.keyset, db.master, db.keyFrom = ks, key, v
+}
+
+// CheckPassphrase reports whether pw unlocks the store, without changing
+// its state.
+func (db *DB) CheckPassphrase(ctx context.Context, pw []byte) error {
+	pw, err := mixKeyFile(db.dir, db.opts.KeyFile, pw)
+	if err != nil {
+		return err
+	}
+	defer secmem.Wipe(pw)
+	_, err = UnlockKeyset(ctx, db.dir, pw)
+	return err
+}
+
+// Has reports whether an entry called name exists.
+func (db *DB) Has(name string) bool {
+	var ok bool
+	db.view(func() {
+		_, ok = db.records[name]
+	})
+	return ok
+}
+
+// Get decrypts the entry called name and records that it was read; see
+// LastRead.
+func (db *DB) Get(ctx context.Context, name string) (*Record, error) {
+	return db.get(ctx, name, true)
+}
+
+// Peek is Get without recording the read, for reading many entries at
+// once as audits and exports do.
+func (db *DB) Peek(ctx context.Context, name string) (*Record, error) {
+	return db.get(ctx, name, false)
+}
+
+func (db *DB) get(ctx context.Context, name string, track bool) (*Record, error) {
+	var (
+		data    []byte
+		ok      bool
+		keys    map[string][]byte
+		ks      *keyset.Handle
+		master  tink.AEAD
+		id      *Identity
+		ad      []byte
+		readErr error
+	)
+	err := db.view(func() {
+		var env Envelope
+		if env, ok = db.records[name]; ok {
+			data, readErr = env.data()
+			keys = env.Keys
+			if readErr == nil && db.identity == nil {
+				ad, readErr = db.format.recordAD(env.Format, name)
+			}
+		}
+		ks, master, id = db.keyset, db.master, db.identity
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, notFound(name)
+	}
+	if master == nil && id == nil {
+		return nil, ErrLocked
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if id != nil {
+		raw, err := id.unwrap(name, keys)
+		if err != nil {
+			return nil, err
+		}
+		defer secmem.Wipe(raw)
+		if master, err = subtle.NewXChaCha20Poly1305(raw); err != nil {
+			return nil, err
+		}
+		ad = []byte(name)
+	}
+	// Decrypting may mean asking an agent, so it is done without mu held.
+	r, err := decryptRecord(ctx, master, name, data, ad)
+	if err != nil && (ks != nil || id != nil) && ctx.Err() == nil && !errors.Is(err, ErrCorrupt) {
+		// With the keyset at hand, a failed decryption means the entry was
+		// damaged or tampered with. Errors from a CachedKey, e.g. an
+		// agent that went away, are passed on as they are.
+		err = fmt.Errorf("%w: entry %q cannot be decrypted: %v", ErrCorrupt, name, err)
+	}
+	if err == nil && r.Derived != nil {
+		if err = db.Derive(r); err != nil {
+			err = fmt.Errorf("entry %q: %w", name, err)
+		}
+	}
+	if err == nil && track && id == nil {
+		// Failing to record the read is no reason to fail the read.
+		db.recordAccess(ctx, master, name)
+	}
+	return r, err
+}
+
+// Put encrypts r and stores it as the entry called name, replacing any
+// entry of that name. It sets r's Modified time to now and, unless r has
+// one, its Created time to that of the entry it replaces, or now. The
+// envelope records r's metadata, see EntryMeta.
+//
+// In a shared vault, r is encrypted with a new data key wrapped to every
+// recipient its ACL allows.
+func (db *DB) Put(ctx context.Context, name string, r *Record) error {
+	return db.put(ctx, name, r, false)
+}
+
+// Restore is Put for a record copied from elsewhere, such as an import, a
+// backup or another vault: it keeps r's Created and Modified times, setting
+// only those r lacks.
+func (db *DB) Restore(ctx context.Context, name string, r *Record) error {
+	return db.put(ctx, name, r, true)
+}
+
+func (db *DB) put(ctx context.Context, name string, r *Record, keepTimes bool) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	master, id, format := db.master, db.identity, db.format
+	db.mu.RUnlock()
+	if master == nil && id == nil {
+		return ErrLocked
+	}
+	now := time.Now()
+	if r.Created == nil {
+		db.mu.RLock()
+		if old, ok := db.records[name]; ok && old.Meta != nil && old.Meta.Created != nil {
+			created := *old.Meta.Created
+			r.Created = &created
+		} else {
+			r.Created = &now
+		}
+		db.mu.RUnlock()
+	}
+	if !keepTimes || r.Modified == nil {
+		r.Modified = &now
+	}
+	kind := r.KindOrDefault()
+	if r.Derived != nil {
+		d, err := db.storedDerived(ctx, name, r)
+		if err != nil {
+			return err
+		}
+		r = d
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if db.opts.Compress {
+		b = compressPayload(b)
+	}
+	var (
+		c       []byte
+		keys    map[string][]byte
+		version int
+	)
+	if id != nil {
+		var list *recipientList
+		if list, err = readRecipientList(db.dir); err != nil {
+			return err
+		}
+		c, keys, err = sealShared(name, b, list.recipientsFor(name))
+	} else {
+		version = format.writeVersion()
+		var ad []byte
+		if ad, err = format.recordAD(version, name); err != nil {
+			return err
+		}
+		c, err = encrypt(ctx, master, b, ad)
+	}
+	if err != nil {
+		return err
+	}
+	meta := &EntryMeta{
+		Kind:     kind,
+		Tags:     append([]string(nil), r.Tags...),
+		Created:  r.Created,
+		Modified: r.Modified,
+		HasTOTP:  r.HasTOTP(),
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	if db.format != format {
+		return errors.New("the store was upgraded by another process; try again")
+	}
+	return db.commit(&journalRecord{Put: &Envelope{Name: name, Format: version, Data: c, Meta: meta, Keys: keys}})
+}
+
+// ForEach decrypts every entry in name order and calls fn with it, stopping
+// at the first error. Like Peek, it does not record the reads.
+func (db *DB) ForEach(ctx context.Context, fn func(name string, r *Record) error) error {
+	return db.ForEachOf(ctx, db.List(), fn)
+}
+
+// ForEachOf is ForEach for the entries called names, in that order. The
+// entries are decrypted on a pool of goroutines, a few ahead of fn, which
+// is called for one at a time.
+func (db *DB) ForEachOf(ctx context.Context, names []string, fn func(name string, r *Record) error) error {
+	return workpool.Ordered(ctx, len(names), func(ctx context.Context, i int) (interface{}, error) {
+		r, err := db.Peek(ctx, names[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %q: %w", names[i], err)
+		}
+		return r, nil
+	}, func(i int, v interface{}) error {
+		return fn(names[i], v.(*Record))
+	}, func(v interface{}) {
+		v.(*Record).Wipe()
+	})
+}
+
+// Delete removes the entry called name from the db.
+func (db *DB) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.refresh(); err != nil {
+		return err
+	}
+	if _, ok := db.records[name]; !ok {
+		return notFound(name)
+	}
+	return db.commit(&journalRecord{Delete: name})
+}
+
+// view calls fn with mu held for reading and the records up to date. Only
+// if pw.db looks changed is mu taken for writing to reload it; fn is
+// called even if that fails, with the records loaded before.
+func (db *DB) view(fn func()) error {
+	db.mu.RLock()
+	stale, err := db.stale()
+	if err == nil && !stale {
+		defer db.mu.RUnlock()
+		fn()
+		return nil
+	}
+	db.mu.RUnlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err = db.refresh()
+	fn()
+	return err
+}
+
+// load reads the records from pw.db and its journal. mu must be held for
+// writing.
+func (db *DB) load() error {
+	format, err := readFormat(db.dir)
+	if err != nil {
+		return err
+	}
+	records, v, err := readRecords(db.dir)
+	if os.IsNotExist(err) {
+		records, v, err = writeSnapshot(db.dir, nil)
+	}
+	if err != nil {
+		return err
+	}
+	db.loaded.close()
+	db.records, db.loaded, db.format = records, v, format
+	db.index = newNameIndex(records)
+	return nil
+}
+
+// stale reports whether pw.db or its journal may differ from the version
+// db holds, going by their file information only. mu must be held.
+func (db *DB) stale() (bool, error) {
+	info, err := os.Stat(filepath.Join(db.dir, dbFile))
+	if err != nil {
+		return false, err
+	}
+	if !sameVersion(db.loaded.info, info) {
+		return true, nil
+	}
+	if db.master != nil && db.keyFrom.info != nil {
+		info, err := os.Stat(filepath.Join(db.dir, masterFile))
+		if err != nil {
+			return false, err
+		}
+		if !sameVersion(db.keyFrom.info, info) {
+			return true, nil
+		}
+	}
+	return db.journalStale()
+}
+
+// changed reports whether pw.db or its journal differs from the version db
+// holds. A pw.db that was replaced or touched is hashed, so that it only
+// counts as changed if its contents did. mu must be held for writing.
+func (db *DB) changed() (bool, error) {
+	if stale, err := db.journalStale(); err != nil || stale {
+		return stale, err
+	}
+	pwPath := filepath.Join(db.dir, dbFile)
+	info, err := os.Stat(pwPath)
+	if err != nil {
+		return false, err
+	}
+	if sameVersion(db.loaded.info, info) {
+		return false, nil
+	}
+	_, v, err := readDB(pwPath)
+	if err != nil {
+		return false, err
+	}
+	v.close()
+	if v.digest == db.loaded.digest {
+		db.loaded.info = v.info
+		return false, nil
+	}
+	return true, nil
+}
+
+// refresh reloads the records if another process, such as durin sync or a
+// long-running durin serve, changed pw.db since db read it. mu must be held
+// for writing.
+func (db *DB) refresh() error {
+	if err := db.checkMaster(); err != nil {
+		return err
+	}
+	changed, err := db.changed()
+	if err != nil || !changed {
+		return err
+	}
+	return db.load()
+}
+
+// checkMaster locks db if master was replaced since its key was unlocked
+// from it, e.g. by durin key rekey in another process. Entries written with
+// the keyset unlocked before would be lost once the rekey drops its keys;
+// unlocking again reads the new one. mu must be held for writing.
+func (db *DB) checkMaster() error {
+	if db.master == nil || db.keyFrom.info == nil {
+		return nil
+	}
+	info, err := os.Stat(filepath.Join(db.dir, masterFile))
+	if err != nil {
+		return err
+	}
+	if sameVersion(db.keyFrom.info, info) {
+		return nil
+	}
+	v, err := readMasterVersion(db.dir)
+	if err != nil {
+		return err
+	}
+	if v.digest == db.keyFrom.digest {
+		db.keyFrom.info = v.info
+		return nil
+	}
+	db.keyset, db.master, db.logKeyset = nil, nil, nil
+	// Unlike Lock, this leaves the read times alone: recordAccess may be
+	// holding accessMu while it waits for mu.
+	db.keyFrom = masterVersion{}
+	return nil
+}
+
+// noteMaster records the master file as the one the key was unlocked
+// from, after db wrote it itself. mu must be held for writing.
+func (db *DB) noteMaster() error {
+	v, err := readMasterVersion(db.dir)
+	if err != nil {
+		return err
+	}
+	db.keyFrom = v
+	return nil
+}
+
+// commit applies change to the records and writes it: to the journal, or,
+// once that is long enough, as a new pw.db. mu must be held for writing,
+// which also keeps commits from interleaving.
+func (db *DB) commit(change *journalRecord) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	// Callers refresh before changing records, so this only trips if pw.db
+	// changed in between; writing then would lose the other change.
+	if changed, err := db.changed(); err != nil {
+		return err
+	} else if changed {
+		return errors.New("pw.db was changed by another process; not overwriting it, try again")
+	}
+	name := change.name()
+	before, err := db.undoBefore(name)
+	if err != nil {
+		return err
+	}
+	old, had := db.records[name]
+	change.apply(db.records)
+	if db.journalFull() {
+		var (
+			records map[string]Envelope
+			v       dbVersion
+		)
+		if records, v, err = writeSnapshot(db.dir, db.records); err == nil {
+			db.loaded.close()
+			db.records, db.loaded = records, v
+		}
+	} else {
+		err = db.appendJournal(change)
+	}
+	if err != nil {
+		// Keep the records in line with what is on disk.
+		if had {
+			db.records[name] = old
+		} else {
+			delete(db.records, name)
+		}
+		return err
+	}
+	op := LogPut
+	if change.Put != nil {
+		db.index.add(name)
+	} else {
+		op = LogDelete
+		db.index.remove(name)
+	}
+	if err := db.appendLog(op, name, ""); err != nil {
+		return fmt.Errorf("%s was changed, but the change was not logged: %w", name, err)
+	}
+	// Failing to record the change for undo is no reason to fail it; the
+	// record of the change before no longer matches the entry, so it
+	// cannot be undone by mistake.
+	db.saveUndo(op, before, []string{name})
+	return nil
+}
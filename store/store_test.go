@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+// testOptions opens stores with testPassphrase.
+func testOptions() Options {
+	return Options{Passphrase: func() ([]byte, error) { return []byte(testPassphrase), nil }}
+}
+
+// createStore creates a store in a new directory and returns it.
+func createStore(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Create(dir, []byte(testPassphrase)); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// openStore opens the store in dir, closing it when the test ends.
+func openStore(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := Open(context.Background(), dir, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// reopen closes db and opens its store again, as another process would.
+func reopen(t *testing.T, db *DB) *DB {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openStore(t, db.Dir())
+}
+
+func put(t *testing.T, db *DB, name, password string) {
+	t.Helper()
+	if err := db.Put(context.Background(), name, &Record{Password: password}); err != nil {
+		t.Fatalf("Put(%q): %v", name, err)
+	}
+}
+
+// wantPassword checks that the entry called name holds password, or that
+// there is none if password is empty.
+func wantPassword(t *testing.T, db *DB, name, password string) {
+	t.Helper()
+	r, err := db.Peek(context.Background(), name)
+	if password == "" {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Peek(%q) = %v, want ErrNotFound", name, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Peek(%q): %v", name, err)
+	}
+	if r.Password != password {
+		t.Errorf("%s holds %q, want %q", name, r.Password, password)
+	}
+}
+
+func wantNames(t *testing.T, db *DB, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	got := db.List()
+	if len(got) != len(want) || len(want) > 0 && !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %q, want %q", got, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	records := map[string]*Record{
+		"github.com": {Username: "octocat", Password: "hunter2", URL: "https://github.com"},
+		"bank/login": {Password: "s3cret", Notes: "PIN is elsewhere", Fields: map[string]string{"question": "answer"}},
+		"empty":      {},
+	}
+	ctx := context.Background()
+	db := openStore(t, createStore(t))
+	for name, r := range records {
+		if err := db.Put(ctx, name, r); err != nil {
+			t.Fatalf("Put(%q): %v", name, err)
+		}
+	}
+	check := func(db *DB) {
+		t.Helper()
+		wantNames(t, db, "bank/login", "empty", "github.com")
+		for name, want := range records {
+			got, err := db.Get(ctx, name)
+			if err != nil {
+				t.Fatalf("Get(%q): %v", name, err)
+			}
+			if got.Username != want.Username || got.Password != want.Password || got.Notes != want.Notes || got.URL != want.URL || !reflect.DeepEqual(got.Fields, want.Fields) {
+				t.Errorf("Get(%q) = %+v, want %+v", name, got, want)
+			}
+		}
+	}
+	check(db)
+	db = reopen(t, db)
+	check(db)
+
+	if err := db.Delete(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	delete(records, "empty")
+	if err := db.Delete(ctx, "empty"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting a deleted entry: %v, want ErrNotFound", err)
+	}
+	db = reopen(t, db)
+	wantPassword(t, db, "empty", "")
+	wantNames(t, db, "bank/login", "github.com")
+	for name, want := range records {
+		wantPassword(t, db, name, want.Password)
+	}
+}
+
+func TestOpenWrongPassphrase(t *testing.T) {
+	dir := createStore(t)
+	_, err := Open(context.Background(), dir, Options{Passphrase: func() ([]byte, error) { return []byte("wrong"), nil }})
+	if !errors.Is(err, ErrBadPassphrase) {
+		t.Errorf("Open with the wrong passphrase: %v, want ErrBadPassphrase", err)
+	}
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/citizencloud/passwordstore/internal/atomicfile"
+)
+
+// undoFile holds what it takes to reverse the last change to the entries:
+// the envelopes they had before, still encrypted, so it is no more
+// sensitive than pw.db. Every change replaces it, and changes to who can
+// decrypt the entries, such as removing a recipient, remove it, since
+// undoing them would restore envelopes wrapped to someone no longer
+// allowed to read them.
+const undoFile = "pw.undo"
+
+// ErrNothingToUndo is returned by Undo if there is no change to reverse.
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// undoRecord records the last change.
+type undoRecord struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	// Names are the entries changed, by their names before the change.
+	Names []string `json:"names"`
+	// Before holds the envelopes the entries changed had before, keyed by
+	// name, or nothing for names that did not exist.
+	Before map[string]*Envelope `json:"before"`
+	// After holds the hex SHA-256 of the ciphertexts the change left, or
+	// an empty string for names it removed, so that Undo can tell whether
+	// anything changed the entries since.
+	After map[string]string `json:"after"`
+}
+
+// Undone describes a change Undo reversed.
+type Undone struct {
+	Time  time.Time `json:"time" yaml:"time"`
+	Op    string    `json:"op" yaml:"op"`
+	Names []string  `json:"names" yaml:"names"`
+}
+
+// envelopeSum returns the hex SHA-256 of the ciphertext of env.
+func envelopeSum(env *Envelope) (string, error) {
+	data, err := env.data()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// undoBefore returns the envelopes of the entries called names as they are
+// now, with their ciphertexts read, for recording with saveUndo once they
+// are changed. mu must be held.
+func (db *DB) undoBefore(names ...string) (map[string]*Envelope, error) {
+	before := make(map[string]*Envelope, len(names))
+	for _, name := range names {
+		env, ok := db.records[name]
+		if !ok {
+			before[name] = nil
+			continue
+		}
+		data, err := env.data()
+		if err != nil {
+			return nil, err
+		}
+		env.Data, env.ref = data, nil
+		before[name] = &env
+	}
+	return before, nil
+}
+
+// saveUndo records that op changed the entries in before, which holds
+// what undoBefore returned for them. mu must be held for writing.
+func (db *DB) saveUndo(op string, before map[string]*Envelope, names []string) error {
+	rec := undoRecord{Time: time.Now().UTC(), Op: op, Names: names, Before: before, After: make(map[string]string, len(before))}
+	for name := range before {
+		rec.After[name] = ""
+		if env, ok := db.records[name]; ok {
+			sum, err := envelopeSum(&env)
+			if err != nil {
+				return err
+			}
+			rec.After[name] = sum
+		}
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(db.dir, undoFile), b)
+}
+
+// dropUndo forgets the last change, so that it cannot be undone.
+func (db *DB) dropUndo() error {
+	if err := os.Remove(filepath.Join(db.dir, undoFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Undo reverses the last change to the entries if it was made within the
+// last within and nothing changed them since.
+func (db *DB) Undo(within time.Duration) (*Undone, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.master == nil && db.identity == nil {
+		return nil, ErrLocked
+	}
+	if err := db.refresh(); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filepath.Join(db.dir, undoFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNothingToUndo
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec undoRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCorrupt, undoFile, err)
+	}
+	if len(rec.Names) == 0 || len(rec.After) == 0 {
+		return nil, fmt.Errorf("%w: %s names no entries", ErrCorrupt, undoFile)
+	}
+	if age := time.Since(rec.Time); age > within {
+		return nil, fmt.Errorf("%w: the last change, %s of %s, was made %v ago", ErrNothingToUndo, rec.Op, rec.Names[0], age.Round(time.Second))
+	}
+	for name, want := range rec.After {
+		got := ""
+		if env, ok := db.records[name]; ok {
+			if got, err = envelopeSum(&env); err != nil {
+				return nil, err
+			}
+		}
+		if got != want {
+			return nil, fmt.Errorf("%w: %s was changed again since the last %s", ErrNothingToUndo, name, rec.Op)
+		}
+	}
+	names := make([]string, 0, len(rec.Before))
+	for name := range rec.Before {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	records := make(map[string]Envelope, len(db.records))
+	for name, env := range db.records {
+		records[name] = env
+	}
+	for _, name := range names {
+		if env := rec.Before[name]; env != nil {
+			records[name] = *env
+		} else {
+			delete(records, name)
+		}
+	}
+	if err := db.rewrite(records); err != nil {
+		return nil, err
+	}
+	db.index = newNameIndex(db.records)
+	for _, name := range names {
+		op := LogPut
+		if rec.Before[name] == nil {
+			op = LogDelete
+		}
+		if err := db.appendLog(op, name, ""); err != nil {
+			return nil, fmt.Errorf("the %s of %s was undone, but not logged: %w", rec.Op, name, err)
+		}
+	}
+	return &Undone{Time: rec.Time, Op: rec.Op, Names: rec.Names}, nil
+}
@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUndo(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// change makes the change to undo, and whatever follows it.
+		change func(t *testing.T, db *DB)
+		within time.Duration
+		// wantErr is what Undo fails with, if it should.
+		wantErr error
+		// want is what a holds afterwards, empty if it does not exist.
+		want string
+	}{{
+		name:   "put",
+		change: func(t *testing.T, db *DB) { put(t, db, "a", "2") },
+		within: time.Hour,
+		want:   "1",
+	}, {
+		name:   "new entry",
+		change: func(t *testing.T, db *DB) { put(t, db, "b", "1") },
+		within: time.Hour,
+		want:   "1",
+	}, {
+		name: "delete",
+		change: func(t *testing.T, db *DB) {
+			if err := db.Delete(ctx, "a"); err != nil {
+				t.Fatal(err)
+			}
+		},
+		within: time.Hour,
+		want:   "1",
+	}, {
+		name: "rename",
+		change: func(t *testing.T, db *DB) {
+			if err := db.Rename(ctx, map[string]string{"a": "b"}); err != nil {
+				t.Fatal(err)
+			}
+		},
+		within: time.Hour,
+		want:   "1",
+	}, {
+		name:    "too old",
+		change:  func(t *testing.T, db *DB) { put(t, db, "a", "2") },
+		within:  0,
+		wantErr: ErrNothingToUndo,
+		want:    "2",
+	}, {
+		// The undo record is of the change before the last one, which
+		// went unrecorded: undoing it would lose the last one.
+		name: "changed since",
+		change: func(t *testing.T, db *DB) {
+			put(t, db, "a", "2")
+			rec, err := ioutil.ReadFile(filepath.Join(db.Dir(), undoFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			put(t, db, "a", "3")
+			if err := ioutil.WriteFile(filepath.Join(db.Dir(), undoFile), rec, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		within:  time.Hour,
+		wantErr: ErrNothingToUndo,
+		want:    "3",
+	}, {
+		name: "record naming no entries",
+		change: func(t *testing.T, db *DB) {
+			rec := []byte(`{"time":"` + time.Now().UTC().Format(time.RFC3339) + `"}`)
+			if err := ioutil.WriteFile(filepath.Join(db.Dir(), undoFile), rec, 0600); err != nil {
+				t.Fatal(err)
+			}
+		},
+		within:  time.Hour,
+		wantErr: ErrCorrupt,
+		want:    "1",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openStore(t, createStore(t))
+			put(t, db, "a", "1")
+			tt.change(t, db)
+			_, err := db.Undo(tt.within)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Undo() = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Undo() = %v", err)
+			}
+			check := func(db *DB) {
+				t.Helper()
+				wantPassword(t, db, "a", tt.want)
+				if tt.wantErr == nil {
+					wantNames(t, db, "a")
+				}
+			}
+			check(db)
+			check(reopen(t, db))
+		})
+	}
+}
+
+func TestUndoNothing(t *testing.T) {
+	db := openStore(t, createStore(t))
+	if _, err := db.Undo(time.Hour); !errors.Is(err, ErrNothingToUndo) {
+		t.Errorf("Undo() in a new store = %v, want ErrNothingToUndo", err)
+	}
+}
@@ -0,0 +1,10 @@
+package store
+
+// notifyChange sends on ch without blocking; a pending notification
+// already covers any further changes.
+func notifyChange(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
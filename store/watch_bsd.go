@@ -0,0 +1,104 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package store
+
+import (
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// kqueueWakeup is how often the watching goroutine wakes up to see whether
+// it was stopped, as closing a kqueue does not interrupt a wait on it.
+const kqueueWakeup = 500 * time.Millisecond
+
+// Watch reports changes to pw.db and its journal in the store in dir, such
+// as those made by durin sync in another terminal. Several changes in quick
+// succession may be reported once, and changes to other files in dir may
+// be reported too. Call stop to stop watching.
+//
+// It uses kqueue rather than FSEvents, which would need cgo. pw.db is
+// replaced by renaming a temporary file over it, which writes the
+// directory, so the directory is watched; the journal is appended to in
+// place, so it is watched itself, and again after each change to the
+// directory, which may have created or replaced it.
+func Watch(dir string) (changes <-chan struct{}, stop func(), err error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		return nil, nil, err
+	}
+	dirFD, err := unix.Open(dir, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(kq)
+		return nil, nil, err
+	}
+	if err := watchVnode(kq, dirFD, unix.NOTE_WRITE|unix.NOTE_DELETE|unix.NOTE_RENAME); err != nil {
+		unix.Close(dirFD)
+		unix.Close(kq)
+		return nil, nil, err
+	}
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer unix.Close(kq)
+		defer unix.Close(dirFD)
+		journalFD := -1
+		watchJournal := func() {
+			// Closing a descriptor drops its events.
+			if journalFD >= 0 {
+				unix.Close(journalFD)
+				journalFD = -1
+			}
+			fd, err := unix.Open(filepath.Join(dir, journalFile), unix.O_RDONLY|unix.O_CLOEXEC|unix.O_NOFOLLOW, 0)
+			if err != nil {
+				return
+			}
+			if err := watchVnode(kq, fd, unix.NOTE_WRITE|unix.NOTE_EXTEND|unix.NOTE_DELETE|unix.NOTE_RENAME); err != nil {
+				unix.Close(fd)
+				return
+			}
+			journalFD = fd
+		}
+		watchJournal()
+		defer func() {
+			if journalFD >= 0 {
+				unix.Close(journalFD)
+			}
+		}()
+		events := make([]unix.Kevent_t, 8)
+		timeout := unix.NsecToTimespec(int64(kqueueWakeup))
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := unix.Kevent(kq, nil, events, &timeout)
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				return
+			}
+			for _, ev := range events[:n] {
+				if int(ev.Ident) == dirFD {
+					watchJournal()
+					break
+				}
+			}
+			if n > 0 {
+				notifyChange(ch)
+			}
+		}
+	}()
+	return ch, func() { close(done) }, nil
+}
+
+// watchVnode adds the vnode events in fflags on fd to kq.
+func watchVnode(kq, fd int, fflags uint32) error {
+	var ev unix.Kevent_t
+	unix.SetKevent(&ev, fd, unix.EVFILT_VNODE, unix.EV_ADD|unix.EV_CLEAR)
+	ev.Fflags = fflags
+	_, err := unix.Kevent(kq, []unix.Kevent_t{ev}, nil, nil)
+	return err
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watch reports changes to pw.db and its journal in the store in dir, such
+// as those made by durin sync in another terminal. Several changes in
+// quick succession may be reported once. Call stop to stop watching.
+func Watch(dir string) (changes <-chan struct{}, stop func(), err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	// pw.db is replaced by renaming a temporary file over it, so watch the
+	// directory rather than the file.
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_DELETE); err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	// A non-blocking descriptor goes through the runtime poller, so Close
+	// interrupts a pending Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+	ch := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+				switch string(bytes.TrimRight(name, "\x00")) {
+				case dbFile, journalFile:
+					notifyChange(ch)
+				}
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+			}
+		}
+	}()
+	return ch, func() { f.Close() }, nil
+}
@@ -0,0 +1,47 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storePollInterval is how often Watch looks at pw.db and its journal
+// where there is neither inotify nor kqueue.
+const storePollInterval = 2 * time.Second
+
+// Watch reports changes to pw.db and its journal in the store in dir,
+// such as those made by durin sync in another terminal. Without inotify
+// or kqueue it polls the files' modification times and sizes. Call stop to
+// stop watching.
+func Watch(dir string) (changes <-chan struct{}, stop func(), err error) {
+	paths := []string{filepath.Join(dir, dbFile), filepath.Join(dir, journalFile)}
+	last := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		last[i], _ = os.Stat(path)
+	}
+	ch := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(storePollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-done:
+				return
+			}
+			for i, path := range paths {
+				// A missing journal is nil, like one that was never there.
+				info, _ := os.Stat(path)
+				if !sameVersion(info, last[i]) {
+					notifyChange(ch)
+				}
+				last[i] = info
+			}
+		}
+	}()
+	return ch, func() { close(done) }, nil
+}
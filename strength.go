@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// minStrengthScore is the lowest zxcvbn score accepted without a warning.
+const minStrengthScore = 3
+
+var strengthLabels = [...]string{"very weak", "weak", "fair", "good", "strong"}
+
+// strength summarizes how hard a password is to guess, as estimated by
+// zxcvbn.
+type strength struct {
+	// Score ranges from 0 (trivially guessable) to 4 (very hard).
+	Score     int     `json:"score" yaml:"score"`
+	Label     string  `json:"label" yaml:"label"`
+	Entropy   float64 `json:"entropy" yaml:"entropy"`
+	CrackTime string  `json:"crack_time" yaml:"crack_time"`
+}
+
+// passwordStrength estimates the strength of pw. hints are strings related
+// to the account, such as its name and username, which make a password
+// weaker if it contains them.
+func passwordStrength(pw string, hints ...string) strength {
+	m := zxcvbn.PasswordStrength(pw, hints)
+	return strength{
+		Score:     m.Score,
+		Label:     strengthLabels[m.Score],
+		Entropy:   m.Entropy,
+		CrackTime: m.CrackTimeDisplay,
+	}
+}
+
+func (s strength) weak() bool {
+	return s.Score < minStrengthScore
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+	"github.com/spf13/cobra"
+)
+
+// tableFlags are the flags of commands printing tables. noHeader leaves
+// out the column names. porcelain prints the rows for scripts instead,
+// their cells separated by single tabs without a header; its columns only
+// ever gain new ones at the end.
+type tableFlags struct {
+	noHeader, porcelain bool
+}
+
+func addTableFlags(cmd *cobra.Command, f *tableFlags) {
+	cmd.Flags().BoolVar(&f.noHeader, "no-header", false, "leave out the header line of tables")
+	cmd.Flags().BoolVar(&f.porcelain, "porcelain", false, "print tables for scripts: tab-separated cells, no header or padding")
+}
+
+// table is text output in columns. Unlike text/tabwriter, which counts
+// runes, it aligns cells by the width they take on a terminal, so that
+// names in scripts with wide characters, such as Chinese or emoji, do not
+// push the columns after them out of line. Whether ambiguous characters are
+// wide follows the locale, as terminals do.
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+func newTable(header ...string) *table {
+	return &table{header: header}
+}
+
+// row adds a row. Tabs and line breaks in cells become spaces, so that
+// each row stays on one line.
+func (t *table) row(cells ...string) {
+	for i, c := range cells {
+		cells[i] = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, c)
+	}
+	t.rows = append(t.rows, cells)
+}
+
+func (t *table) write(w io.Writer, f tableFlags) error {
+	if f.porcelain {
+		for _, r := range t.rows {
+			if _, err := fmt.Fprintln(w, strings.Join(r, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	rows := t.rows
+	if !f.noHeader {
+		rows = append([][]string{t.header}, rows...)
+	}
+	widths := make([]int, len(t.header))
+	for _, r := range rows {
+		for i, c := range r {
+			if n := runewidth.StringWidth(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	var b strings.Builder
+	for _, r := range rows {
+		b.Reset()
+		for i, c := range r {
+			b.WriteString(c)
+			if i < len(r)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-runewidth.StringWidth(c)+2))
+			}
+		}
+		if _, err := fmt.Fprintln(w, strings.TrimRight(b.String(), " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
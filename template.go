@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/citizencloud/passwordstore/internal/secmem"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+// recordTemplate is a kind of entry, defined in the configuration file,
+// whose fields put --template prompts for, e.g.
+//
+//	templates:
+//	  db:
+//	    description: database credential
+//	    tags: [db]
+//	    fields:
+//	      - name: host
+//	      - name: port
+//	        default: "5432"
+//	      - name: username
+//	      - name: password
+//	      - name: notes
+//	        optional: true
+type recordTemplate struct {
+	Description string          `yaml:"description"`
+	Kind        string          `yaml:"kind"`
+	Tags        []string        `yaml:"tags"`
+	Fields      []templateField `yaml:"fields"`
+}
+
+// templateField is a field of a template. The names username, password,
+// notes and url stand for those parts of the record; other names are
+// custom fields.
+type templateField struct {
+	Name     string `yaml:"name"`
+	Default  string `yaml:"default"`
+	Optional bool   `yaml:"optional"`
+	// Secret fields are read without echoing them. The password always is.
+	Secret bool `yaml:"secret"`
+}
+
+func (f templateField) secret() bool {
+	return f.Secret || f.Name == "password"
+}
+
+// lookupTemplate returns the template called name from the configuration.
+func lookupTemplate(name string) (*recordTemplate, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := c.Templates[name]
+	if !ok {
+		names := make([]string, 0, len(c.Templates))
+		for n := range c.Templates {
+			names = append(names, n)
+		}
+		if len(names) == 0 {
+			path, _ := configPath()
+			return nil, usageError{fmt.Errorf("no template %q: %s defines none", name, path)}
+		}
+		sort.Strings(names)
+		return nil, usageError{fmt.Errorf("no template %q: want one of %s", name, strings.Join(names, ", "))}
+	}
+	for _, f := range t.Fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("template %q has a field without a name", name)
+		}
+	}
+	return t, nil
+}
+
+// templateValue returns the value of field f set on r already, by flags.
+func templateValue(r *store.Record, f templateField) string {
+	switch f.Name {
+	case "username":
+		return r.Username
+	case "password":
+		return r.Password
+	case "notes":
+		return r.Notes
+	case "url":
+		return r.URL
+	}
+	return r.Fields[f.Name]
+}
+
+func setTemplateValue(r *store.Record, f templateField, v string) {
+	switch f.Name {
+	case "username":
+		r.Username = v
+	case "password":
+		r.Password = v
+	case "notes":
+		r.Notes = v
+	case "url":
+		r.URL = v
+	default:
+		if r.Fields == nil {
+			r.Fields = make(map[string]string)
+		}
+		r.Fields[f.Name] = v
+	}
+}
+
+// fillTemplate prompts for the fields of t that r does not have yet, for
+// the entry called name, and gives r the template's kind and tags. When
+// stdin is not a terminal, the fields are read from it one per line.
+func fillTemplate(r *store.Record, t *recordTemplate, name string) error {
+	interactive := isTerminal(os.Stdin.Fd())
+	for _, f := range t.Fields {
+		if templateValue(r, f) != "" {
+			continue
+		}
+		var (
+			v   []byte
+			err error
+		)
+		label := f.Name
+		if f.Default != "" && !f.secret() {
+			label += " [" + f.Default + "]"
+		}
+		switch {
+		case interactive && batchMode:
+			return promptAllowed(fmt.Sprintf("the %s of %s", f.Name, name))
+		case !interactive:
+			v, err = readLine(os.Stdin)
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				v, err = nil, nil
+			}
+		case f.secret():
+			v, err = readSecret(fmt.Sprintf("Enter %s for %s: ", f.Name, name))
+		default:
+			fmt.Fprintf(os.Stderr, "%s: ", label)
+			v, err = readLine(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+		s := strings.TrimRight(string(v), "\r")
+		secmem.Wipe(v)
+		if s == "" {
+			s = f.Default
+		}
+		if s == "" && !f.Optional {
+			return fmt.Errorf("%s is required by the template", f.Name)
+		}
+		if s != "" {
+			setTemplateValue(r, f, s)
+		}
+	}
+	if r.Kind == "" {
+		r.Kind = t.Kind
+	}
+	for _, tag := range t.Tags {
+		if !contains(r.Tags, tag) {
+			r.Tags = append(r.Tags, tag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// A timeLock hides a secret behind a time-lock puzzle (Rivest, Shamir and
+// Wagner, 1996): the secret is masked with a hash of 2^(2^t) mod n, which
+// whoever does not know the factors of n can only compute by squaring 2 t
+// times in a row, each squaring needing the one before. Whoever made the
+// puzzle knew them and took a shortcut; they are forgotten once it is made.
+type timeLock struct {
+	Modulus   []byte `json:"modulus"`
+	Squarings uint64 `json:"squarings"`
+	Locked    []byte `json:"locked"`
+}
+
+// timeLockBits is the size of the puzzle's modulus.
+const timeLockBits = 2048
+
+// squaringRate measures how many squarings modulo a number the size of a
+// time-lock modulus this computer does in a second, the same way solving
+// a puzzle does them.
+func squaringRate() float64 {
+	// Any odd number of the size does; finding a prime would take longer
+	// than the measurement.
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), timeLockBits))
+	n.SetBit(n, timeLockBits-1, 1).SetBit(n, 0, 1)
+	x := big.NewInt(2)
+	var done uint64
+	start := time.Now()
+	for time.Since(start) < 250*time.Millisecond {
+		for i := 0; i < 1000; i++ {
+			x.Mul(x, x)
+			x.Mod(x, n)
+		}
+		done += 1000
+	}
+	return float64(done) / time.Since(start).Seconds()
+}
+
+// lockSecret returns secret hidden behind a puzzle that takes about delay
+// to solve on a computer as fast as this one.
+func lockSecret(secret []byte, delay time.Duration) (*timeLock, error) {
+	t := uint64(squaringRate() * delay.Seconds())
+	if t == 0 {
+		t = 1
+	}
+	p, err := rand.Prime(rand.Reader, timeLockBits/2)
+	if err != nil {
+		return nil, err
+	}
+	q, err := rand.Prime(rand.Reader, timeLockBits/2)
+	if err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	n := new(big.Int).Mul(p, q)
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	// 2^(2^t) mod n is 2^e mod n for e = 2^t mod phi(n).
+	e := new(big.Int).Exp(big.NewInt(2), new(big.Int).SetUint64(t), phi)
+	x := new(big.Int).Exp(big.NewInt(2), e, n)
+	return &timeLock{Modulus: n.Bytes(), Squarings: t, Locked: maskSecret(secret, x)}, nil
+}
+
+// maskSecret returns secret masked with the SHA-256 of x, which unmasks it
+// again. secret is at most 32 bytes.
+func maskSecret(secret []byte, x *big.Int) []byte {
+	sum := sha256.Sum256(x.Bytes())
+	out := make([]byte, len(secret))
+	for i := range secret {
+		out[i] = secret[i] ^ sum[i]
+	}
+	return out
+}
+
+// timeLockProgress is how far solving the puzzle with the ID Puzzle got:
+// x after done squarings.
+type timeLockProgress struct {
+	Puzzle string `json:"puzzle"`
+	Done   uint64 `json:"done"`
+	X      []byte `json:"x"`
+}
+
+// id tells the puzzle apart from others.
+func (tl *timeLock) id() string {
+	sum := sha256.Sum256(tl.Modulus)
+	return hex.EncodeToString(sum[:8])
+}
+
+// solve solves the puzzle, starting from progress if it is of this
+// puzzle, and returns the secret. Every so often, and when ctx is done, it
+// passes how far it got to save, which can persist it to resume from.
+func (tl *timeLock) solve(ctx context.Context, progress *timeLockProgress, save func(timeLockProgress) error) ([]byte, error) {
+	const (
+		batch     = 1 << 14
+		saveEvery = 30 * time.Second
+	)
+	if tl.Squarings == 0 || len(tl.Modulus) == 0 {
+		return nil, errors.New("malformed time lock")
+	}
+	n := new(big.Int).SetBytes(tl.Modulus)
+	x, done := big.NewInt(2), uint64(0)
+	if progress != nil && progress.Puzzle == tl.id() && progress.Done <= tl.Squarings {
+		x, done = new(big.Int).SetBytes(progress.X), progress.Done
+	}
+	id := tl.id()
+	saved := time.Now()
+	for done < tl.Squarings {
+		steps := tl.Squarings - done
+		if steps > batch {
+			steps = batch
+		}
+		for i := uint64(0); i < steps; i++ {
+			x.Mul(x, x)
+			x.Mod(x, n)
+		}
+		done += steps
+		if err := ctx.Err(); err != nil {
+			if serr := save(timeLockProgress{Puzzle: id, Done: done, X: x.Bytes()}); serr != nil {
+				return nil, serr
+			}
+			return nil, err
+		}
+		if time.Since(saved) >= saveEvery {
+			if err := save(timeLockProgress{Puzzle: id, Done: done, X: x.Bytes()}); err != nil {
+				return nil, err
+			}
+			saved = time.Now()
+		}
+	}
+	return maskSecret(tl.Locked, x), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// steamAlphabet is what Steam Guard codes are spelt with: five characters
+// instead of digits.
+const steamAlphabet = "23456789BCDFGHJKMNPQRTVWXY"
+
+// otpParams are the settings of a TOTP or HOTP secret.
+type otpParams struct {
+	key    []byte
+	digits int
+	period int
+	hash   func() hash.Hash
+	// steam is set for Steam Guard codes, which KeePassXC marks with
+	// encoder=steam and Bitwarden writes as steam:// URIs.
+	steam bool
+	// hotp is set for RFC 4226 secrets, whose codes are for counter
+	// rather than the time.
+	hotp    bool
+	counter uint64
+}
+
+// parseOTP returns the settings an otpauth://totp/, otpauth://hotp/ or
+// steam:// URI gives, honouring its digits, period, counter, algorithm and
+// encoder parameters.
+func parseOTP(uri string) (*otpParams, error) {
+	if len(uri) > len("steam://") && strings.EqualFold(uri[:len("steam://")], "steam://") {
+		uri = "otpauth://totp/Steam?encoder=steam&secret=" + url.QueryEscape(uri[len("steam://"):])
+	}
+	u, err := url.Parse(uri)
+	if err != nil || !strings.EqualFold(u.Scheme, "otpauth") || !strings.EqualFold(u.Host, "totp") && !strings.EqualFold(u.Host, "hotp") {
+		return nil, fmt.Errorf("invalid OTP URI")
+	}
+	q := u.Query()
+	secret := strings.ToUpper(strings.ReplaceAll(q.Get("secret"), " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid OTP secret")
+	}
+	p := &otpParams{key: key, digits: 6, period: 30, hash: sha1.New, hotp: strings.EqualFold(u.Host, "hotp")}
+	switch enc := strings.ToLower(q.Get("encoder")); enc {
+	case "":
+	case "steam":
+		p.steam, p.digits = true, 5
+	default:
+		return nil, fmt.Errorf("unsupported OTP encoder %q", enc)
+	}
+	if v := q.Get("digits"); v != "" && !p.steam {
+		if p.digits, err = strconv.Atoi(v); err != nil || p.digits < 6 || p.digits > 10 {
+			return nil, fmt.Errorf("invalid OTP digits %q", v)
+		}
+	}
+	if v := q.Get("period"); v != "" {
+		if p.period, err = strconv.Atoi(v); err != nil || p.period <= 0 {
+			return nil, fmt.Errorf("invalid TOTP period %q", v)
+		}
+	}
+	if v := q.Get("counter"); v != "" {
+		if p.counter, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid HOTP counter %q", v)
+		}
+	}
+	switch alg := strings.ToUpper(strings.ReplaceAll(q.Get("algorithm"), "-", "")); alg {
+	case "", "SHA1":
+	case "SHA256":
+		p.hash = sha256.New
+	case "SHA512":
+		p.hash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported OTP algorithm %q", alg)
+	}
+	return p, nil
+}
+
+// totpCode returns the RFC 6238 code, or Steam Guard code, a TOTP URI
+// gives at t; see parseOTP.
+func totpCode(uri string, t time.Time) (string, error) {
+	p, err := parseOTP(uri)
+	if err != nil {
+		return "", err
+	}
+	if p.hotp {
+		return "", fmt.Errorf("the secret is for counter-based HOTP codes; use durin otp")
+	}
+	return p.code(uint64(t.Unix() / int64(p.period))), nil
+}
+
+// code returns the code for counter: the number of periods since the
+// epoch for TOTP, the counter itself for HOTP.
+func (p *otpParams) code(counter uint64) string {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], counter)
+	mac := hmac.New(p.hash, p.key)
+	mac.Write(c[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	code := uint64(binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff)
+	if p.steam {
+		out := make([]byte, p.digits)
+		for i := range out {
+			out[i] = steamAlphabet[code%uint64(len(steamAlphabet))]
+			code /= uint64(len(steamAlphabet))
+		}
+		return string(out)
+	}
+	mod := uint64(1)
+	for i := 0; i < p.digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", p.digits, code%mod)
+}
+
+// totpOptions are the --totp and --hotp flags of put, which set the OTP
+// secret of an entry and its settings.
+type totpOptions struct {
+	secret, hotp, algorithm string
+	digits, period          int
+	counter                 uint64
+	steam                   bool
+}
+
+// addTOTPFlags registers the --totp flags on cmd.
+func addTOTPFlags(cmd *cobra.Command, o *totpOptions) {
+	cmd.Flags().StringVar(&o.secret, "totp", "", "TOTP secret to store with the entry, in base32 or as an otpauth:// URI")
+	cmd.Flags().StringVar(&o.algorithm, "totp-algorithm", "", "hash of the TOTP secret: SHA1 (the default), SHA256 or SHA512")
+	cmd.Flags().IntVar(&o.digits, "totp-digits", 0, "digits of the TOTP codes (default 6)")
+	cmd.Flags().IntVar(&o.period, "totp-period", 0, "seconds each TOTP code is valid for (default 30)")
+	cmd.Flags().BoolVar(&o.steam, "totp-steam", false, "give Steam Guard codes for the TOTP secret")
+	cmd.Flags().StringVar(&o.hotp, "hotp", "", "counter-based HOTP secret to store with the entry instead, in base32 or as an otpauth:// URI; --totp-algorithm and --totp-digits apply to it as well")
+	cmd.Flags().Uint64Var(&o.counter, "hotp-counter", 0, "counter of the next HOTP code")
+}
+
+// setTOTP stores the OTP secret of o in the otpauth field of r, the entry
+// called name, checking that it gives codes.
+func setTOTP(r *store.Record, o *totpOptions, name string) error {
+	secret, kind := o.secret, "totp"
+	switch {
+	case o.secret != "" && o.hotp != "":
+		return usageError{fmt.Errorf("--totp and --hotp are mutually exclusive")}
+	case o.hotp != "":
+		if o.period != 0 || o.steam {
+			return usageError{fmt.Errorf("--totp-period and --totp-steam do not apply to HOTP secrets")}
+		}
+		secret, kind = o.hotp, "hotp"
+	case o.counter != 0:
+		return usageError{fmt.Errorf("--hotp-counter needs --hotp")}
+	}
+	if secret == "" {
+		if o.algorithm != "" || o.digits != 0 || o.period != 0 || o.steam {
+			return usageError{fmt.Errorf("the --totp-* flags need --totp or --hotp")}
+		}
+		return nil
+	}
+	uri := secret
+	if strings.Contains(uri, "://") {
+		if o.algorithm != "" || o.digits != 0 || o.period != 0 || o.steam || o.counter != 0 {
+			return usageError{fmt.Errorf("give a URI's OTP settings in the URI, not with flags")}
+		}
+	} else {
+		params := url.Values{"algorithm": {strings.ToUpper(o.algorithm)}}
+		if o.digits != 0 {
+			params.Set("digits", strconv.Itoa(o.digits))
+		}
+		if o.period != 0 {
+			params.Set("period", strconv.Itoa(o.period))
+		}
+		if kind == "hotp" {
+			params.Set("counter", strconv.FormatUint(o.counter, 10))
+		}
+		if o.steam {
+			if o.digits != 0 {
+				return usageError{fmt.Errorf("Steam Guard codes always have five characters; drop --totp-digits")}
+			}
+			params.Set("encoder", "steam")
+		}
+		uri = otpURI(kind, secret, name, r.Username, params)
+	}
+	p, err := parseOTP(uri)
+	if err != nil {
+		return usageError{err}
+	}
+	if p.hotp != (kind == "hotp") {
+		return usageError{fmt.Errorf("--%s needs an otpauth://%s/ URI", kind, kind)}
+	}
+	if r.Fields == nil {
+		r.Fields = make(map[string]string)
+	}
+	r.Fields[totpField] = uri
+	return nil
+}
+
+// hotpResyncWindow is how many codes past its counter a HOTP token may
+// have given before durin otp --resync stops looking, like the
+// look-ahead RFC 4226 suggests servers allow.
+const hotpResyncWindow = 1000
+
+// withCounter returns the otpauth://hotp/ URI uri with its counter set to
+// counter.
+func withCounter(uri string, counter uint64) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("counter", strconv.FormatUint(counter, 10))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// resync returns the counter following codes, consecutive codes a token
+// gave, looking from p's counter up to hotpResyncWindow codes ahead.
+func (p *otpParams) resync(codes []string) (uint64, error) {
+	if len(codes) < 2 {
+		return 0, fmt.Errorf("resynchronizing takes two consecutive codes")
+	}
+next:
+	for c := p.counter; c < p.counter+hotpResyncWindow; c++ {
+		for i, code := range codes {
+			if !hmac.Equal([]byte(p.code(c+uint64(i))), []byte(code)) {
+				continue next
+			}
+		}
+		return c + uint64(len(codes)), nil
+	}
+	return 0, fmt.Errorf("the codes are not among the next %d the secret gives", hotpResyncWindow)
+}
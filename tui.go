@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/citizencloud/passwordstore/store"
+)
+
+type tuiMode int
+
+const (
+	modeList tuiMode = iota
+	modeSearch
+	modeEdit
+	modeLocked
+)
+
+const maskedSecret = "••••••••"
+
+var (
+	tuiSelected = lipgloss.NewStyle().Reverse(true)
+	tuiPane     = lipgloss.NewStyle().Border(lipgloss.RoundedBorder()).Padding(0, 1)
+	tuiLabel    = lipgloss.NewStyle().Bold(true)
+	tuiStatus   = lipgloss.NewStyle().Faint(true)
+)
+
+type tickMsg time.Time
+
+type unlockMsg struct{ err error }
+
+// lockEventMsg asks the TUI to lock, giving the reason.
+type lockEventMsg string
+
+// storeChangedMsg reports that pw.db was changed, possibly by another
+// process.
+type storeChangedMsg struct{}
+
+type tuiModel struct {
+	ctx       context.Context
+	db        *store.DB
+	lockAfter time.Duration
+	clipOpts  clipOptions
+
+	mode     tuiMode
+	query    string
+	names    []string
+	cursor   int
+	record   *store.Record
+	revealed bool
+	status   string
+
+	inputs     []textinput.Model
+	focus      int
+	passphrase textinput.Model
+
+	width, height int
+	lastInput     time.Time
+}
+
+func newTUIModel(ctx context.Context, db *store.DB, lockAfter time.Duration) *tuiModel {
+	m := &tuiModel{
+		ctx:       ctx,
+		db:        db,
+		lockAfter: lockAfter,
+		clipOpts:  clipOptions{timeout: defaultClipTimeout},
+		lastInput: time.Now(),
+	}
+	for _, label := range []string{"username", "password", "notes"} {
+		in := textinput.New()
+		in.Prompt = label + ": "
+		m.inputs = append(m.inputs, in)
+	}
+	m.inputs[1].EchoMode = textinput.EchoPassword
+	m.passphrase = textinput.New()
+	m.passphrase.Prompt = "Passphrase: "
+	m.passphrase.EchoMode = textinput.EchoPassword
+	m.refilter()
+	return m
+}
+
+func tick() tea.Cmd {
+	return tea.Tick(time.Second, func(t time.Time) tea.Msg { return tickMsg(t) })
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tick()
+}
+
+// refilter recomputes the visible names for the current query and loads the
+// selected record.
+func (m *tuiModel) refilter() {
+	m.names = fuzzyFilter(m.query, m.db.List())
+	if m.cursor >= len(m.names) {
+		m.cursor = len(m.names) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+	m.loadSelected()
+}
+
+// reload picks up changes to the store, keeping the selection on the same
+// entry if it still exists.
+func (m *tuiModel) reload() {
+	name := m.selected()
+	m.names = fuzzyFilter(m.query, m.db.List())
+	m.cursor = 0
+	for i, n := range m.names {
+		if n == name {
+			m.cursor = i
+		}
+	}
+	revealed := m.revealed
+	m.loadSelected()
+	if m.selected() == name {
+		m.revealed = revealed
+	}
+}
+
+func (m *tuiModel) selected() string {
+	if len(m.names) == 0 {
+		return ""
+	}
+	return m.names[m.cursor]
+}
+
+func (m *tuiModel) loadSelected() {
+	m.record, m.revealed = nil, false
+	name := m.selected()
+	if name == "" || m.db.Locked() {
+		return
+	}
+	r, err := m.db.Get(m.ctx, name)
+	if err != nil {
+		m.status = err.Error()
+		return
+	}
+	m.record = r
+}
+
+func (m *tuiModel) lock(status string) {
+	m.db.Lock()
+	m.record, m.revealed = nil, false
+	m.mode = modeLocked
+	m.status = status
+	m.passphrase.SetValue("")
+	m.passphrase.Focus()
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		return m, nil
+	case tickMsg:
+		if m.mode != modeLocked && m.lockAfter > 0 && time.Since(m.lastInput) > m.lockAfter {
+			m.lock("Locked after inactivity.")
+		}
+		return m, tick()
+	case lockEventMsg:
+		if m.mode != modeLocked {
+			m.lock(fmt.Sprintf("Locked on %s.", string(msg)))
+		}
+		return m, nil
+	case storeChangedMsg:
+		// Edits in progress are kept; saving them reloads the store first.
+		if m.mode != modeEdit {
+			m.reload()
+		}
+		return m, nil
+	case unlockMsg:
+		m.passphrase.SetValue("")
+		if msg.err != nil {
+			m.status = fmt.Sprintf("Unlock failed: %v", msg.err)
+			return m, nil
+		}
+		m.mode, m.status = modeList, ""
+		m.lastInput = time.Now()
+		m.refilter()
+		return m, nil
+	case tea.KeyMsg:
+		m.lastInput = time.Now()
+		if msg.String() == "ctrl+c" {
+			return m, tea.Quit
+		}
+		switch m.mode {
+		case modeSearch:
+			return m.updateSearch(msg)
+		case modeEdit:
+			return m.updateEdit(msg)
+		case modeLocked:
+			return m.updateLocked(msg)
+		default:
+			return m.updateList(msg)
+		}
+	}
+	return m, nil
+}
+
+func (m *tuiModel) updateList(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.status = ""
+	switch msg.String() {
+	case "q":
+		return m, tea.Quit
+	case "up", "k":
+		if m.cursor > 0 {
+			m.cursor--
+			m.loadSelected()
+		}
+	case "down", "j":
+		if m.cursor < len(m.names)-1 {
+			m.cursor++
+			m.loadSelected()
+		}
+	case "/":
+		m.mode = modeSearch
+	case "r":
+		m.revealed = !m.revealed
+	case "c", "u":
+		if m.record == nil {
+			return m, nil
+		}
+		field, v := "password", m.record.Password
+		if msg.String() == "u" {
+			field, v = "username", m.record.Username
+		}
+		if err := copyWithTimeout([]byte(v), &m.clipOpts); err != nil {
+			m.status = err.Error()
+		} else {
+			m.status = fmt.Sprintf("Copied %s of %s. Will clear in %v.", field, m.selected(), m.clipOpts.timeout)
+		}
+	case "e":
+		if m.record == nil {
+			return m, nil
+		}
+		m.inputs[0].SetValue(m.record.Username)
+		m.inputs[1].SetValue(m.record.Password)
+		m.inputs[2].SetValue(m.record.Notes)
+		m.focus = 0
+		m.focusInput()
+		m.mode = modeEdit
+	}
+	return m, nil
+}
+
+func (m *tuiModel) updateSearch(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		m.mode = modeList
+	case tea.KeyEsc:
+		m.query = ""
+		m.mode = modeList
+		m.refilter()
+	case tea.KeyBackspace:
+		if r := []rune(m.query); len(r) > 0 {
+			m.query = string(r[:len(r)-1])
+			m.refilter()
+		}
+	case tea.KeyRunes, tea.KeySpace:
+		m.query += string(msg.Runes)
+		m.cursor = 0
+		m.refilter()
+	}
+	return m, nil
+}
+
+func (m *tuiModel) focusInput() {
+	for i := range m.inputs {
+		if i == m.focus {
+			m.inputs[i].Focus()
+		} else {
+			m.inputs[i].Blur()
+		}
+	}
+}
+
+func (m *tuiModel) updateEdit(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		m.mode = modeList
+		return m, nil
+	case tea.KeyTab, tea.KeyShiftTab:
+		if msg.Type == tea.KeyTab {
+			m.focus = (m.focus + 1) % len(m.inputs)
+		} else {
+			m.focus = (m.focus + len(m.inputs) - 1) % len(m.inputs)
+		}
+		m.focusInput()
+		return m, nil
+	case tea.KeyEnter:
+		r := *m.record
+		r.Username = m.inputs[0].Value()
+		r.Password = m.inputs[1].Value()
+		r.Notes = m.inputs[2].Value()
+		if err := m.db.Put(m.ctx, m.selected(), &r); err != nil {
+			m.status = err.Error()
+			return m, nil
+		}
+		m.record = &r
+		m.mode = modeList
+		m.status = "Saved " + m.selected() + "."
+		return m, nil
+	}
+	var cmd tea.Cmd
+	m.inputs[m.focus], cmd = m.inputs[m.focus].Update(msg)
+	return m, cmd
+}
+
+func (m *tuiModel) updateLocked(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		return m, tea.Quit
+	case tea.KeyEnter:
+		pw := []byte(m.passphrase.Value())
+		m.status = "Unlocking..."
+		return m, func() tea.Msg {
+			return unlockMsg{m.db.UnlockWith(m.ctx, pw)}
+		}
+	}
+	var cmd tea.Cmd
+	m.passphrase, cmd = m.passphrase.Update(msg)
+	return m, cmd
+}
+
+func (m *tuiModel) View() string {
+	if m.mode == modeLocked {
+		return tuiPane.Render("durin is locked\n\n"+m.passphrase.View()) + "\n" + tuiStatus.Render(m.status+"  enter: unlock  esc: quit")
+	}
+
+	listWidth := m.width / 3
+	if listWidth < 20 {
+		listWidth = 20
+	}
+	rows := m.height - 6
+	if rows < 1 {
+		rows = 1
+	}
+
+	var list strings.Builder
+	if m.mode == modeSearch || m.query != "" {
+		fmt.Fprintf(&list, "/%s\n", m.query)
+		rows--
+	}
+	first := 0
+	if m.cursor >= rows {
+		first = m.cursor - rows + 1
+	}
+	for i := first; i < len(m.names) && i < first+rows; i++ {
+		line := m.names[i]
+		if i == m.cursor {
+			line = tuiSelected.Render(line)
+		}
+		list.WriteString(line + "\n")
+	}
+
+	var detail strings.Builder
+	if m.mode == modeEdit {
+		detail.WriteString(tuiLabel.Render("Editing "+m.selected()) + "\n\n")
+		for _, in := range m.inputs {
+			detail.WriteString(in.View() + "\n")
+		}
+	} else if m.record != nil {
+		pw := maskedSecret
+		if m.revealed {
+			pw = m.record.Password
+		}
+		detail.WriteString(tuiLabel.Render(m.selected()) + "\n\n")
+		fmt.Fprintf(&detail, "%s %s\n", tuiLabel.Render("username:"), m.record.Username)
+		fmt.Fprintf(&detail, "%s %s\n", tuiLabel.Render("password:"), pw)
+		if u := m.record.LoginURL(); u != "" {
+			fmt.Fprintf(&detail, "%s %s\n", tuiLabel.Render("url:"), u)
+		}
+		fmt.Fprintf(&detail, "%s %s\n", tuiLabel.Render("notes:"), m.record.Notes)
+	}
+
+	help := "j/k: move  /: search  r: reveal  c: copy password  u: copy username  e: edit  q: quit"
+	switch m.mode {
+	case modeSearch:
+		help = "type to filter  enter: done  esc: clear"
+	case modeEdit:
+		help = "tab: next field  enter: save  esc: cancel"
+	}
+	if m.status != "" {
+		help = m.status
+	}
+
+	detailWidth := m.width - listWidth - 6
+	if detailWidth < 20 {
+		detailWidth = 20
+	}
+	panes := lipgloss.JoinHorizontal(lipgloss.Top,
+		tuiPane.Width(listWidth).Height(m.height-4).Render(list.String()),
+		tuiPane.Width(detailWidth).Height(m.height-4).Render(detail.String()),
+	)
+	return panes + "\n" + tuiStatus.Render(help)
+}
+
+// runTUI runs the full-screen interface on db until the user quits. It
+// locks on suspend and session lock, shows changes other processes make to
+// the store as they happen, and drops the key on the way out.
+func runTUI(ctx context.Context, db *store.DB, lockAfter time.Duration) error {
+	if err := promptAllowed("the TUI"); err != nil {
+		return err
+	}
+	defer db.Lock()
+	p := tea.NewProgram(newTUIModel(ctx, db, lockAfter), tea.WithAltScreen(), tea.WithContext(ctx))
+	events, stop := watchLockEvents()
+	defer stop()
+	go func() {
+		for reason := range events {
+			p.Send(lockEventMsg(reason))
+		}
+	}()
+	// Without a watch, the list is refreshed when it is filtered again.
+	if changes, stopWatch, err := store.Watch(db.Dir()); err == nil {
+		defer stopWatch()
+		go func() {
+			for range changes {
+				p.Send(storeChangedMsg{})
+			}
+		}()
+	}
+	_, err := p.Run()
+	return err
+}
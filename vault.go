@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/citizencloud/passwordstore/store"
+	"github.com/spf13/cobra"
+)
+
+// vaultFlags are the flags of import vault and export vault telling how to
+// reach and log in to HashiCorp Vault. Like the vault CLI, they default
+// to $VAULT_ADDR, $VAULT_TOKEN or ~/.vault-token, $VAULT_NAMESPACE and
+// $VAULT_CACERT.
+type vaultFlags struct {
+	addr, path, tokenFile, namespace, caCert string
+	roleID, secretIDFile, approleMount       string
+}
+
+func addVaultFlags(cmd *cobra.Command, f *vaultFlags) {
+	cmd.Flags().StringVar(&f.path, "path", "", "KV v2 mount and path to read or write under, e.g. secret/team/")
+	cmd.Flags().StringVar(&f.addr, "addr", os.Getenv("VAULT_ADDR"), "address of the Vault server")
+	cmd.Flags().StringVar(&f.tokenFile, "token-file", "", "read the Vault token from this file instead of $VAULT_TOKEN or ~/.vault-token")
+	cmd.Flags().StringVar(&f.namespace, "namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace")
+	cmd.Flags().StringVar(&f.caCert, "ca-cert", os.Getenv("VAULT_CACERT"), "PEM file of the CA to verify the server with")
+	cmd.Flags().StringVar(&f.roleID, "role-id", "", "log in with AppRole with this role ID instead of a token")
+	cmd.Flags().StringVar(&f.secretIDFile, "secret-id-file", "", "file holding the AppRole secret ID")
+	cmd.Flags().StringVar(&f.approleMount, "approle-mount", "approle", "where the AppRole auth method is mounted")
+}
+
+// vaultClient speaks the parts of the Vault HTTP API that import and
+// export need.
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	http      *http.Client
+}
+
+// newVaultClient connects to Vault as f says and logs in.
+func newVaultClient(ctx context.Context, f *vaultFlags) (*vaultClient, error) {
+	if f.addr == "" {
+		return nil, usageError{errors.New("no Vault address; give --addr or set $VAULT_ADDR")}
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if f.caCert != "" {
+		pem, err := ioutil.ReadFile(f.caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", f.caCert)
+		}
+	}
+	c := &vaultClient{
+		addr:      strings.TrimSuffix(f.addr, "/"),
+		namespace: f.namespace,
+		http:      newHTTPClient(30*time.Second, config),
+	}
+	switch {
+	case f.roleID != "":
+		if f.secretIDFile == "" {
+			return nil, usageError{errors.New("--role-id needs --secret-id-file")}
+		}
+		secretID, err := passphraseFromFile(f.secretIDFile)()
+		if err != nil {
+			return nil, err
+		}
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		body := map[string]string{"role_id": f.roleID, "secret_id": string(secretID)}
+		if err := c.do(ctx, http.MethodPost, "auth/"+strings.Trim(f.approleMount, "/")+"/login", body, &resp); err != nil {
+			return nil, fmt.Errorf("AppRole login failed: %w", err)
+		}
+		c.token = resp.Auth.ClientToken
+	case f.tokenFile != "":
+		tok, err := passphraseFromFile(f.tokenFile)()
+		if err != nil {
+			return nil, err
+		}
+		c.token = string(tok)
+	case os.Getenv("VAULT_TOKEN") != "":
+		c.token = os.Getenv("VAULT_TOKEN")
+	default:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		tok, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+		if err != nil {
+			return nil, usageError{errors.New("no Vault token; give --token-file or --role-id, set $VAULT_TOKEN, or run vault login")}
+		}
+		c.token = strings.TrimSpace(string(tok))
+	}
+	return c, nil
+}
+
+// errVaultNotFound is a 404 from Vault.
+var errVaultNotFound = errors.New("not found in Vault")
+
+// do sends a request for the API path p, with body as JSON if not nil, and
+// decodes the reply into out if not nil.
+func (c *vaultClient) do(ctx context.Context, method, p string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+"/v1/"+p, r)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	p, _, _ = strings.Cut(p, "?")
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", p, errVaultNotFound)
+	}
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("%s: %s", p, strings.Join(e.Errors, "; "))
+		}
+		return fmt.Errorf("%s: %s", p, resp.Status)
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// splitVaultPath splits --path into the KV v2 mount, its first element,
+// and the path under it, which ends in a slash unless empty.
+func splitVaultPath(p string) (mount, sub string, err error) {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "", "", usageError{errors.New("give the KV v2 mount and path with --path, e.g. secret/ or secret/team/")}
+	}
+	mount, sub, _ = strings.Cut(p, "/")
+	if sub != "" {
+		sub += "/"
+	}
+	return mount, sub, nil
+}
+
+// list returns the paths of the secrets under dir in mount, recursively,
+// relative to dir.
+func (c *vaultClient) list(ctx context.Context, mount, dir string) ([]string, error) {
+	var resp struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, mount+"/metadata/"+escapeVaultPath(dir)+"?list=true", nil, &resp)
+	if errors.Is(err, errVaultNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, k := range resp.Data.Keys {
+		if !strings.HasSuffix(k, "/") {
+			paths = append(paths, k)
+			continue
+		}
+		under, err := c.list(ctx, mount, dir+k)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range under {
+			paths = append(paths, k+p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// read returns the latest version of the secret at p in mount.
+func (c *vaultClient) read(ctx context.Context, mount, p string) (map[string]interface{}, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, mount+"/data/"+escapeVaultPath(p), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data.Data, nil
+}
+
+// write stores data as a new version of the secret at p in mount.
+func (c *vaultClient) write(ctx context.Context, mount, p string, data map[string]string) error {
+	return c.do(ctx, http.MethodPost, mount+"/data/"+escapeVaultPath(p), map[string]interface{}{"data": data}, nil)
+}
+
+func escapeVaultPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// vaultRecord turns the key/value pairs of a Vault secret into a record:
+// password, username, user or login, url and notes become those and the
+// rest fields. Values that are not strings are kept as JSON.
+func vaultRecord(data map[string]interface{}) *store.Record {
+	r := &store.Record{}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var v string
+		switch x := data[k].(type) {
+		case string:
+			v = x
+		case nil:
+			continue
+		default:
+			b, _ := json.Marshal(x)
+			v = string(b)
+		}
+		switch strings.ToLower(k) {
+		case "password":
+			if r.Password == "" {
+				r.Password = v
+				continue
+			}
+		case "username", "user", "login":
+			if r.Username == "" {
+				r.Username = v
+				continue
+			}
+		case "url":
+			setURL(r, v)
+			continue
+		case "notes":
+			if r.Notes == "" {
+				r.Notes = v
+				continue
+			}
+		}
+		setField(r, k, v)
+	}
+	return r
+}
+
+// vaultData is the reverse of vaultRecord. Fields named like one of the
+// other keys are numbered, as setField does.
+func vaultData(r *store.Record) map[string]string {
+	data := make(map[string]string)
+	for k, v := range map[string]string{"password": r.Password, "username": r.Username, "url": r.URL, "notes": r.Notes} {
+		if v != "" {
+			data[k] = v
+		}
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		k := key
+		for i := 2; ; i++ {
+			if _, taken := data[k]; !taken {
+				break
+			}
+			k = fmt.Sprintf("%s%d", key, i)
+		}
+		data[k] = r.Fields[key]
+	}
+	return data
+}
+
+// readVault returns the secrets under f.path, named by their paths below
+// it.
+func readVault(ctx context.Context, f *vaultFlags) ([]importedEntry, error) {
+	mount, sub, err := splitVaultPath(f.path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newVaultClient(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := c.list(ctx, mount, sub)
+	if err != nil {
+		return nil, err
+	}
+	var entries []importedEntry
+	for _, p := range paths {
+		data, err := c.read(ctx, mount, sub+p)
+		if errors.Is(err, errVaultNotFound) {
+			// The latest version is deleted or destroyed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, importedEntry{Name: p, Record: vaultRecord(data)})
+	}
+	return entries, nil
+}
+
+// writeVault writes the entries called names from db under f.path, as
+// new versions of any secrets already there, and returns how many it
+// wrote.
+func writeVault(ctx context.Context, db *store.DB, f *vaultFlags, names []string) (int, error) {
+	mount, sub, err := splitVaultPath(f.path)
+	if err != nil {
+		return 0, err
+	}
+	c, err := newVaultClient(ctx, f)
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range names {
+		r, err := db.Peek(ctx, name)
+		if err != nil {
+			return i, err
+		}
+		err = c.write(ctx, mount, sub+name, vaultData(r))
+		r.Wipe()
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(names), nil
+}
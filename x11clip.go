@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xclip and xsel offer what they copy under text targets only, so there is
+// no telling clipboard managers such as Klipper that it is a password.
+// x11Owner instead owns the CLIPBOARD selection itself, speaking just enough
+// of the X protocol to answer requests for it, and offers the secret along
+// with the x-kde-passwordManagerHint target, which Klipper, and managers
+// following it, take as a sign not to keep it in their history. It does
+// not answer the SAVE_TARGETS handover either, so managers that persist the
+// clipboard when its owner exits never get the secret.
+type x11Owner struct {
+	conn       net.Conn
+	r          *bufio.Reader
+	seq        uint16
+	root       uint32
+	window     uint32
+	maxRequest int
+	// id is the first resource ID the server assigned the connection, and
+	// the only one it needs.
+	id uint32
+	// time is when the selection was taken, for TIMESTAMP requests.
+	time  uint32
+	atoms map[string]uint32
+	data  []byte
+}
+
+// Requests, events and predefined atoms of the core X protocol.
+const (
+	x11CreateWindow      = 1
+	x11InternAtom        = 16
+	x11ChangeProperty    = 18
+	x11SetSelectionOwner = 22
+	x11GetSelectionOwner = 23
+	x11SendEvent         = 25
+
+	x11PropertyNotify   = 28
+	x11SelectionClear   = 29
+	x11SelectionRequest = 30
+	x11SelectionNotify  = 31
+
+	x11AtomAtom    = 4
+	x11AtomInteger = 19
+	x11AtomString  = 31
+	x11AtomWMName  = 39
+)
+
+// x11PasswordHint is the target marking a selection as a password.
+const x11PasswordHint = "x-kde-passwordManagerHint"
+
+// x11TextTargets are the text targets the secret is offered under.
+var x11TextTargets = []string{"UTF8_STRING", "TEXT", "text/plain;charset=utf-8", "text/plain"}
+
+// ownX11Clipboard connects to the X server of display and takes the
+// CLIPBOARD selection with data, which it answers requests with until
+// serve returns.
+func ownX11Clipboard(display string, data []byte) (*x11Owner, error) {
+	o, err := dialX11(display)
+	if err != nil {
+		return nil, err
+	}
+	o.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := o.own(data); err != nil {
+		o.conn.Close()
+		return nil, err
+	}
+	o.conn.SetDeadline(time.Time{})
+	return o, nil
+}
+
+func (o *x11Owner) own(data []byte) error {
+	// Requests may be at most maxRequest bytes; the property data goes in
+	// one ChangeProperty of 24 bytes besides it.
+	if len(data)+24 > o.maxRequest {
+		return fmt.Errorf("too large for the X11 clipboard (%d bytes)", len(data))
+	}
+	o.data = data
+	o.atoms = make(map[string]uint32)
+	names := append([]string{"CLIPBOARD", "TARGETS", "TIMESTAMP", x11PasswordHint}, x11TextTargets...)
+	for _, name := range names {
+		a, err := o.internAtom(name)
+		if err != nil {
+			return err
+		}
+		o.atoms[name] = a
+	}
+
+	// The window only receives events; it is never mapped.
+	o.window = o.id
+	body := make([]byte, 32)
+	le := binary.LittleEndian
+	le.PutUint32(body[0:], o.window)
+	le.PutUint32(body[4:], o.root)
+	le.PutUint16(body[12:], 1)
+	le.PutUint16(body[14:], 1)
+	le.PutUint16(body[18:], 2)        // InputOnly
+	le.PutUint32(body[24:], 0x800)    // the event mask is given
+	le.PutUint32(body[28:], 0x400000) // PropertyChange
+	o.send(x11CreateWindow, 0, body)
+
+	// ICCCM wants the selection taken with a real timestamp, which the
+	// server tells with the event for appending nothing to a property.
+	o.changeProperty(2, o.window, x11AtomWMName, x11AtomString, 8, nil)
+	for {
+		ev, err := o.next()
+		if err != nil {
+			return err
+		}
+		if ev[0]&0x7f == x11PropertyNotify && le.Uint32(ev[4:]) == o.window {
+			o.time = le.Uint32(ev[12:])
+			break
+		}
+	}
+	body = make([]byte, 12)
+	le.PutUint32(body[0:], o.window)
+	le.PutUint32(body[4:], o.atoms["CLIPBOARD"])
+	le.PutUint32(body[8:], o.time)
+	o.send(x11SetSelectionOwner, 0, body)
+	reply, err := o.roundTrip(x11GetSelectionOwner, 0, body[4:8])
+	if err != nil {
+		return err
+	}
+	if le.Uint32(reply[8:]) != o.window {
+		return errors.New("another program took the X11 clipboard first")
+	}
+	return nil
+}
+
+// serve answers requests for the selection for d, or until another program
+// takes it, when lost is true.
+func (o *x11Owner) serve(d time.Duration) (lost bool, err error) {
+	le := binary.LittleEndian
+	o.conn.SetReadDeadline(time.Now().Add(d))
+	for {
+		ev, err := o.next()
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch ev[0] & 0x7f {
+		case x11SelectionClear:
+			if le.Uint32(ev[8:]) == o.window {
+				return true, nil
+			}
+		case x11SelectionRequest:
+			o.answer(ev)
+		}
+	}
+}
+
+// answer replies to the SelectionRequest event ev: it sets the property
+// the requestor named to the target asked for, or refuses the request, and
+// tells the requestor.
+func (o *x11Owner) answer(ev []byte) {
+	le := binary.LittleEndian
+	requestor, selection := le.Uint32(ev[12:]), le.Uint32(ev[16:])
+	target, property := le.Uint32(ev[20:]), le.Uint32(ev[24:])
+	if property == 0 {
+		// Obsolete clients leave the property to the owner.
+		property = target
+	}
+	switch {
+	case selection != o.atoms["CLIPBOARD"]:
+		property = 0
+	case target == o.atoms["TARGETS"]:
+		targets := []uint32{o.atoms["TARGETS"], o.atoms["TIMESTAMP"], o.atoms[x11PasswordHint], x11AtomString}
+		for _, name := range x11TextTargets {
+			targets = append(targets, o.atoms[name])
+		}
+		b := make([]byte, 4*len(targets))
+		for i, a := range targets {
+			le.PutUint32(b[4*i:], a)
+		}
+		o.changeProperty(0, requestor, property, x11AtomAtom, 32, b)
+	case target == o.atoms["TIMESTAMP"]:
+		b := make([]byte, 4)
+		le.PutUint32(b, o.time)
+		o.changeProperty(0, requestor, property, x11AtomInteger, 32, b)
+	case target == o.atoms[x11PasswordHint]:
+		o.changeProperty(0, requestor, property, target, 8, []byte("secret"))
+	case target == x11AtomString:
+		o.changeProperty(0, requestor, property, x11AtomString, 8, o.data)
+	case o.isText(target):
+		o.changeProperty(0, requestor, property, o.atoms["UTF8_STRING"], 8, o.data)
+	default:
+		property = 0
+	}
+	notify := make([]byte, 32)
+	notify[0] = x11SelectionNotify
+	copy(notify[4:], ev[4:8])
+	le.PutUint32(notify[8:], requestor)
+	le.PutUint32(notify[12:], selection)
+	le.PutUint32(notify[16:], target)
+	le.PutUint32(notify[20:], property)
+	body := make([]byte, 40)
+	le.PutUint32(body[0:], requestor)
+	copy(body[8:], notify)
+	o.send(x11SendEvent, 0, body)
+}
+
+func (o *x11Owner) isText(target uint32) bool {
+	for _, name := range x11TextTargets {
+		if o.atoms[name] == target {
+			return true
+		}
+	}
+	return false
+}
+
+// close disconnects from the server, which gives up the selection.
+func (o *x11Owner) close() error {
+	return o.conn.Close()
+}
+
+// send writes a request. Errors, such as a requestor that went away before
+// its property was set, are reported by the server asynchronously and
+// ignored.
+func (o *x11Owner) send(op, data byte, body []byte) uint16 {
+	b := make([]byte, 4, 4+len(body)+3)
+	b[0], b[1] = op, data
+	b = append(b, body...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)/4))
+	o.conn.Write(b)
+	o.seq++
+	return o.seq
+}
+
+// roundTrip sends a request and waits for its reply. Any error the server
+// reports meanwhile, for this request or one before, fails it.
+func (o *x11Owner) roundTrip(op, data byte, body []byte) ([]byte, error) {
+	seq := o.send(op, data, body)
+	for {
+		msg, err := o.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case msg[0] == 0:
+			return nil, fmt.Errorf("X11 request failed with error %d", msg[1])
+		case msg[0] == 1 && binary.LittleEndian.Uint16(msg[2:]) == seq:
+			return msg, nil
+		}
+	}
+}
+
+// next reads the next event, error or reply.
+func (o *x11Owner) next() ([]byte, error) {
+	msg := make([]byte, 32)
+	if _, err := io.ReadFull(o.r, msg); err != nil {
+		return nil, err
+	}
+	if msg[0] == 1 {
+		if n := binary.LittleEndian.Uint32(msg[4:]); n > 0 {
+			extra := make([]byte, 4*int(n))
+			if _, err := io.ReadFull(o.r, extra); err != nil {
+				return nil, err
+			}
+			msg = append(msg, extra...)
+		}
+	}
+	return msg, nil
+}
+
+func (o *x11Owner) internAtom(name string) (uint32, error) {
+	body := make([]byte, 4, 4+len(name))
+	binary.LittleEndian.PutUint16(body, uint16(len(name)))
+	reply, err := o.roundTrip(x11InternAtom, 0, append(body, name...))
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(reply[8:]), nil
+}
+
+func (o *x11Owner) changeProperty(mode byte, window, property, typ uint32, format byte, data []byte) {
+	body := make([]byte, 20, 20+len(data))
+	le := binary.LittleEndian
+	le.PutUint32(body[0:], window)
+	le.PutUint32(body[4:], property)
+	le.PutUint32(body[8:], typ)
+	body[12] = format
+	le.PutUint32(body[16:], uint32(len(data)/int(format/8)))
+	o.send(x11ChangeProperty, mode, append(body, data...))
+}
+
+// dialX11 connects to the X server of display, such as ":0" or
+// "host:10.0", authenticating with its MIT-MAGIC-COOKIE-1 from the
+// Xauthority file if there is one.
+func dialX11(display string) (*x11Owner, error) {
+	host, number, err := parseDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch {
+	case host == "" || host == "unix":
+		// Linux servers also listen on an abstract socket, which works
+		// from sandboxes without /tmp/.X11-unix.
+		path := "/tmp/.X11-unix/X" + number
+		if conn, err = net.Dial("unix", path); err != nil {
+			conn, err = net.Dial("unix", "@"+path)
+		}
+	default:
+		// Displays forwarded by ssh -X are on localhost.
+		if host != "localhost" {
+			if err := egressAllowed("X display " + display); err != nil {
+				return nil, err
+			}
+		}
+		n, _ := strconv.Atoi(number)
+		conn, err = net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(6000+n)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to X display %s: %v", display, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	o, err := x11Setup(conn, xauthCookie(host, number))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("X display %s: %v", display, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return o, nil
+}
+
+// parseDisplay splits display into its host and display number.
+func parseDisplay(display string) (host, number string, err error) {
+	i := strings.LastIndex(display, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid X display %q", display)
+	}
+	host, number = display[:i], display[i+1:]
+	if j := strings.Index(number, "."); j >= 0 {
+		number = number[:j]
+	}
+	if _, err := strconv.Atoi(number); err != nil {
+		return "", "", fmt.Errorf("invalid X display %q", display)
+	}
+	return host, number, nil
+}
+
+// x11Setup sends the connection setup with cookie and reads the server's
+// reply.
+func x11Setup(conn net.Conn, cookie []byte) (*x11Owner, error) {
+	le := binary.LittleEndian
+	const authName = "MIT-MAGIC-COOKIE-1"
+	req := []byte{'l', 0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if cookie != nil {
+		le.PutUint16(req[6:], uint16(len(authName)))
+		le.PutUint16(req[8:], uint16(len(cookie)))
+		req = append(req, authName...)
+		req = append(req, 0, 0)
+		req = append(req, cookie...)
+		for len(req)%4 != 0 {
+			req = append(req, 0)
+		}
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	extra := make([]byte, 4*int(le.Uint16(head[6:])))
+	if _, err := io.ReadFull(r, extra); err != nil {
+		return nil, err
+	}
+	switch head[0] {
+	case 0:
+		n := int(head[1])
+		if n > len(extra) {
+			n = len(extra)
+		}
+		return nil, fmt.Errorf("connection refused: %s", strings.TrimSpace(string(extra[:n])))
+	case 1:
+	default:
+		return nil, fmt.Errorf("connection refused: %s", strings.TrimSpace(strings.TrimRight(string(extra), "\x00")))
+	}
+	vendorLen := int(le.Uint16(extra[16:]))
+	screens := 32 + (vendorLen+3)/4*4 + 8*int(extra[21])
+	if len(extra) < screens+4 || extra[20] == 0 {
+		return nil, errors.New("server reports no screens")
+	}
+	base, mask := le.Uint32(extra[4:]), le.Uint32(extra[8:])
+	o := &x11Owner{
+		conn:       conn,
+		r:          r,
+		root:       le.Uint32(extra[screens:]),
+		maxRequest: 4 * int(le.Uint16(extra[18:])),
+		id:         base | mask&^(mask-1),
+	}
+	return o, nil
+}
+
+// xauthCookie returns the MIT-MAGIC-COOKIE-1 for display number of host
+// from the Xauthority file, or nil if there is none.
+func xauthCookie(host, number string) []byte {
+	path := os.Getenv("XAUTHORITY")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, ".Xauthority")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	local := host == "" || host == "unix"
+	hostname, _ := os.Hostname()
+	var fallback []byte
+	// Entries are a family followed by the address, display number, auth
+	// name and data, each with a big-endian length.
+	for len(b) >= 2 {
+		family := binary.BigEndian.Uint16(b)
+		b = b[2:]
+		var fields [4][]byte
+		for i := range fields {
+			if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+				return fallback
+			}
+			n := int(binary.BigEndian.Uint16(b))
+			fields[i], b = b[2:2+n], b[2+n:]
+		}
+		addr, num, name, data := string(fields[0]), string(fields[1]), string(fields[2]), fields[3]
+		if name != "MIT-MAGIC-COOKIE-1" || (num != "" && num != number) {
+			continue
+		}
+		switch {
+		case family == 0xffff:
+			// A wildcard entry matches any host.
+			return data
+		case local && family == 256 && addr == hostname:
+			return data
+		case !local && family == 256 && addr == host:
+			return data
+		case fallback == nil:
+			fallback = data
+		}
+	}
+	return fallback
+}